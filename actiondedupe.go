@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// statementCreateProcessedActions creates the table the IDs of processed action requests are recorded in with their response.
+const statementCreateProcessedActions = `CREATE TABLE IF NOT EXISTS processed_actions (
+	action_request_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	status VARCHAR(32) NOT NULL,
+	error TEXT NOT NULL,
+	expires BIGINT NOT NULL
+)`
+
+// actionInProgress is the stored status of an action request which is still being processed by the first delivery.
+// Action requests without response are stored with an empty status.
+const actionInProgress = "IN_PROGRESS"
+
+// actionDeduplicator records the IDs of processed action requests, so an action request delivered again by the platform
+// is not executed a second time and its status is not updated twice. Duplicates are answered with the response of the
+// first delivery, or with its final status once it was sent to connctd. The IDs are stored in the database until the TTL
+// expired, so duplicates are detected across restarts and replicas. Unlike the replay protection, this also catches
+// redeliveries with a new Date and signature.
+type actionDeduplicator struct {
+	db         *sqlx.DB
+	ttl        time.Duration
+	duplicates *metricVec
+
+	lastCleanup time.Time
+	lock        sync.Mutex
+}
+
+// newActionDeduplicator returns a deduplicator keeping processed action request IDs for the TTL.
+func newActionDeduplicator(db *sqlx.DB, ttl time.Duration, metrics *metricsRegistry) *actionDeduplicator {
+	return &actionDeduplicator{
+		db:         db,
+		ttl:        ttl,
+		duplicates: metrics.Counter("action_requests_duplicate_total", "Number of action requests answered with the response of an earlier delivery."),
+	}
+}
+
+// Claim records the action request as in progress. If it was processed or is being processed already,
+// it returns false and the response of the earlier delivery, which is nil for requests without response.
+// Only one of concurrent deliveries can claim a request.
+func (d *actionDeduplicator) Claim(ctx context.Context, actionRequestId string) (bool, *connector.ActionResponse, error) {
+	now := clock()
+	d.cleanup(ctx, now)
+
+	var row struct {
+		Status  string `db:"status"`
+		Error   string `db:"error"`
+		Expires int64  `db:"expires"`
+	}
+	err := d.db.GetContext(ctx, &row, d.db.Rebind("SELECT status, error, expires FROM processed_actions WHERE action_request_id = ?"), actionRequestId)
+	switch {
+	case err == nil && time.Unix(row.Expires, 0).After(now):
+		d.duplicates.Inc()
+		return false, storedResponse(row.Status, row.Error), nil
+	case err == nil:
+		if _, err := d.db.ExecContext(ctx, d.db.Rebind("DELETE FROM processed_actions WHERE action_request_id = ?"), actionRequestId); err != nil {
+			return false, nil, err
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return false, nil, err
+	}
+
+	_, err = d.db.ExecContext(ctx, d.db.Rebind("INSERT INTO processed_actions (action_request_id, status, error, expires) VALUES (?, ?, ?, ?)"),
+		actionRequestId, actionInProgress, "", now.Add(d.ttl).Unix())
+	if err != nil {
+		// A concurrent delivery claimed the request in the meantime
+		d.duplicates.Inc()
+		return false, &connector.ActionResponse{Status: connector.ActionRequestStatusPending}, nil
+	}
+	return true, nil, nil
+}
+
+// storedResponse returns the response of an earlier delivery with the stored status and error.
+func storedResponse(status string, e string) *connector.ActionResponse {
+	switch status {
+	case "":
+		return nil
+	case actionInProgress:
+		return &connector.ActionResponse{Status: connector.ActionRequestStatusPending}
+	}
+	return &connector.ActionResponse{Status: connector.ActionRequestStatus(status), Error: e}
+}
+
+// Record stores the response of the action request, nil for requests without response.
+// A final status sent to connctd in the meantime is kept.
+func (d *actionDeduplicator) Record(ctx context.Context, actionRequestId string, response *connector.ActionResponse) {
+	var status, e string
+	if response != nil {
+		status, e = string(response.Status), response.Error
+	}
+	statement := "UPDATE processed_actions SET status = ?, error = ? WHERE action_request_id = ? AND status = ?"
+	if _, err := d.db.ExecContext(ctx, d.db.Rebind(statement), status, e, actionRequestId, actionInProgress); err != nil {
+		logrus.WithError(err).WithField("actionRequestId", actionRequestId).Warnln("failed to record response of action request")
+	}
+}
+
+// Finish stores the final status of the action request sent to connctd.
+func (d *actionDeduplicator) Finish(ctx context.Context, actionRequestId string, status connector.ActionRequestStatus, e string) {
+	statement := "UPDATE processed_actions SET status = ?, error = ? WHERE action_request_id = ?"
+	if _, err := d.db.ExecContext(ctx, d.db.Rebind(statement), string(status), e, actionRequestId); err != nil {
+		logrus.WithError(err).WithField("actionRequestId", actionRequestId).Warnln("failed to record final status of action request")
+	}
+}
+
+// Release forgets the action request, e.g. because it failed with an error, so it is processed again when it is delivered again.
+func (d *actionDeduplicator) Release(ctx context.Context, actionRequestId string) {
+	if _, err := d.db.ExecContext(ctx, d.db.Rebind("DELETE FROM processed_actions WHERE action_request_id = ?"), actionRequestId); err != nil {
+		logrus.WithError(err).WithField("actionRequestId", actionRequestId).Warnln("failed to release action request")
+	}
+}
+
+// cleanup deletes expired action request IDs at most once per TTL.
+func (d *actionDeduplicator) cleanup(ctx context.Context, now time.Time) {
+	d.lock.Lock()
+	if now.Sub(d.lastCleanup) <= d.ttl {
+		d.lock.Unlock()
+		return
+	}
+	d.lastCleanup = now
+	d.lock.Unlock()
+	if _, err := d.db.ExecContext(ctx, d.db.Rebind("DELETE FROM processed_actions WHERE expires < ?"), now.Unix()); err != nil {
+		logrus.WithError(err).Warnln("failed to delete expired action request IDs")
+	}
+}
+
+// deduplicatingService answers action requests which were delivered before with the response of the earlier delivery
+// instead of executing them again. Requests failing with an error are released, so the platform can retry them.
+type deduplicatingService struct {
+	connector.ConnectorService
+	actions *actionDeduplicator
+}
+
+// PerformAction implements connector.ConnectorService.
+func (s *deduplicatingService) PerformAction(ctx context.Context, request connector.ActionRequest) (*connector.ActionResponse, error) {
+	claimed, response, err := s.actions.Claim(ctx, request.ID)
+	if err != nil {
+		// The request is executed rather than rejected if the database is unavailable
+		logrus.WithError(err).WithField("actionRequestId", request.ID).WithField("correlationId", correlationID(ctx)).Warnln("failed to check for duplicate action request")
+		return s.ConnectorService.PerformAction(ctx, request)
+	}
+	if !claimed {
+		logrus.WithField("actionRequestId", request.ID).WithField("correlationId", correlationID(ctx)).Infoln("answering duplicate action request with the earlier response")
+		return response, nil
+	}
+
+	response, err = s.ConnectorService.PerformAction(ctx, request)
+	if err != nil {
+		s.actions.Release(ctx, request.ID)
+		return response, err
+	}
+	s.actions.Record(ctx, request.ID, response)
+	return response, nil
+}
+
+// deduplicatingClient records the final status of action requests sent to connctd, so duplicates delivered afterwards
+// are answered with it.
+type deduplicatingClient struct {
+	connector.Client
+	actions *actionDeduplicator
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *deduplicatingClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	if status != connector.ActionRequestStatusPending {
+		c.actions.Finish(ctx, actionRequestID, status, e)
+	}
+	return c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e)
+}
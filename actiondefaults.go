@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/connctd/connector-go"
+)
+
+// actionParameterDefaultPrefix prefixes the optional instance configuration parameters holding the default value of
+// an action parameter, e.g. "default_keyword" for the keyword of search actions or "default_phrase" for translate actions.
+const actionParameterDefaultPrefix = "default_"
+
+// withParameterDefaults returns the action request with the missing or empty parameters of the action set to the
+// defaults configured for the instance, so platform automations can trigger actions without parameters.
+// Things of keywords keep searching for their keyword, it is more specific than the default of the instance.
+// The parameters of the request are copied, the request itself is not changed.
+func withParameterDefaults(instance *connector.Instance, actionRequest connector.ActionRequest) connector.ActionRequest {
+	for _, action := range handledActions {
+		if action.ComponentID != actionRequest.ComponentID || action.ActionID != actionRequest.ActionID {
+			continue
+		}
+		if strings.TrimSpace(actionRequest.Parameters[action.ParameterID]) != "" {
+			continue
+		}
+		if action == searchAction && thingKeyword(instance, actionRequest.ThingID) != "" {
+			continue
+		}
+		value, ok := instanceParameterDefault(instance.Configuration, action.ParameterID)
+		if !ok {
+			continue
+		}
+		parameters := make(map[string]string, len(actionRequest.Parameters)+1)
+		for k, v := range actionRequest.Parameters {
+			parameters[k] = v
+		}
+		parameters[action.ParameterID] = value
+		actionRequest.Parameters = parameters
+	}
+	return actionRequest
+}
+
+// instanceParameterDefault returns the default value of the action parameter configured for the instance.
+func instanceParameterDefault(configuration []connector.Configuration, parameterId string) (string, bool) {
+	for _, c := range configuration {
+		if c.ID == actionParameterDefaultPrefix+parameterId && strings.TrimSpace(c.Value) != "" {
+			return strings.TrimSpace(c.Value), true
+		}
+	}
+	return "", false
+}
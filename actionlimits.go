@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+)
+
+// errorRateLimitedID is the error of action requests rejected because the installation has too many pending actions.
+const errorRateLimitedID = "RATE_LIMITED"
+
+// actionLimiter limits the number of actions executed concurrently for each installation,
+// so a single noisy instance can not use up the Giphy API key of its installation and the workers of the connector.
+// Actions beyond the limit wait in a queue of the installation, new action requests are rejected when the queue is full.
+// The waiting actions are only kept in memory.
+type actionLimiter struct {
+	maxRunning int
+	maxQueued  int
+
+	pending map[string]int
+	running map[string]int
+	queued  map[string][]func()
+	limited *metricVec
+	lock    sync.Mutex
+}
+
+// newActionLimiter returns a limiter running at most maxRunning actions of an installation at once with at most maxQueued waiting.
+func newActionLimiter(maxRunning int, maxQueued int, metrics *metricsRegistry) *actionLimiter {
+	return &actionLimiter{
+		maxRunning: maxRunning,
+		maxQueued:  maxQueued,
+		pending:    map[string]int{},
+		running:    map[string]int{},
+		queued:     map[string][]func(){},
+		limited:    metrics.Counter("actions_rate_limited_total", "Number of action requests rejected because their installation had too many pending actions."),
+	}
+}
+
+// Admit reserves a place for a new action request of the installation.
+// It returns false if the installation already has the maximum number of running and queued actions.
+func (l *actionLimiter) Admit(installationId string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.pending[installationId] >= l.maxRunning+l.maxQueued {
+		l.limited.Inc()
+		return false
+	}
+	l.pending[installationId]++
+	return true
+}
+
+// Release gives up the place of an admitted action request which is not executed.
+func (l *actionLimiter) Release(installationId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.release(installationId)
+}
+
+// Run executes the action right away if the installation has less than the maximum number of running actions,
+// otherwise it is queued and executed by the goroutine finishing the next action of the installation.
+// Actions enqueued before a restart are run without having been admitted.
+func (l *actionLimiter) Run(installationId string, action func()) {
+	l.lock.Lock()
+	if l.running[installationId] >= l.maxRunning {
+		l.queued[installationId] = append(l.queued[installationId], action)
+		l.lock.Unlock()
+		return
+	}
+	l.running[installationId]++
+	l.lock.Unlock()
+
+	for action != nil {
+		action()
+
+		l.lock.Lock()
+		l.release(installationId)
+		action = nil
+		if queue := l.queued[installationId]; len(queue) > 0 {
+			action = queue[0]
+			l.queued[installationId] = queue[1:]
+		} else {
+			l.running[installationId]--
+			delete(l.queued, installationId)
+			if l.running[installationId] == 0 {
+				delete(l.running, installationId)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+// release must be called with the lock held.
+func (l *actionLimiter) release(installationId string) {
+	if l.pending[installationId] <= 1 {
+		delete(l.pending, installationId)
+		return
+	}
+	l.pending[installationId]--
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/provider"
+	"github.com/sirupsen/logrus"
+)
+
+// errActionTimeout is the error of actions which did not finish within the action timeout.
+var errActionTimeout = errors.New("action timed out")
+
+// actionTimeouts fail actions which do not finish in time, e.g. because the Giphy API hangs, so the platform is not left
+// with an action which stays pending forever. The result of an action is sent by whichever comes first, the action or
+// its timeout, the other one is dropped. Requests to Giphy can not be canceled, a timed out action keeps running in the
+// background until its request returns.
+type actionTimeouts struct {
+	timeout  time.Duration
+	timedOut *metricVec
+
+	lock sync.Mutex
+	// running are the IDs of the action requests whose result was not sent yet.
+	running map[string]bool
+}
+
+func newActionTimeouts(timeout time.Duration, metrics *metricsRegistry) *actionTimeouts {
+	return &actionTimeouts{
+		timeout:  timeout,
+		timedOut: metrics.Counter("actions_timed_out_total", "Number of actions failed because they did not finish within the action timeout."),
+		running:  map[string]bool{},
+	}
+}
+
+// start records the action request as running.
+func (t *actionTimeouts) start(actionRequestId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.running[actionRequestId] = true
+}
+
+// claim reports whether the result of the action request can be sent, only the first caller of a running action can send it.
+func (t *actionTimeouts) claim(actionRequestId string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.running[actionRequestId] {
+		return false
+	}
+	delete(t.running, actionRequestId)
+	return true
+}
+
+// SetActionTimeouts lets the provider fail actions which do not finish in time. Must be called before the provider is started.
+func (h *GiphyProvider) SetActionTimeouts(timeouts *actionTimeouts) {
+	h.timeouts = timeouts
+}
+
+// handleActionInTime executes the action request and fails it if it does not finish within the action timeout.
+// It returns at the latest once the timeout is exceeded, so a hanging action does not block the actions waiting for it.
+func (h *GiphyProvider) handleActionInTime(pendingAction provider.PendingAction) {
+	if h.timeouts == nil {
+		h.handleAction(pendingAction)
+		return
+	}
+	h.timeouts.start(pendingAction.ID)
+	// A panic of the action is passed on to the caller, like if the action was executed by it
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		h.handleAction(pendingAction)
+	}()
+
+	timer := time.NewTimer(h.timeouts.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-panicked:
+		// Forget the action if it did not send a result
+		h.timeouts.claim(pendingAction.ID)
+		if r != nil {
+			panic(r)
+		}
+		return
+	case <-timer.C:
+	}
+	correlationId := h.correlations.Take(actionKey(pendingAction.ID))
+	h.correlations.Put(actionKey(pendingAction.ID), correlationId)
+	logger := h.logger.WithField("correlationId", correlationId).WithField("actionRequestId", pendingAction.ID)
+	go func() {
+		if r := <-panicked; r != nil {
+			logger.Errorf("timed out action panicked: %v", r)
+		}
+	}()
+	if !h.timeouts.claim(pendingAction.ID) {
+		// The action sent its result just now
+		return
+	}
+	h.timeouts.timedOut.Inc()
+	logger.WithField("timeout", h.timeouts.timeout.String()).Warnln("action timed out")
+
+	err := fmt.Errorf("%w after %s", errActionTimeout, h.timeouts.timeout)
+	h.UpdateEvent(actionUpdate(pendingAction.Instance.ID, pendingAction.ID, &connector.ActionResponse{
+		Status: connector.ActionRequestStatusFailed,
+		Error:  h.messages.ActionError(h.actionLocale(pendingAction.Instance.InstallationID), err),
+	}))
+	h.finishAction(pendingAction.ID)
+}
+
+// claimActionResult reports whether the action may send its result, which is not the case if it timed out already.
+// It must be called once before the first update of the result, including the property values sent before the action status.
+func (h *GiphyProvider) claimActionResult(logger *logrus.Entry, actionRequestId string) bool {
+	if h.timeouts == nil || h.timeouts.claim(actionRequestId) {
+		return true
+	}
+	logger.Infoln("dropping result of timed out action")
+	return false
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/go-logr/logr"
+)
+
+// adminBackupPath is the path backups are downloaded from and uploaded to.
+const adminBackupPath = "/admin/backup"
+
+// adminHandler serves operational endpoints which are not part of the connector protocol.
+// It is served on a separate listener, which by default only accepts connections from localhost.
+type adminHandler struct {
+	mux           *http.ServeMux
+	logger        logr.Logger
+	db            connector.Database
+	giphyProvider *GiphyProvider
+	metrics       *metricsRegistry
+	quota         *quotaTracker
+	status        *statusRecorder
+	signer        *payloadSigner
+	backups       *backupManager
+	remover       *forceRemover
+	integrity     *integrityLog
+}
+
+// newAdminHandler returns the handler for the admin API.
+// If a signer is given, its public key is served, so consumers of signed data can verify it.
+// If a backup manager is given, backups of the database can be downloaded and restored.
+// The remover force-removes installations and instances whose removal callback never arrived.
+// If an integrity log is given, it can be verified and searched.
+func newAdminHandler(logger logr.Logger, db connector.Database, giphyProvider *GiphyProvider, metrics *metricsRegistry, quota *quotaTracker, status *statusRecorder, signer *payloadSigner, backups *backupManager, remover *forceRemover, integrity *integrityLog) *adminHandler {
+	h := &adminHandler{
+		mux:           http.NewServeMux(),
+		logger:        logger,
+		db:            db,
+		giphyProvider: giphyProvider,
+		metrics:       metrics,
+		quota:         quota,
+		status:        status,
+		signer:        signer,
+		backups:       backups,
+		remover:       remover,
+		integrity:     integrity,
+	}
+
+	h.mux.Handle("/metrics", metrics)
+	h.mux.HandleFunc("/status", h.getStatus)
+	h.mux.HandleFunc("/admin/quota", h.getQuota)
+	h.mux.HandleFunc("/admin/installations", h.getInstallations)
+	h.mux.HandleFunc("/admin/installations/", h.postInstallationOperation)
+	h.mux.HandleFunc("/admin/instances", h.getInstances)
+	h.mux.HandleFunc("/admin/instances/", h.postInstanceOperation)
+	h.mux.HandleFunc("/admin/refresh", h.postRefresh)
+	h.mux.HandleFunc("/admin/reconcile", h.postReconcile)
+	h.mux.HandleFunc("/graphql", h.serveGraphQL)
+	if signer != nil {
+		h.mux.HandleFunc("/admin/signing-key", h.getSigningKey)
+	}
+	if backups != nil {
+		h.mux.HandleFunc(adminBackupPath, h.serveBackup)
+	}
+	if integrity != nil {
+		h.mux.HandleFunc("/admin/integrity", h.getIntegrity)
+		h.mux.HandleFunc("/admin/integrity/entries", h.getIntegrityEntries)
+	}
+
+	return h
+}
+
+// ServeHTTP implements the http.Handler interface by delegating to the mux.
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// getQuota returns today's Giphy quota usage of all installations.
+func (h *adminHandler) getQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.quota.Usage())
+}
+
+// getSigningKey returns the public key of the key the connector signs outgoing data with.
+func (h *adminHandler) getSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"publicKey": h.signer.PublicKey()})
+}
+
+// getIntegrity verifies the whole integrity log. A broken log is answered with 409 Conflict, so scripts can tell it by the status.
+func (h *adminHandler) getIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	result, err := h.integrity.Verify()
+	if err != nil {
+		h.logger.Error(err, "failed to verify integrity log")
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	if !result.Valid {
+		writeJSON(w, http.StatusConflict, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// getIntegrityEntries returns the logged values of a thing, optionally of one component and property:
+// GET /admin/integrity/entries?thingId=...&componentId=...&propertyId=...&limit=100.
+// With value, only the entries of that value are returned, so a disputed value can be checked without hashing it.
+func (h *adminHandler) getIntegrityEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("thingId") == "" {
+		connector.NewError("MISSING_THING_ID", "thingId is required", http.StatusBadRequest).Write(w)
+		return
+	}
+	limit := 100
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			connector.NewError("INVALID_LIMIT", "limit must be a positive number, 0 returns all entries", http.StatusBadRequest).Write(w)
+			return
+		}
+	}
+	entries, err := h.integrity.Entries(query.Get("thingId"), query.Get("componentId"), query.Get("propertyId"))
+	if err != nil {
+		h.logger.Error(err, "failed to read integrity log")
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	if value, ok := query["value"]; ok {
+		hash := valueHash(value[0])
+		matching := []integrityEntry{}
+		for _, entry := range entries {
+			if entry.ValueHash == hash {
+				matching = append(matching, entry)
+			}
+		}
+		entries = matching
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// getInstallations returns all installations with their instances.
+func (h *adminHandler) getInstallations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	report, err := statusReport(r.Context(), h.db, h.giphyProvider, h.status)
+	if err != nil {
+		h.logger.Error(err, "failed to list installations")
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, report.Installations)
+}
+
+// getInstances returns all instances.
+func (h *adminHandler) getInstances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	report, err := statusReport(r.Context(), h.db, h.giphyProvider, h.status)
+	if err != nil {
+		h.logger.Error(err, "failed to list instances")
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	instances := []InstanceStatus{}
+	for _, installation := range report.Installations {
+		instances = append(instances, installation.Instances...)
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+// postInstanceOperation pauses or resumes the periodic update of an instance:
+// POST /admin/instances/{id}/pause and POST /admin/instances/{id}/resume.
+// POST /admin/instances/{id}/reauthorized sends updates of an instance again whose token was rejected by connctd.
+// POST /admin/instances/{id}/remove removes an instance whose removal callback never arrived, see postForceRemoval.
+func (h *adminHandler) postInstanceOperation(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/instances/"), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "pause" && parts[1] != "resume" && parts[1] != "reauthorized" && parts[1] != "remove") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	if _, err := h.db.GetInstance(r.Context(), parts[0]); err != nil {
+		connector.ErrorInstanceNotFound.Write(w)
+		return
+	}
+	if parts[1] == "remove" {
+		h.postForceRemoval(w, r, "instance", parts[0])
+		return
+	}
+
+	switch parts[1] {
+	case "pause":
+		h.giphyProvider.Pause(parts[0])
+	case "resume":
+		h.giphyProvider.Resume(parts[0])
+	case "reauthorized":
+		if err := h.giphyProvider.Reauthorized(r.Context(), parts[0]); err != nil {
+			h.logger.Error(err, "failed to mark instance as re-authorized", "instanceId", parts[0])
+			connector.ErrorInternal.Write(w)
+			return
+		}
+	}
+	h.logger.Info("changed periodic update of instance", "instanceId", parts[0], "operation", parts[1])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postRefresh runs an update cycle immediately.
+func (h *adminHandler) postRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	if err := h.giphyProvider.Refresh(r.Context()); err != nil {
+		h.logger.Error(err, "failed to refresh")
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postReconcile aligns the registrations of the provider with the database and returns the changes.
+func (h *adminHandler) postReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	result, err := h.giphyProvider.Reconcile(r.Context(), h.db)
+	if err != nil {
+		h.logger.Error(err, "failed to reconcile")
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	h.logger.Info("reconciled registrations", "addedInstallations", len(result.AddedInstallations), "removedInstallations", len(result.RemovedInstallations),
+		"addedInstances", len(result.AddedInstances), "removedInstances", len(result.RemovedInstances))
+	writeJSON(w, http.StatusOK, result)
+}
+
+// serveBackup streams an encrypted backup of the database with GET and restores an uploaded backup with POST.
+// A restore replaces all installations and instances and aligns the registrations of the provider afterwards.
+// Errors during a download can only be logged, the backup then lacks its last chunk and is rejected by a restore.
+func (h *adminHandler) serveBackup(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="giphy-connector-%s.backup"`, time.Now().UTC().Format("20060102-150405")))
+		if err := h.backups.Backup(r.Context(), w); err != nil {
+			h.logger.Error(err, "failed to write backup")
+			return
+		}
+		h.logger.Info("wrote backup")
+	case http.MethodPost:
+		summary, err := h.backups.Restore(r.Context(), r.Body)
+		if errors.Is(err, errInvalidBackup) {
+			connector.NewError("INVALID_BACKUP", err.Error(), http.StatusBadRequest).Write(w)
+			return
+		}
+		if err != nil {
+			h.logger.Error(err, "failed to restore backup")
+			connector.ErrorInternal.Write(w)
+			return
+		}
+		h.logger.Info("restored backup", "installations", summary["installations"], "instances", summary["instances"])
+		if cache, ok := h.db.(*cachingDatabase); ok {
+			cache.Purge()
+		}
+		if _, err := h.giphyProvider.Reconcile(r.Context(), h.db); err != nil {
+			h.logger.Error(err, "failed to reconcile after restore")
+		}
+		writeJSON(w, http.StatusOK, summary)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// getStatus renders the status page as HTML or, if requested, as JSON.
+func (h *adminHandler) getStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	report, err := statusReport(r.Context(), h.db, h.giphyProvider, h.status)
+	if err != nil {
+		h.logger.Error(err, "failed to create status report")
+		connector.ErrorInternal.Write(w)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, report); err != nil {
+		h.logger.Error(err, "failed to render status page")
+	}
+}
+
+// writeJSON writes v as JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// methodNotAllowed writes a connector style error for unsupported methods.
+func methodNotAllowed(w http.ResponseWriter) {
+	connector.NewError("METHOD_NOT_ALLOWED", "Method not allowed", http.StatusMethodNotAllowed).Write(w)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+// adminRole is the scope of an admin credential.
+type adminRole int
+
+const (
+	// adminRoleRead may read the status, metrics and quota.
+	adminRoleRead adminRole = iota + 1
+	// adminRoleOperate may additionally change the state of the connector.
+	adminRoleOperate
+)
+
+var adminRoles = map[string]adminRole{
+	"read":    adminRoleRead,
+	"operate": adminRoleOperate,
+}
+
+// adminCredential is a credential of the admin API.
+// Only the SHA-256 hash of the secret is kept, so the auth file contains no usable secrets.
+type adminCredential struct {
+	role adminRole
+	name string
+	hash []byte
+}
+
+// loadAdminCredentials reads an auth file with one credential per line, given as role, name and
+// hex encoded SHA-256 hash of the secret separated by spaces, e.g. "read prometheus 9f86d0...".
+// The secret is sent as bearer token or as password of basic auth with the name as user.
+// Empty lines and lines starting with # are ignored.
+func loadAdminCredentials(file string) ([]adminCredential, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open auth file: %w", err)
+	}
+	defer f.Close()
+
+	var credentials []adminCredential
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New("invalid auth file: expected lines of role, name and SHA-256 hash of the secret")
+		}
+		role, ok := adminRoles[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid auth file: unknown role %s of %s, expected read or operate", fields[0], fields[1])
+		}
+		hash, err := hex.DecodeString(fields[2])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid auth file: secret of %s is not a hex encoded SHA-256 hash", fields[1])
+		}
+		if names[fields[1]] {
+			return nil, fmt.Errorf("invalid auth file: duplicate name %s", fields[1])
+		}
+		names[fields[1]] = true
+		credentials = append(credentials, adminCredential{role, fields[1], hash})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, errors.New("invalid auth file: no credentials")
+	}
+	return credentials, nil
+}
+
+// authenticate returns the credential matching the bearer token or basic auth of the request.
+func authenticate(credentials []adminCredential, r *http.Request) (adminCredential, bool) {
+	user, secret, basic := r.BasicAuth()
+	if !basic {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return adminCredential{}, false
+		}
+		secret = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	for _, c := range credentials {
+		if basic && c.name != user {
+			continue
+		}
+		if subtle.ConstantTimeCompare(c.hash, hash[:]) == 1 {
+			return c, true
+		}
+	}
+	return adminCredential{}, false
+}
+
+// requiredAdminRole returns the role needed for the request.
+// Reading requires the read role, everything else the operate role.
+// The GraphQL API only reads, also when the query is posted. Backups contain the tokens, so downloading them requires the operate role.
+func requiredAdminRole(r *http.Request) adminRole {
+	switch r.URL.Path {
+	case "/graphql":
+		return adminRoleRead
+	case adminBackupPath:
+		return adminRoleOperate
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return adminRoleRead
+	default:
+		return adminRoleOperate
+	}
+}
+
+// adminAuthHandler only passes requests with a credential of the required role to the admin API.
+func adminAuthHandler(credentials []adminCredential, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential, ok := authenticate(credentials, r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="giphy-connector admin"`)
+			connector.ErrorUnauthorized.Write(w)
+			return
+		}
+		if credential.role < requiredAdminRole(r) {
+			logrus.WithField("name", credential.name).WithField("path", r.URL.Path).Warnln("rejected admin request with insufficient role")
+			connector.ErrorForbidden.Write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,207 @@
+// Package adminclient is a client of the admin API of the Giphy connector,
+// for services which automate the management of the connector.
+// It lists installations and instances, triggers update cycles, pauses instances, rotates API keys, reconciles registrations
+// and force-removes installations and instances.
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Installation is an installation stored by the connector.
+type Installation struct {
+	ID         string     `json:"id"`
+	Registered bool       `json:"registered"`
+	Instances  []Instance `json:"instances"`
+}
+
+// Instance is an instance stored by the connector.
+// Registered instances are updated periodically unless they are paused.
+type Instance struct {
+	ID             string `json:"id"`
+	InstallationID string `json:"installationId"`
+	Registered     bool   `json:"registered"`
+	Paused         bool   `json:"paused"`
+	// NeedsReauthorization is set once connctd rejected the token of the instance, it is not updated until it is marked as re-authorized.
+	NeedsReauthorization bool    `json:"needsReauthorization"`
+	Things               []Thing `json:"things"`
+}
+
+// Thing is a thing created for an instance.
+type Thing struct {
+	ID         string     `json:"id"`
+	ExternalID string     `json:"externalId,omitempty"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+}
+
+// ReconcileResult lists the registrations changed by a reconciliation.
+type ReconcileResult struct {
+	AddedInstallations   []string `json:"addedInstallations"`
+	RemovedInstallations []string `json:"removedInstallations"`
+	AddedInstances       []string `json:"addedInstances"`
+	RemovedInstances     []string `json:"removedInstances"`
+}
+
+// ForceRemoval is the result of a force-removal.
+// Notified is the number of notifications connctd accepted, NotificationErrors the number it did not.
+type ForceRemoval struct {
+	InstallationID     string   `json:"installationId,omitempty"`
+	Instances          []string `json:"instances"`
+	Notified           int      `json:"notified"`
+	NotificationErrors int      `json:"notificationErrors"`
+}
+
+// Error is an error response of the admin API.
+type Error struct {
+	Status      int    `json:"status"`
+	Code        string `json:"error"`
+	Description string `json:"description"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("admin api responded with %d %s: %s", e.Status, e.Code, e.Description)
+}
+
+// Client calls the admin API at BaseURL, e.g. "http://127.0.0.1:8081".
+// If the admin API requires authentication, Token is sent as bearer token.
+// Listing requires the read role, all other operations the operate role.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// New returns a client with a default HTTP client.
+func New(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// ListInstallations returns all installations with their instances.
+func (c *Client) ListInstallations(ctx context.Context) ([]Installation, error) {
+	var installations []Installation
+	err := c.do(ctx, http.MethodGet, "/admin/installations", nil, &installations)
+	return installations, err
+}
+
+// ListInstances returns all instances.
+func (c *Client) ListInstances(ctx context.Context) ([]Instance, error) {
+	var instances []Instance
+	err := c.do(ctx, http.MethodGet, "/admin/instances", nil, &instances)
+	return instances, err
+}
+
+// Refresh runs an update cycle of all instances which are not paused and waits until it is finished.
+func (c *Client) Refresh(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/admin/refresh", nil, nil)
+}
+
+// PauseInstance stops the periodic update of the instance until it is resumed or the connector is restarted.
+func (c *Client) PauseInstance(ctx context.Context, instanceId string) error {
+	return c.do(ctx, http.MethodPost, "/admin/instances/"+url.PathEscape(instanceId)+"/pause", nil, nil)
+}
+
+// ResumeInstance continues the periodic update of a paused instance.
+func (c *Client) ResumeInstance(ctx context.Context, instanceId string) error {
+	return c.do(ctx, http.MethodPost, "/admin/instances/"+url.PathEscape(instanceId)+"/resume", nil, nil)
+}
+
+// RotateApiKey replaces the Giphy API key of an installation, e.g. after the customer's key was revoked.
+// The key is validated with Giphy first, a rejected key results in an error with the code INVALID_API_KEY.
+func (c *Client) RotateApiKey(ctx context.Context, installationId string, apiKey string) error {
+	body := map[string]string{"apiKey": apiKey}
+	return c.do(ctx, http.MethodPost, "/admin/installations/"+url.PathEscape(installationId)+"/api-key", body, nil)
+}
+
+// MarkInstanceReauthorized sends updates of an instance again after connctd rejected its token.
+func (c *Client) MarkInstanceReauthorized(ctx context.Context, instanceId string) error {
+	return c.do(ctx, http.MethodPost, "/admin/instances/"+url.PathEscape(instanceId)+"/reauthorized", nil, nil)
+}
+
+// Reconcile registers stored installations and instances which are not registered,
+// removes registrations which are not stored anymore and runs an update cycle.
+func (c *Client) Reconcile(ctx context.Context) (*ReconcileResult, error) {
+	var result ReconcileResult
+	if err := c.do(ctx, http.MethodPost, "/admin/reconcile", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ForceRemoveInstallation removes an installation with all its instances whose removal callback never arrived,
+// e.g. because the connector was offline. With notify, connctd is told on a best-effort basis that their things are
+// unavailable and that the installation and its instances failed.
+func (c *Client) ForceRemoveInstallation(ctx context.Context, installationId string, notify bool) (*ForceRemoval, error) {
+	return c.forceRemove(ctx, "/admin/installations/"+url.PathEscape(installationId)+"/remove", notify)
+}
+
+// ForceRemoveInstance removes an instance whose removal callback never arrived, see ForceRemoveInstallation.
+func (c *Client) ForceRemoveInstance(ctx context.Context, instanceId string, notify bool) (*ForceRemoval, error) {
+	return c.forceRemove(ctx, "/admin/instances/"+url.PathEscape(instanceId)+"/remove", notify)
+}
+
+func (c *Client) forceRemove(ctx context.Context, path string, notify bool) (*ForceRemoval, error) {
+	if notify {
+		path += "?notify=true"
+	}
+	var result ForceRemoval
+	if err := c.do(ctx, http.MethodPost, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// do sends the request with body as JSON, if it is not nil, and decodes the JSON response into result, if it is not nil.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{Status: resp.StatusCode}
+		if json.Unmarshal(respBody, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Description = strings.TrimSpace(string(respBody))
+		}
+		return apiErr
+	}
+	if result == nil || len(bytes.TrimSpace(respBody)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/connctd/connector-go"
+)
+
+// Errors of the rotation of an installation's Giphy API key.
+var (
+	errApiKeyRejected  = errors.New("giphy rejected the API key")
+	errorApiKeyInvalid = connector.NewError("INVALID_API_KEY", "Giphy rejected the API key", http.StatusBadRequest)
+	errorGiphyFailed   = connector.NewError("GIPHY_UNAVAILABLE", "The API key could not be validated with Giphy", http.StatusBadGateway)
+)
+
+// installationConfigurationUpdater is implemented by the databases which can change a configuration parameter of an existing installation.
+// The SDK database can only add installations with their configuration, so the wrappers pass the change on themselves.
+type installationConfigurationUpdater interface {
+	SetInstallationConfiguration(ctx context.Context, installationId string, config connector.Configuration) error
+}
+
+// setInstallationConfiguration replaces the configuration parameter of the installation or adds it if it has none.
+func setInstallationConfiguration(ctx context.Context, db connector.Database, installationId string, config connector.Configuration) error {
+	updater, ok := db.(installationConfigurationUpdater)
+	if !ok {
+		return errors.New("the database can not change the configuration of installations")
+	}
+	return updater.SetInstallationConfiguration(ctx, installationId, config)
+}
+
+// replaceConfiguration returns a copy of the configuration with the parameter replaced or added.
+func replaceConfiguration(configuration []connector.Configuration, config connector.Configuration) []connector.Configuration {
+	replaced := make([]connector.Configuration, 0, len(configuration)+1)
+	for _, c := range configuration {
+		if c.ID != config.ID {
+			replaced = append(replaced, c)
+		}
+	}
+	return append(replaced, config)
+}
+
+// Statements replacing a configuration parameter of an installation.
+const (
+	statementDeleteInstallationConfig = `DELETE FROM installation_configuration WHERE installation_id = ? AND id = ?`
+	statementInsertInstallationConfig = `INSERT INTO installation_configuration (installation_id, id, value) VALUES (?, ?, ?)`
+)
+
+// SetInstallationConfiguration implements installationConfigurationUpdater.
+func (d *bulkDatabase) SetInstallationConfiguration(ctx context.Context, installationId string, config connector.Configuration) error {
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, tx.Rebind(statementDeleteInstallationConfig), installationId, config.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(statementInsertInstallationConfig), installationId, config.ID, config.Value); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postInstallationOperation rotates the Giphy API key of an installation with POST /admin/installations/{id}/api-key
+// and a body like {"apiKey":"..."}, e.g. after the customer's key was revoked.
+// The key is validated with Giphy before it is stored and used by the provider right away.
+// POST /admin/installations/{id}/remove removes an installation whose removal callback never arrived, see postForceRemoval.
+func (h *adminHandler) postInstallationOperation(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/installations/"), "/")
+	if len(parts) != 2 || parts[0] == "" || (parts[1] != "api-key" && parts[1] != "remove") {
+		http.NotFound(w, r)
+		return
+	}
+	id := parts[0]
+	if parts[1] == "remove" {
+		h.postForceRemoval(w, r, "installation", id)
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	var body struct {
+		ApiKey string `json:"apiKey"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil || body.ApiKey == "" {
+		connector.ErrorBadRequestBody.Write(w)
+		return
+	}
+	if !h.installationExists(r.Context(), id) {
+		connector.ErrorInstallationNotFound.Write(w)
+		return
+	}
+
+	if err := h.giphyProvider.ValidateApiKey(r.Context(), body.ApiKey); err != nil {
+		h.logger.Info("rejected Giphy API key of installation", "installationId", id, "error", err.Error())
+		if errors.Is(err, errApiKeyRejected) {
+			errorApiKeyInvalid.Write(w)
+		} else {
+			errorGiphyFailed.Write(w)
+		}
+		return
+	}
+	config := connector.Configuration{ID: giphyApiKeyConfigID, Value: body.ApiKey}
+	if err := setInstallationConfiguration(r.Context(), h.db, id, config); err != nil {
+		h.logger.Error(err, "failed to store Giphy API key of installation", "installationId", id)
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	if err := h.giphyProvider.SetApiKey(r.Context(), id, body.ApiKey); err != nil {
+		h.logger.Error(err, "failed to use the new Giphy API key of installation", "installationId", id)
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	h.logger.Info("rotated Giphy API key of installation", "installationId", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) installationExists(ctx context.Context, installationId string) bool {
+	installations, err := h.db.GetInstallations(ctx)
+	if err != nil {
+		return false
+	}
+	for _, installation := range installations {
+		if installation.ID == installationId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// backupMagic starts every backup, followed by the ID of the key the data key is wrapped with.
+	backupMagic = "giphy-connector-backup 1\n"
+	// backupChunkSize is the maximum plaintext size of an encrypted chunk.
+	backupChunkSize = 64 * 1024
+)
+
+// errInvalidBackup is returned if a backup can not be decrypted or parsed.
+var errInvalidBackup = errors.New("invalid backup")
+
+// invalidBackupError wraps errors of parsing the decrypted backup, errors of decrypting it are already invalid backup errors.
+func invalidBackupError(err error) error {
+	if errors.Is(err, errInvalidBackup) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errInvalidBackup, err)
+}
+
+// backupTable is a table of the connector state with the columns contained in backups.
+type backupTable struct {
+	name    string
+	columns []string
+}
+
+// backupTables are the tables of the SDK in insertion order, children follow their parents.
+// Jobs, seen signatures and replicas are not backed up, they are only meaningful for the running replicas.
+var backupTables = []backupTable{
+	{"installations", []string{"id", "token"}},
+	{"installation_configuration", []string{"installation_id", "id", "value"}},
+	{"instances", []string{"id", "token", "installation_id", "thing_id"}},
+	{"instance_configuration", []string{"instance_id", "id", "value"}},
+	{"instance_thing_mapping", []string{"instance_id", "thing_id", "external_id"}},
+}
+
+// backupHeader is the first record of a backup.
+type backupHeader struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// backupRecord is a row of a table. NULL values are nil.
+type backupRecord struct {
+	Table  string    `json:"table"`
+	Values []*string `json:"values"`
+}
+
+// backupSummary is the number of restored rows by table.
+type backupSummary map[string]int
+
+// backupManager writes and restores backups of the connector database.
+// The rows are written as newline delimited JSON, which is encrypted in chunks with a new data key per backup.
+// The data key is wrapped with the primary key of the key wrapper, so backups can be restored after a key rotation
+// as long as the old key is still in the key file. Values encrypted with the secrets key file stay encrypted in the backup.
+type backupManager struct {
+	db   *sqlx.DB
+	keys keyWrapper
+}
+
+func newBackupManager(db *sqlx.DB, keys keyWrapper) *backupManager {
+	return &backupManager{db: db, keys: keys}
+}
+
+// Backup streams an encrypted backup of all tables to w.
+// The tables are read in one transaction, so the backup is consistent.
+func (m *backupManager) Backup(ctx context.Context, w io.Writer) error {
+	tx, err := m.db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ew, err := newBackupWriter(w, m.keys)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriterSize(ew, backupChunkSize)
+	encoder := json.NewEncoder(buffered)
+	if err := encoder.Encode(backupHeader{Version: 1, CreatedAt: time.Now().UTC()}); err != nil {
+		return err
+	}
+	for _, table := range backupTables {
+		if err := m.backupTable(ctx, tx, table, encoder); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", table.name, err)
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+func (m *backupManager) backupTable(ctx context.Context, tx *sqlx.Tx, table backupTable, encoder *json.Encoder) error {
+	rows, err := tx.QueryContext(ctx, "SELECT "+strings.Join(table.columns, ", ")+" FROM "+table.name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make([]sql.NullString, len(table.columns))
+	pointers := make([]interface{}, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		record := backupRecord{Table: table.name, Values: make([]*string, len(values))}
+		for i, v := range values {
+			if v.Valid {
+				value := v.String
+				record.Values[i] = &value
+			}
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Restore replaces the content of all tables with the backup read from r.
+// The backup is restored in one transaction, which is only committed if the whole backup could be decrypted and verified,
+// so a corrupted or truncated backup leaves the database unchanged.
+func (m *backupManager) Restore(ctx context.Context, r io.Reader) (backupSummary, error) {
+	dr, err := newBackupReader(r, m.keys)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(dr)
+	var header backupHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, invalidBackupError(err)
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidBackup, header.Version)
+	}
+
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tables := map[string]backupTable{}
+	for i := len(backupTables) - 1; i >= 0; i-- {
+		table := backupTables[i]
+		tables[table.name] = table
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table.name); err != nil {
+			return nil, fmt.Errorf("failed to clear %s: %w", table.name, err)
+		}
+	}
+
+	summary := backupSummary{}
+	for _, table := range backupTables {
+		summary[table.name] = 0
+	}
+	for {
+		var record backupRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, invalidBackupError(err)
+		}
+		table, ok := tables[record.Table]
+		if !ok || len(record.Values) != len(table.columns) {
+			return nil, fmt.Errorf("%w: unexpected record of table %q", errInvalidBackup, record.Table)
+		}
+		values := make([]interface{}, len(record.Values))
+		for i, v := range record.Values {
+			if v != nil {
+				values[i] = *v
+			}
+		}
+		statement := "INSERT INTO " + table.name + " (" + strings.Join(table.columns, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(values)-1) + ")"
+		if _, err := tx.ExecContext(ctx, tx.Rebind(statement), values...); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", table.name, err)
+		}
+		summary[table.name]++
+	}
+	return summary, tx.Commit()
+}
+
+// backupWriter encrypts a stream in chunks of at most backupChunkSize bytes with AES-GCM.
+// Each chunk is written with its length and its nonce is the chunk counter with a flag marking the last chunk,
+// so reordered, removed or appended chunks fail to decrypt.
+type backupWriter struct {
+	w       io.Writer
+	aead    *backupCipher
+	counter uint64
+	buf     []byte
+}
+
+func newBackupWriter(w io.Writer, keys keyWrapper) (*backupWriter, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	defer zero(dataKey)
+	keyID := keys.PrimaryKeyID()
+	wrapped, err := keys.WrapKey(keyID, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	aead, err := newBackupCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte(backupMagic + keyID + "\n")
+	header = append(header, byte(len(wrapped)>>8), byte(len(wrapped)))
+	if _, err := w.Write(append(header, wrapped...)); err != nil {
+		return nil, err
+	}
+	return &backupWriter{w: w, aead: aead, buf: make([]byte, 0, backupChunkSize)}, nil
+}
+
+// Write implements io.Writer.
+func (w *backupWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.buf) == backupChunkSize {
+			if err := w.writeChunk(false); err != nil {
+				return 0, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):backupChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// Close writes the last chunk. It does not close the underlying writer.
+func (w *backupWriter) Close() error {
+	return w.writeChunk(true)
+}
+
+func (w *backupWriter) writeChunk(last bool) error {
+	ciphertext := w.aead.seal(w.counter, last, w.buf)
+	w.counter++
+	w.buf = w.buf[:0]
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(ciphertext)))
+	if _, err := w.w.Write(length); err != nil {
+		return err
+	}
+	_, err := w.w.Write(ciphertext)
+	return err
+}
+
+// backupReader decrypts a stream written by a backupWriter.
+// It returns an error instead of io.EOF if the stream ends before the last chunk.
+type backupReader struct {
+	r       *bufio.Reader
+	aead    *backupCipher
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func newBackupReader(r io.Reader, keys keyWrapper) (*backupReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != backupMagic {
+		return nil, fmt.Errorf("%w: unknown format", errInvalidBackup)
+	}
+	keyID, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing key ID", errInvalidBackup)
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(br, length); err != nil {
+		return nil, fmt.Errorf("%w: missing data key", errInvalidBackup)
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(br, wrapped); err != nil {
+		return nil, fmt.Errorf("%w: missing data key", errInvalidBackup)
+	}
+
+	dataKey, err := keys.UnwrapKey(strings.TrimSuffix(keyID, "\n"), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to unwrap data key: %v", errInvalidBackup, err)
+	}
+	defer zero(dataKey)
+	aead, err := newBackupCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &backupReader{r: br, aead: aead}, nil
+}
+
+// Read implements io.Reader.
+func (r *backupReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *backupReader) readChunk() error {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, length); err != nil {
+		return fmt.Errorf("%w: truncated", errInvalidBackup)
+	}
+	n := binary.BigEndian.Uint32(length)
+	if n > backupChunkSize+uint32(r.aead.Overhead()) {
+		return fmt.Errorf("%w: chunk too large", errInvalidBackup)
+	}
+	ciphertext := make([]byte, n)
+	if _, err := io.ReadFull(r.r, ciphertext); err != nil {
+		return fmt.Errorf("%w: truncated", errInvalidBackup)
+	}
+
+	// The flag of the last chunk is not known before decrypting, so it is tried with and without
+	plaintext, err := r.aead.open(r.counter, false, ciphertext)
+	if err != nil {
+		if plaintext, err = r.aead.open(r.counter, true, ciphertext); err != nil {
+			return fmt.Errorf("%w: failed to decrypt, the backup is corrupted or was encrypted with another key", errInvalidBackup)
+		}
+		r.done = true
+		if _, err := r.r.ReadByte(); err != io.EOF {
+			return fmt.Errorf("%w: data after the last chunk", errInvalidBackup)
+		}
+	}
+	r.counter++
+	r.buf = plaintext
+	return nil
+}
+
+// backupCipher seals chunks with AES-GCM using the chunk counter and the last chunk flag as nonce.
+// Every backup has its own data key, so nonces are never reused.
+type backupCipher struct {
+	aead cipher.AEAD
+}
+
+func newBackupCipher(key []byte) (*backupCipher, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &backupCipher{aead: aead}, nil
+}
+
+func (c *backupCipher) nonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func (c *backupCipher) seal(counter uint64, last bool, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nonce(counter, last), plaintext, nil)
+}
+
+func (c *backupCipher) open(counter uint64, last bool, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce(counter, last), ciphertext, nil)
+}
+
+// Overhead returns the number of bytes a chunk grows by encryption.
+func (c *backupCipher) Overhead() int {
+	return c.aead.Overhead()
+}
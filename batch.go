@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+// updateBatcher collects the property updates sent to connctd for a short window and sends them together, so deployments
+// with thousands of instances send bursts over the kept connections instead of opening connections for single updates.
+// The connctd API has no batch endpoint, the updates of a batch are sent concurrently, at most one request per idle connection.
+// Updates of a property superseded within the window are not sent, only the latest value is.
+type updateBatcher struct {
+	client      connector.Client
+	window      time.Duration
+	maxSize     int
+	concurrency int
+
+	lock    sync.Mutex
+	pending []*batchedUpdate
+	// properties are the positions of the pending updates by property key.
+	properties map[string]int
+	timer      *time.Timer
+	// queue holds the taken batches in the order they were taken, they are sent one after another by a single goroutine,
+	// so a later value of a property is never sent before an earlier one.
+	queue chan *queuedBatch
+
+	batches   *metricVec
+	coalesced *metricVec
+}
+
+// batchedUpdate is a property update waiting for its batch. The context keeps the values it was added with, e.g. its correlation ID.
+type batchedUpdate struct {
+	ctx         context.Context
+	token       connector.InstantiationToken
+	thingID     string
+	componentID string
+	propertyID  string
+	value       string
+	lastUpdate  time.Time
+}
+
+// queuedBatch is a batch waiting to be sent, done is closed once it was sent.
+type queuedBatch struct {
+	updates []*batchedUpdate
+	done    chan struct{}
+}
+
+// newUpdateBatcher returns a batcher sending the updates with the client after the window, or as soon as maxSize updates are pending.
+func newUpdateBatcher(client connector.Client, window time.Duration, maxSize int, concurrency int, metrics *metricsRegistry) *updateBatcher {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	b := &updateBatcher{
+		client:      client,
+		window:      window,
+		maxSize:     maxSize,
+		concurrency: concurrency,
+		properties:  map[string]int{},
+		queue:       make(chan *queuedBatch, 16),
+		batches:     metrics.Counter("connctd_update_batches_total", "Number of batches of property updates sent to connctd by result.", "result"),
+		coalesced:   metrics.Counter("connctd_updates_coalesced_total", "Number of property updates not sent to connctd because a later value of the property was batched."),
+	}
+	go b.run()
+	return b
+}
+
+// run sends the queued batches in order for the lifetime of the process.
+func (b *updateBatcher) run() {
+	for batch := range b.queue {
+		b.send(batch.updates)
+		close(batch.done)
+	}
+}
+
+// Add queues the update for the current batch, replacing a pending update of the same property.
+// The window starts with the first update of a batch.
+func (b *updateBatcher) Add(update *batchedUpdate) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := propertyKey(update.thingID, update.componentID, update.propertyID)
+	if i, ok := b.properties[key]; ok {
+		b.pending[i] = update
+		b.coalesced.Inc()
+		return
+	}
+	b.properties[key] = len(b.pending)
+	b.pending = append(b.pending, update)
+	if b.maxSize > 0 && len(b.pending) >= b.maxSize {
+		b.take()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			b.take()
+		})
+	}
+}
+
+// take queues the pending updates for sending and starts a new batch, the caller holds the lock.
+// Batches are queued while the lock is held, so they are queued in the order they were taken.
+// If the queue is full, take waits for the sender, which makes further updates wait as well.
+func (b *updateBatcher) take() *queuedBatch {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := &queuedBatch{b.pending, make(chan struct{})}
+	b.pending = nil
+	b.properties = map[string]int{}
+	b.queue <- batch
+	return batch
+}
+
+// Flush sends the pending updates and waits until they and the batches taken before were sent.
+// It fails if the context is done first, the updates are sent nevertheless. The context only limits the wait,
+// the batch holds updates of other instances as well, which must not be canceled with the caller.
+func (b *updateBatcher) Flush(ctx context.Context) error {
+	b.lock.Lock()
+	batch := b.take()
+	b.lock.Unlock()
+
+	select {
+	case <-batch.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d batched updates were not sent: %w", len(batch.updates), ctx.Err())
+	}
+}
+
+// send sends the updates of the batch with at most concurrency requests at a time.
+// Failed updates are retried by the client, they are only logged here.
+func (b *updateBatcher) send(batch []*batchedUpdate) {
+	if len(batch) == 0 {
+		return
+	}
+
+	updates := make(chan *batchedUpdate)
+	var failed int
+	var failedLock sync.Mutex
+	var workers sync.WaitGroup
+	for i := 0; i < b.concurrency && i < len(batch); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for update := range updates {
+				err := b.client.UpdateThingPropertyValue(batchContext{context.Background(), update.ctx}, update.token, update.thingID, update.componentID, update.propertyID, update.value, update.lastUpdate)
+				if err != nil {
+					failedLock.Lock()
+					failed++
+					failedLock.Unlock()
+					logrus.WithError(err).WithField("correlationId", correlationID(update.ctx)).WithField("thingId", update.thingID).
+						WithField("componentId", update.componentID).WithField("propertyId", update.propertyID).Warnln("failed to send batched property update")
+				}
+			}
+		}()
+	}
+	for _, update := range batch {
+		updates <- update
+	}
+	close(updates)
+	workers.Wait()
+
+	if failed > 0 {
+		b.batches.Inc("failed")
+		return
+	}
+	b.batches.Inc("sent")
+}
+
+// batchContext carries the values of the context an update was added with, but not its cancellation,
+// the context of the event handler is canceled on shutdown before the last batch is flushed.
+type batchContext struct {
+	context.Context
+	values context.Context
+}
+
+// Value implements context.Context.
+func (c batchContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// batchingClient adds property updates to the batch instead of sending them right away. It returns before the update
+// is sent, failures are retried and reported by the clients the batch is sent with. Action results are sent right away,
+// after the pending updates, so the values of an action are set when it completes.
+type batchingClient struct {
+	connector.Client
+	batcher *updateBatcher
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *batchingClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	c.batcher.Add(&batchedUpdate{ctx, token, thingID, componentID, propertyID, value, lastUpdate})
+	return nil
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *batchingClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	if err := c.batcher.Flush(ctx); err != nil {
+		return err
+	}
+	return c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e)
+}
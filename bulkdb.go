@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// Statements loading all installations and instances with their configuration and things at once.
+// They are joined in memory, which is faster than a join in the database as instances have several configuration parameters.
+const (
+	statementBulkGetInstallations             = `SELECT id FROM installations`
+	statementBulkGetInstallationConfiguration = `SELECT installation_id, id, value FROM installation_configuration`
+	statementBulkGetInstances                 = `SELECT id, token, installation_id FROM instances`
+	statementBulkGetInstanceConfiguration     = `SELECT instance_id, id, value FROM instance_configuration`
+	statementBulkGetThingMappings             = `SELECT instance_id, thing_id, external_id FROM instance_thing_mapping`
+)
+
+// bulkProgressInterval is the number of rows after which the progress of loading them is logged.
+const bulkProgressInterval = 10000
+
+// bulkDatabase loads all installations and instances with a fixed number of queries.
+// The SDK queries the configuration and things of each instance separately, which makes the start with
+// tens of thousands of instances take minutes. Both are loaded by the service on start and by every reconciliation.
+type bulkDatabase struct {
+	connector.Database
+	db *sqlx.DB
+}
+
+// GetInstallations implements connector.Database.
+func (d *bulkDatabase) GetInstallations(ctx context.Context) ([]*connector.Installation, error) {
+	start := time.Now()
+	installations := []*connector.Installation{}
+	byId := map[string]*connector.Installation{}
+	err := d.scan(ctx, "installations", statementBulkGetInstallations, func(rows *sqlx.Rows) error {
+		installation := &connector.Installation{}
+		if err := rows.Scan(&installation.ID); err != nil {
+			return err
+		}
+		installations = append(installations, installation)
+		byId[installation.ID] = installation
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve installations: %w", err)
+	}
+
+	err = d.scan(ctx, "installation configuration", statementBulkGetInstallationConfiguration, func(rows *sqlx.Rows) error {
+		var installationId string
+		var config connector.Configuration
+		if err := rows.Scan(&installationId, &config.ID, &config.Value); err != nil {
+			return err
+		}
+		if installation, ok := byId[installationId]; ok {
+			installation.Configuration = append(installation.Configuration, config)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve installation configuration: %w", err)
+	}
+
+	logrus.WithField("installations", len(installations)).WithField("duration", time.Since(start)).Debugln("loaded installations")
+	return installations, nil
+}
+
+// GetInstances implements connector.Database.
+func (d *bulkDatabase) GetInstances(ctx context.Context) ([]*connector.Instance, error) {
+	start := time.Now()
+	instances := []*connector.Instance{}
+	byId := map[string]*connector.Instance{}
+	err := d.scan(ctx, "instances", statementBulkGetInstances, func(rows *sqlx.Rows) error {
+		instance := &connector.Instance{}
+		if err := rows.Scan(&instance.ID, &instance.Token, &instance.InstallationID); err != nil {
+			return err
+		}
+		instances = append(instances, instance)
+		byId[instance.ID] = instance
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve instances: %w", err)
+	}
+
+	err = d.scan(ctx, "instance configuration", statementBulkGetInstanceConfiguration, func(rows *sqlx.Rows) error {
+		var instanceId string
+		var config connector.Configuration
+		if err := rows.Scan(&instanceId, &config.ID, &config.Value); err != nil {
+			return err
+		}
+		if instance, ok := byId[instanceId]; ok {
+			instance.Configuration = append(instance.Configuration, config)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve instance configuration: %w", err)
+	}
+
+	err = d.scan(ctx, "thing mappings", statementBulkGetThingMappings, func(rows *sqlx.Rows) error {
+		var mapping connector.ThingMapping
+		if err := rows.Scan(&mapping.InstanceID, &mapping.ThingID, &mapping.ExternalID); err != nil {
+			return err
+		}
+		if instance, ok := byId[mapping.InstanceID]; ok {
+			instance.ThingMapping = append(instance.ThingMapping, mapping)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve thing mappings: %w", err)
+	}
+
+	logrus.WithField("instances", len(instances)).WithField("duration", time.Since(start)).Debugln("loaded instances")
+	return instances, nil
+}
+
+// scan calls fn for each row of the query and logs the progress of large results.
+func (d *bulkDatabase) scan(ctx context.Context, what string, query string, fn func(rows *sqlx.Rows) error) error {
+	rows, err := d.db.QueryxContext(ctx, d.db.Rebind(query))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+		n++
+		if n%bulkProgressInterval == 0 {
+			logrus.WithField("rows", n).Infof("loading %s", what)
+		}
+	}
+	return rows.Err()
+}
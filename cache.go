@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// searchLanguage is the language of search results. The Giphy client does not send a language,
+// so the results are in the default language of the Giphy API.
+const searchLanguage = "en"
+
+// searchCache caches Giphy search and translate results in Redis, so popular keywords do not cost a Giphy request for every instance.
+// Results are shared between installations, they only depend on the keyword or phrase, rating and language.
+// The whole result is cached as JSON, so cached results have the same ID and rating as fresh ones.
+// Cache errors are logged and counted, the search then falls back to the Giphy API.
+type searchCache struct {
+	redis    *redisClient
+	ttl      time.Duration
+	requests *metricVec
+}
+
+// newSearchCache returns a cache storing results in the Redis server given by the URL for the given time.
+func newSearchCache(rawURL string, ttl time.Duration, metrics *metricsRegistry) (*searchCache, error) {
+	redis, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &searchCache{
+		redis:    redis,
+		ttl:      ttl,
+		requests: metrics.Counter("giphy_cache_requests_total", "Number of Giphy search cache lookups by result (hit, miss or error).", "result"),
+	}, nil
+}
+
+func searchCacheKey(kind string, keyword string, rating string, lang string) string {
+	return fmt.Sprintf("giphy-connector:%s:%s:%s:%s", kind, rating, lang, strings.ToLower(strings.TrimSpace(keyword)))
+}
+
+// Get returns the cached result of the search.
+func (c *searchCache) Get(keyword string, rating string, lang string) (searchResult, bool) {
+	return c.get(searchCacheKey("search", keyword, rating, lang))
+}
+
+// Set caches the result of the search.
+func (c *searchCache) Set(keyword string, rating string, lang string, result searchResult) {
+	c.set(searchCacheKey("search", keyword, rating, lang), result)
+}
+
+// GetTranslation returns the cached result of the translation of the phrase.
+func (c *searchCache) GetTranslation(phrase string, rating string, lang string) (searchResult, bool) {
+	return c.get(searchCacheKey("translate", phrase, rating, lang))
+}
+
+// SetTranslation caches the result of the translation of the phrase.
+func (c *searchCache) SetTranslation(phrase string, rating string, lang string, result searchResult) {
+	c.set(searchCacheKey("translate", phrase, rating, lang), result)
+}
+
+// get reads the result of the key. Values which are no result, e.g. the plain URLs cached by earlier versions, are misses.
+func (c *searchCache) get(key string) (searchResult, bool) {
+	var result searchResult
+	value, ok, err := c.redis.Get(key)
+	switch {
+	case err != nil:
+		logrus.WithError(err).Warnln("failed to read from the search cache")
+		c.requests.Inc("error")
+		return result, false
+	case !ok || json.Unmarshal([]byte(value), &result) != nil || result.URL == "":
+		c.requests.Inc("miss")
+		return searchResult{}, false
+	}
+	c.requests.Inc("hit")
+	return result, true
+}
+
+func (c *searchCache) set(key string, result searchResult) {
+	value, err := json.Marshal(result)
+	if err == nil {
+		err = c.redis.Set(key, string(value), c.ttl)
+	}
+	if err != nil {
+		logrus.WithError(err).Warnln("failed to write to the search cache")
+		c.requests.Inc("error")
+	}
+}
+
+// redisClient is a minimal client of the Redis protocol, which only implements the commands needed by the cache and the job queue.
+// It uses a single connection, which is established on the first command and again after it failed.
+type redisClient struct {
+	addr     string
+	tls      bool
+	password string
+	db       int
+	timeout  time.Duration
+
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+}
+
+// newRedisClient parses a URL like redis://[:password@]host:6379/0, rediss:// connects with TLS.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis url: unsupported scheme %q, expected redis or rediss", u.Scheme)
+	}
+	c := &redisClient{addr: u.Host, tls: u.Scheme == "rediss", timeout: 500 * time.Millisecond}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis url: invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Get returns the value of the key and whether it exists.
+func (c *redisClient) Get(key string) (string, bool, error) {
+	reply, err := c.do("GET", key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	return reply.(string), true, nil
+}
+
+// Set sets the value of the key, which expires after the TTL.
+func (c *redisClient) Set(key string, value string, ttl time.Duration) error {
+	_, err := c.do("SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Eval runs the Lua script with the given keys and arguments and returns its reply.
+func (c *redisClient) Eval(script string, keys []string, args ...string) (interface{}, error) {
+	command := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	return c.do(append(command, args...)...)
+}
+
+// do sends the command and returns the reply, which is a string, an integer or nil.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := c.command(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// connect opens the connection, authenticates and selects the database.
+// Must be called with the lock held.
+func (c *redisClient) connect() error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if c.password != "" {
+		if _, err := c.command("AUTH", c.password); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("failed to authenticate with redis: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := c.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("failed to select redis database: %w", err)
+		}
+	}
+	return nil
+}
+
+// command writes the command as array of bulk strings and reads the reply.
+func (c *redisClient) command(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("invalid redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("invalid redis reply")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply %q", line[0])
+	}
+}
+
+// redisError is an error reply of the server. The connection can still be used after it.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
@@ -0,0 +1,154 @@
+//go:build go1.18
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/crypto"
+)
+
+// fuzzSeeds are valid callback requests the fuzzer starts from.
+var fuzzSeeds = []struct {
+	method string
+	path   string
+	body   interface{}
+}{
+	{http.MethodPost, "/installations", connector.InstallationRequest{ID: "8c2b3b86-4a38-4a53-9a7f-0d8f3d4c2f1a", Token: "token", Configuration: []connector.Configuration{{ID: "giphy_api_key", Value: "key"}}}},
+	{http.MethodDelete, "/installations/8c2b3b86-4a38-4a53-9a7f-0d8f3d4c2f1a", nil},
+	{http.MethodPost, "/instances", connector.InstantiationRequest{ID: "1d6e1d2e-5b1c-4bb9-9f6b-3c3a8b3a7e55", InstallationID: "8c2b3b86-4a38-4a53-9a7f-0d8f3d4c2f1a", Token: "token"}},
+	{http.MethodDelete, "/instances/1d6e1d2e-5b1c-4bb9-9f6b-3c3a8b3a7e55", nil},
+	{http.MethodPost, "/actions", connector.ActionRequest{ID: "a1", ThingID: "t1", ComponentID: "search", ActionID: "search", Status: connector.ActionRequestStatusPending, Parameters: map[string]string{"keyword": "cat"}}},
+}
+
+// fuzzHostileBodies are malformed bodies added to the seed corpus.
+var fuzzHostileBodies = []string{
+	"",
+	"null",
+	"{",
+	`{"id":`,
+	`{"id":1,"token":{},"configuration":"x"}`,
+	`{"configuration":[null,1,"x",{"id":null}]}`,
+	`{"parameters":{"keyword":["a"]}}`,
+	`{"state":1e999}`,
+	`{"id":"\ud800"}`,
+	"{\"id\":\"\xff\xfe\"}",
+	strings.Repeat("[", 10000),
+	strings.Repeat(`{"a":`, 1000) + "1" + strings.Repeat("}", 1000),
+	`[]`,
+	`"string"`,
+}
+
+// FuzzCallbackHandler sends mutated callback requests through the callback handlers and fails on panics.
+// With sign set, the request is signed again after the mutation, so the body decoding is reached
+// and not only the signature validation. An empty date is replaced by the current time.
+func FuzzCallbackHandler(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		var body []byte
+		if seed.body != nil {
+			body, _ = json.Marshal(seed.body)
+		}
+		f.Add(seed.method, seed.path, "application/json", "", "", body, true)
+		f.Add(seed.method, seed.path, "application/json; charset=utf-8", "", "", body, true)
+		f.Add(seed.method, seed.path, "application/json", "", "not base64!", body, false)
+		if len(body) > 0 {
+			f.Add(seed.method, seed.path, "application/json", "", "", body[:len(body)/2], true)
+		}
+	}
+	for _, body := range fuzzHostileBodies {
+		f.Add(http.MethodPost, "/installations", "application/json", "", "", []byte(body), true)
+	}
+	f.Add(http.MethodPost, "/actions", "text/json; charset=latin1", "Mon, 02 Jan 2006 15:04:05 GMT\r\nX-Injected: 1", base64.StdEncoding.EncodeToString(make([]byte, 63)), []byte("{}"), false)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	handler := limitBodyHandler(maxCallbackBodySize, jsonContentTypeHandler(true, connector.NewConnectorHandler(nil, acceptingService{}, publicKey)))
+
+	f.Fuzz(func(t *testing.T, method, path, contentType, date, signature string, body []byte, sign bool) {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		req, err := http.NewRequest(method, "http://connector.example.com"+path, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		if date == "" {
+			date = time.Now().UTC().Format(http.TimeFormat)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Date", date)
+		req.Header.Set(crypto.SignatureHeaderKey, signature)
+		if sign {
+			payload, err := crypto.SignablePayload(req.Method, "https", req.Host, req.URL.RequestURI(), req.Header, body)
+			if err == nil {
+				req.Header.Set(crypto.SignatureHeaderKey, base64.StdEncoding.EncodeToString(crypto.Sign(privateKey, payload)))
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code >= http.StatusInternalServerError {
+			t.Errorf("got status %d for %s %s", rec.Code, method, path)
+		}
+	})
+}
+
+// FuzzSignablePayload calls SignablePayload and Verify with arbitrary input and fails on panics.
+func FuzzSignablePayload(f *testing.F) {
+	f.Add(http.MethodPost, "https", "connector.example.com", "/installations", "Mon, 02 Jan 2006 15:04:05 GMT", []byte(`{"id":"x"}`), make([]byte, ed25519.SignatureSize))
+	f.Add("", "", "", "", "", []byte{}, []byte{})
+	f.Add("\x00", "\xff", " ", "?a=b#c", "not a date", []byte{0}, []byte("AAAA"))
+
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, method, scheme, host, uri, date string, body, signature []byte) {
+		headers := http.Header{}
+		if date != "" {
+			headers.Set("Date", date)
+		}
+		payload, err := crypto.SignablePayload(method, scheme, host, uri, headers, body)
+		if err != nil {
+			return
+		}
+		if crypto.Verify(publicKey, payload, signature) && len(signature) != ed25519.SignatureSize {
+			t.Errorf("signature of %d bytes was accepted", len(signature))
+		}
+	})
+}
+
+// acceptingService accepts all callbacks, so requests passing the validation reach the end of the handlers.
+type acceptingService struct{}
+
+func (acceptingService) AddInstallation(ctx context.Context, request connector.InstallationRequest) (*connector.InstallationResponse, error) {
+	return nil, nil
+}
+
+func (acceptingService) RemoveInstallation(ctx context.Context, installationId string) error {
+	return nil
+}
+
+func (acceptingService) AddInstance(ctx context.Context, request connector.InstantiationRequest) (*connector.InstantiationResponse, error) {
+	return nil, nil
+}
+
+func (acceptingService) RemoveInstance(ctx context.Context, instanceId string) error {
+	return nil
+}
+
+func (acceptingService) PerformAction(ctx context.Context, request connector.ActionRequest) (*connector.ActionResponse, error) {
+	return &connector.ActionResponse{Status: connector.ActionRequestStatusCompleted}, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// channelSampleInterval is how often the depth of the provider channels is sampled.
+// The lag of consumed events is only as accurate as the interval, it is reported as the time they waited at least.
+const channelSampleInterval = time.Second
+
+// channelMonitor measures a channel of the provider: how many events are queued, how long the oldest one is waiting and
+// how long the events consumed last waited, the lag of the consumer. The send time of each event is recorded, the events
+// consumed since the last sample are derived from the length of the channel, since the consumers belong to the SDK.
+type channelMonitor struct {
+	name     string
+	depth    *metricVec
+	capacity *metricVec
+	oldest   *metricVec
+	lag      *metricVec
+
+	lock sync.Mutex
+	// sent are the send times of the events which were not consumed as of the last sample, the oldest first.
+	sent []time.Time
+	// sending is the number of senders waiting for room in the channel.
+	sending int
+	// sampled is the time of the last sample, events consumed since then were consumed after it.
+	sampled time.Time
+}
+
+func newChannelMonitor(name string, metrics *metricsRegistry) *channelMonitor {
+	return &channelMonitor{
+		name:     name,
+		depth:    metrics.Gauge("provider_channel_depth", "Number of events queued in the provider channel.", "channel"),
+		capacity: metrics.Gauge("provider_channel_capacity", "Number of events the provider channel can buffer.", "channel"),
+		oldest:   metrics.Gauge("provider_channel_oldest_event_age_seconds", "How long the oldest event queued in the provider channel is waiting.", "channel"),
+		lag:      metrics.Gauge("provider_channel_lag_seconds", "How long the events consumed from the provider channel last waited.", "channel"),
+	}
+}
+
+// Send records the send time of an event and sends it with the given function, which blocks while the channel is full.
+func (m *channelMonitor) Send(send func()) {
+	m.lock.Lock()
+	m.sent = append(m.sent, clock())
+	m.sending++
+	m.lock.Unlock()
+
+	send()
+
+	m.lock.Lock()
+	m.sending--
+	m.lock.Unlock()
+}
+
+// Sample updates the metrics from the current length and capacity of the channel.
+func (m *channelMonitor) Sample(length int, capacity int) {
+	now := clock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Events are consumed in the order they were sent, all but the queued and the waiting ones were consumed
+	if consumed := len(m.sent) - length - m.sending; consumed > 0 {
+		lag := m.sampled.Sub(m.sent[consumed-1])
+		if lag < 0 {
+			lag = 0
+		}
+		m.lag.Set(lag.Seconds(), m.name)
+		m.sent = append(m.sent[:0:0], m.sent[consumed:]...)
+	} else if len(m.sent) == 0 {
+		m.lag.Set(0, m.name)
+	}
+	m.sampled = now
+	m.depth.Set(float64(length), m.name)
+	m.capacity.Set(float64(capacity), m.name)
+	if len(m.sent) > 0 {
+		m.oldest.Set(now.Sub(m.sent[0]).Seconds(), m.name)
+	} else {
+		m.oldest.Set(0, m.name)
+	}
+}
+
+// providerChannels are the monitors of the update and the action channel of the provider.
+type providerChannels struct {
+	updates *channelMonitor
+	actions *channelMonitor
+}
+
+// SetChannelMetrics lets the provider export the depth and lag of its update and action channels.
+// It must be called before the provider is run.
+func (h *GiphyProvider) SetChannelMetrics(metrics *metricsRegistry) {
+	h.channels = &providerChannels{
+		updates: newChannelMonitor("updates", metrics),
+		actions: newChannelMonitor("actions", metrics),
+	}
+}
+
+// UpdateEvent sends the update to the event handler, which sends it to connctd.
+// With fair updates, it is queued with the other updates of the installation of its instance first.
+func (h *GiphyProvider) UpdateEvent(update connector.UpdateEvent) {
+	if h.fair == nil {
+		h.sendUpdate(update)
+		return
+	}
+	var instanceId string
+	if update.PropertyUpdateEvent != nil {
+		instanceId = update.PropertyUpdateEvent.InstanceId
+	} else if update.ActionEvent != nil {
+		instanceId = update.ActionEvent.InstanceId
+	}
+	h.fair.Send(h.instanceInstallation(instanceId), update)
+}
+
+// sendUpdate sends the update to the update channel.
+func (h *GiphyProvider) sendUpdate(update connector.UpdateEvent) {
+	if h.channels == nil {
+		h.DefaultProvider.UpdateEvent(update)
+		return
+	}
+	h.channels.updates.Send(func() { h.DefaultProvider.UpdateEvent(update) })
+}
+
+// sampleChannels updates the channel metrics until the context is done.
+func (h *GiphyProvider) sampleChannels(ctx context.Context) {
+	ticker := time.NewTicker(channelSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.channels.updates.Sample(len(h.UpdateChannel()), cap(h.UpdateChannel()))
+			h.channels.actions.Sample(len(h.ActionChannel()), cap(h.ActionChannel()))
+		}
+	}
+}
@@ -0,0 +1,515 @@
+// The connctd simulator drives a locally running Giphy connector the way the connctd platform does.
+// It signs installation, instantiation and action requests with its own key and serves the parts of the connctd API
+// used by the connector, so the connector can be developed end-to-end without publishing it.
+//
+// Start the connector with the public key printed by "connctd-simulator keygen" and
+// "-connctd-url http://localhost:8090/", then run "connctd-simulator run".
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/connctd/connector-go/crypto"
+	"github.com/connctd/giphy-connector/internal/signing"
+	"github.com/gorilla/mux"
+)
+
+const usage = `Usage: connctd-simulator [flags] <command>
+
+Commands:
+  keygen        print the public key the connector has to be started with
+  run           install and instantiate the connector, trigger a search action and print all updates
+  sign-request  print the Date and Signature headers of a request, see "sign-request -h"
+  replay        re-send callbacks recorded by the connector, see "replay -h"
+
+Flags:
+`
+
+func main() {
+	keyFile := flag.String("key", "simulator.key", "file containing the private signing key, it is created if it does not exist")
+	connectorURL := flag.String("connector", "http://localhost:8080", "base URL of the connector")
+	listen := flag.String("listen", ":8090", "listen address of the simulated connctd API")
+	apiKey := flag.String("api-key", os.Getenv("GIPHY_API_KEY"), "Giphy API key used as installation configuration")
+	webhookURL := flag.String("webhook-url", "", "webhook URL used as installation configuration, property updates are posted to it if the connector has a signing key")
+	quietHours := flag.String("quiet-hours", "", "quiet hours in UTC used as instance configuration, e.g. 22:00-06:00, the periodic update is suppressed during them")
+	keywords := flag.String("keywords", "", "comma separated keywords used as instance configuration, the connector creates a thing per keyword")
+	emptySearchResult := flag.String("empty-search-result", "", "how searches without result end used as instance configuration, fail or complete")
+	keyword := flag.String("keyword", "cat", "keyword of the search action")
+	actionDelay := flag.Duration("action-delay", 65*time.Second, "time to wait before the search action is requested, the connector registers new installations once a minute")
+	signedHeaderList := flag.String("signed-headers", strings.Join(signing.DefaultHeaders, ","), "comma separated headers covered by the signatures, in signing order, other than Date they are announced with the Signed-Headers header")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	signedHeaders, err := signing.ParseHeaders(*signedHeaderList)
+	if err != nil {
+		log.Fatalf("Invalid signed headers: %v", err)
+	}
+
+	privateKey, err := loadOrGenerateKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load signing key: %v", err)
+	}
+
+	switch flag.Arg(0) {
+	case "keygen":
+		fmt.Println(base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)))
+	case "run":
+		target, err := url.Parse(*connectorURL)
+		if err != nil {
+			log.Fatalf("Invalid connector URL: %v", err)
+		}
+		s := newSimulator(privateKey, target, signedHeaders)
+		if err := s.Run(*listen, *apiKey, *webhookURL, *quietHours, *emptySearchResult, *keywords, *keyword, *actionDelay); err != nil {
+			log.Fatal(err)
+		}
+	case "sign-request":
+		if err := signRequest(privateKey, signedHeaders, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	case "replay":
+		target, err := url.Parse(*connectorURL)
+		if err != nil {
+			log.Fatalf("Invalid connector URL: %v", err)
+		}
+		s := newSimulator(privateKey, target, signedHeaders)
+		if err := s.Replay(*listen, *apiKey, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// loadOrGenerateKey reads the base64 encoded seed of the private key from the file.
+// If the file does not exist, a new key is generated and stored.
+func loadOrGenerateKey(file string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid key in %s", file)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(privateKey.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated new signing key in %s", file)
+	return privateKey, nil
+}
+
+// simulator plays the role of the connctd platform.
+type simulator struct {
+	privateKey    ed25519.PrivateKey
+	target        *url.URL
+	signedHeaders []string
+	httpClient    *http.Client
+
+	things chan string
+	lock   sync.Mutex
+	count  int
+}
+
+func newSimulator(privateKey ed25519.PrivateKey, target *url.URL, signedHeaders []string) *simulator {
+	return &simulator{
+		privateKey:    privateKey,
+		target:        target,
+		signedHeaders: signedHeaders,
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+		things:        make(chan string, 16),
+	}
+}
+
+// Run serves the connctd API and walks through the lifecycle of an installation until it is interrupted.
+// The installation and instance are removed again on interruption.
+func (s *simulator) Run(listen string, apiKey string, webhookURL string, quietHours string, emptySearchResult string, keywords string, keyword string, actionDelay time.Duration) error {
+	server := &http.Server{Addr: listen, Handler: s.apiHandler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start connctd API: %v", err)
+		}
+	}()
+	defer server.Shutdown(context.Background())
+
+	installationId := randomId()
+	instanceId := randomId()
+
+	configuration := []connector.Configuration{
+		{ID: "giphy_api_key", Value: apiKey},
+	}
+	if webhookURL != "" {
+		configuration = append(configuration, connector.Configuration{ID: "webhook_url", Value: webhookURL})
+	}
+	instanceConfiguration := []connector.Configuration{}
+	if quietHours != "" {
+		instanceConfiguration = append(instanceConfiguration, connector.Configuration{ID: "quiet_hours", Value: quietHours})
+	}
+	if keywords != "" {
+		instanceConfiguration = append(instanceConfiguration, connector.Configuration{ID: "keywords", Value: keywords})
+	}
+	if emptySearchResult != "" {
+		instanceConfiguration = append(instanceConfiguration, connector.Configuration{ID: "empty_search_result", Value: emptySearchResult})
+	}
+
+	log.Printf("Installing %s", installationId)
+	if err := s.send(http.MethodPost, "/installations", connector.InstallationRequest{
+		ID:            installationId,
+		Token:         connector.InstallationToken(randomId()),
+		State:         connector.InstallationStateInitialized,
+		Configuration: configuration,
+	}); err != nil {
+		return fmt.Errorf("installation failed: %w", err)
+	}
+
+	log.Printf("Instantiating %s", instanceId)
+	if err := s.send(http.MethodPost, "/instances", connector.InstantiationRequest{
+		ID:             instanceId,
+		InstallationID: installationId,
+		Token:          connector.InstantiationToken(randomId()),
+		State:          connector.InstantiationStateInitialized,
+		Configuration:  instanceConfiguration,
+	}); err != nil {
+		return fmt.Errorf("instantiation failed: %w", err)
+	}
+
+	// The connector retries the thing creation in the background if it fails, the first two retries are awaited
+	var thingId string
+	select {
+	case thingId = <-s.things:
+	case <-time.After(35 * time.Second):
+		return errors.New("connector did not create a thing")
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	log.Printf("Waiting %s before searching for %q, press Ctrl+C to uninstall", actionDelay, keyword)
+	select {
+	case <-time.After(actionDelay):
+		if err := s.search(thingId, keyword); err != nil {
+			return err
+		}
+		log.Printf("Waiting for updates, press Ctrl+C to uninstall")
+		<-interrupt
+	case <-interrupt:
+	}
+
+	log.Printf("Removing instance %s", instanceId)
+	if err := s.send(http.MethodDelete, "/instances/"+instanceId, nil); err != nil {
+		log.Printf("Failed to remove instance: %v", err)
+	}
+	log.Printf("Removing installation %s", installationId)
+	if err := s.send(http.MethodDelete, "/installations/"+installationId, nil); err != nil {
+		log.Printf("Failed to remove installation: %v", err)
+	}
+	return nil
+}
+
+// search requests the search action of the thing.
+func (s *simulator) search(thingId string, keyword string) error {
+	log.Printf("Searching for %q", keyword)
+	if err := s.send(http.MethodPost, "/actions", connector.ActionRequest{
+		ID:          randomId(),
+		ThingID:     thingId,
+		ComponentID: "search",
+		ActionID:    "search",
+		Status:      connector.ActionRequestStatusPending,
+		Parameters:  map[string]string{"keyword": keyword},
+	}); err != nil {
+		return fmt.Errorf("action request failed: %w", err)
+	}
+	return nil
+}
+
+// send signs the request the way the connctd platform does and sends it to the connector.
+// Any status code other than 2xx is returned as error.
+func (s *simulator) send(method string, path string, payload interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	return s.sendRaw(method, path, http.Header{"Content-Type": {"application/json"}}, body)
+}
+
+// sendRaw signs and sends the body unchanged.
+// The request URI may contain a query. The Date header is always set to the current time,
+// each request gets a new X-Request-Id, so it can be included in the signed headers.
+func (s *simulator) sendRaw(method string, requestURI string, headers http.Header, body []byte) error {
+	ref, err := url.Parse(requestURI)
+	if err != nil {
+		return err
+	}
+	u := *s.target
+	u.Path = strings.TrimSuffix(u.Path, "/") + ref.Path
+	u.RawQuery = ref.RawQuery
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Request-Id", randomId())
+
+	// The platform always signs the public https URL of the connector
+	signature, err := sign(s.privateKey, method, "https", &u, req.Header, s.signedHeaders, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(crypto.SignatureHeaderKey, signature)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(resp.Body)
+
+	log.Printf("%s %s: %s %s", method, requestURI, resp.Status, strings.TrimSpace(string(response)))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the value of the Signature header of the request.
+// If other headers than the default ones are signed, they are announced with the Signed-Headers header.
+func sign(privateKey ed25519.PrivateKey, method string, scheme string, u *url.URL, headers http.Header, signedHeaders []string, body []byte) (string, error) {
+	if !signing.IsDefault(signedHeaders) {
+		headers.Set(signing.SignedHeadersHeaderKey, strings.Join(signedHeaders, ", "))
+	}
+	signable, err := signing.Payload(method, scheme, u.Host, u.RequestURI(), headers, signedHeaders, body)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(crypto.Sign(privateKey, signable)), nil
+}
+
+// headerFlags collects repeated -header flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return ""
+}
+
+func (h headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("expected \"Name: value\"")
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// signRequest prints the Date and Signature headers for the request described by args,
+// so the endpoints of the connector can be called with curl while signature validation stays enabled.
+// Other signed headers are printed as well and must be sent with the same values.
+func signRequest(privateKey ed25519.PrivateKey, signedHeaders []string, args []string) error {
+	flags := flag.NewFlagSet("sign-request", flag.ExitOnError)
+	method := flags.String("method", http.MethodPost, "HTTP method of the request")
+	rawURL := flags.String("url", "", "URL of the request, e.g. http://localhost:8080/installations")
+	scheme := flags.String("scheme", "https", "scheme used for the signature, the connector expects https unless X-Forwarded-Proto is set")
+	date := flags.String("date", time.Now().UTC().Format(http.TimeFormat), "value of the Date header")
+	body := flags.String("body", "", "body of the request")
+	bodyFile := flags.String("body-file", "", "file containing the body of the request, \"-\" for stdin")
+	headers := headerFlags{}
+	flags.Var(headers, "header", "header of the request as \"Name: value\", required for signed headers other than Date, may be repeated")
+	flags.Parse(args)
+
+	if *rawURL == "" {
+		return errors.New("missing -url")
+	}
+	u, err := url.Parse(*rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+
+	payload := []byte(*body)
+	switch *bodyFile {
+	case "":
+	case "-":
+		payload, err = ioutil.ReadAll(os.Stdin)
+	default:
+		payload, err = ioutil.ReadFile(*bodyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	header := http.Header(headers)
+	header.Set("Date", *date)
+	signature, err := sign(privateKey, strings.ToUpper(*method), *scheme, u, header, signedHeaders, payload)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Date: %s\n%s: %s\n", *date, crypto.SignatureHeaderKey, signature)
+	for _, name := range signedHeaders {
+		if name != "Date" {
+			fmt.Printf("%s: %s\n", name, header.Get(name))
+		}
+	}
+	if value := header.Get(signing.SignedHeadersHeaderKey); value != "" {
+		fmt.Printf("%s: %s\n", signing.SignedHeadersHeaderKey, value)
+	}
+	return nil
+}
+
+// apiHandler serves the callback endpoints of the connctd API used by the connector and logs all calls.
+func (s *simulator) apiHandler() http.Handler {
+	root := mux.NewRouter()
+
+	// Public key discovery, so the connector can be started with -public-key-url instead of the public key
+	root.Path("/keys").Methods(http.MethodGet).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		publicKey := s.privateKey.Public().(ed25519.PublicKey)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{"id": "simulator", "publicKey": base64.StdEncoding.EncodeToString(publicKey)}},
+		})
+	})
+
+	r := root.PathPrefix("/connectorhub/callback").Subrouter()
+	r.Use(decompressRequests)
+
+	r.Path("/instances/things").Methods(http.MethodPost).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var thingRequest connector.AddThingRequest
+		if err := json.NewDecoder(req.Body).Decode(&thingRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.lock.Lock()
+		s.count++
+		thingId := fmt.Sprintf("thing-%d", s.count)
+		s.lock.Unlock()
+
+		log.Printf("Created thing %s (%s)", thingId, thingRequest.Thing.Name)
+		select {
+		case s.things <- thingId:
+		default:
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(connector.AddThingResponse{ID: thingId})
+	})
+
+	r.Path("/instances/things/{thingId}").Methods(http.MethodPatch).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var upgrade struct {
+			Components []connctd.Component      `json:"components"`
+			Attributes []connctd.ThingAttribute `json:"attributes"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&upgrade); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var added []string
+		for _, component := range upgrade.Components {
+			for _, property := range component.Properties {
+				added = append(added, component.ID+"/"+property.ID)
+			}
+			for _, action := range component.Actions {
+				added = append(added, component.ID+"/"+action.ID+"()")
+			}
+		}
+		for _, attribute := range upgrade.Attributes {
+			added = append(added, attribute.Name)
+		}
+		log.Printf("Updated thing %s, added %s", mux.Vars(req)["thingId"], strings.Join(added, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Path("/instances/things/{thingId}/components/{componentId}/properties/{propertyId}").Methods(http.MethodPut).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var update connector.UpdateThingPropertyValueRequest
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		vars := mux.Vars(req)
+		log.Printf("Property %s/%s/%s = %s", vars["thingId"], vars["componentId"], vars["propertyId"], update.Value)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Path("/instances/actions/requests/{id}").Methods(http.MethodPut).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var update connector.ActionRequestStatusUpdate
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Action request %s is %s %s", mux.Vars(req)["id"], update.Status, update.Error)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// All other calls, e.g. state updates, are only logged
+	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		log.Printf("connctd API call %s %s %s", req.Method, req.URL.Path, strings.TrimSpace(string(body)))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return root
+}
+
+// decompressRequests decompresses request bodies sent with Content-Encoding: gzip, e.g. by -connctd-compress-requests.
+func decompressRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			body, err := gzip.NewReader(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			log.Printf("Received compressed %s %s", req.Method, req.URL.Path)
+			req.Body = body
+			req.Header.Del("Content-Encoding")
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/connctd/giphy-connector/internal/recording"
+)
+
+// redacted is the placeholder the connector writes instead of secrets.
+const redacted = "[REDACTED]"
+
+// Replay re-sends callbacks recorded by the connector in their original order, signed with the simulator key.
+// The connctd API is served during the replay, so the connector can create things.
+// Masked Giphy API keys are replaced by apiKey, masked tokens are sent as they are.
+func (s *simulator) Replay(listen string, apiKey string, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := flags.String("file", "callbacks.ndjson", "file written by the -record-callbacks option of the connector")
+	delay := flags.Duration("delay", 0, "time to wait between two callbacks")
+	flags.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	callbacks, err := recording.Read(f)
+	if err != nil {
+		return fmt.Errorf("invalid recording: %w", err)
+	}
+	if len(callbacks) == 0 {
+		return errors.New("recording is empty")
+	}
+
+	server := &http.Server{Addr: listen, Handler: s.apiHandler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start connctd API: %v", err)
+		}
+	}()
+	defer server.Shutdown(context.Background())
+
+	for i, c := range callbacks {
+		if i > 0 && *delay > 0 {
+			time.Sleep(*delay)
+		}
+
+		headers := http.Header{}
+		headers.Set("Content-Type", c.Headers["Content-Type"])
+		if c.CorrelationID != "" {
+			headers.Set("X-Correlation-Id", c.CorrelationID)
+		}
+
+		log.Printf("Replaying callback %d of %d recorded at %s, original status %d", i+1, len(callbacks), c.Time.Format(time.RFC3339), c.Status)
+		if err := s.sendRaw(c.Method, c.RequestURI, headers, []byte(withAPIKey(c.Body, apiKey))); err != nil {
+			log.Printf("Callback %d failed: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// withAPIKey replaces a masked Giphy API key in the configuration of the body.
+func withAPIKey(body string, apiKey string) string {
+	var fields map[string]interface{}
+	if apiKey == "" || json.Unmarshal([]byte(body), &fields) != nil {
+		return body
+	}
+	config, ok := fields["configuration"].([]interface{})
+	if !ok {
+		return body
+	}
+	for _, c := range config {
+		if c, ok := c.(map[string]interface{}); ok && c["id"] == "giphy_api_key" && c["value"] == redacted {
+			c["value"] = apiKey
+		}
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return string(b)
+}
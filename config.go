@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go/db"
+	"github.com/sirupsen/logrus"
+)
+
+// Config is the basic configuration of the connector. It is loaded from an optional YAML or TOML file,
+// environment variables override the file and command line flags override both.
+// The remaining settings are only available as flags and environment variables.
+type Config struct {
+	DatabaseDriver string
+	DatabaseDSN    string
+	ListenAddr     string
+	// PublicKey is the public key of the connector publication, it is optional if the keys are fetched from -public-key-url.
+	PublicKey      string
+	UpdateInterval time.Duration
+	LogLevel       logrus.Level
+	// GiphyRating and Locale are used for installations without rating or locale configuration parameter.
+	GiphyRating string
+	Locale      string
+}
+
+// defaultConfig returns the configuration used if neither file, environment nor flags set a value.
+// The rating defaults to GIPHY_RATING, which the Giphy client read before the rating was configurable.
+func defaultConfig() *Config {
+	return &Config{
+		DatabaseDriver: string(db.DefaultOptions.Driver),
+		DatabaseDSN:    db.DefaultOptions.DSN,
+		ListenAddr:     ":8080",
+		UpdateInterval: defaultUpdateInterval,
+		LogLevel:       logrus.InfoLevel,
+		GiphyRating:    envOrDefault("GIPHY_RATING", "g"),
+		Locale:         "en",
+	}
+}
+
+// configField is a setting of Config with its key in the configuration file, nested keys are joined with a dot,
+// its environment variable and its command line flag, if it has one.
+type configField struct {
+	Key  string
+	Env  string
+	Flag string
+	set  func(c *Config, value string) error
+}
+
+var configFields = []configField{
+	{"database.driver", "GIPHY_CONNECTOR_DATABASE_DRIVER", "database-driver", func(c *Config, value string) error {
+		switch db.DBDriverName(value) {
+		case db.DriverSqlite3, db.DriverMysql, db.DriverPostgresql:
+			c.DatabaseDriver = value
+			return nil
+		}
+		return fmt.Errorf("unsupported driver %q, expected sqlite3, mysql or postgres", value)
+	}},
+	{"database.dsn", "GIPHY_CONNECTOR_DATABASE_DSN", "database-dsn", func(c *Config, value string) error {
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("must not be empty")
+		}
+		c.DatabaseDSN = value
+		return nil
+	}},
+	{"listen_addr", "GIPHY_CONNECTOR_LISTEN_ADDR", "listen-addr", func(c *Config, value string) error {
+		if _, port, err := net.SplitHostPort(value); err != nil || port == "" {
+			return fmt.Errorf("invalid address %q, expected host:port or :port", value)
+		}
+		c.ListenAddr = value
+		return nil
+	}},
+	{"public_key", "GIPHY_CONNECTOR_PUBLIC_KEY", "", func(c *Config, value string) error {
+		if _, err := parsePublicKey(value); err != nil {
+			return fmt.Errorf("invalid public key: %w", err)
+		}
+		c.PublicKey = value
+		return nil
+	}},
+	{"update_interval", "GIPHY_CONNECTOR_UPDATE_INTERVAL", "update-interval", func(c *Config, value string) error {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, expected e.g. 5m", value)
+		}
+		if interval < minUpdateInterval {
+			return fmt.Errorf("%s is shorter than the minimum of %s", interval, minUpdateInterval)
+		}
+		c.UpdateInterval = interval
+		return nil
+	}},
+	{"log_level", "GIPHY_CONNECTOR_LOG_LEVEL", "log-level", func(c *Config, value string) error {
+		level, err := logrus.ParseLevel(value)
+		if err != nil {
+			return fmt.Errorf("invalid level %q, expected debug, info, warn or error", value)
+		}
+		c.LogLevel = level
+		return nil
+	}},
+	{"giphy.rating", "GIPHY_CONNECTOR_GIPHY_RATING", "giphy-rating", func(c *Config, value string) error {
+		rating, ok := giphyRating(value)
+		if !ok {
+			return fmt.Errorf("unsupported rating %q, expected one of %s", value, strings.Join(giphyRatings, ", "))
+		}
+		c.GiphyRating = rating
+		return nil
+	}},
+	{"locale", "GIPHY_CONNECTOR_LOCALE", "locale", func(c *Config, value string) error {
+		locale, ok := supportedLocale(value)
+		if !ok {
+			return fmt.Errorf("unsupported locale %q, expected one of %s", value, strings.Join(supportedLocales(), ", "))
+		}
+		c.Locale = locale
+		return nil
+	}},
+}
+
+// configErrors are all problems found while loading the configuration, so they can be fixed at once.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n  ")
+}
+
+// loadConfig loads the configuration from the file, if one is given, the environment and the flags set on the command line.
+// All invalid values are returned as one error naming where each of them came from.
+func loadConfig(file string, flags *flag.FlagSet) (*Config, error) {
+	config := defaultConfig()
+	var errs configErrors
+
+	if file != "" {
+		values, err := readConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return values[keys[i]].Line < values[keys[j]].Line })
+		for _, key := range keys {
+			field, ok := findConfigField(func(f configField) bool { return f.Key == key })
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s:%d: unknown setting %s", file, values[key].Line, key))
+				continue
+			}
+			if err := field.set(config, values[key].Value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: %s: %s", file, values[key].Line, key, err))
+			}
+		}
+	}
+
+	for _, field := range configFields {
+		if value := os.Getenv(field.Env); value != "" {
+			if err := field.set(config, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", field.Env, err))
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		field, ok := findConfigField(func(field configField) bool { return field.Flag != "" && field.Flag == f.Name })
+		if !ok {
+			return
+		}
+		if err := field.set(config, f.Value.String()); err != nil {
+			errs = append(errs, fmt.Sprintf("-%s: %s", f.Name, err))
+		}
+	})
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return config, nil
+}
+
+// DatabaseOptions returns the options of the database client. Foreign keys of SQLite have to be enabled explicitly,
+// otherwise removing an installation does not cascade to its instances.
+func (c *Config) DatabaseOptions() *db.DBOptions {
+	dsn := c.DatabaseDSN
+	if db.DBDriverName(c.DatabaseDriver) == db.DriverSqlite3 && !strings.Contains(dsn, "_foreign_keys=") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&_foreign_keys=on"
+		} else {
+			dsn += "?_foreign_keys=on"
+		}
+	}
+	return &db.DBOptions{Driver: db.DBDriverName(c.DatabaseDriver), DSN: dsn}
+}
+
+func findConfigField(match func(configField) bool) (configField, bool) {
+	for _, field := range configFields {
+		if match(field) {
+			return field, true
+		}
+	}
+	return configField{}, false
+}
+
+// configValue is a value of the configuration file and the line it was read from.
+type configValue struct {
+	Value string
+	Line  int
+}
+
+// readConfigFile reads the settings of the file by their dotted key. The format follows the file extension:
+// .yaml and .yml files hold "key: value" lines, .toml files "key = value" lines. Both support one level of sections,
+// indented keys below "section:" in YAML and "[section]" tables in TOML, quoted values and comments.
+// Lists, multi-line values and further nesting are not supported.
+func readConfigFile(file string) (map[string]configValue, error) {
+	var separator string
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		separator = ":"
+	case ".toml":
+		separator = "="
+	default:
+		return nil, fmt.Errorf("unsupported configuration file %s, expected a .yaml, .yml or .toml file", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open configuration file: %w", err)
+	}
+	defer f.Close()
+
+	values := map[string]configValue{}
+	section := ""
+	lineNumber := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNumber++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		invalid := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", file, lineNumber, fmt.Sprintf(format, args...))
+		}
+
+		if separator == "=" && strings.HasPrefix(line, "[") {
+			name := strings.TrimSpace(stripConfigComment(line))
+			if !strings.HasSuffix(name, "]") || strings.Contains(name, ".") {
+				return nil, invalid("invalid table %s, only [name] tables are supported", name)
+			}
+			section = strings.TrimSpace(name[1 : len(name)-1])
+			continue
+		}
+
+		i := strings.Index(line, separator)
+		if i <= 0 {
+			return nil, invalid("expected key%svalue", map[string]string{":": ": ", "=": " = "}[separator])
+		}
+		key := strings.TrimSpace(line[:i])
+		value, err := unquoteConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, invalid("%s: %s", key, err)
+		}
+
+		if separator == ":" {
+			indented := raw[0] == ' ' || raw[0] == '\t'
+			if !indented {
+				section = ""
+			} else if section == "" {
+				return nil, invalid("unexpected indentation of %s", key)
+			}
+			if value == "" && !indented {
+				section = key
+				continue
+			}
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		if previous, ok := values[key]; ok {
+			return nil, invalid("%s is already set in line %d", key, previous.Line)
+		}
+		values[key] = configValue{value, lineNumber}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	return values, nil
+}
+
+// unquoteConfigValue returns the value without quotes and trailing comment.
+// Double quoted values support escapes, single quoted values are taken literally.
+func unquoteConfigValue(value string) (string, error) {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return strings.TrimSpace(stripConfigComment(value)), nil
+	}
+	for i := 1; i < len(value); i++ {
+		if value[0] == '"' && value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] != value[0] {
+			continue
+		}
+		if rest := strings.TrimSpace(value[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %s after quoted value", rest)
+		}
+		if value[0] == '\'' {
+			return value[1:i], nil
+		}
+		return strconv.Unquote(value[:i+1])
+	}
+	return "", fmt.Errorf("missing closing quote")
+}
+
+// stripConfigComment removes a comment at the end of an unquoted value, which starts with " #".
+func stripConfigComment(value string) string {
+	if i := strings.Index(value, " #"); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
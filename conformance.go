@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/giphy-connector/internal/giphytest"
+	"github.com/connctd/giphy-connector/providertest"
+)
+
+// runProviderConformance runs the Giphy provider through the provider conformance checks.
+// Giphy is replaced by a local fake server, so no API key is needed and no quota is used.
+func runProviderConformance() error {
+	giphy := giphytest.NewServer()
+	defer giphy.Close()
+	giphyURL, err := url.Parse(giphy.URL())
+	if err != nil {
+		return err
+	}
+
+	reporter := nopReporter{}
+	giphyProvider := NewGiphyProvider(reporter, newCorrelationRegistry(), newQuotaTracker(0, 0, reporter, newMetricsRegistry()), newLogSampler(0), nil)
+	giphyProvider.SetBaseURL(giphyURL)
+
+	// Only the action handler is started, the periodic update is replaced by Sync
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go giphyProvider.actionHandler(ctx)
+
+	err = providertest.TestProvider(providertest.Config{
+		Provider:                  giphyProvider,
+		Sync:                      giphyProvider.update,
+		InstallationConfiguration: []connector.Configuration{{ID: "giphy_api_key", Value: "conformance"}},
+		Action: connector.ActionRequest{
+			ComponentID: SearchComponentId,
+			ActionID:    "search",
+			Parameters:  map[string]string{"keyword": "cat"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("PASS")
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/connctd/connector-go"
+)
+
+// jsonContentTypeHandler normalizes the Content-Type of callbacks with a JSON body to application/json, since the SDK
+// only accepts it without parameters, e.g. not "application/json; charset=utf-8". Bodies in charsets other than UTF-8
+// are rejected like other content types by the SDK. With compatible, text/json and structured syntax types like
+// application/vnd.connctd+json are accepted as well. Other content types are passed on unchanged, so the SDK rejects them.
+// The handler must not run before a signature validation covering the Content-Type header.
+func jsonContentTypeHandler(compatible bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" || contentType == "application/json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil || !isJSONMediaType(mediaType, compatible) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if charset, ok := params["charset"]; ok && !isUTF8Charset(charset) {
+			connector.ErrorBadContentType.Write(w)
+			return
+		}
+		r.Header.Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isJSONMediaType reports whether the lower case media type denotes JSON, only application/json unless compatible types are accepted.
+func isJSONMediaType(mediaType string, compatible bool) bool {
+	if mediaType == "application/json" {
+		return true
+	}
+	return compatible && (mediaType == "text/json" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")))
+}
+
+func isUTF8Charset(charset string) bool {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	return charset == "utf-8" || charset == "utf8"
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONContentTypeHandler(t *testing.T) {
+	tests := []struct {
+		contentType string
+		compatible  bool
+		// forwarded is the Content-Type the SDK handler gets, empty if the request is rejected
+		forwarded string
+	}{
+		// Sent by the connctd platform and common HTTP clients
+		{"application/json", false, "application/json"},
+		{"application/json; charset=utf-8", false, "application/json"},
+		{"application/json;charset=UTF-8", false, "application/json"},
+		{`application/json; charset="utf-8"`, false, "application/json"},
+		{"Application/JSON; Charset=utf8", false, "application/json"},
+		{"", false, ""},
+		// Rejected by the SDK
+		{"text/plain", false, "text/plain"},
+		{"application/json; charset=", false, "application/json; charset="},
+		{"text/json", false, "text/json"},
+		{"application/vnd.connctd+json", false, "application/vnd.connctd+json"},
+		// Compatible types
+		{"text/json", true, "application/json"},
+		{"application/vnd.connctd+json; charset=utf-8", true, "application/json"},
+		{"application/xml", true, "application/xml"},
+	}
+	for _, test := range tests {
+		var forwarded string
+		handler := jsonContentTypeHandler(test.compatible, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwarded = r.Header.Get("Content-Type")
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/installations", nil)
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || forwarded != test.forwarded {
+			t.Errorf("%q (compatible %t): got status %d and %q, want %q", test.contentType, test.compatible, rec.Code, forwarded, test.forwarded)
+		}
+	}
+}
+
+func TestJSONContentTypeHandlerRejectsOtherCharsets(t *testing.T) {
+	for _, contentType := range []string{"application/json; charset=iso-8859-1", "application/json; charset=utf-16"} {
+		called := false
+		handler := jsonContentTypeHandler(false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/installations", nil)
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if called || rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d (forwarded %t), want the request to be rejected", contentType, rec.Code, called)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/go-logr/logr"
+)
+
+// CorrelationHeader carries the correlation ID of incoming callbacks and outgoing connctd API calls.
+// If an incoming request has no correlation header, we fall back to RequestIDHeader or generate a new ID.
+const (
+	CorrelationHeader = "X-Correlation-Id"
+	RequestIDHeader   = "X-Request-Id"
+)
+
+// maxCorrelationIDLength limits the length of correlation IDs taken from untrusted request headers.
+const maxCorrelationIDLength = 128
+
+type correlationKey struct{}
+
+// newCorrelationID returns a new random correlation ID.
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(randomness, id); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(id)
+}
+
+// withCorrelationID returns a copy of ctx carrying the given correlation ID.
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// correlationID returns the correlation ID carried by ctx or an empty string.
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// validCorrelationID reports whether the ID taken from a request header can safely be logged and forwarded.
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// correlationHandler attaches a correlation ID to the request context and the response headers.
+// The ID is taken from the request if present, otherwise a new one is generated.
+func correlationHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(CorrelationHeader)
+		if !validCorrelationID(id) {
+			id = r.Header.Get(RequestIDHeader)
+		}
+		if !validCorrelationID(id) {
+			id = newCorrelationID()
+		}
+
+		w.Header().Set(CorrelationHeader, id)
+		next.ServeHTTP(w, r.WithContext(withCorrelationID(r.Context(), id)))
+	})
+}
+
+// correlationTransport sets the correlation header on outgoing requests if their context carries a correlation ID.
+type correlationTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *correlationTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if id := correlationID(r.Context()); id != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set(CorrelationHeader, id)
+	}
+	return t.next.RoundTrip(r)
+}
+
+// correlationTTL is the time after which unclaimed entries of the correlationRegistry are discarded.
+const correlationTTL = 10 * time.Minute
+
+// correlationSweepInterval is the minimum time between two scans for expired entries, so a Put is O(1) amortized.
+const correlationSweepInterval = time.Minute
+
+type correlationEntry struct {
+	id      string
+	created time.Time
+}
+
+// correlationRegistry hands correlation IDs from the provider to the connctd client.
+// The SDK owns the UpdateEvent and PendingAction structs and passes a single background context to the client,
+// so the provider registers the ID for the action request or property it is about to update
+// and the client claims it when the service sends the update.
+type correlationRegistry struct {
+	entries   map[string]correlationEntry
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func newCorrelationRegistry() *correlationRegistry {
+	return &correlationRegistry{
+		entries: map[string]correlationEntry{},
+	}
+}
+
+// Put registers the correlation ID for the given key.
+// Empty IDs are ignored. Expired entries are removed at most once per correlationSweepInterval.
+func (r *correlationRegistry) Put(key string, id string) {
+	if id == "" {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := clock()
+	if now.Sub(r.lastSweep) >= correlationSweepInterval {
+		for k, e := range r.entries {
+			if now.Sub(e.created) > correlationTTL {
+				delete(r.entries, k)
+			}
+		}
+		r.lastSweep = now
+	}
+	r.entries[key] = correlationEntry{id, now}
+}
+
+// Take returns and removes the correlation ID registered for the given key.
+func (r *correlationRegistry) Take(key string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e, ok := r.entries[key]
+	if !ok {
+		return ""
+	}
+	delete(r.entries, key)
+	return e.id
+}
+
+// propertyKey returns the correlationRegistry key for a property update.
+func propertyKey(thingID string, componentID string, propertyID string) string {
+	return "property/" + thingID + "/" + componentID + "/" + propertyID
+}
+
+// actionKey returns the correlationRegistry key for an action request.
+func actionKey(actionRequestID string) string {
+	return "action/" + actionRequestID
+}
+
+// contextLogger returns the logger stored in ctx or the fallback, enriched with the correlation ID of ctx.
+func contextLogger(ctx context.Context, fallback logr.Logger) logr.Logger {
+	logger := logr.FromContext(ctx)
+	if logger == nil {
+		logger = fallback
+	}
+	if id := correlationID(ctx); id != "" {
+		logger = logger.WithValues("correlationId", id)
+	}
+	return logger
+}
+
+// correlatedService logs every callback handled by the wrapped service together with its correlation ID.
+// The correlated logger is also stored in the context passed to the service.
+type correlatedService struct {
+	connector.ConnectorService
+	logger logr.Logger
+}
+
+func (s *correlatedService) begin(ctx context.Context, operation string) (context.Context, logr.Logger) {
+	logger := contextLogger(ctx, s.logger).WithValues("operation", operation)
+	logger.Info("Handling callback")
+	return logr.NewContext(ctx, logger), logger
+}
+
+// AddInstallation implements connector.ConnectorService.
+func (s *correlatedService) AddInstallation(ctx context.Context, request connector.InstallationRequest) (*connector.InstallationResponse, error) {
+	ctx, logger := s.begin(ctx, "AddInstallation")
+	response, err := s.ConnectorService.AddInstallation(ctx, request)
+	if err != nil {
+		logger.Error(err, "Callback failed", "installationId", request.ID)
+	}
+	return response, err
+}
+
+// RemoveInstallation implements connector.ConnectorService.
+func (s *correlatedService) RemoveInstallation(ctx context.Context, installationId string) error {
+	ctx, logger := s.begin(ctx, "RemoveInstallation")
+	err := s.ConnectorService.RemoveInstallation(ctx, installationId)
+	if err != nil {
+		logger.Error(err, "Callback failed", "installationId", installationId)
+	}
+	return err
+}
+
+// AddInstance implements connector.ConnectorService.
+func (s *correlatedService) AddInstance(ctx context.Context, request connector.InstantiationRequest) (*connector.InstantiationResponse, error) {
+	ctx, logger := s.begin(ctx, "AddInstance")
+	response, err := s.ConnectorService.AddInstance(ctx, request)
+	if err != nil {
+		logger.Error(err, "Callback failed", "instanceId", request.ID)
+	}
+	return response, err
+}
+
+// RemoveInstance implements connector.ConnectorService.
+func (s *correlatedService) RemoveInstance(ctx context.Context, instanceId string) error {
+	ctx, logger := s.begin(ctx, "RemoveInstance")
+	err := s.ConnectorService.RemoveInstance(ctx, instanceId)
+	if err != nil {
+		logger.Error(err, "Callback failed", "instanceId", instanceId)
+	}
+	return err
+}
+
+// PerformAction implements connector.ConnectorService.
+func (s *correlatedService) PerformAction(ctx context.Context, request connector.ActionRequest) (*connector.ActionResponse, error) {
+	ctx, logger := s.begin(ctx, "PerformAction")
+	response, err := s.ConnectorService.PerformAction(ctx, request)
+	if err != nil {
+		logger.Error(err, "Callback failed", "actionRequestId", request.ID)
+	}
+	return response, err
+}
+
+// correlatedDatabase logs failed database operations together with the correlation ID of the calling operation.
+type correlatedDatabase struct {
+	connector.Database
+	logger logr.Logger
+}
+
+func (d *correlatedDatabase) check(ctx context.Context, operation string, err error) error {
+	if err != nil {
+		contextLogger(ctx, d.logger).Error(err, "Database operation failed", "operation", operation)
+	}
+	return err
+}
+
+// AddInstallation implements connector.Database.
+func (d *correlatedDatabase) AddInstallation(ctx context.Context, installationRequest connector.InstallationRequest) error {
+	return d.check(ctx, "AddInstallation", d.Database.AddInstallation(ctx, installationRequest))
+}
+
+// AddInstallationConfiguration implements connector.Database.
+func (d *correlatedDatabase) AddInstallationConfiguration(ctx context.Context, installationId string, config []connector.Configuration) error {
+	return d.check(ctx, "AddInstallationConfiguration", d.Database.AddInstallationConfiguration(ctx, installationId, config))
+}
+
+// GetInstallations implements connector.Database.
+func (d *correlatedDatabase) GetInstallations(ctx context.Context) ([]*connector.Installation, error) {
+	installations, err := d.Database.GetInstallations(ctx)
+	return installations, d.check(ctx, "GetInstallations", err)
+}
+
+// RemoveInstallation implements connector.Database.
+func (d *correlatedDatabase) RemoveInstallation(ctx context.Context, installationId string) error {
+	return d.check(ctx, "RemoveInstallation", d.Database.RemoveInstallation(ctx, installationId))
+}
+
+// AddInstance implements connector.Database.
+func (d *correlatedDatabase) AddInstance(ctx context.Context, instantiationRequest connector.InstantiationRequest) error {
+	return d.check(ctx, "AddInstance", d.Database.AddInstance(ctx, instantiationRequest))
+}
+
+// AddInstanceConfiguration implements connector.Database.
+func (d *correlatedDatabase) AddInstanceConfiguration(ctx context.Context, instanceId string, config []connector.Configuration) error {
+	return d.check(ctx, "AddInstanceConfiguration", d.Database.AddInstanceConfiguration(ctx, instanceId, config))
+}
+
+// GetInstance implements connector.Database.
+func (d *correlatedDatabase) GetInstance(ctx context.Context, instanceId string) (*connector.Instance, error) {
+	instance, err := d.Database.GetInstance(ctx, instanceId)
+	return instance, d.check(ctx, "GetInstance", err)
+}
+
+// GetInstances implements connector.Database.
+func (d *correlatedDatabase) GetInstances(ctx context.Context) ([]*connector.Instance, error) {
+	instances, err := d.Database.GetInstances(ctx)
+	return instances, d.check(ctx, "GetInstances", err)
+}
+
+// GetInstanceByThingId implements connector.Database.
+func (d *correlatedDatabase) GetInstanceByThingId(ctx context.Context, thingId string) (*connector.Instance, error) {
+	instance, err := d.Database.GetInstanceByThingId(ctx, thingId)
+	return instance, d.check(ctx, "GetInstanceByThingId", err)
+}
+
+// GetInstanceConfiguration implements connector.Database.
+func (d *correlatedDatabase) GetInstanceConfiguration(ctx context.Context, instanceId string) ([]connector.Configuration, error) {
+	config, err := d.Database.GetInstanceConfiguration(ctx, instanceId)
+	return config, d.check(ctx, "GetInstanceConfiguration", err)
+}
+
+// GetMappingByInstanceId implements connector.Database.
+func (d *correlatedDatabase) GetMappingByInstanceId(ctx context.Context, instanceId string) ([]connector.ThingMapping, error) {
+	mapping, err := d.Database.GetMappingByInstanceId(ctx, instanceId)
+	return mapping, d.check(ctx, "GetMappingByInstanceId", err)
+}
+
+// RemoveInstance implements connector.Database.
+func (d *correlatedDatabase) RemoveInstance(ctx context.Context, instanceId string) error {
+	return d.check(ctx, "RemoveInstance", d.Database.RemoveInstance(ctx, instanceId))
+}
+
+// AddThingMapping implements connector.Database.
+func (d *correlatedDatabase) AddThingMapping(ctx context.Context, instanceID string, thingID string, externalId string) error {
+	return d.check(ctx, "AddThingMapping", d.Database.AddThingMapping(ctx, instanceID, thingID, externalId))
+}
+
+// correlatedClient attaches the correlation ID registered by the provider to the context of outgoing update calls.
+type correlatedClient struct {
+	connector.Client
+	correlations *correlationRegistry
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *correlatedClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	if id := c.correlations.Take(propertyKey(thingID, componentID, propertyID)); id != "" {
+		ctx = withCorrelationID(ctx, id)
+	}
+	return c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *correlatedClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	if id := c.correlations.Take(actionKey(actionRequestID)); id != "" {
+		ctx = withCorrelationID(ctx, id)
+	}
+	return c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// cachingDatabase is a read-through cache of the instances and installations in front of the database.
+// The service looks up the instance of every property update and action result, which is at least one query per instance and minute.
+// Writes through the cache invalidate the affected entries. Entries expire after the TTL,
+// so changes made by other replicas sharing the database are picked up eventually.
+type cachingDatabase struct {
+	connector.Database
+	ttl      time.Duration
+	requests *metricVec
+
+	instances     map[string]cachedInstance // by instance ID
+	things        map[string]string         // instance ID by thing ID
+	installations []*connector.Installation
+	loaded        time.Time
+	lock          sync.Mutex
+}
+
+type cachedInstance struct {
+	instance *connector.Instance
+	expires  time.Time
+}
+
+func newCachingDatabase(db connector.Database, ttl time.Duration, metrics *metricsRegistry) *cachingDatabase {
+	return &cachingDatabase{
+		Database:  db,
+		ttl:       ttl,
+		requests:  metrics.Counter("database_cache_requests_total", "Number of instance and installation lookups by result.", "result"),
+		instances: map[string]cachedInstance{},
+		things:    map[string]string{},
+	}
+}
+
+// GetInstance implements connector.Database.
+func (d *cachingDatabase) GetInstance(ctx context.Context, instanceId string) (*connector.Instance, error) {
+	if instance, ok := d.cached(instanceId); ok {
+		return instance, nil
+	}
+	instance, err := d.Database.GetInstance(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	d.store(instance)
+	return copyInstance(instance), nil
+}
+
+// GetInstanceByThingId implements connector.Database.
+func (d *cachingDatabase) GetInstanceByThingId(ctx context.Context, thingId string) (*connector.Instance, error) {
+	d.lock.Lock()
+	instanceId, ok := d.things[thingId]
+	d.lock.Unlock()
+	if ok {
+		if instance, ok := d.cached(instanceId); ok {
+			return instance, nil
+		}
+	}
+	instance, err := d.Database.GetInstanceByThingId(ctx, thingId)
+	if err != nil {
+		return nil, err
+	}
+	d.store(instance)
+	return copyInstance(instance), nil
+}
+
+// GetInstallations implements connector.Database.
+func (d *cachingDatabase) GetInstallations(ctx context.Context) ([]*connector.Installation, error) {
+	d.lock.Lock()
+	if d.installations != nil && clock().Before(d.loaded.Add(d.ttl)) {
+		installations := copyInstallations(d.installations)
+		d.lock.Unlock()
+		d.requests.Inc("hit")
+		return installations, nil
+	}
+	d.lock.Unlock()
+	d.requests.Inc("miss")
+
+	installations, err := d.Database.GetInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	d.installations = copyInstallations(installations)
+	d.loaded = clock()
+	d.lock.Unlock()
+	return installations, nil
+}
+
+// AddInstallation implements connector.Database.
+func (d *cachingDatabase) AddInstallation(ctx context.Context, installationRequest connector.InstallationRequest) error {
+	defer d.forgetInstallations()
+	return d.Database.AddInstallation(ctx, installationRequest)
+}
+
+// AddInstallationConfiguration implements connector.Database.
+func (d *cachingDatabase) AddInstallationConfiguration(ctx context.Context, installationId string, config []connector.Configuration) error {
+	defer d.forgetInstallations()
+	return d.Database.AddInstallationConfiguration(ctx, installationId, config)
+}
+
+// SetInstallationConfiguration implements installationConfigurationUpdater.
+func (d *cachingDatabase) SetInstallationConfiguration(ctx context.Context, installationId string, config connector.Configuration) error {
+	defer d.forgetInstallations()
+	return setInstallationConfiguration(ctx, d.Database, installationId, config)
+}
+
+// RemoveInstallation implements connector.Database. The instances of the installation are removed with it.
+func (d *cachingDatabase) RemoveInstallation(ctx context.Context, installationId string) error {
+	defer func() {
+		d.forgetInstallations()
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		for id, cached := range d.instances {
+			if cached.instance.InstallationID == installationId {
+				d.forget(id)
+			}
+		}
+	}()
+	return d.Database.RemoveInstallation(ctx, installationId)
+}
+
+// AddInstance implements connector.Database.
+func (d *cachingDatabase) AddInstance(ctx context.Context, instantiationRequest connector.InstantiationRequest) error {
+	defer d.forgetInstance(instantiationRequest.ID)
+	return d.Database.AddInstance(ctx, instantiationRequest)
+}
+
+// AddInstanceConfiguration implements connector.Database.
+func (d *cachingDatabase) AddInstanceConfiguration(ctx context.Context, instanceId string, config []connector.Configuration) error {
+	defer d.forgetInstance(instanceId)
+	return d.Database.AddInstanceConfiguration(ctx, instanceId, config)
+}
+
+// RemoveInstance implements connector.Database.
+func (d *cachingDatabase) RemoveInstance(ctx context.Context, instanceId string) error {
+	defer d.forgetInstance(instanceId)
+	return d.Database.RemoveInstance(ctx, instanceId)
+}
+
+// AddThingMapping implements connector.Database.
+func (d *cachingDatabase) AddThingMapping(ctx context.Context, instanceID string, thingID string, externalId string) error {
+	defer d.forgetInstance(instanceID)
+	return d.Database.AddThingMapping(ctx, instanceID, thingID, externalId)
+}
+
+// Purge empties the cache, e.g. after the database was restored from a backup.
+func (d *cachingDatabase) Purge() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.instances = map[string]cachedInstance{}
+	d.things = map[string]string{}
+	d.installations = nil
+}
+
+// cached returns a copy of the cached instance if it has not expired.
+func (d *cachingDatabase) cached(instanceId string) (*connector.Instance, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cached, ok := d.instances[instanceId]
+	if !ok || !clock().Before(cached.expires) {
+		d.requests.Inc("miss")
+		return nil, false
+	}
+	d.requests.Inc("hit")
+	return copyInstance(cached.instance), true
+}
+
+func (d *cachingDatabase) store(instance *connector.Instance) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.instances[instance.ID] = cachedInstance{copyInstance(instance), clock().Add(d.ttl)}
+	for _, mapping := range instance.ThingMapping {
+		d.things[mapping.ThingID] = instance.ID
+	}
+}
+
+func (d *cachingDatabase) forgetInstance(instanceId string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.forget(instanceId)
+}
+
+// forget must be called with the lock held.
+func (d *cachingDatabase) forget(instanceId string) {
+	delete(d.instances, instanceId)
+	for thingId, id := range d.things {
+		if id == instanceId {
+			delete(d.things, thingId)
+		}
+	}
+}
+
+func (d *cachingDatabase) forgetInstallations() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.installations = nil
+}
+
+// copyInstance returns a copy of the instance, so callers can not modify the cached one.
+func copyInstance(instance *connector.Instance) *connector.Instance {
+	c := *instance
+	c.Configuration = append([]connector.Configuration(nil), instance.Configuration...)
+	c.ThingMapping = append([]connector.ThingMapping(nil), instance.ThingMapping...)
+	return &c
+}
+
+func copyInstallations(installations []*connector.Installation) []*connector.Installation {
+	copies := make([]*connector.Installation, len(installations))
+	for i, installation := range installations {
+		c := *installation
+		c.Configuration = append([]connector.Configuration(nil), installation.Configuration...)
+		copies[i] = &c
+	}
+	return copies
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// databaseProbeInterval is the interval in which an unavailable database is checked for being available again.
+const databaseProbeInterval = 5 * time.Second
+
+// maxQueuedWrites is the number of writes kept while the database is unavailable, further writes fail.
+const maxQueuedWrites = 10000
+
+var errTooManyQueuedWrites = errors.New("database is unavailable and too many writes are queued")
+
+// queuedWrite is a write made while the database was unavailable.
+type queuedWrite struct {
+	description string
+	apply       func(ctx context.Context, db connector.Database) error
+}
+
+// degradingDatabase keeps serving the installations and instances while the database is unavailable.
+// Every successful read is kept as snapshot, which answers the reads while the database fails.
+// Writes are applied to the snapshot and queued, they are replayed in order once the database is available again.
+// Whether a failure means that the database is unavailable is decided by pinging it, other errors are returned as usual.
+// The snapshot and the queue are only kept in memory, queued writes are lost on a restart.
+type degradingDatabase struct {
+	connector.Database
+	db *sqlx.DB
+
+	degradedGauge *metricVec
+	queuedGauge   *metricVec
+	degradedReads *metricVec
+
+	degraded      bool
+	since         time.Time
+	queue         []queuedWrite
+	instances     map[string]*connector.Instance
+	installations map[string]*connector.Installation
+	lock          sync.Mutex
+}
+
+func newDegradingDatabase(database connector.Database, db *sqlx.DB, metrics *metricsRegistry) *degradingDatabase {
+	d := &degradingDatabase{
+		Database:      database,
+		db:            db,
+		degradedGauge: metrics.Gauge("database_degraded", "Whether the database is unavailable and reads are served from memory."),
+		queuedGauge:   metrics.Gauge("database_queued_writes", "Number of writes queued while the database is unavailable."),
+		degradedReads: metrics.Counter("database_degraded_reads_total", "Number of reads served from memory while the database was unavailable."),
+		instances:     map[string]*connector.Instance{},
+		installations: map[string]*connector.Installation{},
+	}
+	d.degradedGauge.Set(0)
+	d.queuedGauge.Set(0)
+	return d
+}
+
+// Degraded reports whether the database is unavailable, since when and how many writes are queued.
+func (d *degradingDatabase) Degraded() (bool, time.Time, int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.degraded, d.since, len(d.queue)
+}
+
+// Run checks an unavailable database until the context is canceled and replays the queued writes once it is available.
+func (d *degradingDatabase) Run(ctx context.Context) {
+	ticker := time.NewTicker(databaseProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if degraded, _, _ := d.Degraded(); degraded {
+				d.recover(ctx)
+			}
+		}
+	}
+}
+
+// recover replays the queued writes if the database is available again.
+// Writes failing although the database is available are logged and dropped, e.g. because they were applied before it failed.
+func (d *degradingDatabase) recover(ctx context.Context) {
+	if err := d.db.PingContext(ctx); err != nil {
+		return
+	}
+	for {
+		d.lock.Lock()
+		if len(d.queue) == 0 {
+			d.degraded = false
+			d.degradedGauge.Set(0)
+			d.queuedGauge.Set(0)
+			since := d.since
+			d.lock.Unlock()
+			logrus.WithField("degradedFor", time.Since(since).String()).Infoln("database is available again")
+			return
+		}
+		write := d.queue[0]
+		d.lock.Unlock()
+
+		if err := write.apply(ctx, d.Database); err != nil {
+			if d.db.PingContext(ctx) != nil {
+				return
+			}
+			logrus.WithError(err).WithField("write", write.description).Warnln("dropping queued write which failed on replay")
+		}
+		d.lock.Lock()
+		d.queue = d.queue[1:]
+		d.queuedGauge.Set(float64(len(d.queue)))
+		d.lock.Unlock()
+	}
+}
+
+// unavailable reports whether the error is caused by an unavailable database and switches to the degraded mode if so.
+func (d *degradingDatabase) unavailable(ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	d.lock.Lock()
+	degraded := d.degraded
+	d.lock.Unlock()
+	if !degraded && d.db.PingContext(ctx) == nil {
+		return false
+	}
+	d.degrade(err)
+	return true
+}
+
+func (d *degradingDatabase) degrade(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.degraded {
+		return
+	}
+	d.degraded = true
+	d.since = clock()
+	d.degradedGauge.Set(1)
+	logrus.WithError(err).Errorln("database is unavailable, serving from memory and queueing writes")
+}
+
+// read returns true if reads are served from the snapshot without asking the database.
+func (d *degradingDatabase) read() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.degraded {
+		d.degradedReads.Inc()
+	}
+	return d.degraded
+}
+
+// write queues the write if the database is unavailable, otherwise it is applied and queued if the database fails.
+// The snapshot is updated in both cases.
+func (d *degradingDatabase) write(ctx context.Context, description string, apply func(ctx context.Context, db connector.Database) error, update func()) error {
+	d.lock.Lock()
+	degraded := d.degraded
+	d.lock.Unlock()
+	if !degraded {
+		err := apply(ctx, d.Database)
+		if !d.unavailable(ctx, err) {
+			if err == nil {
+				d.lock.Lock()
+				update()
+				d.lock.Unlock()
+			}
+			return err
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.queue) >= maxQueuedWrites {
+		return errTooManyQueuedWrites
+	}
+	d.queue = append(d.queue, queuedWrite{description, apply})
+	d.queuedGauge.Set(float64(len(d.queue)))
+	update()
+	logrus.WithField("write", description).Warnln("queued write while the database is unavailable")
+	return nil
+}
+
+// GetInstallations implements connector.Database.
+func (d *degradingDatabase) GetInstallations(ctx context.Context) ([]*connector.Installation, error) {
+	if !d.read() {
+		installations, err := d.Database.GetInstallations(ctx)
+		if !d.unavailable(ctx, err) {
+			if err == nil {
+				d.lock.Lock()
+				d.installations = make(map[string]*connector.Installation, len(installations))
+				for _, installation := range copyInstallations(installations) {
+					d.installations[installation.ID] = installation
+				}
+				d.lock.Unlock()
+			}
+			return installations, err
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	installations := make([]*connector.Installation, 0, len(d.installations))
+	for _, installation := range d.installations {
+		installations = append(installations, installation)
+	}
+	return copyInstallations(installations), nil
+}
+
+// GetInstances implements connector.Database.
+func (d *degradingDatabase) GetInstances(ctx context.Context) ([]*connector.Instance, error) {
+	if !d.read() {
+		instances, err := d.Database.GetInstances(ctx)
+		if !d.unavailable(ctx, err) {
+			if err == nil {
+				d.lock.Lock()
+				d.instances = make(map[string]*connector.Instance, len(instances))
+				for _, instance := range instances {
+					d.instances[instance.ID] = copyInstance(instance)
+				}
+				d.lock.Unlock()
+			}
+			return instances, err
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	instances := make([]*connector.Instance, 0, len(d.instances))
+	for _, instance := range d.instances {
+		instances = append(instances, copyInstance(instance))
+	}
+	return instances, nil
+}
+
+// GetInstance implements connector.Database.
+func (d *degradingDatabase) GetInstance(ctx context.Context, instanceId string) (*connector.Instance, error) {
+	if !d.read() {
+		instance, err := d.Database.GetInstance(ctx, instanceId)
+		if !d.unavailable(ctx, err) {
+			if err == nil {
+				d.lock.Lock()
+				d.instances[instance.ID] = copyInstance(instance)
+				d.lock.Unlock()
+			}
+			return instance, err
+		}
+	}
+	return d.snapshotInstance(func(instance *connector.Instance) bool { return instance.ID == instanceId })
+}
+
+// GetInstanceByThingId implements connector.Database.
+func (d *degradingDatabase) GetInstanceByThingId(ctx context.Context, thingId string) (*connector.Instance, error) {
+	if !d.read() {
+		instance, err := d.Database.GetInstanceByThingId(ctx, thingId)
+		if !d.unavailable(ctx, err) {
+			if err == nil {
+				d.lock.Lock()
+				d.instances[instance.ID] = copyInstance(instance)
+				d.lock.Unlock()
+			}
+			return instance, err
+		}
+	}
+	return d.snapshotInstance(func(instance *connector.Instance) bool {
+		for _, mapping := range instance.ThingMapping {
+			if mapping.ThingID == thingId {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// GetInstanceConfiguration implements connector.Database.
+func (d *degradingDatabase) GetInstanceConfiguration(ctx context.Context, instanceId string) ([]connector.Configuration, error) {
+	instance, err := d.GetInstance(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	return instance.Configuration, nil
+}
+
+// GetMappingByInstanceId implements connector.Database.
+func (d *degradingDatabase) GetMappingByInstanceId(ctx context.Context, instanceId string) ([]connector.ThingMapping, error) {
+	instance, err := d.GetInstance(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	return instance.ThingMapping, nil
+}
+
+func (d *degradingDatabase) snapshotInstance(match func(instance *connector.Instance) bool) (*connector.Instance, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, instance := range d.instances {
+		if match(instance) {
+			return copyInstance(instance), nil
+		}
+	}
+	return nil, connector.ErrorInstanceNotFound
+}
+
+// AddInstallation implements connector.Database.
+func (d *degradingDatabase) AddInstallation(ctx context.Context, installationRequest connector.InstallationRequest) error {
+	return d.write(ctx, "add installation "+installationRequest.ID, func(ctx context.Context, db connector.Database) error {
+		return db.AddInstallation(ctx, installationRequest)
+	}, func() {
+		d.installations[installationRequest.ID] = &connector.Installation{
+			ID:            installationRequest.ID,
+			Configuration: append([]connector.Configuration(nil), installationRequest.Configuration...),
+		}
+	})
+}
+
+// AddInstallationConfiguration implements connector.Database.
+func (d *degradingDatabase) AddInstallationConfiguration(ctx context.Context, installationId string, config []connector.Configuration) error {
+	return d.write(ctx, "add configuration of installation "+installationId, func(ctx context.Context, db connector.Database) error {
+		return db.AddInstallationConfiguration(ctx, installationId, config)
+	}, func() {
+		if installation, ok := d.installations[installationId]; ok {
+			installation.Configuration = append(installation.Configuration, config...)
+		}
+	})
+}
+
+// SetInstallationConfiguration implements installationConfigurationUpdater.
+func (d *degradingDatabase) SetInstallationConfiguration(ctx context.Context, installationId string, config connector.Configuration) error {
+	return d.write(ctx, "set configuration of installation "+installationId, func(ctx context.Context, db connector.Database) error {
+		return setInstallationConfiguration(ctx, db, installationId, config)
+	}, func() {
+		if installation, ok := d.installations[installationId]; ok {
+			installation.Configuration = replaceConfiguration(installation.Configuration, config)
+		}
+	})
+}
+
+// RemoveInstallation implements connector.Database. The instances of the installation are removed with it.
+func (d *degradingDatabase) RemoveInstallation(ctx context.Context, installationId string) error {
+	return d.write(ctx, "remove installation "+installationId, func(ctx context.Context, db connector.Database) error {
+		return db.RemoveInstallation(ctx, installationId)
+	}, func() {
+		delete(d.installations, installationId)
+		for id, instance := range d.instances {
+			if instance.InstallationID == installationId {
+				delete(d.instances, id)
+			}
+		}
+	})
+}
+
+// AddInstance implements connector.Database.
+func (d *degradingDatabase) AddInstance(ctx context.Context, instantiationRequest connector.InstantiationRequest) error {
+	return d.write(ctx, "add instance "+instantiationRequest.ID, func(ctx context.Context, db connector.Database) error {
+		return db.AddInstance(ctx, instantiationRequest)
+	}, func() {
+		d.instances[instantiationRequest.ID] = &connector.Instance{
+			ID:             instantiationRequest.ID,
+			InstallationID: instantiationRequest.InstallationID,
+			Token:          instantiationRequest.Token,
+		}
+	})
+}
+
+// AddInstanceConfiguration implements connector.Database.
+func (d *degradingDatabase) AddInstanceConfiguration(ctx context.Context, instanceId string, config []connector.Configuration) error {
+	return d.write(ctx, "add configuration of instance "+instanceId, func(ctx context.Context, db connector.Database) error {
+		return db.AddInstanceConfiguration(ctx, instanceId, config)
+	}, func() {
+		if instance, ok := d.instances[instanceId]; ok {
+			instance.Configuration = append(instance.Configuration, config...)
+		}
+	})
+}
+
+// RemoveInstance implements connector.Database.
+func (d *degradingDatabase) RemoveInstance(ctx context.Context, instanceId string) error {
+	return d.write(ctx, "remove instance "+instanceId, func(ctx context.Context, db connector.Database) error {
+		return db.RemoveInstance(ctx, instanceId)
+	}, func() {
+		delete(d.instances, instanceId)
+	})
+}
+
+// AddThingMapping implements connector.Database.
+func (d *degradingDatabase) AddThingMapping(ctx context.Context, instanceID string, thingID string, externalId string) error {
+	return d.write(ctx, "add thing "+thingID+" of instance "+instanceID, func(ctx context.Context, db connector.Database) error {
+		return db.AddThingMapping(ctx, instanceID, thingID, externalId)
+	}, func() {
+		if instance, ok := d.instances[instanceID]; ok {
+			instance.ThingMapping = append(instance.ThingMapping, connector.ThingMapping{InstanceID: instanceID, ThingID: thingID, ExternalID: externalId})
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+// randomness is the source of all random IDs generated by the connector.
+// It is replaced by a seeded source in deterministic mode.
+var randomness io.Reader = rand.Reader
+
+// clock returns the current time used for timestamps and expiry.
+// It is replaced by a frozen clock in deterministic mode.
+var clock = time.Now
+
+// deterministicTime is the time returned by the clock in deterministic mode.
+var deterministicTime = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// enableDeterministicMode replaces the random source by one seeded with the given seed and freezes the clock,
+// so runs with the same input produce the same IDs and timestamps, e.g. for golden output tests and demos.
+// Random gifs are selected by the Giphy API, so the update values are only deterministic with a fake Giphy API.
+// The frozen clock also disables the expiry of correlation IDs and the daily rollover of the Giphy quota.
+// It must be called before any other goroutine is started.
+func enableDeterministicMode(seed int64) {
+	randomness = &seededReader{rand: mathrand.New(mathrand.NewSource(seed))}
+	clock = func() time.Time { return deterministicTime }
+}
+
+// seededReader makes a seeded math/rand source safe for concurrent use.
+type seededReader struct {
+	rand *mathrand.Rand
+	lock sync.Mutex
+}
+
+// Read implements io.Reader.
+func (r *seededReader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rand.Read(p)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/crypto"
+	"github.com/connctd/giphy-connector/internal/signing"
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the signing profiles callbacks are counted by.
+const (
+	signingProfileProduction  = "production"
+	signingProfileDevelopment = "development"
+)
+
+// parsePublicKey decodes a base64 encoded ed25519 public key.
+// The signature validation panics on keys of the wrong size, so they are rejected here instead of on every callback.
+func parsePublicKey(key string) (ed25519.PublicKey, error) {
+	publicKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PublicKeySize, len(publicKey))
+	}
+	return publicKey, nil
+}
+
+// developmentSigningProfile accepts callbacks signed with locally generated keys, like the ones of the connctd simulator
+// or a staging platform, in addition to the keys of the connector publication.
+// Its keys are configured separately from the production keys, so one deployment can serve both without
+// mixing them up, and callbacks are counted and logged by the profile they were signed for.
+type developmentSigningProfile struct {
+	keys            []ed25519.PublicKey
+	requiredHeaders []string
+	callbacks       *metricVec
+}
+
+// newDevelopmentSigningProfile parses the comma separated base64 encoded keys.
+// requiredHeaders are the headers callbacks must sign, see signing.Negotiate.
+func newDevelopmentSigningProfile(keys string, requiredHeaders []string, metrics *metricsRegistry) (*developmentSigningProfile, error) {
+	profile := &developmentSigningProfile{
+		requiredHeaders: requiredHeaders,
+		callbacks:       metrics.Counter("callbacks_by_signing_profile_total", "Number of callbacks by the signing profile of the key they were signed with.", "profile"),
+	}
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		publicKey, err := parsePublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid development public key: %w", err)
+		}
+		profile.keys = append(profile.keys, publicKey)
+	}
+	if len(profile.keys) == 0 {
+		return nil, fmt.Errorf("no development public key given")
+	}
+	return profile, nil
+}
+
+// Keys returns the production keys followed by the development keys.
+func (p *developmentSigningProfile) Keys(production func() []ed25519.PublicKey) func() []ed25519.PublicKey {
+	return func() []ed25519.PublicKey {
+		keys := append([]ed25519.PublicKey{}, production()...)
+		return append(keys, p.keys...)
+	}
+}
+
+// Handler counts the callbacks by signing profile and logs those signed with a development key.
+// It does not reject any request, the signature is verified by the next handler.
+func (p *developmentSigningProfile) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			connector.ErrorInvalidBody.Write(w)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		profile := signingProfileProduction
+		if p.signedWithDevelopmentKey(r, body) {
+			profile = signingProfileDevelopment
+			logrus.WithField("correlationId", correlationID(r.Context())).WithField("path", r.URL.Path).Infoln("callback signed with a development key")
+		}
+		p.callbacks.Inc(profile)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *developmentSigningProfile) signedWithDevelopmentKey(r *http.Request, body []byte) bool {
+	signature, err := base64.StdEncoding.DecodeString(r.Header.Get(crypto.SignatureHeaderKey))
+	if err != nil {
+		return false
+	}
+	signedHeaders, err := signing.Negotiate(p.requiredHeaders, r.Header.Get(signing.SignedHeadersHeaderKey))
+	if err != nil {
+		return false
+	}
+	params := connector.AutoProxyRequestValidationPreProcessor()(r)
+	payload, err := signing.Payload(r.Method, params.Scheme, params.Host, params.RequestURI, r.Header, signedHeaders, body)
+	if err != nil {
+		return false
+	}
+	for _, key := range p.keys {
+		if crypto.Verify(key, payload, signature) {
+			return true
+		}
+	}
+	return false
+}
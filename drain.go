@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Parts of the shutdown, each gets a share of the drain budget.
+const (
+	drainHTTP     = "http"
+	drainProvider = "provider"
+	drainHosted   = "hosted"
+	drainUpdates  = "updates"
+	drainTraces   = "traces"
+)
+
+// lossyShutdownExitCode is the exit code of a shutdown which could not finish all parts within the drain budget,
+// so deploy tooling can tell it from a clean shutdown, which exits with 0.
+const lossyShutdownExitCode = 3
+
+// defaultDrainShares are the shares of the drain budget in the order the parts are drained.
+// Callbacks in progress and the queued updates get most of it.
+var defaultDrainShares = []drainShare{
+	{drainHTTP, 30},
+	{drainProvider, 20},
+	{drainHosted, 10},
+	{drainUpdates, 30},
+	{drainTraces, 10},
+}
+
+type drainShare struct {
+	Name   string
+	Weight int
+}
+
+// parseDrainShares returns the default shares with the weights of the spec, e.g. "http=50,traces=0".
+func parseDrainShares(spec string) ([]drainShare, error) {
+	shares := append([]drainShare(nil), defaultDrainShares...)
+	for _, override := range strings.Split(spec, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid drain share %q, expected name=weight", override)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid drain share %q, expected name=weight", override)
+		}
+		found := false
+		for i := range shares {
+			if shares[i].Name == strings.TrimSpace(parts[0]) {
+				shares[i].Weight, found = weight, true
+			}
+		}
+		if !found {
+			names := make([]string, len(shares))
+			for i, share := range shares {
+				names[i] = share.Name
+			}
+			return nil, fmt.Errorf("unknown drain share %q, expected one of %s", parts[0], strings.Join(names, ", "))
+		}
+	}
+	total := 0
+	for _, share := range shares {
+		total += share.Weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("drain shares must not all be 0")
+	}
+	return shares, nil
+}
+
+// shutdownDrain runs the parts of the shutdown one after another within a total budget.
+// Each part may run until its share of the budget is used up, time left by earlier parts is passed on to the later ones.
+// A part which did not finish in time is canceled and reported, the later parts are drained nevertheless.
+type shutdownDrain struct {
+	budget time.Duration
+	shares []drainShare
+	parts  map[string]func(ctx context.Context) error
+	drains *metricVec
+}
+
+func newShutdownDrain(budget time.Duration, shares []drainShare, metrics *metricsRegistry) *shutdownDrain {
+	return &shutdownDrain{
+		budget: budget,
+		shares: shares,
+		parts:  map[string]func(ctx context.Context) error{},
+		drains: metrics.Counter("shutdown_drains_total", "Number of parts drained on shutdown by part and result.", "part", "result"),
+	}
+}
+
+// Add sets the function draining the part, parts without function are skipped.
+func (d *shutdownDrain) Add(name string, drain func(ctx context.Context) error) {
+	d.parts[name] = drain
+}
+
+// Run drains all parts and returns the failures by part, which are empty if the shutdown was clean.
+func (d *shutdownDrain) Run() map[string]error {
+	total := 0
+	for _, share := range d.shares {
+		total += share.Weight
+	}
+	failures := map[string]error{}
+	start := time.Now()
+	used := 0
+	for _, share := range d.shares {
+		used += share.Weight
+		drain, ok := d.parts[share.Name]
+		if !ok {
+			continue
+		}
+		// Deadlines are cumulative, so time left by faster parts is available to the later ones
+		deadline := start.Add(d.budget * time.Duration(used) / time.Duration(total))
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		partStart := time.Now()
+		err := drain(ctx)
+		cancel()
+
+		logger := logrus.WithField("part", share.Name).WithField("duration", time.Since(partStart).String())
+		if err != nil {
+			failures[share.Name] = err
+			d.drains.Inc(share.Name, "failed")
+			logger.WithError(err).Warnln("failed to drain on shutdown")
+			continue
+		}
+		d.drains.Inc(share.Name, "drained")
+		logger.Debugln("drained on shutdown")
+	}
+	return failures
+}
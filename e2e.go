@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/crypto"
+	"github.com/connctd/connector-go/db"
+	"github.com/connctd/connector-go/service"
+	"github.com/connctd/giphy-connector/internal/connctdtest"
+	"github.com/connctd/giphy-connector/internal/giphytest"
+	"github.com/go-logr/logr"
+	"github.com/sirupsen/logrus"
+)
+
+// endToEndTimeout limits the wait for asynchronous results of a single step.
+const endToEndTimeout = 10 * time.Second
+
+// runEndToEnd runs the complete lifecycle of an installation through the connector and checks the database
+// and the connctd API calls after each step.
+func runEndToEnd() error {
+	// The steps print their own results
+	logrus.SetLevel(logrus.WarnLevel)
+
+	e, closeEndToEnd, err := newEndToEnd("e2e")
+	if err != nil {
+		return err
+	}
+	defer closeEndToEnd()
+
+	err = e.run(func(step string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", step, err)
+		} else {
+			fmt.Printf("ok   %s\n", step)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("PASS")
+	return nil
+}
+
+// newEndToEnd sets up the connector service for the lifecycle with an in-memory Sqlite database of the given name
+// behind the same handler chain as in production.
+// Callbacks are signed with a generated platform key, connctd is replaced by a fake client and Giphy by a fake API.
+// The periodic update is triggered directly instead of waiting for the ticker.
+// The returned function stops the fake servers, the connector can be run again until then.
+func newEndToEnd(name string) (*endToEnd, func(), error) {
+	logger := logr.Discard()
+
+	giphy := giphytest.NewServer()
+	giphyURL, err := url.Parse(giphy.URL())
+	if err != nil {
+		giphy.Close()
+		return nil, nil, err
+	}
+
+	dbClient, err := db.NewDBClient(&db.DBOptions{Driver: db.DriverSqlite3, DSN: "file:" + name + "?mode=memory&cache=shared&_foreign_keys=on"}, logger)
+	if err != nil {
+		giphy.Close()
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := dbClient.Migrate(); err != nil {
+		giphy.Close()
+		return nil, nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	reporter := nopReporter{}
+	correlations := newCorrelationRegistry()
+	// The self-test runs in the service, so only warnings of the provider are logged
+	providerLogger := logrus.New()
+	providerLogger.SetLevel(logrus.WarnLevel)
+	providerLogger.AddHook(redactionHook{})
+	giphyProvider := NewGiphyProvider(reporter, correlations, newQuotaTracker(0, 0, reporter, newMetricsRegistry()), newLogSampler(0), providerLogger)
+	giphyProvider.SetBaseURL(giphyURL)
+
+	platform := connctdtest.NewClient()
+	connectorService, err := service.NewConnectorService(&correlatedDatabase{&bulkDatabase{dbClient, dbClient.DB}, logger}, &correlatedClient{platform, correlations}, giphyProvider, thingTemplate, logger)
+	if err != nil {
+		giphy.Close()
+		return nil, nil, fmt.Errorf("failed to create connector service: %w", err)
+	}
+	connectorService.EventHandler(context.Background())
+	go giphyProvider.actionHandler(context.Background())
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		giphy.Close()
+		return nil, nil, err
+	}
+	things := newThingResolver(dbClient, thingTemplate, newMetricsRegistry())
+	callbackHandler := jsonContentTypeHandler(false, connector.NewConnectorHandler(nil, &correlatedService{&resolvingService{connectorService, things, giphyProvider}, logger}, publicKey))
+	server := httptest.NewServer(correlationHandler(recoverHandler(reporter, limitBodyHandler(maxCallbackBodySize, callbackHandler))))
+
+	e := &endToEnd{
+		server:         server,
+		privateKey:     privateKey,
+		db:             dbClient,
+		platform:       platform,
+		giphy:          giphy,
+		provider:       giphyProvider,
+		installationId: name + "-installation",
+		instanceId:     name + "-instance",
+	}
+	return e, func() {
+		server.Close()
+		giphy.Close()
+	}, nil
+}
+
+// run runs the steps of the lifecycle and calls report with the result of each. It stops at the first failed step.
+// Calls and requests of previous runs are forgotten and what a failed run left behind is removed first.
+func (e *endToEnd) run(report func(step string, err error)) error {
+	e.reset()
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"install", e.install},
+		{"instantiate", e.instantiate},
+		{"periodic update", e.periodicUpdate},
+		{"search action", e.searchAction},
+		{"translate action", e.translateAction},
+		{"remove instance", e.removeInstance},
+		{"remove installation", e.removeInstallation},
+	}
+	for _, step := range steps {
+		err := step.run()
+		report(step.name, err)
+		if err != nil {
+			return fmt.Errorf("step %q failed", step.name)
+		}
+	}
+	return nil
+}
+
+// reset removes the instance and installation of a failed run and forgets all calls and requests.
+// The removals fail if the previous run succeeded, which is ignored.
+func (e *endToEnd) reset() {
+	_ = e.send(http.MethodDelete, "/instances/"+e.instanceId, nil, http.StatusNoContent)
+	_ = e.send(http.MethodDelete, "/installations/"+e.installationId, nil, http.StatusNoContent)
+	e.provider.update()
+	e.platform.Reset()
+	e.giphy.Reset()
+	e.thingId = ""
+}
+
+type endToEnd struct {
+	server     *httptest.Server
+	privateKey ed25519.PrivateKey
+	db         connector.Database
+	platform   *connctdtest.Client
+	giphy      *giphytest.Server
+	provider   *GiphyProvider
+
+	installationId string
+	instanceId     string
+	thingId        string
+}
+
+// install sends an installation request and expects the installation with its configuration in the database.
+func (e *endToEnd) install() error {
+	err := e.send(http.MethodPost, "/installations", connector.InstallationRequest{
+		ID:            e.installationId,
+		Token:         "e2e-installation-token",
+		State:         connector.InstallationStateInitialized,
+		Configuration: []connector.Configuration{{ID: "giphy_api_key", Value: "e2e"}},
+	}, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+
+	installations, err := e.db.GetInstallations(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, installation := range installations {
+		if installation.ID != e.installationId {
+			continue
+		}
+		if key, ok := installation.GetConfig("giphy_api_key"); !ok || key.Value != "e2e" {
+			return errors.New("installation stored without API key")
+		}
+		return e.expectCalls(map[string]int{})
+	}
+	return errors.New("installation not stored")
+}
+
+// instantiate sends an instantiation request and expects the instance and one thing mapping in the database
+// and exactly one thing created at connctd.
+func (e *endToEnd) instantiate() error {
+	err := e.send(http.MethodPost, "/instances", connector.InstantiationRequest{
+		ID:             e.instanceId,
+		InstallationID: e.installationId,
+		Token:          "e2e-instance-token",
+		State:          connector.InstantiationStateInitialized,
+	}, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+
+	if _, err := e.db.GetInstance(context.Background(), e.instanceId); err != nil {
+		return fmt.Errorf("instance not stored: %w", err)
+	}
+	mappings, err := e.db.GetMappingByInstanceId(context.Background(), e.instanceId)
+	if err != nil {
+		return err
+	}
+	if len(mappings) != 1 {
+		return fmt.Errorf("got %d thing mappings, want 1", len(mappings))
+	}
+	things := e.platform.Things()
+	if len(things) != 1 || things[0].ID != mappings[0].ThingID {
+		return fmt.Errorf("thing mapping %s does not match created things %v", mappings[0].ThingID, things)
+	}
+	e.thingId = mappings[0].ThingID
+	return e.expectCalls(map[string]int{connctdtest.MethodCreateThing: 1})
+}
+
+// periodicUpdate runs one update cycle and expects one random gif request and one update of the random property.
+func (e *endToEnd) periodicUpdate() error {
+	e.provider.update()
+	e.provider.updateInstances()
+
+	if err := e.waitForCalls(connctdtest.MethodUpdateThingPropertyValue, 2); err != nil {
+		return err
+	}
+	update := e.platform.PropertyUpdates()[0]
+	if update.ThingID != e.thingId || update.ComponentID != RandomComponentId || update.PropertyID != RandomPropertyId {
+		return fmt.Errorf("unexpected property update %+v", update)
+	}
+	if !strings.Contains(update.Value, "random") {
+		return fmt.Errorf("property value %q is not a random gif", update.Value)
+	}
+	update = e.platform.PropertyUpdates()[1]
+	if update.ThingID != e.thingId || update.ComponentID != TrendingComponentId || update.PropertyID != TrendingPropertyId || !strings.Contains(update.Value, "trending") {
+		return fmt.Errorf("unexpected trending property update %+v", update)
+	}
+	if err := e.expectGiphyRequests("/v1/gifs/random", "/v1/gifs/trending"); err != nil {
+		return err
+	}
+	return e.expectCalls(map[string]int{connctdtest.MethodCreateThing: 1, connctdtest.MethodUpdateThingPropertyValue: 2})
+}
+
+// searchAction requests a search and expects it to be accepted as pending, followed by updates of the search properties
+// and a completed action request.
+func (e *endToEnd) searchAction() error {
+	err := e.send(http.MethodPost, "/actions", connector.ActionRequest{
+		ID:          "e2e-action",
+		ThingID:     e.thingId,
+		ComponentID: SearchComponentId,
+		ActionID:    "search",
+		Status:      connector.ActionRequestStatusPending,
+		Parameters:  map[string]string{"keyword": "cat"},
+	}, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+
+	if err := e.waitForCalls(connctdtest.MethodUpdateActionStatus, 1); err != nil {
+		return err
+	}
+	status := e.platform.ActionStatusUpdates()[0]
+	if status.ActionRequestID != "e2e-action" || status.Status != connector.ActionRequestStatusCompleted {
+		return fmt.Errorf("unexpected action status update %+v", status)
+	}
+	updates := e.platform.PropertyUpdates()
+	if len(updates) != 6 {
+		return fmt.Errorf("got %d property updates, want 6", len(updates))
+	}
+	// The search updates the result count, the structured results, whether they were truncated and the search result
+	values := map[string]string{}
+	for _, update := range updates[2:] {
+		if update.ComponentID != SearchComponentId {
+			return fmt.Errorf("unexpected property update %+v", update)
+		}
+		values[update.PropertyID] = update.Value
+	}
+	if values[SearchResultCountPropertyId] != "1" || !strings.Contains(values[SearchResultsPropertyId], "search-cat") || !strings.Contains(values[SearchPropertyId], "search-cat") || values[SearchResultsTruncatedPropertyId] != "false" {
+		return fmt.Errorf("unexpected search property updates %v", values)
+	}
+	if err := e.expectGiphyRequests("/v1/gifs/random", "/v1/gifs/trending", "/v1/gifs/search"); err != nil {
+		return err
+	}
+	return e.expectCalls(map[string]int{connctdtest.MethodCreateThing: 1, connctdtest.MethodUpdateThingPropertyValue: 6, connctdtest.MethodUpdateActionStatus: 1})
+}
+
+// translateAction requests a translation and expects the translate property to be updated together with the completed action request.
+func (e *endToEnd) translateAction() error {
+	err := e.send(http.MethodPost, "/actions", connector.ActionRequest{
+		ID:          "e2e-translate",
+		ThingID:     e.thingId,
+		ComponentID: TranslateComponentId,
+		ActionID:    TranslateActionId,
+		Status:      connector.ActionRequestStatusPending,
+		Parameters:  map[string]string{TranslateActionParameterId: "good morning"},
+	}, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+
+	if err := e.waitForCalls(connctdtest.MethodUpdateActionStatus, 2); err != nil {
+		return err
+	}
+	status := e.platform.ActionStatusUpdates()[1]
+	if status.ActionRequestID != "e2e-translate" || status.Status != connector.ActionRequestStatusCompleted {
+		return fmt.Errorf("unexpected action status update %+v", status)
+	}
+	updates := e.platform.PropertyUpdates()
+	if len(updates) != 7 {
+		return fmt.Errorf("got %d property updates, want 7", len(updates))
+	}
+	if update := updates[6]; update.ComponentID != TranslateComponentId || update.PropertyID != TranslatePropertyId || !strings.Contains(update.Value, "translate-good") {
+		return fmt.Errorf("unexpected translate property update %+v", update)
+	}
+	if err := e.expectGiphyRequests("/v1/gifs/random", "/v1/gifs/trending", "/v1/gifs/search", "/v1/gifs/translate"); err != nil {
+		return err
+	}
+	return e.expectCalls(map[string]int{connctdtest.MethodCreateThing: 1, connctdtest.MethodUpdateThingPropertyValue: 7, connctdtest.MethodUpdateActionStatus: 2})
+}
+
+// removeInstance removes the instance and expects it to be gone from the database and the provider.
+func (e *endToEnd) removeInstance() error {
+	if err := e.send(http.MethodDelete, "/instances/"+e.instanceId, nil, http.StatusNoContent); err != nil {
+		return err
+	}
+	if _, err := e.db.GetInstance(context.Background(), e.instanceId); err == nil {
+		return errors.New("instance still stored")
+	}
+
+	e.provider.update()
+	if _, instances := e.provider.Registered(); instances[e.instanceId] {
+		return errors.New("instance still registered with the provider")
+	}
+	e.provider.updateInstances()
+	if err := e.expectGiphyRequests("/v1/gifs/random", "/v1/gifs/trending", "/v1/gifs/search", "/v1/gifs/translate"); err != nil {
+		return err
+	}
+	return e.expectCalls(map[string]int{connctdtest.MethodCreateThing: 1, connctdtest.MethodUpdateThingPropertyValue: 7, connctdtest.MethodUpdateActionStatus: 2})
+}
+
+// removeInstallation removes the installation and expects it to be gone from the database and the provider.
+func (e *endToEnd) removeInstallation() error {
+	if err := e.send(http.MethodDelete, "/installations/"+e.installationId, nil, http.StatusNoContent); err != nil {
+		return err
+	}
+	installations, err := e.db.GetInstallations(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, installation := range installations {
+		if installation.ID == e.installationId {
+			return errors.New("installation still stored")
+		}
+	}
+
+	e.provider.update()
+	if installations, _ := e.provider.Registered(); installations[e.installationId] {
+		return errors.New("installation still registered with the provider")
+	}
+	return e.expectCalls(map[string]int{connctdtest.MethodCreateThing: 1, connctdtest.MethodUpdateThingPropertyValue: 7, connctdtest.MethodUpdateActionStatus: 2})
+}
+
+// send sends a callback signed with the platform key and expects one of the given status codes.
+func (e *endToEnd) send(method string, path string, payload interface{}, expectedStatus ...int) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, e.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// The platform sends the charset with the content type
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	signable, err := crypto.SignablePayload(method, "https", req.URL.Host, req.URL.RequestURI(), req.Header, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(crypto.SignatureHeaderKey, base64.StdEncoding.EncodeToString(crypto.Sign(e.privateKey, signable)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, status := range expectedStatus {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+}
+
+// expectCalls compares the number of connctd API calls with the expected ones. Missing methods are expected to be called never.
+func (e *endToEnd) expectCalls(expected map[string]int) error {
+	methods := []string{
+		connctdtest.MethodCreateThing,
+		connctdtest.MethodUpdateThingPropertyValue,
+		connctdtest.MethodUpdateThingStatus,
+		connctdtest.MethodUpdateActionStatus,
+		connctdtest.MethodUpdateInstallationState,
+		connctdtest.MethodUpdateInstanceState,
+		connctdtest.MethodDeleteThing,
+	}
+	for _, method := range methods {
+		if calls := e.platform.Calls(method); calls != expected[method] {
+			return fmt.Errorf("got %d calls of %s, want %d", calls, method, expected[method])
+		}
+	}
+	return nil
+}
+
+// expectGiphyRequests compares the paths of all requests sent to Giphy with the expected ones.
+func (e *endToEnd) expectGiphyRequests(paths ...string) error {
+	requests := e.giphy.Requests()
+	if len(requests) != len(paths) {
+		return fmt.Errorf("got %d Giphy requests, want %d", len(requests), len(paths))
+	}
+	for i, r := range requests {
+		if r.Path != paths[i] {
+			return fmt.Errorf("Giphy request %d: got %s, want %s", i, r.Path, paths[i])
+		}
+		if r.APIKey != "e2e" {
+			return fmt.Errorf("Giphy request %d: sent with API key %q", i, r.APIKey)
+		}
+	}
+	return nil
+}
+
+// waitForCalls waits until the connctd API method was called the given number of times.
+func (e *endToEnd) waitForCalls(method string, calls int) error {
+	deadline := time.Now().Add(endToEndTimeout)
+	for e.platform.Calls(method) < calls {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("got %d calls of %s within %s, want %d", e.platform.Calls(method), method, endToEndTimeout, calls)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// eventBusQueueSize is the number of events buffered while the broker is slow or unreachable.
+// Further events are dropped, so the connector never blocks on the event bus.
+const eventBusQueueSize = 1000
+
+// eventPublisher publishes messages to a message broker.
+type eventPublisher interface {
+	// Publish sends the message to the topic. The key groups related messages, e.g. for partitioning.
+	Publish(topic string, key string, message []byte) error
+}
+
+// NewEventBus returns a sink publishing events as JSON messages to the broker given by the URL:
+//
+//	nats://[user:password@]host:4222/subject-prefix publishes each event to <subject-prefix>.<event type>
+//	kafka+http(s)://host:8082/topic publishes all events to the topic using the Kafka REST Proxy
+//
+// Messages are published asynchronously and in order, keyed by the instance, thing or installation ID.
+// With a signer, each message is a signedEvent envelope, since neither core NATS nor the REST Proxy v2 JSON API carry headers.
+func NewEventBus(rawURL string, signer *payloadSigner, retry *retryPolicy, metrics *metricsRegistry) (EventSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event bus url: %w", err)
+	}
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		return nil, errors.New("invalid event bus url: missing subject or topic")
+	}
+
+	var publisher eventPublisher
+	topic := func(event Event) string { return name }
+	switch u.Scheme {
+	case "nats":
+		publisher = newNATSPublisher(u)
+		topic = func(event Event) string { return name + "." + event.Type }
+	case "kafka+http", "kafka+https":
+		publisher = newKafkaRESTPublisher(u)
+	default:
+		return nil, fmt.Errorf("unsupported event bus %q, expected nats or kafka+http(s)", u.Scheme)
+	}
+
+	s := &busSink{
+		publisher: publisher,
+		topic:     topic,
+		signer:    signer,
+		retry:     retry,
+		queue:     make(chan Event, eventBusQueueSize),
+		published: metrics.Counter("event_bus_published_total", "Number of events published to the event bus."),
+		dropped:   metrics.Counter("event_bus_dropped_total", "Number of events which could not be published to the event bus."),
+	}
+	go s.run()
+	return s, nil
+}
+
+// busSink publishes events from a queue, so emitting never blocks.
+type busSink struct {
+	publisher eventPublisher
+	topic     func(Event) string
+	signer    *payloadSigner
+	retry     *retryPolicy
+	queue     chan Event
+	published *metricVec
+	dropped   *metricVec
+}
+
+// Emit implements EventSink.
+func (s *busSink) Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = clock().UTC()
+	}
+	select {
+	case s.queue <- event:
+	default:
+		s.dropped.Inc()
+	}
+}
+
+// run publishes the queued events. Failed events are retried a few times before they are dropped.
+func (s *busSink) run() {
+	for event := range s.queue {
+		message, err := json.Marshal(event)
+		if err == nil && s.signer != nil {
+			message, err = json.Marshal(signedEvent{Event: message, Signature: s.signer.SignData(message)})
+		}
+		if err != nil {
+			s.dropped.Inc()
+			continue
+		}
+		key := event.InstanceID
+		if key == "" {
+			key = event.ThingID
+		}
+		if key == "" {
+			key = event.InstallationID
+		}
+
+		err = s.retry.Do(context.Background(), func(ctx context.Context) error {
+			return s.publisher.Publish(s.topic(event), key, message)
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("type", event.Type).Warnln("failed to publish event")
+			s.dropped.Inc()
+			continue
+		}
+		s.published.Inc()
+	}
+}
+
+// signedEvent is the message published for an event with a signing key. The signature is made over the exact bytes of
+// the event, so consumers verify the raw event field with the public key before they decode it.
+type signedEvent struct {
+	Event     json.RawMessage `json:"event"`
+	Signature string          `json:"signature"`
+}
+
+// multiSink emits events to several sinks.
+type multiSink []EventSink
+
+// Emit implements EventSink.
+func (m multiSink) Emit(event Event) {
+	for _, sink := range m {
+		sink.Emit(event)
+	}
+}
+
+// natsPublisher publishes messages with the core NATS protocol.
+// It only implements what is needed to publish: the handshake, PUB and answering the PINGs of the server.
+// The connection is established on the first publish and again after it failed.
+type natsPublisher struct {
+	addr     string
+	user     *url.Userinfo
+	conn     net.Conn
+	writer   *bufio.Writer
+	lock     sync.Mutex
+	deadline time.Duration
+}
+
+func newNATSPublisher(u *url.URL) *natsPublisher {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &natsPublisher{addr: addr, user: u.User, deadline: 5 * time.Second}
+}
+
+// Publish implements eventPublisher. NATS has no keys, the order of messages is kept by the connection.
+func (p *natsPublisher) Publish(subject string, key string, message []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(p.deadline))
+	fmt.Fprintf(p.writer, "PUB %s %d\r\n", subject, len(message))
+	p.writer.Write(message)
+	p.writer.WriteString("\r\n")
+	if err := p.writer.Flush(); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return fmt.Errorf("failed to publish to nats: %w", err)
+	}
+	return nil
+}
+
+// connect opens the connection and waits for the server to acknowledge the CONNECT with a PONG.
+// Must be called with the lock held.
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, p.deadline)
+	if err != nil {
+		return fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(p.deadline))
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return errors.New("failed to connect to nats: missing INFO")
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "giphy-connector", "lang": "go"}
+	if p.user != nil {
+		options["user"] = p.user.Username()
+		options["pass"], _ = p.user.Password()
+	}
+	b, _ := json.Marshal(options)
+	writer := bufio.NewWriter(conn)
+	writer.WriteString("CONNECT " + string(b) + "\r\nPING\r\n")
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "PONG" {
+		conn.Close()
+		return fmt.Errorf("failed to connect to nats: %s", strings.TrimSpace(line))
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.conn = conn
+	p.writer = writer
+	go p.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop answers the PINGs of the server, which closes connections that do not answer.
+// Errors sent by the server are logged, the connection is discarded when it fails.
+func (p *natsPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			p.lock.Lock()
+			if p.conn == conn {
+				p.conn.Close()
+				p.conn = nil
+			}
+			p.lock.Unlock()
+			return
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			p.lock.Lock()
+			if p.conn == conn {
+				p.writer.WriteString("PONG\r\n")
+				p.writer.Flush()
+			}
+			p.lock.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			logrus.WithField("error", line).Warnln("nats server reported an error")
+		}
+	}
+}
+
+// kafkaRESTPublisher publishes messages to Kafka with the v2 API of the Kafka REST Proxy.
+type kafkaRESTPublisher struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newKafkaRESTPublisher(u *url.URL) *kafkaRESTPublisher {
+	base := url.URL{Scheme: strings.TrimPrefix(u.Scheme, "kafka+"), User: u.User, Host: u.Host}
+	return &kafkaRESTPublisher{baseURL: base.String(), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Publish implements eventPublisher. Messages with the same key are written to the same partition.
+func (p *kafkaRESTPublisher) Publish(topic string, key string, message []byte) error {
+	record := map[string]interface{}{"value": json.RawMessage(message)}
+	if key != "" {
+		record["key"] = key
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": []interface{}{record}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Post(p.baseURL+"/topics/"+url.PathEscape(topic), "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to publish to kafka: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to publish to kafka: kafka rest proxy responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of events emitted to the event sink:
+const (
+	EventInstallationAdded   = "installation.added"
+	EventInstallationRemoved = "installation.removed"
+	EventInstanceAdded       = "instance.added"
+	EventInstanceRemoved     = "instance.removed"
+	EventThingCreated        = "thing.created"
+	EventActionRequested     = "action.requested"
+	EventActionFinished      = "action.finished"
+	EventPropertyUpdated     = "property.updated"
+)
+
+// Event describes a lifecycle or update event of the connector.
+// Events are meant for analytics and are kept separate from the operational logs.
+// Fields which do not apply to the event type are left empty.
+// Action events name the request ID ActionRequestID like the connctd API, unlike the RequestId of the SDK's ActionEvent.
+// Action events carry the parameters of the request, action.finished events also the time the request was received and its duration.
+// Metadata contains further information which only applies to some events, e.g. "searchCache" with hit or miss for searches.
+type Event struct {
+	Time            time.Time         `json:"time"`
+	Type            string            `json:"type"`
+	CorrelationID   string            `json:"correlationId,omitempty"`
+	InstallationID  string            `json:"installationId,omitempty"`
+	InstanceID      string            `json:"instanceId,omitempty"`
+	ThingID         string            `json:"thingId,omitempty"`
+	ComponentID     string            `json:"componentId,omitempty"`
+	PropertyID      string            `json:"propertyId,omitempty"`
+	ActionRequestID string            `json:"actionRequestId,omitempty"`
+	ActionID        string            `json:"actionId,omitempty"`
+	Parameters      map[string]string `json:"parameters,omitempty"`
+	Received        *time.Time        `json:"received,omitempty"`
+	DurationMs      int64             `json:"durationMs,omitempty"`
+	Status          string            `json:"status,omitempty"`
+	Value           string            `json:"value,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// EventSink receives all events emitted by the connector.
+type EventSink interface {
+	// Emit publishes the event.
+	// Implementations must be safe for concurrent use and should not block the caller for long.
+	Emit(event Event)
+}
+
+// NewEventLog returns a sink writing newline delimited JSON to the given target.
+// The target is either a file path, to which events are appended, or "-" for stdout.
+// If the target is empty, events are discarded.
+func NewEventLog(target string) (EventSink, error) {
+	switch target {
+	case "":
+		return nopSink{}, nil
+	case "-":
+		return newNDJSONSink(os.Stdout), nil
+	default:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open event log: %w", err)
+		}
+		return newNDJSONSink(f), nil
+	}
+}
+
+// nopSink discards all events.
+type nopSink struct{}
+
+func (nopSink) Emit(event Event) {}
+
+// ndjsonSink writes each event as a single JSON line.
+type ndjsonSink struct {
+	encoder *json.Encoder
+	lock    sync.Mutex
+}
+
+func newNDJSONSink(w io.Writer) *ndjsonSink {
+	return &ndjsonSink{encoder: json.NewEncoder(w)}
+}
+
+// Emit implements EventSink.
+func (s *ndjsonSink) Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = clock().UTC()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.encoder.Encode(event); err != nil {
+		logrus.WithError(err).Warnln("failed to write event")
+	}
+}
+
+// maxTrackedActions is the number of action requests whose context is kept until their result is sent.
+const maxTrackedActions = 10000
+
+// trackedAction is the context of an action request, which is added to the event of its result.
+type trackedAction struct {
+	thingID     string
+	componentID string
+	actionID    string
+	parameters  map[string]string
+	received    time.Time
+	metadata    map[string]string
+}
+
+// actionTracker keeps the context of action requests from the callback until their result is sent to connctd,
+// so the action.finished event contains the same thing, action and parameters as the action.requested event.
+// Results sent by another replica or after a restart only contain the action request ID.
+type actionTracker struct {
+	actions map[string]*trackedAction
+	lock    sync.Mutex
+}
+
+func newActionTracker() *actionTracker {
+	return &actionTracker{actions: map[string]*trackedAction{}}
+}
+
+// Track remembers the context of the action request. If too many requests are tracked, the context is not kept.
+func (t *actionTracker) Track(request connector.ActionRequest, received time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.actions) >= maxTrackedActions {
+		// Results of some requests may never be sent by this replica, their context is dropped after an hour
+		for id, action := range t.actions {
+			if received.Sub(action.received) > time.Hour {
+				delete(t.actions, id)
+			}
+		}
+		if len(t.actions) >= maxTrackedActions {
+			return
+		}
+	}
+	t.actions[request.ID] = &trackedAction{
+		thingID:     request.ThingID,
+		componentID: request.ComponentID,
+		actionID:    request.ActionID,
+		parameters:  request.Parameters,
+		received:    received,
+		metadata:    map[string]string{},
+	}
+}
+
+// Annotate adds metadata to the event of the result of the action request.
+func (t *actionTracker) Annotate(actionRequestId string, key string, value string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if action, ok := t.actions[actionRequestId]; ok {
+		action.metadata[key] = value
+	}
+}
+
+// Finish adds the context of the action request to the event of its result.
+// The context is forgotten once the result was sent, failed results may be retried.
+func (t *actionTracker) Finish(event *Event, finished time.Time, sent bool) {
+	t.lock.Lock()
+	action, ok := t.actions[event.ActionRequestID]
+	if sent {
+		delete(t.actions, event.ActionRequestID)
+	}
+	t.lock.Unlock()
+	if !ok {
+		return
+	}
+	event.ThingID = action.thingID
+	event.ComponentID = action.componentID
+	event.ActionID = action.actionID
+	event.Parameters = action.parameters
+	event.Received = &action.received
+	event.DurationMs = finished.Sub(action.received).Milliseconds()
+	if len(action.metadata) > 0 {
+		event.Metadata = action.metadata
+	}
+}
+
+// Forget drops the context of an action request whose result is not sent, e.g. because it was rejected.
+func (t *actionTracker) Forget(actionRequestId string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.actions, actionRequestId)
+}
+
+// eventService emits lifecycle events for all callbacks successfully handled by the wrapped service.
+// The context of action requests is tracked for the events of their results.
+type eventService struct {
+	connector.ConnectorService
+	events  EventSink
+	actions *actionTracker
+}
+
+// AddInstallation implements connector.ConnectorService.
+func (s *eventService) AddInstallation(ctx context.Context, request connector.InstallationRequest) (*connector.InstallationResponse, error) {
+	response, err := s.ConnectorService.AddInstallation(ctx, request)
+	if err == nil {
+		s.events.Emit(Event{Type: EventInstallationAdded, CorrelationID: correlationID(ctx), InstallationID: request.ID})
+	}
+	return response, err
+}
+
+// RemoveInstallation implements connector.ConnectorService.
+func (s *eventService) RemoveInstallation(ctx context.Context, installationId string) error {
+	err := s.ConnectorService.RemoveInstallation(ctx, installationId)
+	if err == nil {
+		s.events.Emit(Event{Type: EventInstallationRemoved, CorrelationID: correlationID(ctx), InstallationID: installationId})
+	}
+	return err
+}
+
+// AddInstance implements connector.ConnectorService.
+func (s *eventService) AddInstance(ctx context.Context, request connector.InstantiationRequest) (*connector.InstantiationResponse, error) {
+	response, err := s.ConnectorService.AddInstance(ctx, request)
+	if err == nil {
+		s.events.Emit(Event{Type: EventInstanceAdded, CorrelationID: correlationID(ctx), InstallationID: request.InstallationID, InstanceID: request.ID})
+	}
+	return response, err
+}
+
+// RemoveInstance implements connector.ConnectorService.
+func (s *eventService) RemoveInstance(ctx context.Context, instanceId string) error {
+	err := s.ConnectorService.RemoveInstance(ctx, instanceId)
+	if err == nil {
+		s.events.Emit(Event{Type: EventInstanceRemoved, CorrelationID: correlationID(ctx), InstanceID: instanceId})
+	}
+	return err
+}
+
+// PerformAction implements connector.ConnectorService.
+func (s *eventService) PerformAction(ctx context.Context, request connector.ActionRequest) (*connector.ActionResponse, error) {
+	received := clock().UTC()
+	// The result may be sent before the service returns, so the request is tracked before
+	s.actions.Track(request, received)
+	response, err := s.ConnectorService.PerformAction(ctx, request)
+	event := Event{
+		Time:            received,
+		Type:            EventActionRequested,
+		CorrelationID:   correlationID(ctx),
+		ThingID:         request.ThingID,
+		ComponentID:     request.ComponentID,
+		ActionRequestID: request.ID,
+		ActionID:        request.ActionID,
+		Parameters:      request.Parameters,
+		Status:          string(connector.ActionRequestStatusCompleted),
+	}
+	if response != nil {
+		event.Status = string(response.Status)
+		event.Error = response.Error
+	}
+	if err != nil {
+		event.Status = string(connector.ActionRequestStatusFailed)
+		event.Error = err.Error()
+	}
+	if event.Status != string(connector.ActionRequestStatusPending) {
+		s.actions.Forget(request.ID)
+	}
+	s.events.Emit(event)
+	return response, err
+}
+
+// eventClient emits events for all thing creations, property updates and action status updates sent to connctd.
+// The events of action results contain the context of the action requests tracked by the event service.
+type eventClient struct {
+	connector.Client
+	events  EventSink
+	actions *actionTracker
+}
+
+// CreateThing implements connector.Client.
+func (c *eventClient) CreateThing(ctx context.Context, token connector.InstantiationToken, thing connctd.Thing) (connctd.Thing, error) {
+	result, err := c.Client.CreateThing(ctx, token, thing)
+	if err == nil {
+		c.events.Emit(Event{Type: EventThingCreated, CorrelationID: correlationID(ctx), ThingID: result.ID})
+	}
+	return result, err
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *eventClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+	event := Event{
+		Time:          lastUpdate.UTC(),
+		Type:          EventPropertyUpdated,
+		CorrelationID: correlationID(ctx),
+		ThingID:       thingID,
+		ComponentID:   componentID,
+		PropertyID:    propertyID,
+		Value:         value,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	c.events.Emit(event)
+	return err
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *eventClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	err := c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e)
+	event := Event{
+		Time:            clock().UTC(),
+		Type:            EventActionFinished,
+		CorrelationID:   correlationID(ctx),
+		ActionRequestID: actionRequestID,
+		Status:          string(status),
+		Error:           e,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	c.actions.Finish(&event, event.Time, err == nil)
+	c.events.Emit(event)
+	return err
+}
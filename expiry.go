@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+// propertyExpiryInterval is the interval in which expired properties are looked for.
+const propertyExpiryInterval = 30 * time.Second
+
+// expiringProperty is a property with a TTL and the last value sent for it.
+type expiringProperty struct {
+	token       connector.InstantiationToken
+	thingID     string
+	componentID string
+	propertyID  string
+	expires     time.Time
+}
+
+// propertyExpiry empties properties of components with a TTL which were not updated within the TTL,
+// so connctd does not show outdated values like the result of a search made days ago as current.
+// The last updates are only kept in memory, properties updated before a restart or by another replica do not expire.
+type propertyExpiry struct {
+	client      connector.Client
+	ttls        map[string]time.Duration
+	emptyValues map[string]string
+	properties  map[string]*expiringProperty
+	expired     *metricVec
+	lock        sync.Mutex
+}
+
+// newPropertyExpiry returns an expiry sending the empty values with the given client.
+// ttls are the TTLs by component ID, properties of other components never expire.
+// emptyValues are the values expired properties are set to by component and property ID like "search/result_count", others are set to an empty string.
+func newPropertyExpiry(client connector.Client, ttls map[string]time.Duration, emptyValues map[string]string, metrics *metricsRegistry) *propertyExpiry {
+	return &propertyExpiry{
+		client:      client,
+		ttls:        ttls,
+		emptyValues: emptyValues,
+		properties:  map[string]*expiringProperty{},
+		expired:     metrics.Counter("properties_expired_total", "Number of properties emptied because they were not updated within the TTL of their component.", "component"),
+	}
+}
+
+// Updated records a successful update of the property. Empty values, or the configured empty value of the property, do not expire.
+func (e *propertyExpiry) Updated(token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) {
+	ttl, ok := e.ttls[componentID]
+	if !ok {
+		return
+	}
+	key := thingID + "/" + componentID + "/" + propertyID
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if value == e.emptyValues[componentID+"/"+propertyID] {
+		delete(e.properties, key)
+		return
+	}
+	e.properties[key] = &expiringProperty{token, thingID, componentID, propertyID, lastUpdate.Add(ttl)}
+}
+
+// Run empties expired properties until the context is canceled.
+func (e *propertyExpiry) Run(ctx context.Context) {
+	ticker := time.NewTicker(propertyExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.expire(ctx, time.Now())
+		}
+	}
+}
+
+// expire sends an empty value for all properties which expired before now.
+// A property is only emptied once, a failed update is retried by the job queue if the client retries.
+func (e *propertyExpiry) expire(ctx context.Context, now time.Time) {
+	var expired []*expiringProperty
+	e.lock.Lock()
+	for key, property := range e.properties {
+		if property.expires.Before(now) {
+			expired = append(expired, property)
+			delete(e.properties, key)
+		}
+	}
+	e.lock.Unlock()
+
+	for _, property := range expired {
+		logger := logrus.WithField("thingId", property.thingID).WithField("componentId", property.componentID).WithField("propertyId", property.propertyID)
+		if err := e.client.UpdateThingPropertyValue(ctx, property.token, property.thingID, property.componentID, property.propertyID, e.emptyValues[property.componentID+"/"+property.propertyID], now); err != nil {
+			logger.WithError(err).Warnln("failed to empty expired property")
+			continue
+		}
+		logger.Infoln("emptied expired property")
+		e.expired.Inc(property.componentID)
+	}
+}
+
+// expiringClient records the property updates sent to connctd with the property expiry.
+type expiringClient struct {
+	connector.Client
+	expiry *propertyExpiry
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *expiringClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+	if err == nil {
+		c.expiry.Updated(token, thingID, componentID, propertyID, value, lastUpdate)
+	}
+	return err
+}
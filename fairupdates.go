@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/connctd/connector-go"
+)
+
+// fairUpdates queues the updates of each installation separately and passes them on to the update channel round-robin,
+// one update of each installation with queued updates at a time. The event handler of the SDK consumes the update channel
+// in order, so without it an installation with thousands of instances delays the updates of all other installations.
+// Senders of an installation whose queue is full wait, like senders on a full channel, without blocking other installations.
+type fairUpdates struct {
+	maxQueued int
+	queued    *metricVec
+
+	lock sync.Mutex
+	// changed is signaled when an update is queued or taken from a queue.
+	changed *sync.Cond
+	queues  map[string][]connector.UpdateEvent
+	// order are the installations with queued updates, the next one to send first.
+	order   []string
+	started sync.Once
+}
+
+// newFairUpdates returns a scheduler queueing up to maxQueued updates of each installation.
+func newFairUpdates(maxQueued int, metrics *metricsRegistry) *fairUpdates {
+	f := &fairUpdates{
+		maxQueued: maxQueued,
+		queued:    metrics.Gauge("updates_queued", "Number of updates waiting in the queues of the installations for the update channel."),
+		queues:    map[string][]connector.UpdateEvent{},
+	}
+	f.changed = sync.NewCond(&f.lock)
+	return f
+}
+
+// Send queues the update of the installation, it waits while the queue of the installation is full.
+func (f *fairUpdates) Send(installationId string, update connector.UpdateEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.queues[installationId]) >= f.maxQueued {
+		f.changed.Wait()
+	}
+	if len(f.queues[installationId]) == 0 {
+		f.order = append(f.order, installationId)
+	}
+	f.queues[installationId] = append(f.queues[installationId], update)
+	f.queued.Add(1)
+	f.changed.Broadcast()
+}
+
+// next waits for a queued update and takes it from the queue of the next installation in turn.
+func (f *fairUpdates) next() connector.UpdateEvent {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.order) == 0 {
+		f.changed.Wait()
+	}
+	installationId := f.order[0]
+	f.order = f.order[1:]
+	queue := f.queues[installationId]
+	update := queue[0]
+	if len(queue) > 1 {
+		f.queues[installationId] = queue[1:]
+		f.order = append(f.order, installationId)
+	} else {
+		delete(f.queues, installationId)
+	}
+	f.queued.Add(-1)
+	f.changed.Broadcast()
+	return update
+}
+
+// Len returns the number of queued updates.
+func (f *fairUpdates) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := 0
+	for _, queue := range f.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Start passes the queued updates on with send until the process exits. Like the update channel, the queues outlive
+// the provider, so updates queued before the provider was stopped are still sent. Further calls have no effect.
+func (f *fairUpdates) Start(send func(update connector.UpdateEvent)) {
+	f.started.Do(func() {
+		go func() {
+			for {
+				send(f.next())
+			}
+		}()
+	})
+}
+
+// SetFairUpdates lets the provider pass the updates of the installations on to the update channel in turns.
+// Must be called before the provider is started.
+func (h *GiphyProvider) SetFairUpdates(fair *fairUpdates) {
+	h.fair = fair
+}
+
+// instanceInstallation returns the ID of the installation of the registered instance, or an empty string if it is unknown.
+func (h *GiphyProvider) instanceInstallation(instanceId string) string {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	return h.instanceInstallations[instanceId]
+}
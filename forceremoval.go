@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/go-logr/logr"
+)
+
+// forceRemovalDetails are sent to connctd as details of the failed state of force-removed installations and instances.
+var forceRemovalDetails = json.RawMessage(`{"reason":"removed by the connector operator"}`)
+
+// forceRemover removes installations and instances whose removal callback never arrived, e.g. because the connector
+// was offline. The removal runs through the same service as the callbacks, so the provider stops updating them, the
+// database rows are deleted and removal events are published. connctd can optionally be told on a best-effort basis:
+// the things are set to UNAVAILABLE and the instance or installation to FAILED, since connctd has no removal API
+// for connectors. Notifications are sent after the removal, with the tokens loaded before it.
+type forceRemover struct {
+	service connector.ConnectorService
+	db      connector.Database
+	client  connector.Client
+	logger  logr.Logger
+}
+
+// ForceRemoval is the result of a force-removal.
+type ForceRemoval struct {
+	InstallationID string   `json:"installationId,omitempty"`
+	Instances      []string `json:"instances"`
+	// Notified is the number of notifications connctd accepted, NotificationErrors the number it did not.
+	Notified           int `json:"notified"`
+	NotificationErrors int `json:"notificationErrors"`
+}
+
+func newForceRemover(service connector.ConnectorService, db connector.Database, client connector.Client, logger logr.Logger) *forceRemover {
+	return &forceRemover{service, db, client, logger}
+}
+
+// RemoveInstance removes the instance and, with notify, tells connctd about it.
+func (f *forceRemover) RemoveInstance(ctx context.Context, instanceId string, notify bool) (*ForceRemoval, error) {
+	instance, err := f.db.GetInstance(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.service.RemoveInstance(ctx, instanceId); err != nil {
+		return nil, err
+	}
+	result := &ForceRemoval{Instances: []string{instanceId}}
+	if notify {
+		f.notifyInstance(ctx, instance, result)
+	}
+	return result, nil
+}
+
+// RemoveInstallation removes the installation with all its instances and, with notify, tells connctd about them.
+func (f *forceRemover) RemoveInstallation(ctx context.Context, installationId string, notify bool) (*ForceRemoval, error) {
+	installations, err := f.db.GetInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var installation *connector.Installation
+	for _, i := range installations {
+		if i.ID == installationId {
+			installation = i
+		}
+	}
+	if installation == nil {
+		return nil, connector.ErrorInstallationNotFound
+	}
+	instances, err := f.db.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The instances are removed one by one first, so each of them is removed from the provider and publishes its removal
+	result := &ForceRemoval{InstallationID: installationId, Instances: []string{}}
+	var removed []*connector.Instance
+	for _, instance := range instances {
+		if instance.InstallationID != installationId {
+			continue
+		}
+		if err := f.service.RemoveInstance(ctx, instance.ID); err != nil {
+			return nil, err
+		}
+		result.Instances = append(result.Instances, instance.ID)
+		removed = append(removed, instance)
+	}
+	if err := f.service.RemoveInstallation(ctx, installationId); err != nil {
+		return nil, err
+	}
+
+	if notify {
+		for _, instance := range removed {
+			f.notifyInstance(ctx, instance, result)
+		}
+		f.count(result, f.client.UpdateInstallationState(ctx, installation.Token, connector.InstallationStateFailed, forceRemovalDetails), "installationId", installationId)
+	}
+	return result, nil
+}
+
+// notifyInstance sets the things of the removed instance to UNAVAILABLE and the instance to FAILED.
+func (f *forceRemover) notifyInstance(ctx context.Context, instance *connector.Instance, result *ForceRemoval) {
+	for _, mapping := range instance.ThingMapping {
+		f.count(result, f.client.UpdateThingStatus(ctx, instance.Token, mapping.ThingID, connctd.StatusTypeUnavailable), "instanceId", instance.ID, "thingId", mapping.ThingID)
+	}
+	f.count(result, f.client.UpdateInstanceState(ctx, instance.Token, connector.InstantiationStateFailed, forceRemovalDetails), "instanceId", instance.ID)
+}
+
+// count adds the outcome of a notification to the result and logs failures.
+func (f *forceRemover) count(result *ForceRemoval, err error, keysAndValues ...interface{}) {
+	if err != nil {
+		result.NotificationErrors++
+		f.logger.Error(err, "failed to notify connctd of force-removal", keysAndValues...)
+		return
+	}
+	result.Notified++
+}
+
+// postForceRemoval force-removes an installation or instance with POST /admin/installations/{id}/remove or
+// POST /admin/instances/{id}/remove, ?notify=true also tells connctd. It returns the removed instances.
+func (h *adminHandler) postForceRemoval(w http.ResponseWriter, r *http.Request, kind string, id string) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+	notify := r.URL.Query().Get("notify") == "true"
+	var result *ForceRemoval
+	var err error
+	if kind == "installation" {
+		result, err = h.remover.RemoveInstallation(r.Context(), id, notify)
+	} else {
+		result, err = h.remover.RemoveInstance(r.Context(), id, notify)
+	}
+	var connectorErr *connector.Error
+	if errors.As(err, &connectorErr) && connectorErr.Status == http.StatusNotFound {
+		connectorErr.Write(w)
+		return
+	}
+	if err != nil {
+		h.logger.Error(err, "failed to force-remove "+kind, "id", id)
+		connector.ErrorInternal.Write(w)
+		return
+	}
+	h.logger.Info("force-removed "+kind, "id", id, "instances", len(result.Instances), "notified", result.Notified, "notificationErrors", result.NotificationErrors)
+	writeJSON(w, http.StatusOK, result)
+}
@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,164 +24,1239 @@ type GiphyProvider struct {
 	provider.DefaultProvider
 	giphyClient *giphyClient.Client
 	clientLock  sync.Mutex
+	// defaultRating is used for installations without rating configuration parameter.
+	defaultRating string
+	// clients are the Giphy clients of the registered installations by installation ID, giphyClient is their template.
+	clients map[string]*installationClient
+	// transport sends the requests of all clients, nil for the default transport.
+	transport    http.RoundTripper
+	reporter     ErrorReporter
+	failures     *failureTracker
+	correlations *correlationRegistry
+	quota        *quotaTracker
+	errorLogs    *logSampler
+	logger       *logrus.Logger
+	searchCache  *searchCache
+	shard        *shardMembership
+	messages     *localizer
+	jobs         *jobQueue
+	actionLimits *actionLimiter
+	actions      *actionTracker
+	reauthorized *reauthorizationTracker
+	values       *valueLimiter
+	throttle     *searchThrottle
+	rateLimits   *giphyRateLimiter
+	channels     *providerChannels
+	pendingStore *pendingActionStore
+	timeouts     *actionTimeouts
+	fair         *fairUpdates
+	tracer       *tracer
+
+	// updateInterval is the interval of the periodic update of instances without update interval parameter.
+	updateInterval time.Duration
+	// schedule holds the next periodic update of each instance and the paused instances.
+	schedule *updateScheduler
+
+	// newInstallations are applied on the next update, registrationLock protects them.
+	registrationLock sync.Mutex
+	newInstallations []*connector.Installation
+
+	// stateLock protects the introspection state below, which is read by the admin API.
+	stateLock               sync.Mutex
+	pendingActions          map[string]PendingActionInfo
+	registeredInstallations map[string]bool
+	registeredInstances     map[string]bool
+	instanceInstallations   map[string]string
+
+	// control runs operations requested by the admin API in the update loop, so they do not race with updates.
+	control chan func()
+
+	// lifecycleLock protects the context of the goroutines started by Run and the function canceling it,
+	// running waits for them to return.
+	lifecycleLock sync.Mutex
+	runContext    context.Context
+	cancel        context.CancelFunc
+	running       sync.WaitGroup
+}
+
+// PendingActionInfo describes an action request that was received but not yet finished.
+type PendingActionInfo struct {
+	ID         string    `json:"id"`
+	ActionID   string    `json:"actionId"`
+	InstanceID string    `json:"instanceId"`
+	ThingID    string    `json:"thingId"`
+	Received   time.Time `json:"received"`
 }
 
+// giphyApiKeyConfigID is the installation configuration parameter with the Giphy API key.
+const giphyApiKeyConfigID = "giphy_api_key"
+
+// giphyRatingConfigID is the optional installation configuration parameter with the content rating all GIFs of the
+// installation are limited to, e.g. "g" for family-friendly results.
+const giphyRatingConfigID = "giphy_rating"
+
+// giphyRatings are the content ratings supported by the Giphy API, from the most to the least restrictive.
+var giphyRatings = []string{"g", "pg", "pg-13", "r"}
+
+// giphyRating returns the normalized rating of the configuration value and whether it is supported.
+func giphyRating(value string) (string, bool) {
+	rating := strings.ToLower(strings.TrimSpace(value))
+	for _, r := range giphyRatings {
+		if r == rating {
+			return rating, true
+		}
+	}
+	return "", false
+}
+
+// Errors of the Giphy requests, their texts returned to the platform are localized.
+var (
+	errInstallationNotRegistered = errors.New("installation not registered")
+	errMissingApiKey             = errors.New("could not find api key")
+	errNoSearchResult            = errors.New("no search result found")
+	errMissingPhrase             = errors.New("missing phrase to translate")
+	errNoTranslation             = errors.New("no translation found")
+)
+
+// repeatedFailureThreshold is the number of consecutive failed Giphy calls of an instance after which the failure is reported.
+const repeatedFailureThreshold = 5
+
 // New return a new Giphy provider.
-func NewGiphyProvider() *GiphyProvider {
-	client := giphyClient.DefaultClient
+// Repeated failures and panics are sent to the given reporter.
+// The correlation IDs of updates are registered with the given registry, so the connctd client can pick them up.
+// Each request to the Giphy API is recorded with the quota tracker.
+// Repeated errors of an instance are only logged as often as the log sampler allows.
+// All logs of the provider are written to the given logger, or to the standard logger of logrus if it is nil.
+func NewGiphyProvider(reporter ErrorReporter, correlations *correlationRegistry, quota *quotaTracker, errorLogs *logSampler, logger *logrus.Logger) *GiphyProvider {
+	client := giphyClient.NewClient()
 	provider := provider.New()
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
 
 	return &GiphyProvider{
-		provider,
-		client,
-		sync.Mutex{},
+		DefaultProvider:         provider,
+		giphyClient:             client,
+		defaultRating:           client.Rating,
+		clients:                 map[string]*installationClient{},
+		reporter:                reporter,
+		failures:                newFailureTracker(repeatedFailureThreshold),
+		correlations:            correlations,
+		quota:                   quota,
+		errorLogs:               errorLogs,
+		logger:                  logger,
+		messages:                &localizer{"en"},
+		updateInterval:          defaultUpdateInterval,
+		schedule:                newUpdateScheduler(),
+		pendingActions:          map[string]PendingActionInfo{},
+		registeredInstallations: map[string]bool{},
+		registeredInstances:     map[string]bool{},
+		instanceInstallations:   map[string]string{},
+		control:                 make(chan func()),
 	}
 }
 
-// Run starts the periodic update and the action handler.
+// SetBaseURL lets the provider send all Giphy requests to the given URL instead of the public Giphy API,
+// e.g. to a fake server in tests. The URL must include the API version path, e.g. "http://localhost:9000/v1".
+func (h *GiphyProvider) SetBaseURL(baseURL *url.URL) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	h.giphyClient.BaseURL = &url.URL{Scheme: baseURL.Scheme, Host: baseURL.Host}
+	h.giphyClient.BasePath = strings.TrimSuffix(baseURL.Path, "/")
+	h.resetInstallationClients()
+}
+
+// SetTransport lets the Giphy client send its requests with the given transport, e.g. through a proxy.
+func (h *GiphyProvider) SetTransport(transport http.RoundTripper) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	h.transport = transport
+	h.giphyClient = copyGiphyClient(h.giphyClient, transport)
+	h.resetInstallationClients()
+}
+
+// SetSearchCache lets the provider cache search results, so repeated searches do not cost a Giphy request.
+func (h *GiphyProvider) SetSearchCache(cache *searchCache) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	h.searchCache = cache
+}
+
+// SetSearchThrottle lets the provider answer repeated searches of an installation for a keyword with the previous result.
+func (h *GiphyProvider) SetSearchThrottle(throttle *searchThrottle) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	h.throttle = throttle
+}
+
+// SetRateLimiter lets the provider limit the Giphy requests of each installation and pause them after 429 responses.
+func (h *GiphyProvider) SetRateLimiter(limits *giphyRateLimiter) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	h.rateLimits = limits
+	h.resetInstallationClients()
+}
+
+// SetLocalizer sets the localizer used for the texts of failed actions, which are in English by default.
+func (h *GiphyProvider) SetLocalizer(messages *localizer) {
+	h.messages = messages
+}
+
+// SetJobQueue lets the provider handle action requests with the job queue instead of the action channel.
+// Actions of installations which are not registered yet are then retried instead of failing.
+func (h *GiphyProvider) SetJobQueue(jobs *jobQueue) {
+	h.jobs = jobs
+	jobs.Handle(jobKindAction, h.handleActionJob)
+}
+
+// SetActionLimits limits the number of concurrent and queued actions of each installation.
+// Action requests beyond the limits are rejected with RATE_LIMITED. Must be called before the provider is started.
+func (h *GiphyProvider) SetActionLimits(limits *actionLimiter) {
+	h.actionLimits = limits
+}
+
+// SetReauthorizationTracker stops the periodic update of instances whose token was rejected by connctd.
+func (h *GiphyProvider) SetReauthorizationTracker(tracker *reauthorizationTracker) {
+	h.reauthorized = tracker
+}
+
+// SetValueLimits limits the length of the property values sent to connctd.
+// Search results are truncated or the action fails, periodic updates with a too long value are skipped.
+func (h *GiphyProvider) SetValueLimits(limits *valueLimiter) {
+	h.values = limits
+}
+
+// checkValue returns errValueTooLong if the value exceeds the maximum length.
+func (h *GiphyProvider) checkValue(property propertyRef, value string) error {
+	if h.values == nil {
+		return nil
+	}
+	return h.values.Check(property, value)
+}
+
+// marshalSearchResults marshals the structured search results and reports whether they were truncated to fit the maximum length.
+func (h *GiphyProvider) marshalSearchResults(results searchResults) (string, bool, error) {
+	if h.values == nil {
+		value, err := marshalStructuredValue(searchResultsProperty, results)
+		return value, false, err
+	}
+	return h.values.Results(results)
+}
+
+// NeedsReauthorization returns since when the instances whose token was rejected by connctd need to be re-authorized.
+func (h *GiphyProvider) NeedsReauthorization() map[string]time.Time {
+	if h.reauthorized == nil {
+		return map[string]time.Time{}
+	}
+	return h.reauthorized.Instances()
+}
+
+// Reauthorized resumes the periodic update of an instance whose token was rejected by connctd.
+func (h *GiphyProvider) Reauthorized(ctx context.Context, instanceId string) error {
+	if h.reauthorized == nil {
+		return nil
+	}
+	return h.reauthorized.Reauthorized(ctx, instanceId)
+}
+
+// SetActionTracker lets the provider add metadata to the events of action results, e.g. whether the search cache was hit.
+func (h *GiphyProvider) SetActionTracker(actions *actionTracker) {
+	h.actions = actions
+}
+
+// annotateAction adds metadata to the event of the result of the action request.
+func (h *GiphyProvider) annotateAction(actionRequestId string, key string, value string) {
+	if h.actions != nil {
+		h.actions.Annotate(actionRequestId, key, value)
+	}
+}
+
+// SetSharding lets the provider only update the instances owned by this replica.
+// Must be called before the provider is started.
+func (h *GiphyProvider) SetSharding(shard *shardMembership) {
+	h.shard = shard
+}
+
+// Registered returns the IDs of the installations and instances currently used by the periodic update.
+func (h *GiphyProvider) Registered() (installations map[string]bool, instances map[string]bool) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	return h.registeredInstallations, h.registeredInstances
+}
+
+// PendingActions returns all action requests which are not finished yet.
+func (h *GiphyProvider) PendingActions() []PendingActionInfo {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	actions := make([]PendingActionInfo, 0, len(h.pendingActions))
+	for _, a := range h.pendingActions {
+		actions = append(actions, a)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Received.Before(actions[j].Received) })
+	return actions
+}
+
+// update applies pending registrations and removals, passes the instances on to the schedule
+// and takes a snapshot of the registered IDs for introspection.
+func (h *GiphyProvider) update() {
+	h.Update()
+	h.removeInstallationClients()
+
+	h.registrationLock.Lock()
+	for _, installation := range h.newInstallations {
+		h.Installations[installation.ID] = installation
+		h.setInstallationClient(installation)
+	}
+	h.newInstallations = nil
+	h.registrationLock.Unlock()
+
+	installations := make(map[string]bool, len(h.Installations))
+	for id := range h.Installations {
+		installations[id] = true
+	}
+	instances := make(map[string]bool, len(h.Instances))
+	instanceInstallations := make(map[string]string, len(h.Instances))
+	for _, instance := range h.Instances {
+		instances[instance.ID] = true
+		instanceInstallations[instance.ID] = instance.InstallationID
+	}
+	h.schedule.Sync(h.Instances, time.Now())
+
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.registeredInstallations = installations
+	h.registeredInstances = instances
+	h.instanceInstallations = instanceInstallations
+}
+
+// finishAction removes the action request from the pending actions.
+func (h *GiphyProvider) finishAction(actionRequestId string) {
+	h.stateLock.Lock()
+	delete(h.pendingActions, actionRequestId)
+	h.stateLock.Unlock()
+
+	if h.pendingStore != nil {
+		if err := h.pendingStore.Remove(context.Background(), actionRequestId); err != nil {
+			h.logger.WithError(err).WithField("actionRequestId", actionRequestId).Warnln("failed to remove finished pending action")
+		}
+	}
+}
+
+// RegisterInstallations overrides the default implementation, which never forgets newly registered installations
+// and adds removed installations again on every update. The installations are applied by the next update.
+// The provider keeps copies without token, see withoutInstallationToken.
+func (h *GiphyProvider) RegisterInstallations(installations ...*connector.Installation) error {
+	copies := make([]*connector.Installation, len(installations))
+	for i, installation := range installations {
+		copies[i] = withoutInstallationToken(installation)
+		logRegistrationProgress(h.logger, "installations", i+1, len(installations))
+	}
+	h.registrationLock.Lock()
+	defer h.registrationLock.Unlock()
+	h.newInstallations = append(h.newInstallations, copies...)
+	return nil
+}
+
+// RegisterInstances overrides the default implementation to keep copies of the instances without token.
+func (h *GiphyProvider) RegisterInstances(instances ...*connector.Instance) error {
+	copies := make([]*connector.Instance, len(instances))
+	for i, instance := range instances {
+		copies[i] = withoutInstanceToken(instance)
+		logRegistrationProgress(h.logger, "instances", i+1, len(instances))
+	}
+	return h.DefaultProvider.RegisterInstances(copies...)
+}
+
+// logRegistrationProgress logs the progress of registering large numbers of installations or instances, e.g. on start.
+func logRegistrationProgress(logger *logrus.Logger, what string, registered int, total int) {
+	if total >= bulkProgressInterval && (registered%bulkProgressInterval == 0 || registered == total) {
+		logger.WithField("registered", registered).WithField("total", total).Infof("registering %s", what)
+	}
+}
+
+// withoutInstallationToken returns a copy of the installation without its token.
+// The provider never calls connctd itself, the connector service loads the tokens from the database for each call.
+// So tokens are not kept in memory for the lifetime of the installation and can not leak through the provider,
+// its channels or log fields.
+func withoutInstallationToken(installation *connector.Installation) *connector.Installation {
+	c := *installation
+	c.Token = ""
+	return &c
+}
+
+// withoutInstanceToken returns a copy of the instance without its token, see withoutInstallationToken.
+func withoutInstanceToken(instance *connector.Instance) *connector.Instance {
+	c := *instance
+	c.Token = ""
+	return &c
+}
+
+// RemoveInstallation overrides the default implementation to also discard the quota usage of the installation.
+func (h *GiphyProvider) RemoveInstallation(installationId string) error {
+	h.quota.Remove(installationId)
+	return h.DefaultProvider.RemoveInstallation(installationId)
+}
+
+// RequestAction overrides the default implementation to remember the correlation ID of the action request.
+// The action is then executed asynchronously by the action handler, the pending action carries no token.
+func (h *GiphyProvider) RequestAction(ctx context.Context, instance *connector.Instance, actionRequest connector.ActionRequest) (connector.ActionRequestStatus, error) {
+	if h.actionLimits != nil && !h.actionLimits.Admit(instance.InstallationID) {
+		return connector.ActionRequestStatusFailed, connector.NewError(errorRateLimitedID, h.messages.Text(h.actionLocale(instance.InstallationID), messageActionRateLimited), http.StatusTooManyRequests)
+	}
+	h.correlations.Put(actionKey(actionRequest.ID), correlationID(ctx))
+	h.tracer.Put(actionKey(actionRequest.ID), spanFromContext(ctx).Context())
+
+	received := clock()
+	h.stateLock.Lock()
+	h.pendingActions[actionRequest.ID] = PendingActionInfo{
+		ID:         actionRequest.ID,
+		ActionID:   actionRequest.ActionID,
+		InstanceID: instance.ID,
+		ThingID:    actionRequest.ThingID,
+		Received:   received,
+	}
+	h.stateLock.Unlock()
+
+	// The action is stored before it is queued, so it can not be finished before it is stored
+	pendingAction := provider.PendingAction{ActionRequest: actionRequest, Instance: withoutInstanceToken(instance)}
+	h.storePendingAction(ctx, pendingAction, received)
+
+	if h.jobs != nil {
+		if err := h.jobs.Enqueue(ctx, jobKindAction, pendingAction); err != nil {
+			h.finishAction(actionRequest.ID)
+			if h.actionLimits != nil {
+				h.actionLimits.Release(instance.InstallationID)
+			}
+			return connector.ActionRequestStatusFailed, err
+		}
+		return connector.ActionRequestStatusPending, nil
+	}
+	var status connector.ActionRequestStatus
+	var err error
+	if h.channels == nil {
+		status, err = h.DefaultProvider.RequestAction(ctx, pendingAction.Instance, actionRequest)
+	} else {
+		h.channels.actions.Send(func() {
+			status, err = h.DefaultProvider.RequestAction(ctx, pendingAction.Instance, actionRequest)
+		})
+	}
+	if err != nil || status != connector.ActionRequestStatusPending {
+		h.finishAction(actionRequest.ID)
+	}
+	return status, err
+}
+
+// Run starts the periodic update and the action handler, they stop when the context is done or Stop is called.
+// Run must not be called again until the provider was stopped.
 func (h *GiphyProvider) Run(ctx context.Context) {
-	go h.periodicUpdate(ctx)
-	go h.actionHandler()
+	h.lifecycleLock.Lock()
+	defer h.lifecycleLock.Unlock()
+	h.runContext, h.cancel = context.WithCancel(ctx)
+	h.running.Add(2)
+	go func() {
+		defer h.running.Done()
+		h.periodicUpdate(h.runContext)
+	}()
+	go func() {
+		defer h.running.Done()
+		h.actionHandler(h.runContext)
+	}()
+	if h.channels != nil {
+		h.running.Add(1)
+		go func() {
+			defer h.running.Done()
+			h.sampleChannels(h.runContext)
+		}()
+	}
+	if h.fair != nil {
+		h.fair.Start(h.sendUpdate)
+	}
+}
+
+// Stop stops the periodic update and the action handler started by Run and waits until they returned.
+// An update cycle or action in progress is finished first, it returns the error of the context if that takes too long.
+// Stopping a provider which is not running does nothing.
+func (h *GiphyProvider) Stop(ctx context.Context) error {
+	h.lifecycleLock.Lock()
+	cancel := h.cancel
+	h.cancel = nil
+	h.lifecycleLock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lifecycleContext returns the context of the goroutines started by Run, which is done once the provider is stopped.
+func (h *GiphyProvider) lifecycleContext() context.Context {
+	h.lifecycleLock.Lock()
+	defer h.lifecycleLock.Unlock()
+	if h.runContext == nil {
+		return context.Background()
+	}
+	return h.runContext
+}
+
+// DrainUpdates waits until the event handler took all queued updates from the update channel and the queues of the
+// installations, e.g. before shutting down.
+// It does not wait for the update the event handler is sending at that moment.
+func (h *GiphyProvider) DrainUpdates(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for h.queuedUpdates() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d updates were not sent: %w", h.queuedUpdates(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// queuedUpdates returns the number of updates the event handler did not take yet.
+func (h *GiphyProvider) queuedUpdates() int {
+	if h.fair == nil {
+		return len(h.UpdateChannel())
+	}
+	return len(h.UpdateChannel()) + h.fair.Len()
 }
 
 // periodicUpdate starts an endless loop which will periodically update the random component of each instance
+// once its update interval passed. It sleeps until the next instance is due, pending registrations are applied
+// every minUpdateInterval and when a one-off update is requested.
 func (h *GiphyProvider) periodicUpdate(ctx context.Context) {
-	ticker := time.NewTicker(1 * time.Minute)
+	defer reportPanic(h.reporter, ErrorContext{Component: "giphy periodic update"})
+
+	applied := time.Now()
 	for {
+		timer := time.NewTimer(h.schedule.Wait(time.Now(), applied.Add(minUpdateInterval)))
 		select {
 		case <-ctx.Done():
-			ticker.Stop()
+			timer.Stop()
 			return
-		case <-ticker.C:
-			h.Update()
-
-			for _, instance := range h.Instances {
-				if len(instance.ThingMapping) <= 0 {
-					logrus.WithField("instance", instance).Info("missing thing id")
-					continue
-				}
-				randomGif, err := h.getRandomGif(instance)
-				if err != nil {
-					continue
-				}
-
-				update := connector.UpdateEvent{
-					PropertyUpdateEvent: &connector.PropertyUpdateEvent{
-						InstanceId:  instance.ID,
-						ThingId:     instance.ThingMapping[0].ThingID,
-						ComponentId: RandomComponentId,
-						PropertyId:  RandomPropertyId,
-						Value:       randomGif,
-					},
-				}
-				h.UpdateEvent(update)
-			}
-		}
-	}
-}
-
-// actionHandler will listen for and execute action requests
-func (h *GiphyProvider) actionHandler() {
-	for pendingAction := range h.ActionChannel() {
-		update := connector.UpdateEvent{
-			ActionEvent: &connector.ActionEvent{
-				InstanceId: pendingAction.Instance.ID,
-				RequestId:  pendingAction.ID,
-				Response:   &connector.ActionResponse{},
-			},
-		}
-
-		switch pendingAction.ActionID {
-		case "search":
-			keyword := pendingAction.Parameters["keyword"]
-			result, err := h.getSearchResult(pendingAction.Instance, keyword)
-
-			if err != nil {
-				update.ActionEvent.Response = &connector.ActionResponse{
-					Status: connector.ActionRequestStatusFailed,
-					Error:  err.Error(),
-				}
-				h.UpdateEvent(update)
-				continue
+		case now := <-timer.C:
+			if now.Sub(applied) >= minUpdateInterval {
+				h.update()
+				applied = now
 			}
+			h.updateDueInstances(now)
+		case <-h.schedule.Wake():
+			timer.Stop()
+			// The instance of a one-off update may have been registered since
+			h.update()
+			applied = time.Now()
+			h.updateDueInstances(applied)
+		case operation := <-h.control:
+			timer.Stop()
+			operation()
+		}
+	}
+}
 
-			update.ActionEvent.Response = &connector.ActionResponse{
-				Status: connector.ActionRequestStatusCompleted,
+// runInUpdateLoop runs the operation in the update loop and waits until it is finished.
+// It fails if the update loop does not pick up the operation in time, e.g. because it is not running.
+func (h *GiphyProvider) runInUpdateLoop(ctx context.Context, operation func()) error {
+	done := make(chan struct{})
+	select {
+	case h.control <- func() { operation(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// ApplyRegistrations applies the pending registrations without waiting for the next update cycle.
+// The service registers the installations and instances stored in the database on start, they are only known
+// to the provider once applied.
+func (h *GiphyProvider) ApplyRegistrations(ctx context.Context) error {
+	return h.runInUpdateLoop(ctx, h.update)
+}
+
+// Refresh runs an update cycle immediately instead of waiting for the next tick.
+func (h *GiphyProvider) Refresh(ctx context.Context) error {
+	return h.runInUpdateLoop(ctx, func() {
+		h.update()
+		h.updateInstances()
+	})
+}
+
+// Pause stops the periodic update of the instance until it is resumed. Actions are still executed.
+// The paused instances are not persisted, all instances are updated again after a restart.
+func (h *GiphyProvider) Pause(instanceId string) {
+	h.schedule.Pause(instanceId)
+}
+
+// Resume continues the periodic update of a paused instance with its next scheduled update.
+func (h *GiphyProvider) Resume(instanceId string) {
+	h.schedule.Resume(instanceId)
+}
+
+// Paused returns the IDs of the paused instances.
+func (h *GiphyProvider) Paused() map[string]bool {
+	return h.schedule.Paused()
+}
+
+// isPaused reports whether the periodic update of the instance is paused.
+func (h *GiphyProvider) isPaused(instanceId string) bool {
+	return h.schedule.IsPaused(instanceId)
+}
+
+// ReconcileResult lists the changes made by a reconciliation.
+type ReconcileResult struct {
+	AddedInstallations   []string `json:"addedInstallations"`
+	RemovedInstallations []string `json:"removedInstallations"`
+	AddedInstances       []string `json:"addedInstances"`
+	RemovedInstances     []string `json:"removedInstances"`
+}
+
+// Reconcile registers all installations and instances stored in the database which are not registered
+// and removes registrations which are not in the database anymore, e.g. after a failed callback or a manual database change.
+// The changes are applied in the update loop, followed by an update cycle.
+func (h *GiphyProvider) Reconcile(ctx context.Context, db connector.Database) (*ReconcileResult, error) {
+	return h.reconcile(ctx, db, true)
+}
+
+// SyncRegistrations applies the changes of Reconcile without an update cycle.
+// Sharded replicas use it to pick up installations and instances received by other replicas.
+func (h *GiphyProvider) SyncRegistrations(ctx context.Context, db connector.Database) (*ReconcileResult, error) {
+	return h.reconcile(ctx, db, false)
+}
+
+func (h *GiphyProvider) reconcile(ctx context.Context, db connector.Database, updateInstances bool) (*ReconcileResult, error) {
+	installations, err := db.GetInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := db.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReconcileResult{[]string{}, []string{}, []string{}, []string{}}
+	err = h.runInUpdateLoop(ctx, func() {
+		h.update()
+
+		stored := map[string]bool{}
+		var added []*connector.Installation
+		for _, installation := range installations {
+			stored[installation.ID] = true
+			if _, ok := h.Installations[installation.ID]; !ok {
+				added = append(added, installation)
+				result.AddedInstallations = append(result.AddedInstallations, installation.ID)
 			}
-			update.PropertyUpdateEvent = &connector.PropertyUpdateEvent{
-				ThingId:     pendingAction.Instance.ThingMapping[0].ThingID,
-				InstanceId:  pendingAction.Instance.ID,
-				ComponentId: SearchComponentId,
-				PropertyId:  SearchPropertyId,
-				Value:       result,
+		}
+		h.RegisterInstallations(added...)
+		for id := range h.Installations {
+			if !stored[id] {
+				h.RemoveInstallation(id)
+				result.RemovedInstallations = append(result.RemovedInstallations, id)
+			}
+		}
+
+		stored = map[string]bool{}
+		registered := map[string]bool{}
+		for _, instance := range h.Instances {
+			registered[instance.ID] = true
+		}
+		var addedInstances []*connector.Instance
+		for _, instance := range instances {
+			stored[instance.ID] = true
+			if !registered[instance.ID] {
+				addedInstances = append(addedInstances, instance)
+				result.AddedInstances = append(result.AddedInstances, instance.ID)
+			}
+		}
+		h.RegisterInstances(addedInstances...)
+		for id := range registered {
+			if !stored[id] {
+				h.RemoveInstance(id)
+				result.RemovedInstances = append(result.RemovedInstances, id)
+			}
+		}
+
+		h.update()
+		if updateInstances {
+			h.updateInstances()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// updateInstances sends a new random gif to each thing of the registered instances.
+// With sharding, only the instances owned by this replica are updated.
+func (h *GiphyProvider) updateInstances() {
+	// The trending GIFs are the same for all instances, they are requested once per installation and cycle, so the quota of each is used once
+	trending := map[string]string{}
+	for _, instance := range h.Instances {
+		h.updateInstance(instance, trending)
+	}
+}
+
+// updateInstance sends a new random gif and the trending gif to each thing of the instance.
+// Trending GIFs are taken from and added to the given GIFs by installation ID.
+func (h *GiphyProvider) updateInstance(instance *connector.Instance, trending map[string]string) {
+	if h.isPaused(instance.ID) || (h.shard != nil && !h.shard.Owns(instance.ID)) || (h.reauthorized != nil && h.reauthorized.NeedsReauthorization(instance.ID)) {
+		return
+	}
+	// Installations throttled by Giphy are skipped until their backoff expired
+	if h.rateLimits != nil && h.rateLimits.Paused(instance.InstallationID) {
+		return
+	}
+	// Each update of an instance is a separate operation with its own correlation ID.
+	correlationId := newCorrelationID()
+	logger := h.logger.WithField("correlationId", correlationId).WithField("instanceId", instance.ID)
+	if len(instance.ThingMapping) <= 0 {
+		logger.Info("missing thing id")
+		return
+	}
+	// The quiet hours are evaluated every cycle, invalid ones were rejected on instantiation and are ignored
+	if quiet, err := parseQuietHours(instance.Configuration); err == nil && quiet.Active(clock()) {
+		return
+	}
+	// Things of keywords get a random GIF tagged with their keyword, which is their external ID
+	for _, mapping := range instance.ThingMapping {
+		logger := logger.WithField("thingId", mapping.ThingID)
+		randomGif, err := h.getRandomGif(logger, instance, mapping.ExternalID)
+		if errors.Is(err, errGiphyRateLimited) {
+			// The requests of the installation are used up, which is not a failure of the instance
+			logger.Debugln("skipping update, Giphy rate limit reached")
+			return
+		}
+		if err != nil {
+			if h.failures.Failed(instance.ID) {
+				h.reporter.Report(fmt.Errorf("repeatedly failed to resolve random gif: %w", err), ErrorContext{
+					Component:      "giphy periodic update",
+					CorrelationID:  correlationId,
+					InstallationID: instance.InstallationID,
+					InstanceID:     instance.ID,
+					ThingID:        mapping.ThingID,
+				})
+			}
+			continue
+		}
+		h.failures.Succeeded(instance.ID)
+		h.errorLogs.Reset(instance.ID)
+
+		if err := h.checkValue(randomValueProperty, randomGif); err != nil {
+			logger.WithError(err).Warnln("skipping random gif")
+			continue
+		}
+		h.sendPropertyValue(instance.ID, mapping.ThingID, correlationId, randomValueProperty, randomGif)
+	}
+
+	trendingGif, ok := trending[instance.InstallationID]
+	if !ok {
+		if gifs, err := h.getTrendingGifs(logger, instance, 1); err == nil {
+			trendingGif = gifs[0]
+		}
+		trending[instance.InstallationID] = trendingGif
+	}
+	if trendingGif == "" || h.checkValue(trendingValueProperty, trendingGif) != nil {
+		return
+	}
+	for _, mapping := range instance.ThingMapping {
+		h.sendPropertyValue(instance.ID, mapping.ThingID, correlationId, trendingValueProperty, trendingGif)
+	}
+}
+
+// ScheduleUpdate updates the instance in the update loop as soon as possible instead of waiting for its next update,
+// e.g. to publish the first values right after its things were created. It does not wait for the update.
+// Further calls for the instance are ignored until the scheduled update ran, its next periodic update follows after its interval.
+func (h *GiphyProvider) ScheduleUpdate(instanceId string) {
+	h.schedule.RunNow(instanceId, time.Now())
+}
+
+// actionHandler will listen for and execute action requests until the context is done
+func (h *GiphyProvider) actionHandler(ctx context.Context) {
+	defer reportPanic(h.reporter, ErrorContext{Component: "giphy action handler"})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pendingAction := <-h.ActionChannel():
+			h.runAction(pendingAction)
+		}
+	}
+}
+
+// handleActionJob handles an action request enqueued by RequestAction.
+func (h *GiphyProvider) handleActionJob(ctx context.Context, payload json.RawMessage, lastAttempt bool) error {
+	var pendingAction provider.PendingAction
+	if err := json.Unmarshal(payload, &pendingAction); err != nil {
+		return err
+	}
+	h.stateLock.Lock()
+	registered := h.registeredInstallations[pendingAction.Instance.InstallationID]
+	h.stateLock.Unlock()
+	if !registered && !lastAttempt {
+		return errInstallationNotRegistered
+	}
+	h.runAction(pendingAction)
+	return nil
+}
+
+// runAction executes the action request right away or, if its installation has too many running actions, once one of them finished.
+func (h *GiphyProvider) runAction(pendingAction provider.PendingAction) {
+	if h.actionLimits == nil {
+		h.handleActionInTime(pendingAction)
+		return
+	}
+	h.actionLimits.Run(pendingAction.Instance.InstallationID, func() { h.handleActionInTime(pendingAction) })
+}
+
+// emptySearchResultConfigID is the instance configuration parameter selecting how searches without result end:
+// "fail" (the default) fails the action, "complete" completes it with an empty result and a result count of 0.
+const emptySearchResultConfigID = "empty_search_result"
+
+// Values of the empty search result parameter.
+const (
+	emptySearchResultFail     = "fail"
+	emptySearchResultComplete = "complete"
+)
+
+// completesEmptySearch reports whether searches without result complete the action of the instance.
+func completesEmptySearch(configuration []connector.Configuration) bool {
+	for _, c := range configuration {
+		if c.ID == emptySearchResultConfigID {
+			return c.Value == emptySearchResultComplete
+		}
+	}
+	return false
+}
+
+// actionUpdate adapts the result of an action request to the update event of the SDK,
+// whose action event names the action request ID RequestId and the result Response.
+func actionUpdate(instanceId string, actionRequestId string, response *connector.ActionResponse) connector.UpdateEvent {
+	return connector.UpdateEvent{
+		ActionEvent: &connector.ActionEvent{
+			InstanceId: instanceId,
+			RequestId:  actionRequestId,
+			Response:   response,
+		},
+	}
+}
+
+// handleAction executes a single action request and publishes the result.
+func (h *GiphyProvider) handleAction(pendingAction provider.PendingAction) {
+	defer h.finishAction(pendingAction.ID)
+
+	// Continue the operation started by the action request or start a new one if it is unknown.
+	correlationId := h.correlations.Take(actionKey(pendingAction.ID))
+	if correlationId == "" {
+		correlationId = newCorrelationID()
+	}
+	h.correlations.Put(actionKey(pendingAction.ID), correlationId)
+	logger := h.logger.WithField("correlationId", correlationId).WithField("actionRequestId", pendingAction.ID)
+
+	// The span continues the trace of the action request, the update of the action status continues it
+	span := h.tracer.StartLinked(actionKey(pendingAction.ID), "actionHandler "+pendingAction.ActionID, spanKindInternal)
+	defer span.End(nil)
+	span.SetAttribute("action.request_id", pendingAction.ID)
+	span.SetAttribute("correlation.id", correlationId)
+	h.tracer.Put(actionKey(pendingAction.ID), span.Context())
+
+	update := actionUpdate(pendingAction.Instance.ID, pendingAction.ID, &connector.ActionResponse{})
+
+	switch pendingAction.ActionID {
+	case "search":
+		// Things of keywords search for their keyword if the action request has none
+		keyword := pendingAction.Parameters["keyword"]
+		if keyword == "" {
+			keyword = thingKeyword(pendingAction.Instance, pendingAction.ThingID)
+		}
+		giphySpan := h.tracer.Child(span, "giphy search", spanKindClient)
+		result, cached, err := h.getSearchResult(logger, pendingAction.Instance, keyword)
+		giphySpan.SetAttribute("cache.hit", strconv.FormatBool(cached))
+		giphySpan.End(err)
+		// Instances can treat a search without result as valid outcome instead of a failure
+		results := searchResults{Keyword: keyword, Results: []searchResult{result}}
+		count := "1"
+		if errors.Is(err, errNoSearchResult) && completesEmptySearch(pendingAction.Instance.Configuration) {
+			results.Results, count, err = []searchResult{}, "0", nil
+		}
+		if h.searchCache != nil && err == nil {
+			cache := "miss"
+			if cached {
+				cache = "hit"
+			}
+			h.annotateAction(pendingAction.ID, "searchCache", cache)
+		}
+
+		// Values exceeding the maximum length fail the action instead of being rejected by connctd
+		var resultsValue string
+		var truncated bool
+		if err == nil {
+			err = h.checkValue(searchValueProperty, result.URL)
+		}
+		if err == nil {
+			if resultsValue, truncated, err = h.marshalSearchResults(results); err != nil && !errors.Is(err, errValueTooLong) {
+				logger.WithError(err).Errorln("failed to send search results")
+				resultsValue, err = "", nil
+			}
+		}
+
+		if err != nil {
+			if h.failures.Failed(pendingAction.Instance.ID) {
+				h.reporter.Report(fmt.Errorf("repeatedly failed to search: %w", err), ErrorContext{
+					Component:       "giphy action handler",
+					CorrelationID:   correlationId,
+					InstallationID:  pendingAction.Instance.InstallationID,
+					InstanceID:      pendingAction.Instance.ID,
+					ThingID:         pendingAction.ThingID,
+					ActionRequestID: pendingAction.ID,
+				})
+			}
+			if !h.claimActionResult(logger, pendingAction.ID) {
+				return
+			}
+			update.ActionEvent.Response = &connector.ActionResponse{
+				Status: connector.ActionRequestStatusFailed,
+				Error:  h.messages.ActionError(h.actionLocale(pendingAction.Instance.InstallationID), err),
 			}
 			h.UpdateEvent(update)
+			return
+		}
+
+		if !h.claimActionResult(logger, pendingAction.ID) {
+			return
+		}
+
+		// The count and the structured results are sent first, so they are up to date when the action is completed together with the result
+		h.sendPropertyValue(pendingAction.Instance.ID, pendingAction.ThingID, correlationId, searchResultCountProperty, count)
+		if resultsValue != "" {
+			h.sendPropertyValue(pendingAction.Instance.ID, pendingAction.ThingID, correlationId, searchResultsProperty, resultsValue)
+			h.sendPropertyValue(pendingAction.Instance.ID, pendingAction.ThingID, correlationId, searchResultsTruncatedProperty, strconv.FormatBool(truncated))
+		}
 
-		default:
+		update.ActionEvent.Response = &connector.ActionResponse{
+			Status: connector.ActionRequestStatusCompleted,
+		}
+		update.PropertyUpdateEvent = searchValueProperty.Event(pendingAction.Instance.ID, pendingAction.ThingID, result.URL)
+		h.correlations.Put(searchValueProperty.correlationKey(pendingAction.ThingID), correlationId)
+		h.UpdateEvent(update)
+
+	case TranslateActionId:
+		giphySpan := h.tracer.Child(span, "giphy translate", spanKindClient)
+		result, cached, err := h.getTranslation(logger, pendingAction.Instance, pendingAction.Parameters[TranslateActionParameterId])
+		giphySpan.SetAttribute("cache.hit", strconv.FormatBool(cached))
+		giphySpan.End(err)
+		if h.searchCache != nil && err == nil {
+			cache := "miss"
+			if cached {
+				cache = "hit"
+			}
+			h.annotateAction(pendingAction.ID, "translateCache", cache)
+		}
+		if err == nil {
+			err = h.checkValue(translateValueProperty, result.URL)
+		}
+		if err != nil {
+			if h.failures.Failed(pendingAction.Instance.ID) {
+				h.reporter.Report(fmt.Errorf("repeatedly failed to translate: %w", err), ErrorContext{
+					Component:       "giphy action handler",
+					CorrelationID:   correlationId,
+					InstallationID:  pendingAction.Instance.InstallationID,
+					InstanceID:      pendingAction.Instance.ID,
+					ThingID:         pendingAction.ThingID,
+					ActionRequestID: pendingAction.ID,
+				})
+			}
+			if !h.claimActionResult(logger, pendingAction.ID) {
+				return
+			}
 			update.ActionEvent.Response = &connector.ActionResponse{
 				Status: connector.ActionRequestStatusFailed,
-				Error:  "Action not supported",
+				Error:  h.messages.ActionError(h.actionLocale(pendingAction.Instance.InstallationID), err),
 			}
 			h.UpdateEvent(update)
+			return
+		}
+
+		if !h.claimActionResult(logger, pendingAction.ID) {
+			return
+		}
+		update.ActionEvent.Response = &connector.ActionResponse{
+			Status: connector.ActionRequestStatusCompleted,
+		}
+		update.PropertyUpdateEvent = translateValueProperty.Event(pendingAction.Instance.ID, pendingAction.ThingID, result.URL)
+		h.correlations.Put(translateValueProperty.correlationKey(pendingAction.ThingID), correlationId)
+		h.UpdateEvent(update)
+
+	default:
+		if !h.claimActionResult(logger, pendingAction.ID) {
+			return
+		}
+		update.ActionEvent.Response = &connector.ActionResponse{
+			Status: connector.ActionRequestStatusFailed,
+			Error:  h.messages.Text(h.actionLocale(pendingAction.Instance.InstallationID), messageActionNotSupported),
 		}
+		h.UpdateEvent(update)
 	}
 }
 
-// setApiKey will set the Giphy API key to the one configured for installation with the given ID.
-// It returns an error if either the installation is not registered or has no API key configuration parameter.
-// We potentially have multiple goroutines access the Giphy API client and calling this method.
-// Therefore we protect it with a mutex which should be locked before calling this.
-// See getRandomGif or getSearchResult for details.
-// Alternatively we could create and use one API client per installation.
-func (h *GiphyProvider) setApiKey(installationId string) error {
-	installation, ok := h.Installations[installationId]
-	if !ok {
-		return errors.New("installation not registered")
-	}
-	key, ok := installation.GetConfig("giphy_api_key")
-	if !ok {
-		return errors.New("could not find api key")
+// thingKeyword returns the keyword of the thing of the instance, which is its external ID, or an empty string if it has none.
+func thingKeyword(instance *connector.Instance, thingId string) string {
+	for _, mapping := range instance.ThingMapping {
+		if mapping.ThingID == thingId {
+			return mapping.ExternalID
+		}
 	}
+	return ""
+}
 
-	h.giphyClient.APIKey = key.Value
-	return nil
+// sendPropertyValue sends a value of a property of the thing as part of the operation with the given correlation ID.
+func (h *GiphyProvider) sendPropertyValue(instanceId string, thingId string, correlationId string, property propertyRef, value string) {
+	h.correlations.Put(property.correlationKey(thingId), correlationId)
+	h.UpdateEvent(connector.UpdateEvent{
+		PropertyUpdateEvent: property.Event(instanceId, thingId, value),
+	})
 }
 
-// getRandomGif uses the Giphy API to return a new random gif.
-func (h *GiphyProvider) getRandomGif(instance *connector.Instance) (string, error) {
+// actionLocale returns the locale configured for the installation with the given ID, or the default locale.
+func (h *GiphyProvider) actionLocale(installationId string) string {
 	h.clientLock.Lock()
 	defer h.clientLock.Unlock()
-	if err := h.setApiKey(instance.InstallationID); err != nil {
-		logrus.WithError(err).Errorln("failed to set API key for " + instance.InstallationID)
+	var configuration []connector.Configuration
+	if installation, ok := h.Installations[installationId]; ok {
+		configuration = installation.Configuration
+	}
+	return h.messages.Locale(configuration)
+}
+
+// ValidateApiKey requests a trending GIF with the key and returns errApiKeyRejected if Giphy rejects it.
+// The request is not counted in the quota of any installation.
+func (h *GiphyProvider) ValidateApiKey(ctx context.Context, key string) error {
+	h.clientLock.Lock()
+	client := *h.giphyClient
+	h.clientLock.Unlock()
+
+	client.APIKey = key
+	req, err := client.NewRequest("/gifs/trending?limit=1")
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Meta giphyClient.Meta `json:"meta"`
+	}
+	resp, err := client.Do(req.WithContext(ctx), &response)
+	if err != nil {
+		return err
+	}
+	status := resp.StatusCode
+	if response.Meta.Status != 0 {
+		status = response.Meta.Status
+	}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errApiKeyRejected
+	case status != http.StatusOK:
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	return nil
+}
+
+// SetApiKey replaces the Giphy API key of the installation, it is used from the next request on.
+func (h *GiphyProvider) SetApiKey(ctx context.Context, installationId string, key string) error {
+	config := connector.Configuration{ID: giphyApiKeyConfigID, Value: key}
+	return h.runInUpdateLoop(ctx, func() {
+		h.clientLock.Lock()
+		installation, ok := h.Installations[installationId]
+		if ok {
+			installation.Configuration = replaceConfiguration(installation.Configuration, config)
+		}
+		h.clientLock.Unlock()
+		if ok {
+			h.setInstallationClient(installation)
+		}
+
+		h.registrationLock.Lock()
+		for _, installation := range h.newInstallations {
+			if installation.ID == installationId {
+				installation.Configuration = replaceConfiguration(installation.Configuration, config)
+			}
+		}
+		h.registrationLock.Unlock()
+	})
+}
+
+// recordRequest is called before each Giphy request of the installation. It returns errGiphyRateLimited
+// instead of recording the request if the installation is rate limited.
+func (h *GiphyProvider) recordRequest(installationId string) error {
+	if h.rateLimits != nil {
+		if err := h.rateLimits.Allow(installationId); err != nil {
+			return err
+		}
+	}
+	h.quota.Record(installationId)
+	return nil
+}
+
+// getRandomGif uses the Giphy API to return a new random gif, tagged with the keyword if it is not empty
+// or else with one of the random tags of the instance.
+func (h *GiphyProvider) getRandomGif(logger *logrus.Entry, instance *connector.Instance, keyword string) (string, error) {
+	if keyword == "" {
+		keyword = randomTag(instance.Configuration)
+	}
+	c, err := h.installationClient(instance.InstallationID)
+	if err != nil {
+		h.errorLogs.Error(logger, instance.ID, err, "failed to get Giphy client for "+instance.InstallationID)
 		return "", err
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	random, err := h.giphyClient.Random([]string{})
+	if err := h.recordRequest(instance.InstallationID); err != nil {
+		return "", err
+	}
+	tags := []string{}
+	if keyword != "" {
+		// The client does not escape the tag
+		tags = append(tags, url.QueryEscape(keyword))
+	}
+	random, err := c.client.Random(tags)
 	if err != nil {
-		logrus.WithError(err).Errorln("Failed to resolve random gif")
+		h.errorLogs.Error(logger, instance.ID, err, "Failed to resolve random gif")
 		return "", err
 	}
 	return random.Data.URL, nil
 }
 
+// getTrendingGifs uses the Giphy API to get the URLs of the given number of currently trending GIFs, the top one first.
+func (h *GiphyProvider) getTrendingGifs(logger *logrus.Entry, instance *connector.Instance, limit int) ([]string, error) {
+	c, err := h.installationClient(instance.InstallationID)
+	if err != nil {
+		h.errorLogs.Error(logger, instance.ID, err, "failed to get Giphy client for "+instance.InstallationID)
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.client.Limit = limit
+	if err := h.recordRequest(instance.InstallationID); err != nil {
+		return nil, err
+	}
+	trending, err := c.client.Trending()
+	if err != nil {
+		h.errorLogs.Error(logger, instance.ID, err, "Failed to resolve trending gifs")
+		return nil, err
+	}
+	gifs := make([]string, 0, len(trending.Data))
+	for _, gif := range trending.Data {
+		gifs = append(gifs, gif.URL)
+	}
+	return gifs, nil
+}
+
+// getTranslation uses the Giphy Translate API to get the GIF for the phrase.
+// The second result reports whether the result was taken from the search cache.
+func (h *GiphyProvider) getTranslation(logger *logrus.Entry, instance *connector.Instance, phrase string) (searchResult, bool, error) {
+	if strings.TrimSpace(phrase) == "" {
+		return searchResult{}, false, errMissingPhrase
+	}
+	c, err := h.installationClient(instance.InstallationID)
+	if err != nil {
+		h.errorLogs.Error(logger, instance.ID, err, "failed to get Giphy client for "+instance.InstallationID)
+		return searchResult{}, false, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if h.searchCache != nil {
+		if cached, ok := h.searchCache.GetTranslation(phrase, c.client.Rating, searchLanguage); ok {
+			logger.WithField("phrase", phrase).WithField("url", cached.URL).Info("Translation finished with cached result")
+			return cached, true, nil
+		}
+	}
+
+	if err := h.recordRequest(instance.InstallationID); err != nil {
+		return searchResult{}, false, err
+	}
+	// The client does not escape the phrase
+	translation, err := c.client.Translate([]string{url.QueryEscape(phrase)})
+	if errors.Is(err, giphyClient.ErrNoImageFound) || errors.Is(err, giphyClient.ErrNoRawData) {
+		return searchResult{}, false, errNoTranslation
+	}
+	if err != nil {
+		return searchResult{}, false, err
+	}
+	logger.WithField("phrase", phrase).WithField("url", translation.Data.URL).Info("Translation finished")
+	found := searchResult{ID: translation.Data.ID, URL: translation.Data.URL, Rating: translation.Data.Rating}
+	if h.searchCache != nil {
+		h.searchCache.SetTranslation(phrase, c.client.Rating, searchLanguage, found)
+	}
+	return found, false, nil
+}
+
 // getSearchResult uses the Giphy API to search for the given keyword.
-func (h *GiphyProvider) getSearchResult(instance *connector.Instance, keyword string) (string, error) {
-	h.clientLock.Lock()
-	defer h.clientLock.Unlock()
-	if err := h.setApiKey(instance.InstallationID); err != nil {
-		logrus.WithError(err).Errorln("failed to set API key for " + instance.InstallationID)
-		return "", err
+// The second result reports whether the result was taken from the search cache or the search throttle.
+func (h *GiphyProvider) getSearchResult(logger *logrus.Entry, instance *connector.Instance, keyword string) (searchResult, bool, error) {
+	c, err := h.installationClient(instance.InstallationID)
+	if err != nil {
+		h.errorLogs.Error(logger, instance.ID, err, "failed to get Giphy client for "+instance.InstallationID)
+		return searchResult{}, false, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var throttleWindow time.Duration
+	if h.throttle != nil {
+		throttleWindow = h.throttle.Window(c.configuration)
+		if throttleWindow > 0 {
+			if previous, ok := h.throttle.Get(instance.InstallationID, keyword, c.client.Rating); ok {
+				logger.WithField("keyword", keyword).WithField("url", previous.URL).Info("Search throttled, using the previous result")
+				return previous, true, nil
+			}
+		}
 	}
 
-	h.giphyClient.Limit = 1
-	result, err := h.giphyClient.Search([]string{keyword})
+	if h.searchCache != nil {
+		if cached, ok := h.searchCache.Get(keyword, c.client.Rating, searchLanguage); ok {
+			logger.WithField("keyword", keyword).WithField("url", cached.URL).Info("Search finished with cached result")
+			if h.throttle != nil {
+				h.throttle.Set(instance.InstallationID, keyword, c.client.Rating, throttleWindow, cached)
+			}
+			return cached, true, nil
+		}
+	}
+
+	c.client.Limit = 1
+	if err := h.recordRequest(instance.InstallationID); err != nil {
+		return searchResult{}, false, err
+	}
+	// The client does not escape the keyword
+	result, err := c.client.Search([]string{url.QueryEscape(keyword)})
 	if err != nil {
-		return "", err
+		return searchResult{}, false, err
 	}
 	if len(result.Data) <= 0 {
-		return "", errors.New("no search result found")
+		return searchResult{}, false, errNoSearchResult
 	}
 
-	logrus.WithField("keyword", keyword).WithField("searchResult", result.Data).WithField("url", result.Data[0].URL).Info("Search finished")
-	return result.Data[0].URL, nil
+	logger.WithField("keyword", keyword).WithField("searchResult", result.Data).WithField("url", result.Data[0].URL).Info("Search finished")
+	found := searchResult{ID: result.Data[0].ID, URL: result.Data[0].URL, Rating: result.Data[0].Rating}
+	if h.searchCache != nil {
+		h.searchCache.Set(keyword, c.client.Rating, searchLanguage, found)
+	}
+	if h.throttle != nil {
+		h.throttle.Set(instance.InstallationID, keyword, c.client.Rating, throttleWindow, found)
+	}
+	return found, false, nil
 }
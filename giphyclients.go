@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/connctd/connector-go"
+	giphyClient "github.com/peterhellberg/giphy"
+)
+
+// installationClient is the Giphy client of an installation, configured with its API key and rating.
+// Requests of different installations run concurrently, the requests of an installation are serialized by the lock,
+// since the limit of the client is set for each request.
+type installationClient struct {
+	lock          sync.Mutex
+	client        *giphyClient.Client
+	configuration []connector.Configuration
+}
+
+// copyGiphyClient returns a copy of the template client sending its requests with the given transport.
+func copyGiphyClient(template *giphyClient.Client, transport http.RoundTripper) *giphyClient.Client {
+	client := giphyClient.NewClient(&http.Client{Transport: transport})
+	client.APIKey = template.APIKey
+	client.Limit = template.Limit
+	client.Rating = template.Rating
+	client.BaseURL = template.BaseURL
+	client.BasePath = template.BasePath
+	client.UserAgent = template.UserAgent
+	return client
+}
+
+// newInstallationClient returns a copy of the template client with the API key and rating of the installation.
+// It returns errMissingApiKey if the installation has no API key configuration parameter.
+// Installations without a valid rating use the default rating.
+// With a rate limiter, the responses are reported to it, so 429 responses pause the requests of the installation.
+func (h *GiphyProvider) newInstallationClient(installation *connector.Installation) (*installationClient, error) {
+	key, ok := installation.GetConfig(giphyApiKeyConfigID)
+	if !ok {
+		return nil, errMissingApiKey
+	}
+	client := *h.giphyClient
+	if h.rateLimits != nil {
+		client = *copyGiphyClient(h.giphyClient, &rateLimitTransport{h.transport, installation.ID, h.rateLimits})
+	}
+	client.APIKey = key.Value
+	client.Rating = h.installationRating(installation)
+	return &installationClient{client: &client, configuration: installation.Configuration}, nil
+}
+
+// installationRating returns the rating the GIFs of the installation are limited to, the default rating if it has no valid one.
+func (h *GiphyProvider) installationRating(installation *connector.Installation) string {
+	if config, ok := installation.GetConfig(giphyRatingConfigID); ok {
+		if rating, ok := giphyRating(config.Value); ok {
+			return rating
+		}
+	}
+	return h.defaultRating
+}
+
+// SetDefaultRating sets the rating of installations without valid rating configuration parameter.
+// Must be called before the provider is started.
+func (h *GiphyProvider) SetDefaultRating(rating string) {
+	h.defaultRating = rating
+}
+
+// setInstallationClient creates the client of the installation when it is registered or its configuration changed.
+// Installations without API key get no client, their requests fail with errMissingApiKey.
+func (h *GiphyProvider) setInstallationClient(installation *connector.Installation) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	client, err := h.newInstallationClient(installation)
+	if err != nil {
+		delete(h.clients, installation.ID)
+		return
+	}
+	h.clients[installation.ID] = client
+}
+
+// removeInstallationClients drops the clients of installations which are not registered anymore.
+func (h *GiphyProvider) removeInstallationClients() {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	for id := range h.clients {
+		if _, ok := h.Installations[id]; !ok {
+			delete(h.clients, id)
+			if h.rateLimits != nil {
+				h.rateLimits.Remove(id)
+			}
+		}
+	}
+}
+
+// resetInstallationClients recreates the clients of all registered installations from the template client,
+// e.g. after its base URL, transport or rate limiter changed.
+func (h *GiphyProvider) resetInstallationClients() {
+	h.clients = make(map[string]*installationClient, len(h.Installations))
+	for _, installation := range h.Installations {
+		if client, err := h.newInstallationClient(installation); err == nil {
+			h.clients[installation.ID] = client
+		}
+	}
+}
+
+// installationClient returns the client of the installation with the given ID.
+// It returns an error if either the installation is not registered or has no API key configuration parameter.
+func (h *GiphyProvider) installationClient(installationId string) (*installationClient, error) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+	if client, ok := h.clients[installationId]; ok {
+		return client, nil
+	}
+	if _, ok := h.Installations[installationId]; ok {
+		return nil, errMissingApiKey
+	}
+	return nil, errInstallationNotRegistered
+}
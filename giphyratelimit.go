@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/sirupsen/logrus"
+)
+
+// errGiphyRateLimited is returned instead of sending a Giphy request while the installation is rate limited.
+var errGiphyRateLimited = errors.New("giphy rate limit reached")
+
+const (
+	// initialGiphyBackoff is how long the requests of an installation are paused after its first 429 response.
+	// The pause doubles with each further 429 response up to maxGiphyBackoff and is reset by the first successful request.
+	initialGiphyBackoff = time.Minute
+	maxGiphyBackoff     = time.Hour
+	// thingStatusTimeout is how long the thing statuses of a rate limited installation may take to update.
+	thingStatusTimeout = 30 * time.Second
+)
+
+// giphyRateLimiter limits the Giphy requests of each installation, since beta keys only allow a few requests per hour.
+// Requests are taken from a bucket per installation which is refilled evenly over the hour. When Giphy answers with
+// 429 Too Many Requests anyway, e.g. because the key is shared, the requests of the installation are paused with an
+// exponential backoff, or for as long as Giphy asks in the Retry-After header.
+type giphyRateLimiter struct {
+	requestsPerHour int
+	logger          *logrus.Logger
+	rejected        *metricVec
+	throttled       *metricVec
+	paused          *metricVec
+
+	lock      sync.Mutex
+	limits    map[string]*installationRateLimit
+	listeners []func(installationId string, throttled bool)
+}
+
+type installationRateLimit struct {
+	tokens  float64
+	updated time.Time
+	// backoff is the current pause after a 429 response, zero if the installation is not throttled by Giphy.
+	backoff time.Duration
+	until   time.Time
+}
+
+// newGiphyRateLimiter returns a rate limiter allowing each installation the given number of requests per hour,
+// 0 only pauses installations after 429 responses.
+func newGiphyRateLimiter(requestsPerHour int, logger *logrus.Logger, metrics *metricsRegistry) *giphyRateLimiter {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &giphyRateLimiter{
+		requestsPerHour: requestsPerHour,
+		logger:          logger,
+		rejected:        metrics.Counter("giphy_requests_rate_limited_total", "Number of Giphy requests not sent because the installation was rate limited."),
+		throttled:       metrics.Counter("giphy_responses_throttled_total", "Number of Giphy responses with status 429 Too Many Requests."),
+		paused:          metrics.Gauge("giphy_installations_throttled", "Number of installations whose requests are paused after a 429 response."),
+		limits:          map[string]*installationRateLimit{},
+	}
+}
+
+// OnThrottle registers a listener called when the requests of an installation are paused after a 429 response and when
+// they are resumed after a successful request. Listeners must not block, since they are called while a request is sent.
+func (l *giphyRateLimiter) OnThrottle(listener func(installationId string, throttled bool)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.listeners = append(l.listeners, listener)
+}
+
+func (l *giphyRateLimiter) limit(installationId string, now time.Time) *installationRateLimit {
+	limit, ok := l.limits[installationId]
+	if !ok {
+		limit = &installationRateLimit{tokens: float64(l.requestsPerHour), updated: now}
+		l.limits[installationId] = limit
+	}
+	if l.requestsPerHour > 0 && now.After(limit.updated) {
+		limit.tokens += now.Sub(limit.updated).Hours() * float64(l.requestsPerHour)
+		if limit.tokens > float64(l.requestsPerHour) {
+			limit.tokens = float64(l.requestsPerHour)
+		}
+	}
+	limit.updated = now
+	return limit
+}
+
+// Allow takes a request of the installation from its bucket. It returns errGiphyRateLimited if the bucket is empty
+// or the requests of the installation are paused.
+func (l *giphyRateLimiter) Allow(installationId string) error {
+	now := clock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit := l.limit(installationId, now)
+	if now.Before(limit.until) || (l.requestsPerHour > 0 && limit.tokens < 1) {
+		l.rejected.Inc()
+		return errGiphyRateLimited
+	}
+	if l.requestsPerHour > 0 {
+		limit.tokens--
+	}
+	return nil
+}
+
+// Paused reports whether the requests of the installation are paused after a 429 response.
+// The periodic update skips paused installations.
+func (l *giphyRateLimiter) Paused(installationId string) bool {
+	now := clock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limit, ok := l.limits[installationId]
+	return ok && now.Before(limit.until)
+}
+
+// Observe records the response of a Giphy request of the installation. A 429 response pauses its requests,
+// a successful one resumes them.
+func (l *giphyRateLimiter) Observe(installationId string, status int, retryAfter string) {
+	now := clock()
+	l.lock.Lock()
+	limit := l.limit(installationId, now)
+	var changed, throttled bool
+	switch {
+	case status == http.StatusTooManyRequests:
+		l.throttled.Inc()
+		changed, throttled = limit.backoff == 0, true
+		limit.backoff *= 2
+		if limit.backoff < initialGiphyBackoff {
+			limit.backoff = initialGiphyBackoff
+		}
+		if limit.backoff > maxGiphyBackoff {
+			limit.backoff = maxGiphyBackoff
+		}
+		pause := limit.backoff
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && time.Duration(seconds)*time.Second > pause {
+			pause = time.Duration(seconds) * time.Second
+		}
+		limit.until = now.Add(pause)
+		// The requests taken from the bucket were not counted by Giphy, so it is not refilled
+		limit.tokens = 0
+		l.logger.WithField("installationId", installationId).WithField("until", limit.until).Warnln("Giphy rate limit reached, pausing requests of the installation")
+	case status >= 200 && status < 300 && limit.backoff > 0:
+		changed = true
+		limit.backoff = 0
+		limit.until = time.Time{}
+		l.logger.WithField("installationId", installationId).Infoln("Giphy rate limit recovered, resuming requests of the installation")
+	}
+	switch {
+	case changed && throttled:
+		l.paused.Add(1)
+	case changed:
+		l.paused.Add(-1)
+	}
+	listeners := l.listeners
+	l.lock.Unlock()
+
+	if changed {
+		for _, listener := range listeners {
+			listener(installationId, throttled)
+		}
+	}
+}
+
+// Remove forgets the state of an installation which is not registered anymore.
+func (l *giphyRateLimiter) Remove(installationId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limit, ok := l.limits[installationId]; ok && limit.backoff > 0 {
+		l.paused.Add(-1)
+	}
+	delete(l.limits, installationId)
+}
+
+// rateLimitTransport reports the status of each Giphy response of an installation to the rate limiter.
+// 429 responses fail with errGiphyRateLimited, since the client would decode them as empty results.
+type rateLimitTransport struct {
+	base           http.RoundTripper
+	installationId string
+	limits         *giphyRateLimiter
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	t.limits.Observe(t.installationId, resp.StatusCode, resp.Header.Get("Retry-After"))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		return nil, errGiphyRateLimited
+	}
+	return resp, nil
+}
+
+// thingStatusUpdater returns a listener setting the things of the installation's instances to unavailable while its
+// requests are paused after a 429 response, and to available again once they are resumed.
+// The statuses are updated in the background, since the listener is called while a Giphy request is sent.
+func thingStatusUpdater(db connector.Database, client connector.Client) func(installationId string, throttled bool) {
+	return func(installationId string, throttled bool) {
+		status := connctd.StatusTypeAvailable
+		if throttled {
+			status = connctd.StatusTypeUnavailable
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), thingStatusTimeout)
+			defer cancel()
+			instances, err := db.GetInstances(ctx)
+			if err != nil {
+				logrus.WithError(err).WithField("installationId", installationId).Warnln("failed to get instances to update the thing status")
+				return
+			}
+			for _, instance := range instances {
+				if instance.InstallationID != installationId {
+					continue
+				}
+				for _, mapping := range instance.ThingMapping {
+					if err := client.UpdateThingStatus(ctx, instance.Token, mapping.ThingID, status); err != nil {
+						logrus.WithError(err).WithField("instanceId", instance.ID).WithField("thingId", mapping.ThingID).Warnln("failed to update thing status")
+					}
+				}
+			}
+		}()
+	}
+}
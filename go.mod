@@ -6,7 +6,13 @@ require github.com/sirupsen/logrus v1.8.1
 
 require (
 	github.com/connctd/connector-go v0.3.0
-	github.com/go-logr/stdr v0.3.0 // indirect
+	github.com/go-logr/logr v0.3.0
+	github.com/go-logr/stdr v0.3.0
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/gorilla/mux v1.8.0
+	github.com/jmoiron/sqlx v1.3.4
+	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/peterhellberg/giphy v0.0.0-20171214132724-091ba7d7516d
 	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
 )
@@ -16,10 +22,4 @@ require (
 	github.com/db-journey/migrate/v2 v2.0.4 // indirect
 	github.com/db-journey/mysql-driver v1.0.1 // indirect
 	github.com/db-journey/postgresql-driver v0.0.0-20190914135041-b502d4210454 // indirect
-	github.com/go-logr/logr v0.3.0 // indirect
-	github.com/go-sql-driver/mysql v1.5.0 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/jmoiron/sqlx v1.3.4 // indirect
-	github.com/lib/pq v1.2.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.6 // indirect
 )
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of GraphQL needed for a read API: queries with fields, aliases,
+// arguments and variables. Fragments, directives, mutations and introspection are not supported.
+
+// gqlField is a field of a GraphQL object type.
+// Fields without type are scalars, list fields resolve to slices of their type.
+type gqlField struct {
+	typ  string
+	args map[string]string
+}
+
+// gqlSchema maps type names to their fields. The root type is Query.
+type gqlSchema map[string]map[string]gqlField
+
+// gqlResolver resolves a field of the Query type with the given arguments.
+// The result is converted to JSON and the selection is applied to it.
+type gqlResolver func(field string, args map[string]interface{}) (interface{}, error)
+
+// gqlSelection is a field of a selection set.
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]gqlValue
+	selections []gqlSelection
+}
+
+// gqlValue is an argument value, either a literal or a variable reference.
+type gqlValue struct {
+	variable string
+	literal  interface{}
+}
+
+// gqlOperation is a parsed query.
+type gqlOperation struct {
+	defaults   map[string]interface{}
+	selections []gqlSelection
+}
+
+// gqlError is an entry of the errors of a GraphQL response.
+type gqlError struct {
+	Message string `json:"message"`
+}
+
+// gqlResponse is the response of a GraphQL request.
+type gqlResponse struct {
+	Data   *gqlObject `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// gqlObject is a JSON object which keeps the order of the selection.
+type gqlObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *gqlObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// executeGraphQL parses and executes the query.
+// Parse and validation errors are returned in the errors of the response without data.
+func executeGraphQL(schema gqlSchema, resolve gqlResolver, query string, variables map[string]interface{}) gqlResponse {
+	op, err := parseGraphQL(query)
+	if err != nil {
+		return gqlResponse{Errors: []gqlError{{err.Error()}}}
+	}
+	if err := schema.validate("Query", op.selections); err != nil {
+		return gqlResponse{Errors: []gqlError{{err.Error()}}}
+	}
+
+	data := &gqlObject{values: map[string]interface{}{}}
+	var errs []gqlError
+	for _, sel := range op.selections {
+		key := sel.key()
+		if sel.name == "__typename" {
+			data.set(key, "Query")
+			continue
+		}
+		args, err := sel.resolveArgs(schema["Query"][sel.name].args, variables, op.defaults)
+		if err != nil {
+			errs = append(errs, gqlError{err.Error()})
+			data.set(key, nil)
+			continue
+		}
+		value, err := resolve(sel.name, args)
+		if err != nil {
+			errs = append(errs, gqlError{fmt.Sprintf("%s: %s", key, err.Error())})
+			data.set(key, nil)
+			continue
+		}
+		// The resolved values are converted to plain JSON values, so the selection is applied to the JSON field names.
+		b, err := json.Marshal(value)
+		if err != nil {
+			errs = append(errs, gqlError{fmt.Sprintf("%s: %s", key, err.Error())})
+			data.set(key, nil)
+			continue
+		}
+		var plain interface{}
+		json.Unmarshal(b, &plain)
+		data.set(key, schema.project(schema["Query"][sel.name].typ, plain, sel.selections))
+	}
+	return gqlResponse{Data: data, Errors: errs}
+}
+
+// validate checks that all selected fields exist and object fields have a selection.
+func (s gqlSchema) validate(typ string, selections []gqlSelection) error {
+	for _, sel := range selections {
+		if sel.name == "__typename" {
+			continue
+		}
+		field, ok := s[typ][sel.name]
+		if !ok {
+			return fmt.Errorf("cannot query field %q on type %q", sel.name, typ)
+		}
+		for name := range sel.args {
+			if _, ok := field.args[name]; !ok {
+				return fmt.Errorf("unknown argument %q on field %q of type %q", name, sel.name, typ)
+			}
+		}
+		if field.typ == "" && len(sel.selections) > 0 {
+			return fmt.Errorf("field %q of type %q is a scalar and must not have a selection", sel.name, typ)
+		}
+		if field.typ != "" && len(sel.selections) == 0 {
+			return fmt.Errorf("field %q of type %q must have a selection", sel.name, typ)
+		}
+		if field.typ != "" {
+			if err := s.validate(field.typ, sel.selections); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// project applies the selection to a plain JSON value of the given type.
+func (s gqlSchema) project(typ string, value interface{}, selections []gqlSelection) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = s.project(typ, item, selections)
+		}
+		return list
+	case map[string]interface{}:
+		o := &gqlObject{values: map[string]interface{}{}}
+		for _, sel := range selections {
+			if sel.name == "__typename" {
+				o.set(sel.key(), typ)
+				continue
+			}
+			o.set(sel.key(), s.project(s[typ][sel.name].typ, v[sel.name], sel.selections))
+		}
+		return o
+	default:
+		return v
+	}
+}
+
+func (sel gqlSelection) key() string {
+	if sel.alias != "" {
+		return sel.alias
+	}
+	return sel.name
+}
+
+// resolveArgs replaces variables with their values and checks the types of the arguments.
+// Numbers are passed as int for Int arguments.
+func (sel gqlSelection) resolveArgs(types map[string]string, variables map[string]interface{}, defaults map[string]interface{}) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, arg := range sel.args {
+		value := arg.literal
+		if arg.variable != "" {
+			var ok bool
+			if value, ok = variables[arg.variable]; !ok {
+				if value, ok = defaults[arg.variable]; !ok {
+					return nil, fmt.Errorf("variable $%s is not defined", arg.variable)
+				}
+			}
+		}
+		if value == nil {
+			continue
+		}
+
+		valid := false
+		switch types[name] {
+		case "String":
+			_, valid = value.(string)
+		case "Boolean":
+			_, valid = value.(bool)
+		case "Int":
+			if f, ok := value.(float64); ok && f == float64(int(f)) {
+				value, valid = int(f), true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("argument %q of field %q must be of type %s", name, sel.name, types[name])
+		}
+		args[name] = value
+	}
+	return args, nil
+}
+
+// gqlParser is a recursive descent parser of GraphQL queries.
+type gqlParser struct {
+	src string
+	pos int
+	tok string
+	str bool
+}
+
+// parseGraphQL parses a query consisting of a single operation.
+func parseGraphQL(query string) (*gqlOperation, error) {
+	p := &gqlParser{src: query}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	op := &gqlOperation{defaults: map[string]interface{}{}}
+
+	if !p.str {
+		switch p.tok {
+		case "query":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if isGraphQLName(p.tok) && !p.str {
+				if err := p.next(); err != nil {
+					return nil, err
+				}
+			}
+			if p.tok == "(" && !p.str {
+				if err := p.parseVariableDefinitions(op.defaults); err != nil {
+					return nil, err
+				}
+			}
+		case "mutation", "subscription":
+			return nil, fmt.Errorf("%s operations are not supported", p.tok)
+		}
+	}
+
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" || p.str {
+		return nil, fmt.Errorf("syntax error: unexpected %q after the operation, only a single operation is supported", p.tok)
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *gqlParser) expect(tok string) error {
+	if p.tok != tok || p.str {
+		if p.tok == "" && !p.str {
+			return fmt.Errorf("syntax error: expected %q, got end of query", tok)
+		}
+		return fmt.Errorf("syntax error: expected %q, got %q", tok, p.tok)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.str || !isGraphQLName(p.tok) {
+		return "", fmt.Errorf("syntax error: expected name, got %q", p.tok)
+	}
+	name := p.tok
+	return name, p.next()
+}
+
+// parseVariableDefinitions parses ($name: Type = default, ...) and records the defaults.
+func (p *gqlParser) parseVariableDefinitions(defaults map[string]interface{}) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for p.tok != ")" || p.str {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.parseType(); err != nil {
+			return err
+		}
+		if p.tok == "=" && !p.str {
+			if err := p.next(); err != nil {
+				return err
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return err
+			}
+			if value.variable != "" {
+				return errors.New("syntax error: default values must not be variables")
+			}
+			defaults[name] = value.literal
+		}
+	}
+	return p.next()
+}
+
+// parseType skips a type reference like String, [Int] or String!.
+func (p *gqlParser) parseType() error {
+	if p.tok == "[" && !p.str {
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.parseType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.tok == "!" && !p.str {
+		return p.next()
+	}
+	return nil
+}
+
+func (p *gqlParser) parseSelectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []gqlSelection
+	for p.tok != "}" || p.str {
+		switch {
+		case p.tok == "..." && !p.str:
+			return nil, errors.New("fragments are not supported")
+		case p.tok == "@" && !p.str:
+			return nil, errors.New("directives are not supported")
+		}
+		sel := gqlSelection{args: map[string]gqlValue{}}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok == ":" && !p.str {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			sel.alias = name
+			if name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		sel.name = name
+
+		if p.tok == "(" && !p.str {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			for p.tok != ")" || p.str {
+				arg, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if sel.args[arg], err = p.parseValue(); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if p.tok == "@" && !p.str {
+			return nil, errors.New("directives are not supported")
+		}
+		if p.tok == "{" && !p.str {
+			if sel.selections, err = p.parseSelectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, errors.New("syntax error: empty selection set")
+	}
+	return selections, p.next()
+}
+
+// parseValue parses a variable reference or a literal. Enum values are passed as strings.
+// Lists and input objects are not needed by the schema and not supported.
+func (p *gqlParser) parseValue() (gqlValue, error) {
+	if p.str {
+		s := p.tok
+		return gqlValue{literal: s}, p.next()
+	}
+	switch tok := p.tok; {
+	case tok == "$":
+		if err := p.next(); err != nil {
+			return gqlValue{}, err
+		}
+		name, err := p.name()
+		return gqlValue{variable: name}, err
+	case tok == "true" || tok == "false":
+		return gqlValue{literal: tok == "true"}, p.next()
+	case tok == "null":
+		return gqlValue{}, p.next()
+	case isGraphQLName(tok):
+		return gqlValue{literal: tok}, p.next()
+	case tok != "" && (tok[0] == '-' || (tok[0] >= '0' && tok[0] <= '9')):
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return gqlValue{}, fmt.Errorf("syntax error: invalid number %q", tok)
+		}
+		return gqlValue{literal: f}, p.next()
+	default:
+		return gqlValue{}, fmt.Errorf("syntax error: unexpected %q, expected a value", tok)
+	}
+}
+
+// next reads the next token. Whitespace, commas and comments are skipped.
+// At the end of the query the token is empty.
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	p.str = false
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return nil
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+	case strings.IndexByte("{}():$!=[]@", c) >= 0:
+		p.pos++
+	case c == '"':
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return errors.New("syntax error: unterminated string")
+		}
+		p.pos++
+		var s string
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+			return fmt.Errorf("syntax error: invalid string %s", p.src[start:p.pos])
+		}
+		p.tok, p.str = s, true
+		return nil
+	case c == '-' || c == '_' || isGraphQLNameChar(c):
+		p.pos++
+		for p.pos < len(p.src) && (isGraphQLNameChar(p.src[p.pos]) || strings.IndexByte(".+-", p.src[p.pos]) >= 0) {
+			p.pos++
+		}
+	default:
+		return fmt.Errorf("syntax error: unexpected character %q", c)
+	}
+	p.tok = p.src[start:p.pos]
+	return nil
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isGraphQLName(tok string) bool {
+	if tok == "" || (tok[0] >= '0' && tok[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(tok); i++ {
+		if !isGraphQLNameChar(tok[i]) {
+			return false
+		}
+	}
+	return true
+}
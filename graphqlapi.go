@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// graphqlSchema is the schema of the read API:
+//
+//	type Query {
+//	  installations(id: String, registered: Boolean): [Installation]
+//	  instances(id: String, installationId: String, registered: Boolean, paused: Boolean): [Instance]
+//	  actions(instanceId: String, thingId: String, status: String, limit: Int): [Action]
+//	}
+//	type Installation { id registered instances }
+//	type Instance { id installationId registered paused things actions }
+//	type Thing { id externalId lastUpdate properties }
+//	type Property { componentId propertyId value updated }
+//	type Action { id actionId instanceId thingId componentId status error received finished }
+var graphqlSchema = gqlSchema{
+	"Query": {
+		"installations": {typ: "Installation", args: map[string]string{"id": "String", "registered": "Boolean"}},
+		"instances":     {typ: "Instance", args: map[string]string{"id": "String", "installationId": "String", "registered": "Boolean", "paused": "Boolean"}},
+		"actions":       {typ: "Action", args: map[string]string{"instanceId": "String", "thingId": "String", "status": "String", "limit": "Int"}},
+	},
+	"Installation": {"id": {}, "registered": {}, "instances": {typ: "Instance"}},
+	"Instance":     {"id": {}, "installationId": {}, "registered": {}, "paused": {}, "things": {typ: "Thing"}, "actions": {typ: "Action"}},
+	"Thing":        {"id": {}, "externalId": {}, "lastUpdate": {}, "properties": {typ: "Property"}},
+	"Property":     {"componentId": {}, "propertyId": {}, "value": {}, "updated": {}},
+	"Action":       {"id": {}, "actionId": {}, "instanceId": {}, "thingId": {}, "componentId": {}, "status": {}, "error": {}, "received": {}, "finished": {}},
+}
+
+// graphqlRequest is the body of a POST request to the GraphQL endpoint.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlThing extends the status of a thing with its last property values.
+type graphqlThing struct {
+	ThingStatus
+	Properties []PropertyValue `json:"properties"`
+}
+
+// graphqlInstance extends the status of an instance with its things and action history.
+type graphqlInstance struct {
+	InstanceStatus
+	Things  []graphqlThing  `json:"things"`
+	Actions []graphqlAction `json:"actions"`
+}
+
+// graphqlInstallation is an installation with its instances.
+type graphqlInstallation struct {
+	ID         string            `json:"id"`
+	Registered bool              `json:"registered"`
+	Instances  []graphqlInstance `json:"instances"`
+}
+
+// graphqlAction is a recorded action request with the instance of its thing.
+type graphqlAction struct {
+	ActionRecord
+	InstanceID string `json:"instanceId"`
+}
+
+// serveGraphQL executes a read-only GraphQL query, given as query parameter of a GET request
+// or as JSON body of a POST request. The response is always a GraphQL response, errors included.
+func (h *adminHandler) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeJSON(w, http.StatusBadRequest, gqlResponse{Errors: []gqlError{{"variables must be a JSON object"}}})
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, gqlResponse{Errors: []gqlError{{"request body must be a JSON object with a query"}}})
+			return
+		}
+	default:
+		methodNotAllowed(w)
+		return
+	}
+	if req.Query == "" {
+		writeJSON(w, http.StatusBadRequest, gqlResponse{Errors: []gqlError{{"missing query"}}})
+		return
+	}
+
+	var installations []graphqlInstallation
+	resolve := func(field string, args map[string]interface{}) (interface{}, error) {
+		// The state is loaded once per request, so all fields of a query see the same state.
+		if installations == nil {
+			var err error
+			if installations, err = h.graphqlState(r.Context()); err != nil {
+				h.logger.Error(err, "failed to load state for graphql query")
+				return nil, errors.New("failed to load state")
+			}
+		}
+		switch field {
+		case "installations":
+			return filterGraphQLInstallations(installations, args), nil
+		case "instances":
+			return filterGraphQLInstances(installations, args), nil
+		default:
+			return filterGraphQLActions(installations, args), nil
+		}
+	}
+	writeJSON(w, http.StatusOK, executeGraphQL(graphqlSchema, resolve, req.Query, req.Variables))
+}
+
+// graphqlState combines the status report with the property values and action history of the status recorder.
+func (h *adminHandler) graphqlState(ctx context.Context) ([]graphqlInstallation, error) {
+	report, err := statusReport(ctx, h.db, h.giphyProvider, h.status)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := map[string][]graphqlAction{}
+	thingInstances := map[string]string{}
+	for _, installation := range report.Installations {
+		for _, instance := range installation.Instances {
+			for _, thing := range instance.Things {
+				thingInstances[thing.ID] = instance.ID
+			}
+		}
+	}
+	for _, action := range h.status.Actions() {
+		instanceId := thingInstances[action.ThingID]
+		actions[instanceId] = append(actions[instanceId], graphqlAction{action, instanceId})
+	}
+
+	installations := make([]graphqlInstallation, len(report.Installations))
+	for i, installation := range report.Installations {
+		installations[i] = graphqlInstallation{
+			ID:         installation.ID,
+			Registered: installation.Registered,
+			Instances:  make([]graphqlInstance, len(installation.Instances)),
+		}
+		for j, instance := range installation.Instances {
+			things := make([]graphqlThing, len(instance.Things))
+			for k, thing := range instance.Things {
+				things[k] = graphqlThing{thing, h.status.PropertyValues(thing.ID)}
+			}
+			if actions[instance.ID] == nil {
+				actions[instance.ID] = []graphqlAction{}
+			}
+			installations[i].Instances[j] = graphqlInstance{instance, things, actions[instance.ID]}
+		}
+	}
+	return installations, nil
+}
+
+func filterGraphQLInstallations(installations []graphqlInstallation, args map[string]interface{}) []graphqlInstallation {
+	filtered := []graphqlInstallation{}
+	for _, installation := range installations {
+		if id, ok := args["id"]; ok && installation.ID != id {
+			continue
+		}
+		if registered, ok := args["registered"]; ok && installation.Registered != registered {
+			continue
+		}
+		filtered = append(filtered, installation)
+	}
+	return filtered
+}
+
+func filterGraphQLInstances(installations []graphqlInstallation, args map[string]interface{}) []graphqlInstance {
+	filtered := []graphqlInstance{}
+	for _, installation := range installations {
+		for _, instance := range installation.Instances {
+			if id, ok := args["id"]; ok && instance.ID != id {
+				continue
+			}
+			if installationId, ok := args["installationId"]; ok && instance.InstallationID != installationId {
+				continue
+			}
+			if registered, ok := args["registered"]; ok && instance.Registered != registered {
+				continue
+			}
+			if paused, ok := args["paused"]; ok && instance.Paused != paused {
+				continue
+			}
+			filtered = append(filtered, instance)
+		}
+	}
+	return filtered
+}
+
+// filterGraphQLActions returns the matching action requests, newest first.
+// Action requests of things which are not stored anymore are not returned.
+func filterGraphQLActions(installations []graphqlInstallation, args map[string]interface{}) []graphqlAction {
+	actions := []graphqlAction{}
+	for _, instance := range filterGraphQLInstances(installations, map[string]interface{}{}) {
+		for _, action := range instance.Actions {
+			if instanceId, ok := args["instanceId"]; ok && action.InstanceID != instanceId {
+				continue
+			}
+			if thingId, ok := args["thingId"]; ok && action.ThingID != thingId {
+				continue
+			}
+			if status, ok := args["status"]; ok && action.Status != status {
+				continue
+			}
+			actions = append(actions, action)
+		}
+	}
+
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].Received.After(actions[j].Received) })
+	if limit, ok := args["limit"].(int); ok && limit >= 0 && limit < len(actions) {
+		actions = actions[:limit]
+	}
+	return actions
+}
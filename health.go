@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// healthPath is the path of the health endpoint on the callback listener.
+const healthPath = "/healthz"
+
+// healthStatus is the response of the health endpoint.
+type healthStatus struct {
+	// Status is "starting" until the connector accepts callbacks, "degraded" while the database is unavailable and "ok" otherwise.
+	Status        string     `json:"status"`
+	Database      string     `json:"database"`
+	DegradedSince *time.Time `json:"degradedSince,omitempty"`
+	QueuedWrites  int        `json:"queuedWrites"`
+	// SelfTest is the result of the last self-test run if the self-test is enabled.
+	SelfTest *selfTestResult `json:"selfTest,omitempty"`
+}
+
+// healthHandler serves the health of the connector at healthPath for load balancers and orchestrators and passes all other requests on.
+// It responds with service unavailable while starting. A degraded connector still handles callbacks, so it responds with OK.
+// A failed self-test is reported, but does not change the status, the connector may still serve the real instances.
+func healthHandler(ready *readinessGate, db *degradingDatabase, selfTests *selfTest, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != healthPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w)
+			return
+		}
+
+		health := healthStatus{Status: "ok", Database: "available"}
+		if degraded, since, queued := db.Degraded(); degraded {
+			health.Status = "degraded"
+			health.Database = "unavailable"
+			health.DegradedSince = &since
+			health.QueuedWrites = queued
+		}
+		if selfTests != nil {
+			result := selfTests.Result()
+			health.SelfTest = &result
+		}
+		status := http.StatusOK
+		if !ready.Ready() {
+			health.Status = "starting"
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, health)
+	})
+}
@@ -0,0 +1,180 @@
+// Package host serves several connectors from one process, so small connectors can share a deployment.
+// Each connector has its own public key, provider, thing templates, database and connctd client
+// and receives its callbacks under /connectors/{name}/, e.g. /connectors/giphy/installations.
+// The connector URL of each publication on the connctd platform has to end with that path.
+package host
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/service"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+// PathPrefix is the path all hosted connectors are served under.
+const PathPrefix = "/connectors/"
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Connector is a connector served by the host.
+type Connector struct {
+	// Name is the path segment the connector is served under.
+	// It consists of lower case letters, digits and dashes and must be unique within the host.
+	Name string
+
+	// PublicKey is the public key of the connector publication the callbacks are signed with.
+	PublicKey ed25519.PublicKey
+
+	// Provider handles the installations, instances and actions of the connector.
+	Provider connector.Provider
+
+	// ThingTemplates returns the things created for each instance.
+	ThingTemplates connector.ThingTemplates
+
+	// Database stores the installations and instances of the connector.
+	// Connectors should not share a database, because providers usually load all installations stored in it.
+	Database connector.Database
+
+	// Client is the client of the connctd API used by the service.
+	Client connector.Client
+
+	// WrapService decorates the default service of the connector, e.g. to log callbacks. It may be nil.
+	WrapService func(connector.ConnectorService) connector.ConnectorService
+
+	// Run starts the provider when the host is started. It may be nil.
+	Run func(ctx context.Context)
+
+	// Stop stops the provider started by Run and waits until it stopped. It may be nil.
+	Stop func(ctx context.Context) error
+}
+
+// Host is a registry of connectors serving the callbacks of all of them.
+// Connectors must be registered before the handler of the host serves requests.
+type Host struct {
+	logger     logr.Logger
+	router     *mux.Router
+	connectors map[string]*hostedConnector
+	lock       sync.Mutex
+}
+
+type hostedConnector struct {
+	Connector
+	service *service.DefaultConnectorService
+}
+
+// New returns a host without connectors, the logger is handed to the service of each connector.
+func New(logger logr.Logger) *Host {
+	return &Host{
+		logger:     logger,
+		router:     mux.NewRouter(),
+		connectors: map[string]*hostedConnector{},
+	}
+}
+
+// Register creates the service of the connector and adds its routes to the host.
+func (h *Host) Register(c Connector) error {
+	if !namePattern.MatchString(c.Name) {
+		return fmt.Errorf("invalid connector name %q: expected lower case letters, digits and dashes", c.Name)
+	}
+	// The signature validation panics on keys of the wrong size, so we fail early instead of on every callback
+	if len(c.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key of connector %s: expected %d bytes, got %d", c.Name, ed25519.PublicKeySize, len(c.PublicKey))
+	}
+	if c.Provider == nil || c.ThingTemplates == nil || c.Database == nil || c.Client == nil {
+		return fmt.Errorf("connector %s needs a provider, thing templates, a database and a client", c.Name)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.connectors[c.Name]; ok {
+		return fmt.Errorf("connector %s is already registered", c.Name)
+	}
+	svc, err := service.NewConnectorService(c.Database, c.Client, c.Provider, c.ThingTemplates, h.logger.WithValues("connector", c.Name))
+	if err != nil {
+		return fmt.Errorf("failed to create service of connector %s: %w", c.Name, err)
+	}
+	var callbacks connector.ConnectorService = svc
+	if c.WrapService != nil {
+		callbacks = c.WrapService(callbacks)
+	}
+
+	// The routes keep the full path, because the signatures cover it
+	connector.NewConnectorHandler(h.router.PathPrefix(PathPrefix+c.Name).Subrouter(), callbacks, c.PublicKey)
+	h.connectors[c.Name] = &hostedConnector{c, svc}
+	return nil
+}
+
+// Names returns the names of all registered connectors in alphabetical order.
+func (h *Host) Names() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	names := make([]string, 0, len(h.connectors))
+	for name := range h.connectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start starts the event handlers of all services and runs the providers until the context is done.
+func (h *Host) Start(ctx context.Context) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.connectors) == 0 {
+		return errors.New("no connectors registered")
+	}
+	for _, c := range h.connectors {
+		c.service.EventHandler(ctx)
+		if c.Run != nil {
+			c.Run(ctx)
+		}
+	}
+	return nil
+}
+
+// Use adds a middleware to the callbacks of all connectors, it runs before the signature validation of the SDK.
+func (h *Host) Use(middleware func(http.Handler) http.Handler) {
+	h.router.Use(middleware)
+}
+
+// Stop stops the providers of all connectors and waits until they stopped or the context is done.
+// It returns the first error of the providers, the other providers are stopped nevertheless.
+func (h *Host) Stop(ctx context.Context) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var firstErr error
+	for name, c := range h.connectors {
+		if c.Stop == nil {
+			continue
+		}
+		if err := c.Stop(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to stop connector %s: %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+// Handler serves the callbacks of the registered connectors and all other requests with the fallback handler.
+// The fallback may be nil, other requests are then answered with 404.
+func (h *Host) Handler(fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, PathPrefix) {
+			h.router.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
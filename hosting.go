@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/db"
+	"github.com/connctd/giphy-connector/host"
+	"github.com/go-logr/logr"
+)
+
+// hostedConnectorConfig is a further publication of the Giphy connector served by the same process.
+type hostedConnectorConfig struct {
+	name      string
+	publicKey ed25519.PublicKey
+	database  string
+}
+
+// loadHostedConnectors reads a file with one connector per line: name, base64 encoded public key and SQLite database file.
+// Empty lines and lines starting with # are ignored.
+func loadHostedConnectors(file string) ([]hostedConnectorConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open connectors file: %w", err)
+	}
+	defer f.Close()
+
+	var configs []hostedConnectorConfig
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New("invalid connectors file: expected lines of name, public key and database file")
+		}
+		publicKey, err := parsePublicKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid connectors file: public key of %s is invalid: %w", fields[0], err)
+		}
+		configs = append(configs, hostedConnectorConfig{fields[0], publicKey, fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read connectors file: %w", err)
+	}
+	return configs, nil
+}
+
+// newHostedGiphyConnector connects to the database of the connector and wires its provider and client
+// like the ones of the main connector, apart from the callback recording and replay protection.
+// Its metrics are added to the ones of the main connector.
+func newHostedGiphyConnector(config hostedConnectorConfig, migrate bool, provider *GiphyProvider, clientOptions *connector.ClientOptions, logger logr.Logger, reporter ErrorReporter, events EventSink, correlations *correlationRegistry, messages *localizer, metrics *metricsRegistry) (host.Connector, error) {
+	dbClient, err := db.NewDBClient(&db.DBOptions{Driver: db.DefaultOptions.Driver, DSN: config.database + "?_foreign_keys=on"}, logger)
+	if err != nil {
+		return host.Connector{}, fmt.Errorf("failed to connect to database of connector %s: %w", config.name, err)
+	}
+	if migrate {
+		if err := dbClient.Migrate(); err != nil {
+			return host.Connector{}, fmt.Errorf("failed to migrate database of connector %s: %w", config.name, err)
+		}
+	}
+
+	client, err := connector.NewClient(clientOptions, logger)
+	if err != nil {
+		return host.Connector{}, err
+	}
+	client = &reportingClient{client, reporter}
+	actions := newActionTracker()
+	provider.SetActionTracker(actions)
+	client = &eventClient{client, events, actions}
+	client = &correlatedClient{client, correlations}
+
+	return host.Connector{
+		Name:           config.name,
+		PublicKey:      config.publicKey,
+		Provider:       provider,
+		ThingTemplates: thingTemplate,
+		Database:       &correlatedDatabase{&bulkDatabase{dbClient, dbClient.DB}, logger},
+		Client:         client,
+		WrapService: func(s connector.ConnectorService) connector.ConnectorService {
+			things := newThingResolver(dbClient, thingTemplate, metrics)
+			return &correlatedService{&eventService{&instructionService{&resolvingService{s, things, provider}, messages}, events, actions}, logger}
+		},
+		Run:  provider.Run,
+		Stop: provider.Stop,
+	}, nil
+}
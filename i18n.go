@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/connctd/connector-go"
+)
+
+// localeConfigID is the installation configuration parameter selecting the language of texts returned to the platform.
+const localeConfigID = "locale"
+
+// errorMissingApiKeyID is the error of installations without Giphy API key, its description is localized.
+const errorMissingApiKeyID = "MISSING_API_KEY"
+
+// IDs of the messages in the bundles.
+const (
+	messageMissingApiKey        = "installation.missing_api_key"
+	messageMissingApiKeyStep    = "installation.missing_api_key.step"
+	messageThingsPending        = "instance.things_pending"
+	messageInvalidQuietHours    = "instance.invalid_quiet_hours"
+	messageInvalidEmptySearch   = "instance.invalid_empty_search_result"
+	messageInvalidKeywords      = "instance.invalid_keywords"
+	messageInvalidRating        = "installation.invalid_rating"
+	messageInvalidRandomTags    = "instance.invalid_random_tags"
+	messageInvalidInterval      = "instance.invalid_update_interval"
+	messageInvalidThrottle      = "installation.invalid_search_throttle_window"
+	messageActionNotSupported   = "action.not_supported"
+	messageActionNotRegistered  = "action.installation_not_registered"
+	messageActionMissingApiKey  = "action.missing_api_key"
+	messageActionNoSearchResult = "action.no_search_result"
+	messageActionSearchFailed   = "action.search_failed"
+	messageActionRateLimited    = "action.rate_limited"
+	messageActionGiphyLimited   = "action.giphy_rate_limited"
+	messageActionValueTooLong   = "action.value_too_long"
+	messageActionMissingPhrase  = "action.missing_phrase"
+	messageActionNoTranslation  = "action.no_translation"
+	messageActionTimeout        = "action.timeout"
+)
+
+// messageBundles contains the texts of each supported locale. Every bundle has to contain all messages of the English one.
+var messageBundles = map[string]map[string]string{
+	"en": {
+		messageMissingApiKey: "The installation has no Giphy API key",
+		messageMissingApiKeyStep: "The connector needs an API key to request GIFs from Giphy.\n\n" +
+			"1. Create an app on the [Giphy developer dashboard](https://developers.giphy.com/dashboard/)\n" +
+			"2. Install the connector again and enter the API key of the app as `giphy_api_key`",
+		messageThingsPending:        "The Giphy thing is created in a moment",
+		messageInvalidQuietHours:    "Invalid quiet hours: %s",
+		messageInvalidEmptySearch:   "Invalid empty_search_result %q, expected fail or complete",
+		messageInvalidKeywords:      "Invalid keywords: %s",
+		messageInvalidRating:        "Invalid giphy_rating %q, expected one of %s",
+		messageInvalidRandomTags:    "Invalid random_tags: %s",
+		messageInvalidInterval:      "Invalid update_interval: %s",
+		messageInvalidThrottle:      "Invalid search_throttle_window: %s",
+		messageActionNotSupported:   "Action not supported",
+		messageActionNotRegistered:  "The installation is not registered yet, please try again in a minute",
+		messageActionMissingApiKey:  "The installation has no Giphy API key",
+		messageActionNoSearchResult: "Giphy found no GIF for the keyword",
+		messageActionSearchFailed:   "The search on Giphy failed: %s",
+		messageActionRateLimited:    "Too many actions of the installation are pending, please try again later",
+		messageActionGiphyLimited:   "The Giphy rate limit of the installation is reached, please try again later",
+		messageActionValueTooLong:   "The search result is too long for the platform",
+		messageActionMissingPhrase:  "The phrase to translate is missing",
+		messageActionNoTranslation:  "Giphy found no GIF for the phrase",
+		messageActionTimeout:        "Giphy did not answer in time, please try again later",
+	},
+	"de": {
+		messageMissingApiKey: "Die Installation hat keinen Giphy-API-Schlüssel",
+		messageMissingApiKeyStep: "Der Connector benötigt einen API-Schlüssel, um GIFs von Giphy abzurufen.\n\n" +
+			"1. Erstelle eine App im [Giphy Developer Dashboard](https://developers.giphy.com/dashboard/)\n" +
+			"2. Installiere den Connector erneut und gib den API-Schlüssel der App als `giphy_api_key` an",
+		messageThingsPending:        "Das Giphy-Thing wird in Kürze angelegt",
+		messageInvalidQuietHours:    "Ungültige Ruhezeiten: %s",
+		messageInvalidEmptySearch:   "Ungültiges empty_search_result %q, erwartet wird fail oder complete",
+		messageInvalidKeywords:      "Ungültige Suchbegriffe: %s",
+		messageInvalidRating:        "Ungültiges giphy_rating %q, erwartet wird eines von %s",
+		messageInvalidRandomTags:    "Ungültige random_tags: %s",
+		messageInvalidInterval:      "Ungültiges update_interval: %s",
+		messageInvalidThrottle:      "Ungültiges search_throttle_window: %s",
+		messageActionNotSupported:   "Aktion wird nicht unterstützt",
+		messageActionNotRegistered:  "Die Installation ist noch nicht registriert, bitte versuche es in einer Minute erneut",
+		messageActionMissingApiKey:  "Die Installation hat keinen Giphy-API-Schlüssel",
+		messageActionNoSearchResult: "Giphy hat kein GIF zu dem Suchbegriff gefunden",
+		messageActionSearchFailed:   "Die Suche bei Giphy ist fehlgeschlagen: %s",
+		messageActionRateLimited:    "Zu viele Aktionen der Installation sind offen, bitte versuche es später erneut",
+		messageActionGiphyLimited:   "Das Giphy-Anfragelimit der Installation ist erreicht, bitte versuche es später erneut",
+		messageActionValueTooLong:   "Das Suchergebnis ist zu lang für die Plattform",
+		messageActionMissingPhrase:  "Der zu übersetzende Satz fehlt",
+		messageActionNoTranslation:  "Giphy hat kein GIF zu dem Satz gefunden",
+		messageActionTimeout:        "Giphy hat nicht rechtzeitig geantwortet, bitte versuche es später erneut",
+	},
+}
+
+// localizer selects the texts returned to the platform by the locale configured for the installation
+// and falls back to the default locale if there is none or it is not supported.
+type localizer struct {
+	defaultLocale string
+}
+
+// newLocalizer returns a localizer with the given default locale, which must be supported.
+func newLocalizer(defaultLocale string) (*localizer, error) {
+	locale, ok := supportedLocale(defaultLocale)
+	if !ok {
+		return nil, fmt.Errorf("unsupported locale %q, expected one of %s", defaultLocale, strings.Join(supportedLocales(), ", "))
+	}
+	return &localizer{locale}, nil
+}
+
+// Locale returns the supported locale configured by the parameters or the default locale.
+func (l *localizer) Locale(configuration []connector.Configuration) string {
+	for _, c := range configuration {
+		if c.ID == localeConfigID {
+			if locale, ok := supportedLocale(c.Value); ok {
+				return locale
+			}
+		}
+	}
+	return l.defaultLocale
+}
+
+// Text returns the message in the given locale, formatted with the arguments.
+func (l *localizer) Text(locale string, id string, args ...interface{}) string {
+	text, ok := messageBundles[locale][id]
+	if !ok {
+		text = messageBundles["en"][id]
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// ActionError returns the text of a failed action, known errors of the provider are translated.
+func (l *localizer) ActionError(locale string, err error) string {
+	switch {
+	case errors.Is(err, errInstallationNotRegistered):
+		return l.Text(locale, messageActionNotRegistered)
+	case errors.Is(err, errMissingApiKey):
+		return l.Text(locale, messageActionMissingApiKey)
+	case errors.Is(err, errNoSearchResult):
+		return l.Text(locale, messageActionNoSearchResult)
+	case errors.Is(err, errMissingPhrase):
+		return l.Text(locale, messageActionMissingPhrase)
+	case errors.Is(err, errNoTranslation):
+		return l.Text(locale, messageActionNoTranslation)
+	case errors.Is(err, errGiphyRateLimited):
+		return l.Text(locale, messageActionGiphyLimited)
+	case errors.Is(err, errValueTooLong):
+		return l.Text(locale, messageActionValueTooLong)
+	case errors.Is(err, errActionTimeout):
+		return l.Text(locale, messageActionTimeout)
+	default:
+		return l.Text(locale, messageActionSearchFailed, err.Error())
+	}
+}
+
+// supportedLocale returns the bundle of a locale like de or de-DE.
+func supportedLocale(locale string) (string, bool) {
+	language := strings.ToLower(strings.SplitN(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"), "-", 2)[0])
+	_, ok := messageBundles[language]
+	return language, ok
+}
+
+func supportedLocales() []string {
+	locales := make([]string, 0, len(messageBundles))
+	for locale := range messageBundles {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// instructionService rejects installations without a Giphy API key or with an unsupported rating and instances with invalid quiet hours or other invalid configuration.
+// The response contains instructions how to get an API key in the locale of the installation.
+type instructionService struct {
+	connector.ConnectorService
+	messages *localizer
+}
+
+// AddInstallation implements connector.ConnectorService.
+func (s *instructionService) AddInstallation(ctx context.Context, request connector.InstallationRequest) (*connector.InstallationResponse, error) {
+	if _, ok := request.GetConfig(giphyApiKeyConfigID); !ok {
+		locale := s.messages.Locale(request.Configuration)
+		return &connector.InstallationResponse{
+				FurtherStep: connector.Step{Type: connector.StepMarkdown, Content: s.messages.Text(locale, messageMissingApiKeyStep)},
+			},
+			connector.NewError(errorMissingApiKeyID, s.messages.Text(locale, messageMissingApiKey), http.StatusBadRequest)
+	}
+	if c, ok := request.GetConfig(giphyRatingConfigID); ok {
+		if _, ok := giphyRating(c.Value); !ok {
+			locale := s.messages.Locale(request.Configuration)
+			return nil, connector.NewError(errorInvalidConfigurationID, s.messages.Text(locale, messageInvalidRating, c.Value, strings.Join(giphyRatings, ", ")), http.StatusBadRequest)
+		}
+	}
+	if _, _, err := parseSearchThrottleWindow(request.Configuration); err != nil {
+		locale := s.messages.Locale(request.Configuration)
+		return nil, connector.NewError(errorInvalidConfigurationID, s.messages.Text(locale, messageInvalidThrottle, err.Error()), http.StatusBadRequest)
+	}
+	return s.ConnectorService.AddInstallation(ctx, request)
+}
+
+// errorInvalidConfigurationID is the error of instantiations with an invalid configuration value, its description is localized.
+const errorInvalidConfigurationID = "INVALID_CONFIGURATION"
+
+// AddInstance implements connector.ConnectorService.
+// The locale is taken from the instance configuration, the installation is not known here.
+func (s *instructionService) AddInstance(ctx context.Context, request connector.InstantiationRequest) (*connector.InstantiationResponse, error) {
+	if _, err := parseQuietHours(request.Configuration); err != nil {
+		locale := s.messages.Locale(request.Configuration)
+		return nil, connector.NewError(errorInvalidQuietHoursID, s.messages.Text(locale, messageInvalidQuietHours, err.Error()), http.StatusBadRequest)
+	}
+	if c, ok := request.GetConfig(emptySearchResultConfigID); ok && c.Value != emptySearchResultFail && c.Value != emptySearchResultComplete {
+		locale := s.messages.Locale(request.Configuration)
+		return nil, connector.NewError(errorInvalidConfigurationID, s.messages.Text(locale, messageInvalidEmptySearch, c.Value), http.StatusBadRequest)
+	}
+	if _, err := instanceKeywords(request.Configuration); err != nil {
+		locale := s.messages.Locale(request.Configuration)
+		return nil, connector.NewError(errorInvalidConfigurationID, s.messages.Text(locale, messageInvalidKeywords, err.Error()), http.StatusBadRequest)
+	}
+	if _, err := instanceRandomTags(request.Configuration); err != nil {
+		locale := s.messages.Locale(request.Configuration)
+		return nil, connector.NewError(errorInvalidConfigurationID, s.messages.Text(locale, messageInvalidRandomTags, err.Error()), http.StatusBadRequest)
+	}
+	if _, err := parseUpdateInterval(request.Configuration); err != nil {
+		locale := s.messages.Locale(request.Configuration)
+		return nil, connector.NewError(errorInvalidConfigurationID, s.messages.Text(locale, messageInvalidInterval, err.Error()), http.StatusBadRequest)
+	}
+	return s.ConnectorService.AddInstance(ctx, request)
+}
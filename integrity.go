@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+// genesisHash is the previous hash of the first entry of an integrity log.
+var genesisHash = strings.Repeat("0", 64)
+
+// integrityEntry is a value published to the platform. Only the hash of the value is logged, so the log holds no
+// secrets or large search results, a disputed value is proven by comparing its hash.
+// Each entry contains the hash of the previous one, so entries can not be changed, removed or reordered without
+// breaking the chain. With a signing key, each hash is signed as well, so the chain can not be rebuilt without the key.
+type integrityEntry struct {
+	Seq          int64     `json:"seq"`
+	Published    time.Time `json:"published"`
+	ThingID      string    `json:"thingId"`
+	ComponentID  string    `json:"componentId"`
+	PropertyID   string    `json:"propertyId"`
+	ValueHash    string    `json:"valueHash"`
+	PreviousHash string    `json:"previousHash"`
+	Hash         string    `json:"hash"`
+	Signature    string    `json:"signature,omitempty"`
+}
+
+// computeHash returns the hash over all fields of the entry but the hash and signature.
+func (e *integrityEntry) computeHash() string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		strconv.FormatInt(e.Seq, 10),
+		e.Published.UTC().Format(time.RFC3339Nano),
+		e.ThingID,
+		e.ComponentID,
+		e.PropertyID,
+		e.ValueHash,
+		e.PreviousHash,
+	}, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// integrityLog appends the published values to a local file of JSON lines. The file is only appended to,
+// entries are not synced to disk one by one, so the last entries can be lost with the machine, but not changed.
+type integrityLog struct {
+	file   string
+	signer *payloadSigner
+
+	lock sync.Mutex
+	f    *os.File
+	seq  int64
+	head string
+	// size is the size of the file after the last complete entry. broken is set if a failed write could not be removed,
+	// no further entries are appended then, so the log stays verifiable up to that entry.
+	size   int64
+	broken error
+
+	failures *metricVec
+}
+
+// openIntegrityLog opens the log and verifies its chain, so a log which was tampered with is noticed on start.
+// A last line without line break, which was torn by a crash while it was written, is removed.
+// Entries are signed with the signer if one is given.
+func openIntegrityLog(file string, signer *payloadSigner, metrics *metricsRegistry) (*integrityLog, error) {
+	l := &integrityLog{
+		file:     file,
+		signer:   signer,
+		head:     genesisHash,
+		failures: metrics.Counter("integrity_log_failures_total", "Number of published property values which could not be added to the integrity log."),
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i+1 < len(b) {
+		logrus.WithField("file", file).Warnln("removing torn last entry of the integrity log")
+		if err := os.Truncate(file, int64(i+1)); err != nil {
+			return nil, err
+		}
+		b = b[:i+1]
+	}
+	result := verifyIntegrityEntries(bytes.NewReader(b), signer)
+	if !result.Valid {
+		return nil, fmt.Errorf("integrity log %s is broken at entry %d: %s", file, result.BrokenAt, result.Error)
+	}
+	l.seq, l.head, l.size = result.Entries, result.Head, int64(len(b))
+
+	if l.f, err = os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append adds the published value to the log. The bytes of a failed write, e.g. on a full disk, are removed again,
+// so the next entry does not continue a partial line.
+func (l *integrityLog) Append(thingID string, componentID string, propertyID string, value string, published time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.broken != nil {
+		return fmt.Errorf("integrity log is not appended to since a failed write could not be removed: %w", l.broken)
+	}
+	entry := &integrityEntry{
+		Seq:          l.seq + 1,
+		Published:    published.UTC(),
+		ThingID:      thingID,
+		ComponentID:  componentID,
+		PropertyID:   propertyID,
+		ValueHash:    valueHash(value),
+		PreviousHash: l.head,
+	}
+	entry.Hash = entry.computeHash()
+	if l.signer != nil {
+		entry.Signature = l.signer.SignData([]byte(entry.Hash))
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := l.f.Write(line); err != nil {
+		if truncateErr := l.f.Truncate(l.size); truncateErr != nil {
+			l.broken = truncateErr
+			logrus.WithError(truncateErr).WithField("file", l.file).Errorln("failed to remove partial entry of the integrity log, no further entries are appended")
+		}
+		return err
+	}
+	l.seq, l.head, l.size = entry.Seq, entry.Hash, l.size+int64(len(line))
+	return nil
+}
+
+// Close closes the file of the log.
+func (l *integrityLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.f.Close()
+}
+
+// integrityVerification is the result of verifying an integrity log.
+type integrityVerification struct {
+	Valid bool `json:"valid"`
+	// Entries is the number of valid entries, Head the hash of the last one.
+	Entries int64  `json:"entries"`
+	Head    string `json:"head"`
+	// BrokenAt is the line of the first invalid entry and Error what is wrong with it.
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Unsigned is the number of entries without signature, e.g. written before the signing key was configured.
+	Unsigned int64 `json:"unsigned"`
+}
+
+// Verify reads the whole log and checks the hashes, the chain and, with a signer, the signatures of all entries.
+// Signatures of another key, e.g. after the signing key was replaced, are reported as invalid.
+func (l *integrityLog) Verify() (*integrityVerification, error) {
+	// Appends are blocked while the log is read, so the last entry is never read partially
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, err := os.Open(l.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return verifyIntegrityEntries(f, l.signer), nil
+}
+
+// Entries returns the entries of the thing in the order they were published. Empty component and property IDs match all.
+func (l *integrityLog) Entries(thingID string, componentID string, propertyID string) ([]integrityEntry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, err := os.Open(l.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []integrityEntry{}
+	scanner := newIntegrityScanner(f)
+	for scanner.Scan() {
+		var entry integrityEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if entry.ThingID != thingID || (componentID != "" && entry.ComponentID != componentID) || (propertyID != "" && entry.PropertyID != propertyID) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func verifyIntegrityEntries(r io.Reader, signer *payloadSigner) *integrityVerification {
+	result := &integrityVerification{Valid: true, Head: genesisHash}
+	broken := func(format string, args ...interface{}) *integrityVerification {
+		result.Valid = false
+		result.BrokenAt = result.Entries + 1
+		result.Error = fmt.Sprintf(format, args...)
+		return result
+	}
+	scanner := newIntegrityScanner(r)
+	for scanner.Scan() {
+		var entry integrityEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return broken("invalid entry: %s", err)
+		}
+		if entry.Seq != result.Entries+1 {
+			return broken("sequence number %d, expected %d", entry.Seq, result.Entries+1)
+		}
+		if entry.PreviousHash != result.Head {
+			return broken("previous hash does not match the hash of the entry before")
+		}
+		if entry.Hash != entry.computeHash() {
+			return broken("hash does not match the entry")
+		}
+		if entry.Signature == "" {
+			result.Unsigned++
+		} else if signer != nil && !signer.VerifyData([]byte(entry.Hash), entry.Signature) {
+			return broken("invalid signature")
+		}
+		result.Entries, result.Head = entry.Seq, entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return broken("failed to read entry: %s", err)
+	}
+	return result
+}
+
+// newIntegrityScanner returns a scanner of the lines of a log, entries are short but the IDs are not limited.
+func newIntegrityScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+// integrityClient adds each value connctd accepted to the integrity log. Values which could not be logged are still published,
+// the failure is logged and counted, so a full disk does not stop the updates.
+type integrityClient struct {
+	connector.Client
+	log *integrityLog
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *integrityClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	if err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate); err != nil {
+		return err
+	}
+	if lastUpdate.IsZero() {
+		lastUpdate = clock()
+	}
+	if err := c.log.Append(thingID, componentID, propertyID, value, lastUpdate); err != nil {
+		c.log.failures.Inc()
+		logrus.WithError(err).WithField("thingId", thingID).WithField("componentId", componentID).WithField("propertyId", propertyID).
+			Errorln("failed to add published value to the integrity log")
+	}
+	return nil
+}
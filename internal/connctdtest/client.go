@@ -0,0 +1,276 @@
+// Package connctdtest provides a fake connctd client which can be used to test connector flows without network access.
+package connctdtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+)
+
+// Names of the client methods, used to program failures.
+const (
+	MethodCreateThing              = "CreateThing"
+	MethodUpdateThingPropertyValue = "UpdateThingPropertyValue"
+	MethodUpdateThingStatus        = "UpdateThingStatus"
+	MethodUpdateActionStatus       = "UpdateActionStatus"
+	MethodUpdateInstallationState  = "UpdateInstallationState"
+	MethodUpdateInstanceState      = "UpdateInstanceState"
+	MethodDeleteThing              = "DeleteThing"
+)
+
+// PropertyUpdate is a recorded call of UpdateThingPropertyValue.
+type PropertyUpdate struct {
+	Token       connector.InstantiationToken
+	ThingID     string
+	ComponentID string
+	PropertyID  string
+	Value       string
+	LastUpdate  time.Time
+}
+
+// ActionStatusUpdate is a recorded call of UpdateActionStatus.
+type ActionStatusUpdate struct {
+	Token           connector.InstantiationToken
+	ActionRequestID string
+	Status          connector.ActionRequestStatus
+	Error           string
+}
+
+// ThingStatusUpdate is a recorded call of UpdateThingStatus.
+type ThingStatusUpdate struct {
+	Token   connector.InstantiationToken
+	ThingID string
+	Status  connctd.StatusType
+}
+
+// InstallationStateUpdate is a recorded call of UpdateInstallationState.
+type InstallationStateUpdate struct {
+	Token   connector.InstallationToken
+	State   connector.InstallationState
+	Details json.RawMessage
+}
+
+// InstanceStateUpdate is a recorded call of UpdateInstanceState.
+type InstanceStateUpdate struct {
+	Token   connector.InstantiationToken
+	State   connector.InstantiationState
+	Details json.RawMessage
+}
+
+// Client is a fake connector.Client which records all calls instead of sending them to connctd.
+// Calls fail only if a failure was programmed with FailNext or FailAlways.
+// Failed calls are not recorded.
+// It is safe for concurrent use.
+type Client struct {
+	things              []connctd.Thing
+	propertyUpdates     []PropertyUpdate
+	thingStatusUpdates  []ThingStatusUpdate
+	actionUpdates       []ActionStatusUpdate
+	installationUpdates []InstallationStateUpdate
+	instanceUpdates     []InstanceStateUpdate
+	deletedThings       []string
+
+	nextErrors   map[string][]error
+	alwaysErrors map[string]error
+	calls        map[string]int
+	lock         sync.Mutex
+}
+
+var _ connector.Client = (*Client)(nil)
+
+// NewClient returns a fake client without recorded calls and without programmed failures.
+func NewClient() *Client {
+	return &Client{
+		nextErrors:   map[string][]error{},
+		alwaysErrors: map[string]error{},
+		calls:        map[string]int{},
+	}
+}
+
+// FailNext lets the next calls of the method fail with the given errors, one error per call.
+func (c *Client) FailNext(method string, errs ...error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nextErrors[method] = append(c.nextErrors[method], errs...)
+}
+
+// FailAlways lets all calls of the method fail with err after the errors programmed with FailNext were used up.
+// A nil error makes the method succeed again.
+func (c *Client) FailAlways(method string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err == nil {
+		delete(c.alwaysErrors, method)
+		return
+	}
+	c.alwaysErrors[method] = err
+}
+
+// Reset removes all recorded calls and programmed failures.
+func (c *Client) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.things = nil
+	c.propertyUpdates = nil
+	c.thingStatusUpdates = nil
+	c.actionUpdates = nil
+	c.installationUpdates = nil
+	c.instanceUpdates = nil
+	c.deletedThings = nil
+	c.nextErrors = map[string][]error{}
+	c.alwaysErrors = map[string]error{}
+	c.calls = map[string]int{}
+}
+
+// Calls returns the number of calls of the method, including failed calls.
+func (c *Client) Calls(method string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls[method]
+}
+
+// Things returns all successfully created things.
+func (c *Client) Things() []connctd.Thing {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]connctd.Thing{}, c.things...)
+}
+
+// PropertyUpdates returns all successful property updates in the order they were received.
+func (c *Client) PropertyUpdates() []PropertyUpdate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]PropertyUpdate{}, c.propertyUpdates...)
+}
+
+// ThingStatusUpdates returns all successful thing status updates in the order they were received.
+func (c *Client) ThingStatusUpdates() []ThingStatusUpdate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]ThingStatusUpdate{}, c.thingStatusUpdates...)
+}
+
+// ActionStatusUpdates returns all successful action status updates in the order they were received.
+func (c *Client) ActionStatusUpdates() []ActionStatusUpdate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]ActionStatusUpdate{}, c.actionUpdates...)
+}
+
+// InstallationStateUpdates returns all successful installation state updates in the order they were received.
+func (c *Client) InstallationStateUpdates() []InstallationStateUpdate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]InstallationStateUpdate{}, c.installationUpdates...)
+}
+
+// InstanceStateUpdates returns all successful instance state updates in the order they were received.
+func (c *Client) InstanceStateUpdates() []InstanceStateUpdate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]InstanceStateUpdate{}, c.instanceUpdates...)
+}
+
+// DeletedThings returns the IDs of all successfully deleted things.
+func (c *Client) DeletedThings() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.deletedThings...)
+}
+
+// call counts a call of the method and returns the programmed error, if any.
+// It must be called with the lock held.
+func (c *Client) call(method string) error {
+	c.calls[method]++
+	if errs := c.nextErrors[method]; len(errs) > 0 {
+		c.nextErrors[method] = errs[1:]
+		return errs[0]
+	}
+	return c.alwaysErrors[method]
+}
+
+// CreateThing implements connector.Client.
+// Things without ID get a generated ID.
+func (c *Client) CreateThing(ctx context.Context, token connector.InstantiationToken, thing connctd.Thing) (connctd.Thing, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.call(MethodCreateThing); err != nil {
+		return connctd.Thing{}, err
+	}
+	if thing.ID == "" {
+		thing.ID = fmt.Sprintf("thing-%d", len(c.things)+1)
+	}
+	c.things = append(c.things, thing)
+	return thing, nil
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *Client) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.call(MethodUpdateThingPropertyValue); err != nil {
+		return err
+	}
+	c.propertyUpdates = append(c.propertyUpdates, PropertyUpdate{token, thingID, componentID, propertyID, value, lastUpdate})
+	return nil
+}
+
+// UpdateThingStatus implements connector.Client.
+func (c *Client) UpdateThingStatus(ctx context.Context, token connector.InstantiationToken, thingID string, status connctd.StatusType) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.call(MethodUpdateThingStatus); err != nil {
+		return err
+	}
+	c.thingStatusUpdates = append(c.thingStatusUpdates, ThingStatusUpdate{token, thingID, status})
+	return nil
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *Client) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.call(MethodUpdateActionStatus); err != nil {
+		return err
+	}
+	c.actionUpdates = append(c.actionUpdates, ActionStatusUpdate{token, actionRequestID, status, e})
+	return nil
+}
+
+// UpdateInstallationState implements connector.Client.
+func (c *Client) UpdateInstallationState(ctx context.Context, token connector.InstallationToken, state connector.InstallationState, details json.RawMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.call(MethodUpdateInstallationState); err != nil {
+		return err
+	}
+	c.installationUpdates = append(c.installationUpdates, InstallationStateUpdate{token, state, details})
+	return nil
+}
+
+// UpdateInstanceState implements connector.Client.
+func (c *Client) UpdateInstanceState(ctx context.Context, token connector.InstantiationToken, state connector.InstantiationState, details json.RawMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.call(MethodUpdateInstanceState); err != nil {
+		return err
+	}
+	c.instanceUpdates = append(c.instanceUpdates, InstanceStateUpdate{token, state, details})
+	return nil
+}
+
+// DeleteThing implements connector.Client.
+func (c *Client) DeleteThing(ctx context.Context, token connector.InstantiationToken, thingID string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.call(MethodDeleteThing); err != nil {
+		return err
+	}
+	c.deletedThings = append(c.deletedThings, thingID)
+	return nil
+}
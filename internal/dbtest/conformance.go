@@ -0,0 +1,248 @@
+// Package dbtest checks implementations of connector.Database against the behavior expected by the default service.
+// The same checks run against every driver, so dialect specific bugs of a single database show up as failures.
+package dbtest
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/connctd/connector-go"
+)
+
+// TestDatabase runs the conformance checks against a migrated database.
+// It only creates and removes its own installations and instances with random IDs, so it can run against a
+// database which is in use. All failed checks are returned as a single error.
+func TestDatabase(ctx context.Context, db connector.Database) error {
+	c := &checker{ctx: ctx, db: db}
+	c.installationAndInstances()
+	c.removalCascades()
+	c.unknownIDs()
+
+	if len(c.failures) == 0 {
+		return nil
+	}
+	return errors.New("database conformance failed:\n\t" + strings.Join(c.failures, "\n\t"))
+}
+
+type checker struct {
+	ctx      context.Context
+	db       connector.Database
+	failures []string
+}
+
+func (c *checker) errorf(format string, args ...interface{}) {
+	c.failures = append(c.failures, fmt.Sprintf(format, args...))
+}
+
+// installationAndInstances stores an installation with an instance and a thing mapping and reads them back.
+func (c *checker) installationAndInstances() {
+	installationId := newId()
+	instanceId := newId()
+	thingId := newId()
+	installationConfig := []connector.Configuration{{ID: "api_key", Value: "secret"}, {ID: "name", Value: "conformance"}}
+	instanceConfig := []connector.Configuration{{ID: "mode", Value: "test"}}
+
+	if err := c.db.AddInstallation(c.ctx, connector.InstallationRequest{ID: installationId, Token: "installation-token"}); err != nil {
+		c.errorf("AddInstallation: %v", err)
+		return
+	}
+	defer c.db.RemoveInstallation(c.ctx, installationId)
+
+	if err := c.db.AddInstallationConfiguration(c.ctx, installationId, installationConfig); err != nil {
+		c.errorf("AddInstallationConfiguration: %v", err)
+	}
+
+	installations, err := c.db.GetInstallations(c.ctx)
+	if err != nil {
+		c.errorf("GetInstallations: %v", err)
+	} else if installation := findInstallation(installations, installationId); installation == nil {
+		c.errorf("GetInstallations: installation %s not returned", installationId)
+	} else if !sameConfiguration(installation.Configuration, installationConfig) {
+		c.errorf("GetInstallations: got configuration %v, want %v", installation.Configuration, installationConfig)
+	}
+
+	if err := c.db.AddInstance(c.ctx, connector.InstantiationRequest{ID: instanceId, InstallationID: installationId, Token: "instance-token"}); err != nil {
+		c.errorf("AddInstance: %v", err)
+		return
+	}
+	defer c.db.RemoveInstance(c.ctx, instanceId)
+
+	if err := c.db.AddInstanceConfiguration(c.ctx, instanceId, instanceConfig); err != nil {
+		c.errorf("AddInstanceConfiguration: %v", err)
+	}
+	if err := c.db.AddThingMapping(c.ctx, instanceId, thingId, "external"); err != nil {
+		c.errorf("AddThingMapping: %v", err)
+	}
+
+	want := connector.Instance{
+		ID:             instanceId,
+		InstallationID: installationId,
+		Token:          "instance-token",
+		ThingMapping:   []connector.ThingMapping{{InstanceID: instanceId, ThingID: thingId, ExternalID: "external"}},
+		Configuration:  instanceConfig,
+	}
+
+	instance, err := c.db.GetInstance(c.ctx, instanceId)
+	if err != nil {
+		c.errorf("GetInstance: %v", err)
+	} else {
+		c.compareInstance("GetInstance", instance, want)
+	}
+
+	instance, err = c.db.GetInstanceByThingId(c.ctx, thingId)
+	if err != nil {
+		c.errorf("GetInstanceByThingId: %v", err)
+	} else {
+		c.compareInstance("GetInstanceByThingId", instance, want)
+	}
+
+	instances, err := c.db.GetInstances(c.ctx)
+	if err != nil {
+		c.errorf("GetInstances: %v", err)
+	} else if instance := findInstance(instances, instanceId); instance == nil {
+		c.errorf("GetInstances: instance %s not returned", instanceId)
+	} else {
+		c.compareInstance("GetInstances", instance, want)
+	}
+
+	config, err := c.db.GetInstanceConfiguration(c.ctx, instanceId)
+	if err != nil {
+		c.errorf("GetInstanceConfiguration: %v", err)
+	} else if !sameConfiguration(config, instanceConfig) {
+		c.errorf("GetInstanceConfiguration: got %v, want %v", config, instanceConfig)
+	}
+
+	mapping, err := c.db.GetMappingByInstanceId(c.ctx, instanceId)
+	if err != nil {
+		c.errorf("GetMappingByInstanceId: %v", err)
+	} else if len(mapping) != 1 || mapping[0].ThingID != thingId || mapping[0].ExternalID != "external" {
+		c.errorf("GetMappingByInstanceId: got %v, want %v", mapping, want.ThingMapping)
+	}
+
+	if err := c.db.RemoveInstance(c.ctx, instanceId); err != nil {
+		c.errorf("RemoveInstance: %v", err)
+	} else if _, err := c.db.GetInstance(c.ctx, instanceId); err == nil {
+		c.errorf("RemoveInstance: instance %s still exists", instanceId)
+	}
+	if mapping, err := c.db.GetMappingByInstanceId(c.ctx, instanceId); err == nil && len(mapping) > 0 {
+		c.errorf("RemoveInstance: thing mapping of instance %s still exists", instanceId)
+	}
+}
+
+// removalCascades checks that removing an installation also removes its instances and all configuration.
+func (c *checker) removalCascades() {
+	installationId := newId()
+	instanceId := newId()
+
+	if err := c.db.AddInstallation(c.ctx, connector.InstallationRequest{ID: installationId, Token: "installation-token"}); err != nil {
+		c.errorf("AddInstallation: %v", err)
+		return
+	}
+	if err := c.db.AddInstallationConfiguration(c.ctx, installationId, []connector.Configuration{{ID: "api_key", Value: "secret"}}); err != nil {
+		c.errorf("AddInstallationConfiguration: %v", err)
+	}
+	if err := c.db.AddInstance(c.ctx, connector.InstantiationRequest{ID: instanceId, InstallationID: installationId, Token: "instance-token"}); err != nil {
+		c.errorf("AddInstance: %v", err)
+	}
+	if err := c.db.AddInstanceConfiguration(c.ctx, instanceId, []connector.Configuration{{ID: "mode", Value: "test"}}); err != nil {
+		c.errorf("AddInstanceConfiguration: %v", err)
+	}
+
+	if err := c.db.RemoveInstallation(c.ctx, installationId); err != nil {
+		c.errorf("RemoveInstallation: %v", err)
+		return
+	}
+
+	installations, err := c.db.GetInstallations(c.ctx)
+	if err != nil {
+		c.errorf("GetInstallations: %v", err)
+	} else if findInstallation(installations, installationId) != nil {
+		c.errorf("RemoveInstallation: installation %s still exists", installationId)
+	}
+	if _, err := c.db.GetInstance(c.ctx, instanceId); err == nil {
+		c.errorf("RemoveInstallation: instance %s of the removed installation still exists, are foreign keys enabled?", instanceId)
+		c.db.RemoveInstance(c.ctx, instanceId)
+	}
+	if config, err := c.db.GetInstanceConfiguration(c.ctx, instanceId); err == nil && len(config) > 0 {
+		c.errorf("RemoveInstallation: configuration of instance %s still exists", instanceId)
+	}
+}
+
+// unknownIDs checks that lookups of unknown IDs fail instead of returning empty objects.
+func (c *checker) unknownIDs() {
+	if instance, err := c.db.GetInstance(c.ctx, newId()); err == nil {
+		c.errorf("GetInstance: got %v for unknown ID, want error", instance)
+	}
+	if instance, err := c.db.GetInstanceByThingId(c.ctx, newId()); err == nil {
+		c.errorf("GetInstanceByThingId: got %v for unknown ID, want error", instance)
+	}
+}
+
+func (c *checker) compareInstance(method string, got *connector.Instance, want connector.Instance) {
+	if got.ID != want.ID || got.InstallationID != want.InstallationID || got.Token != want.Token {
+		c.errorf("%s: got instance %s of installation %s with token %q, want %s of %s with %q",
+			method, got.ID, got.InstallationID, got.Token, want.ID, want.InstallationID, want.Token)
+	}
+	if !sameConfiguration(got.Configuration, want.Configuration) {
+		c.errorf("%s: got configuration %v, want %v", method, got.Configuration, want.Configuration)
+	}
+	if len(got.ThingMapping) != len(want.ThingMapping) {
+		c.errorf("%s: got thing mapping %v, want %v", method, got.ThingMapping, want.ThingMapping)
+		return
+	}
+	for i := range got.ThingMapping {
+		if got.ThingMapping[i].ThingID != want.ThingMapping[i].ThingID || got.ThingMapping[i].ExternalID != want.ThingMapping[i].ExternalID {
+			c.errorf("%s: got thing mapping %v, want %v", method, got.ThingMapping, want.ThingMapping)
+			return
+		}
+	}
+}
+
+func findInstallation(installations []*connector.Installation, id string) *connector.Installation {
+	for _, i := range installations {
+		if i != nil && i.ID == id {
+			return i
+		}
+	}
+	return nil
+}
+
+func findInstance(instances []*connector.Instance, id string) *connector.Instance {
+	for _, i := range instances {
+		if i != nil && i.ID == id {
+			return i
+		}
+	}
+	return nil
+}
+
+// sameConfiguration compares configurations independent of their order.
+func sameConfiguration(got []connector.Configuration, want []connector.Configuration) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	values := map[string]string{}
+	for _, c := range got {
+		values[c.ID] = c.Value
+	}
+	for _, c := range want {
+		if v, ok := values[c.ID]; !ok || v != c.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// newId returns a random UUID, which fits the CHAR(36) columns of the default layout.
+func newId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
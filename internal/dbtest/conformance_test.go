@@ -0,0 +1,29 @@
+package dbtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/db"
+)
+
+// testDriver migrates the database given by driver and DSN and runs the conformance checks against it.
+func testDriver(t *testing.T, driver db.DBDriverName, dsn string) {
+	t.Helper()
+	dbClient, err := db.NewDBClient(&db.DBOptions{Driver: driver, DSN: dsn}, connector.DefaultLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbClient.DB.Close()
+	if err := dbClient.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := TestDatabase(context.Background(), dbClient); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSqlite(t *testing.T) {
+	testDriver(t, db.DriverSqlite3, "file:conformance?mode=memory&cache=shared&_foreign_keys=on")
+}
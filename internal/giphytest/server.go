@@ -0,0 +1,209 @@
+// Package giphytest provides a fake Giphy API which can be used to test the provider deterministically.
+package giphytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// Request is a request received by the fake server.
+type Request struct {
+	Path   string
+	APIKey string
+	Query  url.Values
+}
+
+// Server is a fake Giphy API serving the random, search, trending and translate endpoints.
+// By default all requests with an API key succeed and return generated gifs.
+// Errors, empty results and rate limits can be programmed.
+// It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	requests  []Request
+	failures  []int
+	empty     bool
+	rateLimit int
+	gifs      int
+	lock      sync.Mutex
+}
+
+// NewServer starts a new fake Giphy API.
+// The caller must close the server when finished.
+func NewServer() *Server {
+	s := &Server{rateLimit: -1}
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// URL returns the base URL of the API, including the version path.
+func (s *Server) URL() string {
+	return s.Server.URL + "/v1"
+}
+
+// FailNext lets the next requests fail with the given HTTP status codes, one status code per request.
+func (s *Server) FailNext(statusCodes ...int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = append(s.failures, statusCodes...)
+}
+
+// SetEmpty lets all endpoints return empty results.
+func (s *Server) SetEmpty(empty bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.empty = empty
+}
+
+// SetRateLimit lets all requests fail with status 429 after the given number of further requests.
+// A negative limit disables rate limiting.
+func (s *Server) SetRateLimit(limit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rateLimit = limit
+}
+
+// Requests returns all received requests in the order they were received.
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// Reset removes all received requests and programmed behavior.
+func (s *Server) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = nil
+	s.failures = nil
+	s.empty = false
+	s.rateLimit = -1
+}
+
+// next records the request and returns the status code it has to be answered with.
+func (s *Server) next(r *http.Request) (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	apiKey := r.URL.Query().Get("api_key")
+	s.requests = append(s.requests, Request{r.URL.Path, apiKey, r.URL.Query()})
+
+	switch {
+	case apiKey == "":
+		return http.StatusUnauthorized, s.empty
+	case len(s.failures) > 0:
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		return status, s.empty
+	case s.rateLimit == 0:
+		return http.StatusTooManyRequests, s.empty
+	case s.rateLimit > 0:
+		s.rateLimit--
+	}
+	return http.StatusOK, s.empty
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/gifs/random", func(w http.ResponseWriter, r *http.Request) {
+		status, empty := s.next(r)
+		if status != http.StatusOK {
+			writeError(w, status)
+			return
+		}
+		if empty {
+			writeJSON(w, map[string]interface{}{"data": []interface{}{}, "meta": meta()})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"data": s.gif("random"), "meta": meta()})
+	})
+
+	mux.HandleFunc("/v1/gifs/translate", func(w http.ResponseWriter, r *http.Request) {
+		status, empty := s.next(r)
+		if status != http.StatusOK {
+			writeError(w, status)
+			return
+		}
+		if empty {
+			writeJSON(w, map[string]interface{}{"data": []interface{}{}, "meta": meta()})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"data": s.gif("translate-" + url.PathEscape(r.URL.Query().Get("s"))), "meta": meta()})
+	})
+
+	list := func(w http.ResponseWriter, r *http.Request, name string) {
+		status, empty := s.next(r)
+		if status != http.StatusOK {
+			writeError(w, status)
+			return
+		}
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 25
+		}
+		if empty {
+			limit = 0
+		}
+		data := make([]interface{}, limit)
+		for i := range data {
+			data[i] = s.gif(name)
+		}
+		writeJSON(w, map[string]interface{}{
+			"data":       data,
+			"meta":       meta(),
+			"pagination": map[string]int{"total_count": limit, "count": limit, "offset": 0},
+		})
+	}
+	mux.HandleFunc("/v1/gifs/search", func(w http.ResponseWriter, r *http.Request) {
+		list(w, r, "search-"+url.PathEscape(r.URL.Query().Get("q")))
+	})
+	mux.HandleFunc("/v1/gifs/trending", func(w http.ResponseWriter, r *http.Request) {
+		list(w, r, "trending")
+	})
+
+	return mux
+}
+
+// gif returns a gif with a URL that is unique for the server.
+func (s *Server) gif(name string) map[string]string {
+	s.lock.Lock()
+	s.gifs++
+	id := fmt.Sprintf("%s-%d", name, s.gifs)
+	s.lock.Unlock()
+
+	return map[string]string{
+		"type":      "gif",
+		"id":        id,
+		"url":       "https://giphy.com/gifs/" + id,
+		"image_url": "https://media.giphy.com/media/" + id + "/giphy.gif",
+	}
+}
+
+func meta() map[string]interface{} {
+	return map[string]interface{}{"status": http.StatusOK, "msg": "OK"}
+}
+
+// writeError writes an error in the format used by the Giphy API.
+func writeError(w http.ResponseWriter, status int) {
+	message := http.StatusText(status)
+	switch status {
+	case http.StatusUnauthorized:
+		message = "No API key found in request"
+	case http.StatusTooManyRequests:
+		message = "API rate limit exceeded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
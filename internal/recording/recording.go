@@ -0,0 +1,55 @@
+// Package recording defines the format of recorded platform callbacks.
+// Callbacks are recorded by the connector and re-sent by the replay command of the connctd simulator.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Callback is a callback request received by the connector.
+// The body is stored as received, except for secrets which are masked by the connector before recording.
+type Callback struct {
+	Time          time.Time         `json:"time"`
+	CorrelationID string            `json:"correlationId,omitempty"`
+	Method        string            `json:"method"`
+	RequestURI    string            `json:"requestUri"`
+	Headers       map[string]string `json:"headers"`
+	Body          string            `json:"body"`
+	Status        int               `json:"status"`
+}
+
+// Writer appends callbacks as newline delimited JSON.
+type Writer struct {
+	encoder *json.Encoder
+	lock    sync.Mutex
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{encoder: json.NewEncoder(w)}
+}
+
+// Write appends a single callback. It is safe for concurrent use.
+func (w *Writer) Write(c Callback) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.encoder.Encode(c)
+}
+
+// Read returns all callbacks in the order they were recorded.
+func Read(r io.Reader) ([]Callback, error) {
+	var callbacks []Callback
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var c Callback
+		if err := decoder.Decode(&c); err == io.EOF {
+			return callbacks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, c)
+	}
+}
@@ -0,0 +1,92 @@
+// Package signing builds the signable payload of callbacks with a configurable list of signed headers.
+// With the default headers the payload is identical to crypto.SignablePayload of the SDK, which only signs the Date header.
+package signing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SignedHeadersHeaderKey is the header a signer uses to announce the headers it signed, in order.
+// Without it the verifier uses its configured headers.
+const SignedHeadersHeaderKey = "Signed-Headers"
+
+// DefaultHeaders are the headers signed by the connctd platform.
+var DefaultHeaders = []string{"Date"}
+
+// ErrorMissingHeader is returned if a signed header is missing from the request.
+var ErrorMissingHeader = errors.New("signable payload can not be generated since a signed header is missing")
+
+// ParseHeaders parses a comma separated list of header names.
+// The names are canonicalized and Date must be included, since the freshness of requests is based on it.
+func ParseHeaders(s string) ([]string, error) {
+	var headers []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("header %s is listed twice", name)
+		}
+		seen[name] = true
+		headers = append(headers, name)
+	}
+	if !seen["Date"] {
+		return nil, errors.New("the signed headers must include Date")
+	}
+	return headers, nil
+}
+
+// IsDefault reports whether the headers are the default headers, so the SDK signature validation can be used.
+func IsDefault(headers []string) bool {
+	return len(headers) == 1 && headers[0] == DefaultHeaders[0]
+}
+
+// Negotiate returns the headers the request was signed with.
+// If the request announces its signed headers, they are used if they include all required headers.
+// Otherwise the required headers are used.
+func Negotiate(required []string, announced string) ([]string, error) {
+	if announced == "" {
+		return required, nil
+	}
+	headers, err := ParseHeaders(announced)
+	if err != nil {
+		return nil, err
+	}
+	signed := map[string]bool{}
+	for _, name := range headers {
+		signed[name] = true
+	}
+	for _, name := range required {
+		if !signed[name] {
+			return nil, fmt.Errorf("required header %s is not signed", name)
+		}
+	}
+	return headers, nil
+}
+
+// Payload builds the payload which is signed, in the format of crypto.SignablePayload:
+// (method):-method-\r\n(url):-scheme-://-host--requestURI-\r\n(-header-):-value-\r\n...(body):-body-
+// The headers are written in the given order.
+func Payload(method string, scheme string, host string, requestURI string, header http.Header, signedHeaders []string, body []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	b.WriteString("(method):" + method + "\r\n")
+	b.WriteString("(url):" + scheme + "://" + host + requestURI + "\r\n")
+	for _, name := range signedHeaders {
+		value := header.Get(name)
+		if value == "" {
+			return nil, ErrorMissingHeader
+		}
+		b.WriteString("(" + name + "):" + value + "\r\n")
+	}
+	b.WriteString("(body):")
+	b.Write(body)
+
+	return b.Bytes(), nil
+}
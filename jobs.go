@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/service"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of jobs run by the job queue.
+const (
+	jobKindAction        = "action"
+	jobKindConnctdUpdate = "connctd_update"
+	jobKindThingCreation = "thing_creation"
+)
+
+// connctdUpdateJob is a property update or action result which could not be sent to connctd.
+// The token is not stored with the job, the instance is looked up by the hash of the token when the update is retried.
+type connctdUpdateJob struct {
+	CorrelationID   string                        `json:"correlationId,omitempty"`
+	TokenHash       string                        `json:"tokenHash"`
+	ThingID         string                        `json:"thingId,omitempty"`
+	ComponentID     string                        `json:"componentId,omitempty"`
+	PropertyID      string                        `json:"propertyId,omitempty"`
+	Value           string                        `json:"value,omitempty"`
+	LastUpdate      time.Time                     `json:"lastUpdate,omitempty"`
+	ActionRequestID string                        `json:"actionRequestId,omitempty"`
+	Status          connector.ActionRequestStatus `json:"status,omitempty"`
+	Error           string                        `json:"error,omitempty"`
+}
+
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// retryingClient enqueues property updates and action results which could not be sent to connctd, so they are retried.
+// The error is returned anyway, so the caller still logs the failed attempt. Calls of instances which need to be
+// re-authorized are not retried, they can not succeed with the rejected token.
+type retryingClient struct {
+	connector.Client
+	jobs *jobQueue
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *retryingClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+	if err != nil && !errors.Is(err, errInstanceUnauthorized) {
+		c.retry(ctx, connctdUpdateJob{
+			CorrelationID: correlationID(ctx),
+			TokenHash:     tokenHash(string(token)),
+			ThingID:       thingID,
+			ComponentID:   componentID,
+			PropertyID:    propertyID,
+			Value:         value,
+			LastUpdate:    lastUpdate,
+		})
+	}
+	return err
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *retryingClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	err := c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e)
+	if err != nil && !errors.Is(err, errInstanceUnauthorized) {
+		c.retry(ctx, connctdUpdateJob{
+			CorrelationID:   correlationID(ctx),
+			TokenHash:       tokenHash(string(token)),
+			ActionRequestID: actionRequestID,
+			Status:          status,
+			Error:           e,
+		})
+	}
+	return err
+}
+
+func (c *retryingClient) retry(ctx context.Context, update connctdUpdateJob) {
+	if err := c.jobs.Enqueue(ctx, jobKindConnctdUpdate, update); err != nil {
+		logrus.WithError(err).WithField("correlationId", update.CorrelationID).Warnln("failed to enqueue retry of connctd update")
+	}
+}
+
+// handleConnctdUpdateJobs retries the updates enqueued by the retrying client with the client it wraps.
+// Updates of instances which were removed in the meantime are dropped.
+func handleConnctdUpdateJobs(jobs *jobQueue, client connector.Client, db connector.Database) {
+	jobs.Handle(jobKindConnctdUpdate, func(ctx context.Context, payload json.RawMessage, lastAttempt bool) error {
+		var update connctdUpdateJob
+		if err := json.Unmarshal(payload, &update); err != nil {
+			return err
+		}
+		if update.CorrelationID != "" {
+			ctx = withCorrelationID(ctx, update.CorrelationID)
+		}
+		instances, err := db.GetInstances(ctx)
+		if err != nil {
+			return err
+		}
+		var token connector.InstantiationToken
+		for _, instance := range instances {
+			if tokenHash(string(instance.Token)) == update.TokenHash {
+				token = instance.Token
+			}
+		}
+		if token == "" {
+			logrus.WithField("correlationId", update.CorrelationID).Infoln("dropping connctd update of removed instance")
+			return nil
+		}
+
+		if update.ActionRequestID != "" {
+			err = client.UpdateActionStatus(ctx, token, update.ActionRequestID, update.Status, update.Error)
+		} else {
+			err = client.UpdateThingPropertyValue(ctx, token, update.ThingID, update.ComponentID, update.PropertyID, update.Value, update.LastUpdate)
+		}
+		if errors.Is(err, errInstanceUnauthorized) {
+			logrus.WithField("correlationId", update.CorrelationID).Infoln("dropping connctd update of instance which needs to be re-authorized")
+			return nil
+		}
+		return err
+	})
+}
+
+// thingCreationJob creates the missing things of an instance.
+type thingCreationJob struct {
+	CorrelationID string `json:"correlationId,omitempty"`
+	InstanceID    string `json:"instanceId"`
+}
+
+// thingCreationService answers instantiations whose things could not be created with an ongoing instantiation
+// and creates the things with a job, so a temporary failure of the connctd API does not fail the instantiation.
+// The instance is registered with the provider and completed once its things exist.
+type thingCreationService struct {
+	*service.DefaultConnectorService
+	db             connector.Database
+	client         connector.Client
+	provider       connector.Provider
+	thingTemplates connector.ThingTemplates
+	messages       *localizer
+	jobs           *jobQueue
+	hooks          []thingCreationHook
+}
+
+// AddInstance implements connector.ConnectorService.
+func (s *thingCreationService) AddInstance(ctx context.Context, request connector.InstantiationRequest) (*connector.InstantiationResponse, error) {
+	response, err := s.DefaultConnectorService.AddInstance(ctx, request)
+	s.notifyInstantiation(ctx, request, err)
+	if err == nil {
+		return response, nil
+	}
+	// Only failures after the instance was stored are retried
+	instance, dbErr := s.db.GetInstance(ctx, request.ID)
+	if dbErr != nil || len(instance.ThingMapping) >= len(s.thingTemplates(request)) {
+		return response, err
+	}
+	if err := s.jobs.Enqueue(ctx, jobKindThingCreation, thingCreationJob{correlationID(ctx), request.ID}); err != nil {
+		logrus.WithError(err).WithField("instanceId", request.ID).Warnln("failed to enqueue thing creation")
+		return response, err
+	}
+	logrus.WithError(err).WithField("instanceId", request.ID).WithField("correlationId", correlationID(ctx)).Warnln("failed to create things, retrying in the background")
+
+	installation, _ := s.installation(ctx, request.InstallationID)
+	return &connector.InstantiationResponse{
+		FurtherStep: connector.Step{Type: connector.StepText, Content: s.messages.Text(s.messages.Locale(installation), messageThingsPending)},
+	}, nil
+}
+
+// installation returns the configuration of the installation.
+func (s *thingCreationService) installation(ctx context.Context, installationId string) ([]connector.Configuration, error) {
+	installations, err := s.db.GetInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, installation := range installations {
+		if installation.ID == installationId {
+			return installation.Configuration, nil
+		}
+	}
+	return nil, errors.New("installation not found")
+}
+
+// handle creates the missing things of the instance, registers it with the provider and completes the instantiation.
+// If the last attempt fails, the instantiation is marked as failed.
+func (s *thingCreationService) handle(ctx context.Context, payload json.RawMessage, lastAttempt bool) error {
+	var creation thingCreationJob
+	if err := json.Unmarshal(payload, &creation); err != nil {
+		return err
+	}
+	if creation.CorrelationID != "" {
+		ctx = withCorrelationID(ctx, creation.CorrelationID)
+	}
+	instance, err := s.db.GetInstance(ctx, creation.InstanceID)
+	if err != nil {
+		logrus.WithError(err).WithField("instanceId", creation.InstanceID).Infoln("dropping thing creation of removed instance")
+		return nil
+	}
+
+	err = s.createThings(ctx, instance)
+	if errors.Is(err, errInstanceUnauthorized) {
+		logrus.WithField("instanceId", instance.ID).Infoln("dropping thing creation of instance which needs to be re-authorized")
+		return nil
+	}
+	if err != nil {
+		if lastAttempt {
+			if err := s.client.UpdateInstanceState(ctx, instance.Token, connector.InstantiationStateFailed, nil); err != nil {
+				logrus.WithError(err).WithField("instanceId", instance.ID).Warnln("failed to mark instantiation as failed")
+			}
+		}
+		return err
+	}
+	return s.client.UpdateInstanceState(ctx, instance.Token, connector.InstantiationStateComplete, nil)
+}
+
+func (s *thingCreationService) createThings(ctx context.Context, instance *connector.Instance) error {
+	templates := s.thingTemplates(connector.InstantiationRequest{
+		ID:             instance.ID,
+		InstallationID: instance.InstallationID,
+		Token:          instance.Token,
+		Configuration:  instance.Configuration,
+	})
+	// Things are identified by their external ID, e.g. the keyword, so only the missing ones are created
+	created := map[string]bool{}
+	for _, mapping := range instance.ThingMapping {
+		created[mapping.ExternalID] = true
+	}
+	var results []thingCreationResult
+	for _, template := range templates {
+		if created[template.ExternalID] {
+			continue
+		}
+		thing, err := s.CreateThing(ctx, instance.ID, template.Thing, template.ExternalID)
+		if err != nil {
+			s.notify(ctx, thingCreationResult{InstanceID: instance.ID, ExternalID: template.ExternalID, Err: err})
+			return err
+		}
+		results = append(results, thingCreationResult{InstanceID: instance.ID, ThingID: thing.ID, ExternalID: template.ExternalID})
+	}
+
+	instance, err := s.db.GetInstance(ctx, instance.ID)
+	if err != nil {
+		return err
+	}
+	// A reconciliation may have registered the instance without things in the meantime
+	s.provider.RemoveInstance(instance.ID)
+	if err := s.provider.RegisterInstances(instance); err != nil {
+		return err
+	}
+	for _, result := range results {
+		s.notify(ctx, result)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/crypto"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPublicKeyMaxAge is the time discovered keys are used if the discovery endpoint sends no Cache-Control max-age.
+const defaultPublicKeyMaxAge = time.Hour
+
+var errorNoPublicKey = connector.NewError("NO_PUBLIC_KEY", "No valid public key to verify the request signature", http.StatusServiceUnavailable)
+
+// publicKeySet is the response of the public key discovery endpoint.
+type publicKeySet struct {
+	Keys []struct {
+		ID        string `json:"id"`
+		PublicKey string `json:"publicKey"`
+	} `json:"keys"`
+}
+
+// publicKeyDiscovery periodically fetches the public keys of the connector publication from a discovery endpoint.
+// During a key rotation the endpoint returns the old and the new key, so callbacks signed with either are accepted.
+// Fetched keys expire after the max-age sent by the endpoint, so a key removed by connctd is not accepted forever
+// if the endpoint becomes unreachable. The static key from the environment is always accepted.
+type publicKeyDiscovery struct {
+	url      string
+	client   *http.Client
+	interval time.Duration
+	static   []ed25519.PublicKey
+	reporter ErrorReporter
+
+	fetched []ed25519.PublicKey
+	expires time.Time
+	lock    sync.RWMutex
+}
+
+func newPublicKeyDiscovery(url string, interval time.Duration, static []ed25519.PublicKey, reporter ErrorReporter) *publicKeyDiscovery {
+	return &publicKeyDiscovery{
+		url:      url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		interval: interval,
+		static:   static,
+		reporter: reporter,
+	}
+}
+
+// Keys returns all currently accepted public keys.
+func (d *publicKeyDiscovery) Keys() []ed25519.PublicKey {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	keys := append([]ed25519.PublicKey{}, d.static...)
+	if time.Now().Before(d.expires) {
+		keys = append(keys, d.fetched...)
+	}
+	return keys
+}
+
+// Refresh fetches the public keys from the discovery endpoint.
+func (d *publicKeyDiscovery) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch public keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch public keys: unexpected status %s", resp.Status)
+	}
+
+	var set publicKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode public keys: %w", err)
+	}
+	keys := make([]ed25519.PublicKey, 0, len(set.Keys))
+	ids := make([]string, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := base64.StdEncoding.DecodeString(k.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid public key %q", k.ID)
+		}
+		keys = append(keys, key)
+		ids = append(ids, k.ID)
+	}
+	if len(keys) == 0 {
+		return errors.New("discovery endpoint returned no public keys")
+	}
+
+	d.lock.Lock()
+	d.fetched = keys
+	d.expires = time.Now().Add(maxAge(resp.Header.Get("Cache-Control"), defaultPublicKeyMaxAge))
+	d.lock.Unlock()
+
+	logrus.WithField("keys", strings.Join(ids, ",")).Debugln("refreshed public keys")
+	return nil
+}
+
+// Run refreshes the keys periodically until the context is done.
+func (d *publicKeyDiscovery) Run(ctx context.Context) {
+	defer reportPanic(d.reporter, ErrorContext{Component: "public key discovery"})
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Refresh(ctx); err != nil {
+				d.reporter.Report(err, ErrorContext{Component: "public key discovery"})
+				logrus.WithError(err).Warnln("failed to refresh public keys")
+			}
+		}
+	}
+}
+
+// publicKeyFileCheckInterval is the interval in which the public key file is checked for changes.
+const publicKeyFileCheckInterval = 10 * time.Second
+
+// publicKeyFile accepts the public keys listed in a file, one base64 encoded key per line, lines starting with # are comments.
+// The file is loaded again once it changed, so a key can be rotated without restart: the new key is added, the connctd
+// publication is switched to it and the old key is removed afterwards. A file which fails to load keeps the previous keys.
+type publicKeyFile struct {
+	file     string
+	reporter ErrorReporter
+
+	keys    []ed25519.PublicKey
+	modTime time.Time
+	lock    sync.RWMutex
+}
+
+// newPublicKeyFile loads the keys of the file, which must exist and only contain valid keys.
+func newPublicKeyFile(file string, reporter ErrorReporter) (*publicKeyFile, error) {
+	f := &publicKeyFile{file: file, reporter: reporter}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Keys returns the given keys followed by the keys of the file.
+func (f *publicKeyFile) Keys(other func() []ed25519.PublicKey) func() []ed25519.PublicKey {
+	return func() []ed25519.PublicKey {
+		keys := append([]ed25519.PublicKey{}, other()...)
+		f.lock.RLock()
+		defer f.lock.RUnlock()
+		return append(keys, f.keys...)
+	}
+}
+
+// Reload loads the keys if the file changed since it was loaded last and reports whether it did.
+func (f *publicKeyFile) Reload() (bool, error) {
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read public key file: %w", err)
+	}
+	f.lock.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	content, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read public key file: %w", err)
+	}
+	var keys []ed25519.PublicKey
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parsePublicKey(line)
+		if err != nil {
+			return false, fmt.Errorf("invalid public key in line %d of %s: %w", i+1, f.file, err)
+		}
+		keys = append(keys, key)
+	}
+
+	f.lock.Lock()
+	f.keys = keys
+	f.modTime = info.ModTime()
+	f.lock.Unlock()
+	return true, nil
+}
+
+// Run checks the file for changes until the context is done.
+func (f *publicKeyFile) Run(ctx context.Context) {
+	defer reportPanic(f.reporter, ErrorContext{Component: "public key file"})
+
+	ticker := time.NewTicker(publicKeyFileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := f.Reload()
+			if err != nil {
+				f.reporter.Report(err, ErrorContext{Component: "public key file"})
+				logrus.WithError(err).Warnln("failed to reload public keys, the previous keys are accepted")
+				continue
+			}
+			if reloaded {
+				f.lock.RLock()
+				logrus.WithField("keys", len(f.keys)).Infoln("reloaded public keys")
+				f.lock.RUnlock()
+			}
+		}
+	}
+}
+
+// maxAge returns the max-age directive of a Cache-Control header or the fallback.
+func maxAge(cacheControl string, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return fallback
+}
+
+// keyRotatingHandler dispatches each callback to a connector handler created for the public key its signature was created with.
+// The handler of the SDK only supports a single public key, so the key is selected by verifying the signature up front.
+// Requests whose signature matches no key are passed to the handler of the first key, which rejects them with the usual errors.
+type keyRotatingHandler struct {
+	keys       func() []ed25519.PublicKey
+	newHandler func(publicKey ed25519.PublicKey) http.Handler
+
+	handlers map[string]http.Handler
+	lock     sync.Mutex
+}
+
+func newKeyRotatingHandler(keys func() []ed25519.PublicKey, newHandler func(publicKey ed25519.PublicKey) http.Handler) *keyRotatingHandler {
+	return &keyRotatingHandler{
+		keys:       keys,
+		newHandler: newHandler,
+		handlers:   map[string]http.Handler{},
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *keyRotatingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keys := h.keys()
+	if len(keys) == 0 {
+		errorNoPublicKey.Write(w)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		connector.ErrorInvalidBody.Write(w)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	key := keys[0]
+	if signature, err := base64.StdEncoding.DecodeString(r.Header.Get(crypto.SignatureHeaderKey)); err == nil {
+		params := connector.AutoProxyRequestValidationPreProcessor()(r)
+		if payload, err := crypto.SignablePayload(r.Method, params.Scheme, params.Host, params.RequestURI, r.Header, body); err == nil {
+			for _, k := range keys {
+				if crypto.Verify(k, payload, signature) {
+					key = k
+					break
+				}
+			}
+		}
+	}
+	h.handler(key).ServeHTTP(w, r)
+}
+
+// handler returns the connector handler for the key, creating it on first use.
+func (h *keyRotatingHandler) handler(key ed25519.PublicKey) http.Handler {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	handler, ok := h.handlers[string(key)]
+	if !ok {
+		handler = h.newHandler(key)
+		h.handlers[string(key)] = handler
+	}
+	return handler
+}
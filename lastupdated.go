@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+// LastUpdatedPropertyId is the property of each component holding the time its main property was last updated.
+const LastUpdatedPropertyId = "last_updated"
+
+// lastUpdatedProperties are the main properties of the components by the property holding the time of their last update.
+// The companion property is updated by lastUpdatedClient, the provider never sends values of it.
+var lastUpdatedProperties = map[propertyRef]propertyRef{
+	randomValueProperty:    {RandomComponentId, LastUpdatedPropertyId},
+	trendingValueProperty:  {TrendingComponentId, LastUpdatedPropertyId},
+	searchValueProperty:    {SearchComponentId, LastUpdatedPropertyId},
+	translateValueProperty: {TranslateComponentId, LastUpdatedPropertyId},
+}
+
+// lastUpdatedClient sends the time of each successful update of a main property as value of the last updated property
+// of its component, formatted as RFC 3339, so platform rules can react to components which were not updated for a while.
+// Empty values, which the property expiry sends for expired properties, are no update and leave it unchanged.
+type lastUpdatedClient struct {
+	connector.Client
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *lastUpdatedClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	if err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate); err != nil {
+		return err
+	}
+	companion, ok := lastUpdatedProperties[propertyRef{componentID, propertyID}]
+	if !ok || value == "" {
+		return nil
+	}
+	if lastUpdate.IsZero() {
+		lastUpdate = clock()
+	}
+	// The value was updated already, so a failure is only logged instead of failing the update
+	err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, companion.ComponentID, companion.PropertyID, lastUpdate.UTC().Format(time.RFC3339), lastUpdate)
+	if err != nil {
+		logrus.WithError(err).WithField("thingId", thingID).WithField("componentId", componentID).Warnln("failed to update last updated property")
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/db"
+	"github.com/jmoiron/sqlx"
+)
+
+// statementCreateLegacyThingMapping creates the thing mapping table of the SDK in databases of the legacy layout,
+// which stored the single thing of an instance in the thing_id column of the instances table.
+const statementCreateLegacyThingMapping = `CREATE TABLE IF NOT EXISTS instance_thing_mapping (
+	instance_id CHAR (36) NOT NULL,
+	thing_id CHAR (36) NOT NULL,
+	external_id VARCHAR (255),
+	FOREIGN KEY (instance_id)
+		REFERENCES instances(id) ON DELETE CASCADE
+)`
+
+// statementGetLegacyThings returns the things stored on instances which have no mapping yet.
+const statementGetLegacyThings = `SELECT id, thing_id FROM instances WHERE thing_id <> '' AND NOT EXISTS (
+	SELECT 1 FROM instance_thing_mapping WHERE instance_thing_mapping.instance_id = instances.id AND instance_thing_mapping.thing_id = instances.thing_id
+)`
+
+// legacyThing is the thing of an instance stored in the legacy layout.
+type legacyThing struct {
+	InstanceID string `db:"id"`
+	ThingID    string `db:"thing_id"`
+}
+
+// migrateLegacyThings moves the things of instances from the legacy layout to the thing mapping table and returns them.
+// Legacy instances have a single thing, which is mapped with an empty external ID like the thing of instances without keywords.
+// The thing_id column and the tokens of the instances are kept, so the migration can be run any number of times and only
+// maps things which are not mapped yet. With dryRun, the things are returned without being mapped.
+// The thing mapping table of legacy databases is created by the schema migrations.
+func migrateLegacyThings(ctx context.Context, database *sqlx.DB, dryRun bool) ([]legacyThing, error) {
+	tx, err := database.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var things []legacyThing
+	if err := tx.SelectContext(ctx, &things, statementGetLegacyThings); err != nil {
+		return nil, fmt.Errorf("failed to get legacy things: %w", err)
+	}
+	if dryRun || len(things) == 0 {
+		return things, nil
+	}
+	for _, thing := range things {
+		_, err := tx.ExecContext(ctx, tx.Rebind("INSERT INTO instance_thing_mapping (instance_id, thing_id, external_id) VALUES (?, ?, ?)"), thing.InstanceID, thing.ThingID, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to map thing %s of instance %s: %w", thing.ThingID, thing.InstanceID, err)
+		}
+	}
+	return things, tx.Commit()
+}
+
+// runMigrateLegacy applies the schema migrations and moves the things of a database in the legacy layout to the thing mapping table.
+// The connector does the same on start, the command lets operators check and migrate a database beforehand,
+// e.g. the database of a hosted connector.
+func runMigrateLegacy(args []string) error {
+	flags := flag.NewFlagSet("migrate-legacy", flag.ExitOnError)
+	driver := flags.String("driver", string(db.DefaultOptions.Driver), "database driver, one of sqlite3, mysql or postgres")
+	dsn := flags.String("dsn", db.DefaultOptions.DSN+"?_foreign_keys=on", "data source name of the database")
+	dryRun := flags.Bool("dry-run", false, "only list the things which would be mapped")
+	flags.Parse(args)
+
+	dbClient, err := db.NewDBClient(&db.DBOptions{Driver: db.DBDriverName(*driver), DSN: *dsn}, connector.DefaultLogger)
+	if err != nil {
+		return err
+	}
+	defer dbClient.DB.Close()
+
+	if _, err := migrateSchema(context.Background(), dbClient.DB); err != nil {
+		return err
+	}
+	things, err := migrateLegacyThings(context.Background(), dbClient.DB, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, thing := range things {
+		fmt.Printf("instance %s: thing %s\n", thing.InstanceID, thing.ThingID)
+	}
+	if *dryRun {
+		fmt.Printf("%d things would be mapped\n", len(things))
+	} else {
+		fmt.Printf("%d things mapped\n", len(things))
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/connctd/connector-go"
+)
+
+// maxCallbackBodySize limits the size of callback bodies.
+// Callbacks of the connctd platform are small, larger bodies are rejected before the signature is validated.
+const maxCallbackBodySize = 1 << 20
+
+var errorRequestTooLarge = connector.NewError("REQUEST_TOO_LARGE", "Request body is too large", http.StatusRequestEntityTooLarge)
+
+// limitBodyHandler rejects request bodies larger than maxBytes.
+// Bodies with a known length are rejected right away, all others fail while being read.
+func limitBodyHandler(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			errorRequestTooLarge.Write(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
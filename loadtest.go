@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/giphy-connector/internal/connctdtest"
+	"github.com/connctd/giphy-connector/internal/giphytest"
+	"github.com/sirupsen/logrus"
+)
+
+// runLoadTest registers many in-memory installations and instances with a Giphy provider and measures its update cycles.
+// Giphy is replaced by a local fake server and connctd by a fake client, so no quota is used and nothing leaves the host.
+// The update channel is drained by a single consumer like in the default service, optionally with a simulated connctd latency.
+func runLoadTest(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	installationCount := flags.Int("installations", 1000, "number of installations to register")
+	instanceCount := flags.Int("instances", 1, "number of instances per installation")
+	cycles := flags.Int("cycles", 3, "number of update cycles to run")
+	latency := flags.Duration("connctd-latency", 0, "simulated duration of each connctd API call")
+	flags.Parse(args)
+
+	// Per instance logs would dominate the measurement
+	logrus.SetLevel(logrus.WarnLevel)
+
+	giphy := giphytest.NewServer()
+	defer giphy.Close()
+	giphyURL, err := url.Parse(giphy.URL())
+	if err != nil {
+		return err
+	}
+
+	reporter := nopReporter{}
+	giphyProvider := NewGiphyProvider(reporter, newCorrelationRegistry(), newQuotaTracker(0, 0, reporter, newMetricsRegistry()), newLogSampler(0), nil)
+	giphyProvider.SetBaseURL(giphyURL)
+
+	for i := 0; i < *installationCount; i++ {
+		installation := &connector.Installation{
+			ID:            fmt.Sprintf("loadtest-installation-%d", i),
+			Configuration: []connector.Configuration{{ID: "giphy_api_key", Value: "loadtest"}},
+		}
+		giphyProvider.RegisterInstallations(installation)
+		for j := 0; j < *instanceCount; j++ {
+			id := fmt.Sprintf("loadtest-instance-%d-%d", i, j)
+			giphyProvider.RegisterInstances(&connector.Instance{
+				ID:             id,
+				InstallationID: installation.ID,
+				ThingMapping:   []connector.ThingMapping{{InstanceID: id, ThingID: "thing-" + id}},
+			})
+		}
+	}
+
+	// Drain the update channel like the event handler of the default service
+	client := connctdtest.NewClient()
+	go func() {
+		for update := range giphyProvider.UpdateChannel() {
+			if *latency > 0 {
+				time.Sleep(*latency)
+			}
+			e := update.PropertyUpdateEvent
+			client.UpdateThingPropertyValue(context.Background(), "", e.ThingId, e.ComponentId, e.PropertyId, e.Value, time.Now())
+		}
+	}()
+
+	// Sample the fill level of the update channel
+	saturation := &channelSampler{}
+	stopSampling := make(chan struct{})
+	go saturation.run(giphyProvider.UpdateChannel(), stopSampling)
+
+	fmt.Printf("Running %d update cycles with %d installations and %d instances\n", *cycles, *installationCount, *installationCount**instanceCount)
+
+	start := time.Now()
+	durations := make([]time.Duration, *cycles)
+	for i := range durations {
+		cycleStart := time.Now()
+		giphyProvider.update()
+		giphyProvider.updateInstances()
+		durations[i] = time.Since(cycleStart)
+		fmt.Printf("cycle %d: %s\n", i+1, durations[i].Round(time.Millisecond))
+	}
+
+	// Wait until all updates were sent to connctd
+	expected := *cycles * *installationCount * *instanceCount
+	deadline := time.Now().Add(time.Minute)
+	for client.Calls(connctdtest.MethodUpdateThingPropertyValue) < expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	close(stopSampling)
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	calls := client.Calls(connctdtest.MethodUpdateThingPropertyValue)
+	maxFill, fullShare := saturation.result()
+
+	fmt.Printf("\nupdate cycle     min %s / avg %s / max %s\n", durations[0].Round(time.Millisecond), (total / time.Duration(len(durations))).Round(time.Millisecond), durations[len(durations)-1].Round(time.Millisecond))
+	fmt.Printf("giphy requests   %d (%.0f/s)\n", len(giphy.Requests()), float64(len(giphy.Requests()))/elapsed.Seconds())
+	fmt.Printf("connctd calls    %d of %d (%.0f/s)\n", calls, expected, float64(calls)/elapsed.Seconds())
+	fmt.Printf("update channel   max fill %d of %d, full in %.1f%% of samples\n", maxFill, cap(giphyProvider.UpdateChannel()), fullShare*100)
+	if durations[len(durations)-1] > time.Minute {
+		fmt.Println("\nWARNING: update cycles take longer than the update interval of one minute")
+	}
+	return nil
+}
+
+// channelSampler periodically samples the number of queued elements of a channel.
+type channelSampler struct {
+	samples int
+	full    int
+	maxFill int
+	lock    sync.Mutex
+}
+
+func (s *channelSampler) run(ch <-chan connector.UpdateEvent, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fill := len(ch)
+			s.lock.Lock()
+			s.samples++
+			if fill >= cap(ch) {
+				s.full++
+			}
+			if fill > s.maxFill {
+				s.maxFill = fill
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// result returns the maximum fill level and the share of samples in which the channel was full.
+func (s *channelSampler) result() (int, float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.samples == 0 {
+		return s.maxFill, 0
+	}
+	return s.maxFill, float64(s.full) / float64(s.samples)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logSampler deduplicates high frequency error logs.
+// The first occurrence of an error is always logged, afterwards only every nth occurrence is logged
+// together with the number of occurrences so far.
+type logSampler struct {
+	every  int
+	counts map[string]map[string]int
+	lock   sync.Mutex
+}
+
+// newLogSampler returns a sampler which logs every nth occurrence of a repeated error.
+// A value of 1 or less disables sampling.
+func newLogSampler(every int) *logSampler {
+	return &logSampler{
+		every:  every,
+		counts: map[string]map[string]int{},
+	}
+}
+
+// allow counts an occurrence of the message for the key and reports whether it should be logged.
+func (s *logSampler) allow(key string, message string) (bool, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	messages, ok := s.counts[key]
+	if !ok {
+		messages = map[string]int{}
+		s.counts[key] = messages
+	}
+	messages[message]++
+	count := messages[message]
+
+	return s.every <= 1 || count == 1 || count%s.every == 0, count
+}
+
+// Error logs the error unless the same error was logged for the same key recently.
+// The key identifies the source of the error, e.g. an instance.
+func (s *logSampler) Error(logger *logrus.Entry, key string, err error, message string) {
+	if ok, count := s.allow(key, message+": "+err.Error()); ok {
+		if count > 1 {
+			logger = logger.WithField("occurrences", count)
+		}
+		logger.WithError(err).Errorln(message)
+	}
+}
+
+// Reset forgets all errors of the key, e.g. after the source recovered.
+// The next error of the key will be logged again.
+func (s *logSampler) Reset(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.counts, key)
+}
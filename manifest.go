@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/connctd/connector-go/connctd"
+)
+
+// manifestPath is the path of the capability manifest on the callback listener.
+const manifestPath = "/manifest"
+
+// Types of configuration parameters in the manifest.
+const (
+	parameterTypeString   = "string"
+	parameterTypeEnum     = "enum"
+	parameterTypeList     = "list"
+	parameterTypeDuration = "duration"
+	parameterTypeURL      = "url"
+	parameterTypeTimezone = "timezone"
+)
+
+// Scopes of configuration parameters in the manifest.
+const (
+	parameterScopeInstallation = "installation"
+	parameterScopeInstance     = "instance"
+)
+
+// configurationParameter describes a configuration parameter of installations or instances.
+type configurationParameter struct {
+	ID          string   `json:"id"`
+	Scope       string   `json:"scope"`
+	Type        string   `json:"type"`
+	Required    bool     `json:"required"`
+	Secret      bool     `json:"secret"`
+	Values      []string `json:"values,omitempty"`
+	Description string   `json:"description"`
+}
+
+// configurationParameters are all configuration parameters the connector reads. Whether a parameter is secret
+// is decided by isSecretConfiguration, like for the redaction and encryption of its values.
+func configurationParameters() []configurationParameter {
+	parameters := []configurationParameter{
+		{ID: giphyApiKeyConfigID, Scope: parameterScopeInstallation, Type: parameterTypeString, Required: true, Description: "Giphy API key all requests of the installation are sent with"},
+		{ID: giphyRatingConfigID, Scope: parameterScopeInstallation, Type: parameterTypeEnum, Values: giphyRatings, Description: "content rating all GIFs of the installation are limited to"},
+		{ID: localeConfigID, Scope: parameterScopeInstallation, Type: parameterTypeEnum, Values: supportedLocales(), Description: "language of instructions and errors returned to the platform"},
+		{ID: webhookConfigID, Scope: parameterScopeInstallation, Type: parameterTypeURL, Description: "URL the property updates of the installation are posted to"},
+		{ID: searchThrottleConfigID, Scope: parameterScopeInstallation, Type: parameterTypeDuration, Description: "window in which repeated searches for the same keyword are answered with the previous result"},
+		{ID: keywordsConfigID, Scope: parameterScopeInstance, Type: parameterTypeList, Description: "comma separated keywords, each gets a thing searching for it"},
+		{ID: randomTagsConfigID, Scope: parameterScopeInstance, Type: parameterTypeList, Description: "comma separated tags the random GIF is picked from"},
+		{ID: updateIntervalConfigID, Scope: parameterScopeInstance, Type: parameterTypeDuration, Description: "interval of the periodic update, at least 30s"},
+		{ID: quietHoursConfigID, Scope: parameterScopeInstance, Type: parameterTypeList, Description: "comma separated time ranges like 22:00-06:00 without periodic update"},
+		{ID: quietHoursTimezoneConfigID, Scope: parameterScopeInstance, Type: parameterTypeTimezone, Description: "IANA timezone of the quiet hours, UTC by default"},
+		{ID: emptySearchResultConfigID, Scope: parameterScopeInstance, Type: parameterTypeEnum, Values: []string{emptySearchResultFail, emptySearchResultComplete}, Description: "whether searches without result fail or complete the action"},
+	}
+	for _, action := range handledActions {
+		parameters = append(parameters, configurationParameter{
+			ID:          actionParameterDefaultPrefix + action.ParameterID,
+			Scope:       parameterScopeInstance,
+			Type:        parameterTypeString,
+			Description: "default " + action.ParameterID + " of " + action.ComponentID + " actions without it",
+		})
+	}
+	for i := range parameters {
+		parameters[i].Secret = isSecretConfiguration(parameters[i].ID)
+	}
+	return parameters
+}
+
+// manifestAction is an action the connector handles, with the configuration parameter holding the default of its parameter.
+type manifestAction struct {
+	ComponentID      string `json:"componentId"`
+	ActionID         string `json:"actionId"`
+	ParameterID      string `json:"parameterId"`
+	DefaultParameter string `json:"defaultParameter"`
+}
+
+// manifest describes what the connector supports, so platform UIs and simulators can configure themselves.
+type manifest struct {
+	ThingTemplateVersion int                      `json:"thingTemplateVersion"`
+	Components           []manifestComponent      `json:"components"`
+	Actions              []manifestAction         `json:"actions"`
+	Configuration        []configurationParameter `json:"configuration"`
+	// Features are the optional features of the connector by name and whether they are enabled.
+	Features map[string]bool `json:"features"`
+}
+
+// newManifest returns the manifest of the thing template and the given features.
+// The components are taken from the thing of an instance without keywords, things of keywords have the same components.
+func newManifest(features map[string]bool) *manifest {
+	m := &manifest{
+		ThingTemplateVersion: thingTemplateVersion,
+		Configuration:        configurationParameters(),
+		Features:             features,
+	}
+	for _, template := range thingTemplate(goldenInstantiationRequest) {
+		for _, component := range template.Thing.Components {
+			m.Components = append(m.Components, newManifestComponent(component))
+		}
+	}
+	for _, action := range handledActions {
+		m.Actions = append(m.Actions, manifestAction{action.ComponentID, action.ActionID, action.ParameterID, actionParameterDefaultPrefix + action.ParameterID})
+	}
+	return m
+}
+
+// manifestComponent is a component of the thing template without the initial values of its properties, they are no capability.
+type manifestComponent struct {
+	ID            string             `json:"id"`
+	Name          string             `json:"name"`
+	ComponentType string             `json:"componentType"`
+	Capabilities  []string           `json:"capabilities"`
+	Properties    []manifestProperty `json:"properties,omitempty"`
+	Actions       []connctd.Action   `json:"actions,omitempty"`
+}
+
+type manifestProperty struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Unit         string            `json:"unit,omitempty"`
+	Type         connctd.ValueType `json:"type"`
+	PropertyType string            `json:"propertyType"`
+}
+
+func newManifestComponent(component connctd.Component) manifestComponent {
+	c := manifestComponent{component.ID, component.Name, component.ComponentType, component.Capabilities, nil, component.Actions}
+	for _, p := range component.Properties {
+		c.Properties = append(c.Properties, manifestProperty{p.ID, p.Name, p.Unit, p.Type, p.PropertyType})
+	}
+	return c
+}
+
+// manifestHandler serves the manifest at manifestPath and passes all other requests on.
+// The manifest contains no secrets and is served without authentication, like the health endpoint.
+func manifestHandler(m *manifest, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != manifestPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+	})
+}
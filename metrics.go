@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsRegistry collects counters and gauges and renders them in the Prometheus text exposition format.
+// It only implements the small subset of Prometheus features needed by the connector.
+type metricsRegistry struct {
+	families map[string]*metricVec
+	lock     sync.Mutex
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		families: map[string]*metricVec{},
+	}
+}
+
+// metricVec is a metric family with a fixed set of label names.
+type metricVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	values     map[string]*metricValue
+	lock       sync.Mutex
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+}
+
+// Counter registers a new counter family or returns the existing one with the same name.
+func (r *metricsRegistry) Counter(name string, help string, labelNames ...string) *metricVec {
+	return r.register(name, help, "counter", labelNames)
+}
+
+// Gauge registers a new gauge family or returns the existing one with the same name.
+func (r *metricsRegistry) Gauge(name string, help string, labelNames ...string) *metricVec {
+	return r.register(name, help, "gauge", labelNames)
+}
+
+func (r *metricsRegistry) register(name string, help string, kind string, labelNames []string) *metricVec {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if v, ok := r.families[name]; ok {
+		return v
+	}
+	v := &metricVec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     map[string]*metricValue{},
+	}
+	r.families[name] = v
+	return v
+}
+
+// Add adds delta to the value identified by the label values.
+// The label values must be given in the order of the label names.
+func (v *metricVec) Add(delta float64, labelValues ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(labelValues).value += delta
+}
+
+// Inc increments the value identified by the label values by one.
+func (v *metricVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Set sets the value identified by the label values.
+func (v *metricVec) Set(value float64, labelValues ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(labelValues).value = value
+}
+
+// Delete removes the value identified by the label values, e.g. after an installation was removed.
+func (v *metricVec) Delete(labelValues ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+// get must be called with the lock held.
+func (v *metricVec) get(labelValues []string) *metricValue {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	value, ok := v.values[key]
+	if !ok {
+		value = &metricValue{labelValues: append([]string{}, labelValues...)}
+		v.values[key] = value
+	}
+	return value
+}
+
+// write renders the family in the Prometheus text format.
+func (v *metricVec) write(b *strings.Builder) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value := v.values[k]
+		b.WriteString(v.name)
+		if len(v.labelNames) > 0 {
+			b.WriteString("{")
+			for i, name := range v.labelNames {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				fmt.Fprintf(b, "%s=%s", name, strconv.Quote(value.labelValues[i]))
+			}
+			b.WriteString("}")
+		}
+		b.WriteString(" ")
+		b.WriteString(strconv.FormatFloat(value.value, 'g', -1, 64))
+		b.WriteString("\n")
+	}
+}
+
+// metricSample is a single value of a metric family.
+type metricSample struct {
+	name        string
+	kind        string
+	labelNames  []string
+	labelValues []string
+	value       float64
+}
+
+// samples returns the current values of the family.
+func (v *metricVec) samples() []metricSample {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	samples := make([]metricSample, 0, len(v.values))
+	for _, value := range v.values {
+		samples = append(samples, metricSample{
+			name:        v.name,
+			kind:        v.kind,
+			labelNames:  v.labelNames,
+			labelValues: value.labelValues,
+			value:       value.value,
+		})
+	}
+	return samples
+}
+
+// Samples returns the current values of all registered metrics.
+// It is used by exporters which push metrics instead of being scraped.
+func (r *metricsRegistry) Samples() []metricSample {
+	r.lock.Lock()
+	families := make([]*metricVec, 0, len(r.families))
+	for _, family := range r.families {
+		families = append(families, family)
+	}
+	r.lock.Unlock()
+
+	var samples []metricSample
+	for _, family := range families {
+		samples = append(samples, family.samples()...)
+	}
+	return samples
+}
+
+// ServeHTTP renders all registered metrics.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.lock.Unlock()
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		r.lock.Lock()
+		family := r.families[name]
+		r.lock.Unlock()
+		family.write(&b)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
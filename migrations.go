@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// statementCreateSchemaMigrations creates the table the applied schema migrations of the connector are recorded in.
+const statementCreateSchemaMigrations = `CREATE TABLE IF NOT EXISTS connector_schema_migrations (
+	version INTEGER NOT NULL,
+	description VARCHAR (255) NOT NULL,
+	applied BIGINT NOT NULL,
+	UNIQUE(version)
+)`
+
+// schemaMigration is a change of the tables of the connector, on top of the tables of the SDK.
+type schemaMigration struct {
+	version     int
+	description string
+	statement   string
+	// drivers replaces the statement for changes which differ between the database drivers, by driver name.
+	// Drivers without statement skip the migration, it is recorded nevertheless.
+	drivers map[string]string
+}
+
+// statementsWidenConfigurationValues change the configuration values of the SDK tables from VARCHAR (200) to TEXT,
+// since encrypted values are more than three times as long as their plaintext, e.g. the ones of webhook URLs.
+// SQLite does not enforce the length of VARCHAR columns, so it needs no change.
+var (
+	statementsWidenInstallationConfiguration = map[string]string{
+		"mysql":    "ALTER TABLE installation_configuration MODIFY value TEXT NOT NULL",
+		"postgres": "ALTER TABLE installation_configuration ALTER COLUMN value TYPE TEXT",
+	}
+	statementsWidenInstanceConfiguration = map[string]string{
+		"mysql":    "ALTER TABLE instance_configuration MODIFY value TEXT NOT NULL",
+		"postgres": "ALTER TABLE instance_configuration ALTER COLUMN value TYPE TEXT",
+	}
+)
+
+// schemaMigrations are the changes of the tables of the connector in the order they are applied.
+// Migrations are only added, applied migrations must not be changed. Replicas may start at the same time and
+// apply a migration concurrently, so statements must succeed on tables they were applied to already.
+// The first migrations create the tables which were created by the stores themselves before, so they exist already in older databases.
+var schemaMigrations = []schemaMigration{
+	{version: 1, description: "thing mapping of legacy databases", statement: statementCreateLegacyThingMapping},
+	{version: 2, description: "pending actions", statement: statementCreatePendingActions},
+	{version: 3, description: "processed actions", statement: statementCreateProcessedActions},
+	{version: 4, description: "shard replicas", statement: statementCreateReplicas},
+	{version: 5, description: "seen signatures", statement: statementCreateSeenSignatures},
+	{version: 6, description: "thing template versions", statement: statementCreateThingTemplateVersions},
+	{version: 7, description: "instance reauthorizations", statement: statementCreateInstanceReauthorizations},
+	{version: 8, description: "property values", statement: statementCreatePropertyValues},
+	{version: 9, description: "jobs", statement: statementCreateJobs},
+	{version: 10, description: "installation configuration values as text", drivers: statementsWidenInstallationConfiguration},
+	{version: 11, description: "instance configuration values as text", drivers: statementsWidenInstanceConfiguration},
+}
+
+// migrateSchema applies the schema migrations which were not applied to the database yet and returns their versions.
+// Unlike the migration of the SDK it is run on every start, so the tables of new features exist after an upgrade.
+func migrateSchema(ctx context.Context, database *sqlx.DB) ([]int, error) {
+	if _, err := database.ExecContext(ctx, statementCreateSchemaMigrations); err != nil {
+		return nil, fmt.Errorf("failed to create schema migrations table: %w", err)
+	}
+	var versions []int
+	if err := database.SelectContext(ctx, &versions, "SELECT version FROM connector_schema_migrations"); err != nil {
+		return nil, fmt.Errorf("failed to get applied schema migrations: %w", err)
+	}
+	applied := map[int]bool{}
+	for _, version := range versions {
+		applied[version] = true
+	}
+
+	var migrated []int
+	for _, migration := range schemaMigrations {
+		if applied[migration.version] {
+			continue
+		}
+		statement := migration.statement
+		if migration.drivers != nil {
+			statement = migration.drivers[database.DriverName()]
+		}
+		if statement != "" {
+			if _, err := database.ExecContext(ctx, statement); err != nil {
+				return migrated, fmt.Errorf("failed to apply schema migration %d (%s): %w", migration.version, migration.description, err)
+			}
+		}
+		_, err := database.ExecContext(ctx, database.Rebind("INSERT INTO connector_schema_migrations (version, description, applied) VALUES (?, ?, ?)"),
+			migration.version, migration.description, clock().Unix())
+		if err != nil {
+			// Another replica may have recorded the migration in the meantime
+			var count int
+			if countErr := database.GetContext(ctx, &count, database.Rebind("SELECT COUNT(*) FROM connector_schema_migrations WHERE version = ?"), migration.version); countErr != nil || count == 0 {
+				return migrated, fmt.Errorf("failed to record schema migration %d: %w", migration.version, err)
+			}
+			continue
+		}
+		logrus.WithField("version", migration.version).WithField("description", migration.description).Infoln("applied schema migration")
+		migrated = append(migrated, migration.version)
+	}
+	return migrated, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/connctd/connector-go/crypto"
+	"github.com/connctd/giphy-connector/internal/signing"
+)
+
+// payloadSigner signs data sent by the connector with the connector's own ed25519 key,
+// in the same format the platform signs callbacks with, so consumers can verify it like the connector verifies callbacks.
+type payloadSigner struct {
+	privateKey ed25519.PrivateKey
+}
+
+// loadOrGenerateSigningKey reads the base64 encoded seed of the signing key from the file.
+// If the file does not exist, a new key is generated and stored.
+// The key is always generated with crypto/rand, also in deterministic mode.
+func loadOrGenerateSigningKey(file string) (*payloadSigner, error) {
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid signing key in %s", file)
+		}
+		return &payloadSigner{ed25519.NewKeyFromSeed(seed)}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(privateKey.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return &payloadSigner{privateKey}, nil
+}
+
+// PublicKey returns the base64 encoded public key consumers verify the signatures with.
+func (s *payloadSigner) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.privateKey.Public().(ed25519.PublicKey))
+}
+
+// Sign sets the Date header of the request if it is missing and returns the signature over
+// the method, URL, Date header and body.
+func (s *payloadSigner) Sign(method string, u string, header http.Header, body []byte) (string, error) {
+	target, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if header.Get("Date") == "" {
+		header.Set("Date", clock().UTC().Format(http.TimeFormat))
+	}
+	payload, err := signing.Payload(method, target.Scheme, target.Host, target.RequestURI(), header, signing.DefaultHeaders, body)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(crypto.Sign(s.privateKey, payload)), nil
+}
+
+// SignData returns the base64 encoded signature over the data.
+func (s *payloadSigner) SignData(data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, data))
+}
+
+// VerifyData reports whether the base64 encoded signature over the data was made with the key.
+func (s *payloadSigner) VerifyData(data []byte, signature string) bool {
+	b, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && ed25519.Verify(s.privateKey.Public().(ed25519.PublicKey), data, b)
+}
+
+// SignRequest adds the Date and Signature headers to an outgoing request with the given body.
+func (s *payloadSigner) SignRequest(req *http.Request, body []byte) error {
+	signature, err := s.Sign(req.Method, req.URL.String(), req.Header, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(crypto.SignatureHeaderKey, signature)
+	return nil
+}
+
+// signingResponseWriter buffers the response, so the signature over the body can be sent as header.
+type signingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signingResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *signingResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// signingResponseHandler signs all responses of next.
+// The signature covers the method and URL of the request together with the Date header and body of the response,
+// so a response can not be passed off as the response to another request.
+// The URL is the one requested by the client, as seen by AutoProxyRequestValidationPreProcessor.
+// Backups are streamed instead of buffered for the signature, their encryption already protects them against modification.
+func signingResponseHandler(signer *payloadSigner, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == adminBackupPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &signingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		host := r.Host
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+		signature, err := signer.Sign(r.Method, scheme+"://"+host+r.URL.RequestURI(), w.Header(), sw.body.Bytes())
+		if err == nil {
+			w.Header().Set(crypto.SignatureHeaderKey, signature)
+		}
+		w.WriteHeader(sw.status)
+		w.Write(sw.body.Bytes())
+	})
+}
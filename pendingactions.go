@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/connctd/connector-go/provider"
+	"github.com/jmoiron/sqlx"
+)
+
+// statementCreatePendingActions creates the table pending action requests are stored in until they are finished.
+const statementCreatePendingActions = `CREATE TABLE IF NOT EXISTS pending_actions (
+	action_request_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	instance_id CHAR(36) NOT NULL,
+	payload TEXT NOT NULL,
+	received BIGINT NOT NULL
+)`
+
+// pendingActionStore stores the action requests answered with a pending status until their result was sent,
+// so actions which were not finished when the process stopped are run again on the next start.
+// The stored actions carry no token, like the pending actions of the provider.
+type pendingActionStore struct {
+	db *sqlx.DB
+}
+
+// newPendingActionStore returns a store of pending actions in the database.
+func newPendingActionStore(db *sqlx.DB) *pendingActionStore {
+	return &pendingActionStore{db}
+}
+
+// Put stores the pending action, an action request stored already is replaced.
+func (s *pendingActionStore) Put(ctx context.Context, pendingAction provider.PendingAction, received time.Time) error {
+	payload, err := json.Marshal(pendingAction)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM pending_actions WHERE action_request_id = ?"), pendingAction.ID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, tx.Rebind("INSERT INTO pending_actions (action_request_id, instance_id, payload, received) VALUES (?, ?, ?, ?)"),
+		pendingAction.ID, pendingAction.Instance.ID, string(payload), received.Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove deletes the action request once it is finished.
+func (s *pendingActionStore) Remove(ctx context.Context, actionRequestId string) error {
+	_, err := s.db.ExecContext(ctx, s.db.Rebind("DELETE FROM pending_actions WHERE action_request_id = ?"), actionRequestId)
+	return err
+}
+
+// storedPendingAction is a pending action with the time its request was received.
+type storedPendingAction struct {
+	provider.PendingAction
+	Received time.Time
+}
+
+// All returns the stored actions, the oldest first.
+func (s *pendingActionStore) All(ctx context.Context) ([]storedPendingAction, error) {
+	var rows []struct {
+		ID       string `db:"action_request_id"`
+		Payload  string `db:"payload"`
+		Received int64  `db:"received"`
+	}
+	if err := s.db.SelectContext(ctx, &rows, "SELECT action_request_id, payload, received FROM pending_actions ORDER BY received, action_request_id"); err != nil {
+		return nil, err
+	}
+	actions := make([]storedPendingAction, 0, len(rows))
+	for _, row := range rows {
+		var pendingAction provider.PendingAction
+		if err := json.Unmarshal([]byte(row.Payload), &pendingAction); err != nil {
+			return nil, fmt.Errorf("invalid pending action %s: %w", row.ID, err)
+		}
+		actions = append(actions, storedPendingAction{pendingAction, time.Unix(row.Received, 0)})
+	}
+	return actions, nil
+}
+
+// SetPendingActionStore lets the provider store pending actions, so they survive restarts. Must be called before the provider is started.
+// It is only needed if actions are not run by a job queue persisting them already.
+func (h *GiphyProvider) SetPendingActionStore(store *pendingActionStore) {
+	h.pendingStore = store
+}
+
+// storePendingAction stores the action request answered with a pending status. A failure is only logged,
+// the action is run anyway and only lost if the process stops before it is finished.
+func (h *GiphyProvider) storePendingAction(ctx context.Context, pendingAction provider.PendingAction, received time.Time) {
+	if h.pendingStore == nil {
+		return
+	}
+	if err := h.pendingStore.Put(ctx, pendingAction, received); err != nil {
+		h.logger.WithError(err).WithField("actionRequestId", pendingAction.ID).Warnln("failed to store pending action")
+	}
+}
+
+// ReplayPendingActions runs the stored actions which were not finished before the process stopped again.
+// Their results are sent like those of new action requests, so each of them is completed or failed.
+// It must be called once on start after the registrations were applied and returns the number of replayed actions.
+func (h *GiphyProvider) ReplayPendingActions(ctx context.Context) (int, error) {
+	if h.pendingStore == nil {
+		return 0, nil
+	}
+	actions, err := h.pendingStore.All(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load pending actions: %w", err)
+	}
+	for _, action := range actions {
+		h.stateLock.Lock()
+		h.pendingActions[action.ID] = PendingActionInfo{
+			ID:         action.ID,
+			ActionID:   action.ActionID,
+			InstanceID: action.Instance.ID,
+			ThingID:    action.ThingID,
+			Received:   action.Received,
+		}
+		h.stateLock.Unlock()
+
+		if h.jobs != nil {
+			err = h.jobs.Enqueue(ctx, jobKindAction, action.PendingAction)
+		} else {
+			_, err = h.DefaultProvider.RequestAction(ctx, action.Instance, action.ActionRequest)
+		}
+		if err != nil {
+			// The action stays stored, so it is replayed on the next start
+			h.stateLock.Lock()
+			delete(h.pendingActions, action.ID)
+			h.stateLock.Unlock()
+			return 0, fmt.Errorf("failed to replay action %s: %w", action.ID, err)
+		}
+	}
+	return len(actions), nil
+}
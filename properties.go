@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/connctd/connector-go"
+)
+
+// propertyRef identifies a property of the giphy thing by its component and property ID.
+// Values are only sent for the properties in publishedProperties, which the tests verify against the thing template,
+// so the provider can not publish to a property which does not exist.
+type propertyRef struct {
+	ComponentID string
+	PropertyID  string
+}
+
+// actionRef identifies an action of the giphy thing with the parameter it is called with.
+type actionRef struct {
+	ComponentID string
+	ActionID    string
+	ParameterID string
+}
+
+// The properties the provider sends values of.
+var (
+	randomValueProperty       = propertyRef{RandomComponentId, RandomPropertyId}
+	trendingValueProperty     = propertyRef{TrendingComponentId, TrendingPropertyId}
+	searchValueProperty       = propertyRef{SearchComponentId, SearchPropertyId}
+	searchResultCountProperty = propertyRef{SearchComponentId, SearchResultCountPropertyId}
+	searchResultsProperty     = propertyRef{SearchComponentId, SearchResultsPropertyId}
+	translateValueProperty    = propertyRef{TranslateComponentId, TranslatePropertyId}
+	// searchResultsTruncatedProperty accompanies the search results property.
+	searchResultsTruncatedProperty = propertyRef{SearchComponentId, SearchResultsTruncatedPropertyId}
+)
+
+// The actions the provider handles.
+var (
+	searchAction    = actionRef{SearchComponentId, SearchActionId, SearchActionParameterId}
+	translateAction = actionRef{TranslateComponentId, TranslateActionId, TranslateActionParameterId}
+)
+
+// publishedProperties are all properties the provider sends values of.
+var publishedProperties = []propertyRef{
+	randomValueProperty,
+	trendingValueProperty,
+	searchValueProperty,
+	searchResultCountProperty,
+	searchResultsProperty,
+	searchResultsTruncatedProperty,
+	translateValueProperty,
+}
+
+// handledActions are all actions the provider handles.
+var handledActions = []actionRef{searchAction, translateAction}
+
+// String returns the property as "component/property", e.g. "search/results".
+func (p propertyRef) String() string {
+	return p.ComponentID + "/" + p.PropertyID
+}
+
+// Event returns the event updating the property of the thing to the value.
+func (p propertyRef) Event(instanceId string, thingId string, value string) *connector.PropertyUpdateEvent {
+	return &connector.PropertyUpdateEvent{
+		InstanceId:  instanceId,
+		ThingId:     thingId,
+		ComponentId: p.ComponentID,
+		PropertyId:  p.PropertyID,
+		Value:       value,
+	}
+}
+
+// correlationKey returns the key the correlation ID of an update of the property of the thing is stored by.
+func (p propertyRef) correlationKey(thingId string) string {
+	return propertyKey(thingId, p.ComponentID, p.PropertyID)
+}
@@ -0,0 +1,296 @@
+// Package providertest checks implementations of connector.Provider against the behavior expected by the default service.
+// It covers registration and removal of installations and instances, the update channel and the action lifecycle.
+// The checks only use the connector.Provider interface, so any provider can run them.
+package providertest
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// UnsupportedActionID is requested by the action lifecycle checks to verify that unknown actions fail.
+const UnsupportedActionID = "providertest-unsupported-action"
+
+// Config describes the provider under test.
+type Config struct {
+	// Provider is the provider under test. It has to handle action requests, e.g. run its action handler.
+	Provider connector.Provider
+
+	// Sync applies pending registrations and removals.
+	// Providers based on provider.DefaultProvider apply them only at the beginning of their periodic update,
+	// so Sync should run the same update. Sync may be nil if registrations take effect immediately.
+	Sync func()
+
+	// InstallationConfiguration is used for all installations registered by the checks.
+	InstallationConfiguration []connector.Configuration
+
+	// InstanceConfiguration is used for all instances registered by the checks.
+	InstanceConfiguration []connector.Configuration
+
+	// Action is a supported action request which completes successfully.
+	// The IDs of the request are set by the checks. The action lifecycle is not checked if the action ID is empty.
+	Action connector.ActionRequest
+
+	// Timeout limits the wait for asynchronous action results. It defaults to ten seconds.
+	Timeout time.Duration
+}
+
+// TestProvider runs the conformance checks against a provider.
+// It registers its own installations and instances with random IDs and removes them afterwards.
+// Update events of other instances are ignored, but events of the checks are consumed from the update channel,
+// so nothing else should read the channel while the checks are running. All failed checks are returned as a single error.
+func TestProvider(config Config) error {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	c := &checker{config: config, provider: config.Provider}
+	c.updateChannel()
+	c.registration()
+	c.removal()
+	c.actionLifecycle()
+
+	if len(c.failures) == 0 {
+		return nil
+	}
+	return errors.New("provider conformance failed:\n\t" + strings.Join(c.failures, "\n\t"))
+}
+
+type checker struct {
+	config   Config
+	provider connector.Provider
+	failures []string
+}
+
+func (c *checker) errorf(format string, args ...interface{}) {
+	c.failures = append(c.failures, fmt.Sprintf(format, args...))
+}
+
+func (c *checker) sync() {
+	if c.config.Sync != nil {
+		c.config.Sync()
+	}
+}
+
+// register registers a new installation with one instance mapped to one thing.
+// The returned function removes both again.
+func (c *checker) register() (*connector.Installation, *connector.Instance, func(), error) {
+	installation := &connector.Installation{
+		ID:            newId(),
+		Token:         "installation-token",
+		Configuration: c.config.InstallationConfiguration,
+	}
+	instanceId := newId()
+	instance := &connector.Instance{
+		ID:             instanceId,
+		InstallationID: installation.ID,
+		Token:          "instance-token",
+		Configuration:  c.config.InstanceConfiguration,
+		ThingMapping:   []connector.ThingMapping{{InstanceID: instanceId, ThingID: newId()}},
+	}
+
+	if err := c.provider.RegisterInstallations(installation); err != nil {
+		return nil, nil, nil, fmt.Errorf("RegisterInstallations: %w", err)
+	}
+	if err := c.provider.RegisterInstances(instance); err != nil {
+		return nil, nil, nil, fmt.Errorf("RegisterInstances: %w", err)
+	}
+	c.sync()
+
+	remove := func() {
+		c.provider.RemoveInstance(instance.ID)
+		c.provider.RemoveInstallation(installation.ID)
+		c.sync()
+	}
+	return installation, instance, remove, nil
+}
+
+// updateChannel checks that the update channel exists, is always the same channel and is not closed.
+func (c *checker) updateChannel() {
+	ch := c.provider.UpdateChannel()
+	if ch == nil {
+		c.errorf("UpdateChannel: returned nil")
+		return
+	}
+	if c.provider.UpdateChannel() != ch {
+		c.errorf("UpdateChannel: returned a different channel on the second call")
+	}
+	select {
+	case _, ok := <-ch:
+		if !ok {
+			c.errorf("UpdateChannel: channel is closed")
+		}
+	default:
+	}
+}
+
+// registration registers an installation and an instance and removes them again.
+func (c *checker) registration() {
+	installation, instance, _, err := c.register()
+	if err != nil {
+		c.errorf("%v", err)
+		return
+	}
+
+	// Registering the same installation again happens whenever the connector restarts and must not fail
+	if err := c.provider.RegisterInstallations(installation); err != nil {
+		c.errorf("RegisterInstallations: registering installation %s again: %v", installation.ID, err)
+	}
+
+	if err := c.provider.RemoveInstance(instance.ID); err != nil {
+		c.errorf("RemoveInstance: registered instance %s: %v", instance.ID, err)
+	}
+	if err := c.provider.RemoveInstallation(installation.ID); err != nil {
+		c.errorf("RemoveInstallation: registered installation %s: %v", installation.ID, err)
+	}
+	c.sync()
+
+	if err := c.provider.RegisterInstallations(); err != nil {
+		c.errorf("RegisterInstallations: no installations: %v", err)
+	}
+	if err := c.provider.RegisterInstances(); err != nil {
+		c.errorf("RegisterInstances: no instances: %v", err)
+	}
+}
+
+// removal checks that unknown and already removed installations and instances can not be removed.
+// The default service relies on these errors to answer removal requests for unknown IDs.
+func (c *checker) removal() {
+	if err := c.provider.RemoveInstallation(newId()); err == nil {
+		c.errorf("RemoveInstallation: expected an error for an unknown installation")
+	}
+	if err := c.provider.RemoveInstance(newId()); err == nil {
+		c.errorf("RemoveInstance: expected an error for an unknown instance")
+	}
+
+	installation, instance, _, err := c.register()
+	if err != nil {
+		c.errorf("%v", err)
+		return
+	}
+	c.provider.RemoveInstance(instance.ID)
+	c.provider.RemoveInstallation(installation.ID)
+	c.sync()
+
+	if err := c.provider.RemoveInstance(instance.ID); err == nil {
+		c.errorf("RemoveInstance: expected an error for removed instance %s", instance.ID)
+	}
+	if err := c.provider.RemoveInstallation(installation.ID); err == nil {
+		c.errorf("RemoveInstallation: expected an error for removed installation %s", installation.ID)
+	}
+}
+
+// actionLifecycle requests the supported and an unsupported action.
+// Pending actions have to be finished with an action event for the request on the update channel.
+func (c *checker) actionLifecycle() {
+	if c.config.Action.ActionID == "" {
+		return
+	}
+	_, instance, remove, err := c.register()
+	if err != nil {
+		c.errorf("%v", err)
+		return
+	}
+	defer remove()
+
+	supported := c.config.Action
+	supported.ID = newId()
+	supported.ThingID = instance.ThingMapping[0].ThingID
+	supported.Status = connector.ActionRequestStatusPending
+	if status := c.requestAction(instance, supported); status != "" && status != connector.ActionRequestStatusCompleted {
+		c.errorf("action %s: got status %s, want %s", supported.ActionID, status, connector.ActionRequestStatusCompleted)
+	}
+
+	unsupported := supported
+	unsupported.ID = newId()
+	unsupported.ActionID = UnsupportedActionID
+	unsupported.Parameters = nil
+	if status := c.requestAction(instance, unsupported); status != "" && status != connector.ActionRequestStatusFailed {
+		c.errorf("unsupported action: got status %s, want %s", status, connector.ActionRequestStatusFailed)
+	}
+}
+
+// requestAction requests the action and returns its final status.
+// It returns an empty status if a failure was already recorded.
+func (c *checker) requestAction(instance *connector.Instance, request connector.ActionRequest) connector.ActionRequestStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+	defer cancel()
+
+	status, err := c.provider.RequestAction(ctx, instance, request)
+	switch status {
+	case connector.ActionRequestStatusCompleted:
+		if err != nil {
+			c.errorf("RequestAction %s: completed with error %v", request.ActionID, err)
+			return ""
+		}
+		return status
+	case connector.ActionRequestStatusFailed:
+		if err == nil {
+			c.errorf("RequestAction %s: failed without an error", request.ActionID)
+			return ""
+		}
+		return status
+	case connector.ActionRequestStatusPending:
+		if err != nil {
+			c.errorf("RequestAction %s: pending with error %v", request.ActionID, err)
+			return ""
+		}
+	default:
+		c.errorf("RequestAction %s: unexpected status %q", request.ActionID, status)
+		return ""
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.errorf("RequestAction %s: no result for pending action request within %s", request.ActionID, c.config.Timeout)
+			return ""
+		case update, ok := <-c.provider.UpdateChannel():
+			if !ok {
+				c.errorf("RequestAction %s: update channel closed", request.ActionID)
+				return ""
+			}
+			event := update.ActionEvent
+			if event == nil || event.RequestId != request.ID {
+				continue
+			}
+			if event.InstanceId != instance.ID {
+				c.errorf("RequestAction %s: got action event for instance %s, want %s", request.ActionID, event.InstanceId, instance.ID)
+			}
+			if event.Response == nil {
+				c.errorf("RequestAction %s: action event without response", request.ActionID)
+				return ""
+			}
+			switch event.Response.Status {
+			case connector.ActionRequestStatusCompleted:
+				if update.PropertyUpdateEvent != nil && update.PropertyUpdateEvent.InstanceId != instance.ID {
+					c.errorf("RequestAction %s: property update for instance %s, want %s", request.ActionID, update.PropertyUpdateEvent.InstanceId, instance.ID)
+				}
+			case connector.ActionRequestStatusFailed:
+				if event.Response.Error == "" {
+					c.errorf("RequestAction %s: failed action event without error", request.ActionID)
+				}
+			default:
+				c.errorf("RequestAction %s: action event with non final status %q", request.ActionID, event.Response.Status)
+				return ""
+			}
+			return event.Response.Status
+		}
+	}
+}
+
+// newId returns a random UUID, so the checks do not collide with registrations of the provider.
+func newId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newOutboundTransport returns the transport of the connctd and Giphy clients.
+// Without a proxy URL the proxy is taken from HTTPS_PROXY, HTTP_PROXY and NO_PROXY like by the default transport,
+// a proxy URL is used for all requests regardless of these variables.
+// The certificates of the CA bundle are trusted in addition to the system CAs, e.g. for proxies which intercept TLS.
+func newOutboundTransport(proxyURL string, caBundleFile string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil {
+			// The parse error contains the URL, which may contain credentials of the proxy
+			return nil, errors.New("invalid proxy url")
+		}
+		if proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5" {
+			return nil, fmt.Errorf("invalid proxy url: unsupported scheme %q, expected http, https or socks5", proxy.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if caBundleFile == "" {
+		return transport, nil
+	}
+
+	pem, err := ioutil.ReadFile(caBundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("CA bundle contains no certificates")
+	}
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	return transport, nil
+}
+
+// transportTuning configures how many connections a transport keeps open to reuse them.
+// With many instances the default of 2 idle connections per host makes most requests open a new connection.
+type transportTuning struct {
+	// MaxIdleConnsPerHost is the number of idle connections kept per host.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept, 0 keeps it until the server closes it.
+	IdleConnTimeout time.Duration
+	// DisableCompression stops the transport from requesting gzip compressed responses.
+	DisableCompression bool
+}
+
+// tunedTransport returns a copy of the transport with the tuning applied, so the connctd and Giphy clients
+// can share the proxy and CA configuration but keep separate connection pools.
+func tunedTransport(transport *http.Transport, tuning transportTuning) *http.Transport {
+	tuned := transport.Clone()
+	tuned.MaxIdleConnsPerHost = tuning.MaxIdleConnsPerHost
+	if tuned.MaxIdleConns != 0 && tuned.MaxIdleConns < tuning.MaxIdleConnsPerHost {
+		tuned.MaxIdleConns = tuning.MaxIdleConnsPerHost
+	}
+	tuned.IdleConnTimeout = tuning.IdleConnTimeout
+	tuned.DisableCompression = tuning.DisableCompression
+	return tuned
+}
+
+// minCompressedRequestSize is the size from which request bodies are compressed, gzip makes smaller bodies larger.
+const minCompressedRequestSize = 1024
+
+// compressingTransport sends request bodies of at least minSize bytes gzip compressed with Content-Encoding: gzip,
+// e.g. the search results sent to connctd. It may only be used for APIs which accept compressed requests.
+type compressingTransport struct {
+	next    http.RoundTripper
+	minSize int
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *compressingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Header.Get("Content-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	c := req.Clone(req.Context())
+	if len(body) < t.minSize {
+		c.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return t.next.RoundTrip(c)
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	c.Body = ioutil.NopCloser(&compressed)
+	c.ContentLength = int64(compressed.Len())
+	c.Header.Set("Content-Encoding", "gzip")
+	return t.next.RoundTrip(c)
+}
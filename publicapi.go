@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+var errorNoGif = connector.NewError("NO_GIF", "No GIF was published for the instance yet", http.StatusNotFound)
+
+// PublishedGif is a GIF published to a property of an instance's thing.
+type PublishedGif struct {
+	URL     string    `json:"url"`
+	Updated time.Time `json:"updated"`
+}
+
+// InstanceGifs are the latest GIFs published for an instance.
+type InstanceGifs struct {
+	InstanceID string        `json:"instanceId"`
+	Random     *PublishedGif `json:"random,omitempty"`
+	Search     *PublishedGif `json:"search,omitempty"`
+}
+
+// publicAPIHandler serves the latest GIFs of instances to display clients without a connctd account:
+//
+//	GET /api/instances/{id}         the latest random and search GIF
+//	GET /api/instances/{id}/random  the latest random GIF
+//	GET /api/instances/{id}/search  the latest search result
+//
+// The values are the ones the connector sent to connctd since it was started.
+// If a token is given, requests must send it as bearer token, otherwise the instance ID is the only secret.
+type publicAPIHandler struct {
+	db        connector.Database
+	status    *statusRecorder
+	tokenHash []byte
+}
+
+func newPublicAPIHandler(db connector.Database, status *statusRecorder, token string) *publicAPIHandler {
+	h := &publicAPIHandler{db: db, status: status}
+	if token != "" {
+		hash := sha256.Sum256([]byte(token))
+		h.tokenHash = hash[:]
+	}
+	return h
+}
+
+func (h *publicAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Display clients may run in browsers on other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	if h.tokenHash != nil {
+		auth := r.Header.Get("Authorization")
+		hash := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare(hash[:], h.tokenHash) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="giphy-connector"`)
+			connector.ErrorUnauthorized.Write(w)
+			return
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/instances/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/api/instances/") || parts[0] == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	gifs, err := h.instanceGifs(r, parts[0])
+	if err != nil {
+		connector.ErrorInstanceNotFound.Write(w)
+		return
+	}
+
+	var gif *PublishedGif
+	switch {
+	case len(parts) == 1:
+		writeJSON(w, http.StatusOK, gifs)
+		return
+	case parts[1] == RandomComponentId:
+		gif = gifs.Random
+	case parts[1] == SearchComponentId:
+		gif = gifs.Search
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if gif == nil {
+		errorNoGif.Write(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, gif)
+}
+
+// instanceGifs returns the latest values of the GIF properties of the instance's thing.
+func (h *publicAPIHandler) instanceGifs(r *http.Request, instanceId string) (*InstanceGifs, error) {
+	instance, err := h.db.GetInstance(r.Context(), instanceId)
+	if err != nil {
+		return nil, err
+	}
+	gifs := &InstanceGifs{InstanceID: instance.ID}
+	for _, mapping := range instance.ThingMapping {
+		for _, value := range h.status.PropertyValues(mapping.ThingID) {
+			gif := &PublishedGif{URL: value.Value, Updated: value.Updated}
+			switch {
+			case value.ComponentID == RandomComponentId && value.PropertyID == RandomPropertyId:
+				gifs.Random = gif
+			case value.ComponentID == SearchComponentId && value.PropertyID == SearchPropertyId:
+				gifs.Search = gif
+			}
+		}
+	}
+	return gifs, nil
+}
+
+// publicAPIRouter serves the public API under /api/ and everything else with the callback handler.
+func publicAPIRouter(api http.Handler, callbacks http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", api)
+	mux.Handle("/", callbacks)
+	return mux
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// Instance configuration parameters of the quiet hours.
+const (
+	// quietHoursConfigID are comma separated time ranges like "22:00-06:00" in which the periodic update of the instance is suppressed.
+	quietHoursConfigID = "quiet_hours"
+	// quietHoursTimezoneConfigID is the IANA timezone of the quiet hours, e.g. "Europe/Berlin", UTC by default.
+	quietHoursTimezoneConfigID = "quiet_hours_timezone"
+)
+
+// errorInvalidQuietHoursID is the error of instantiations with invalid quiet hours, its description is localized.
+const errorInvalidQuietHoursID = "INVALID_QUIET_HOURS"
+
+// quietRange is a range of minutes of the day. Ranges ending before they start span midnight.
+type quietRange struct {
+	start int
+	end   int
+}
+
+// quietHours are the times of the day in which the periodic update of an instance is suppressed, e.g. overnight for signage.
+// Actions are still executed during quiet hours.
+type quietHours struct {
+	ranges   []quietRange
+	location *time.Location
+}
+
+// parseQuietHours parses the quiet hours configured for an instance. It returns nil if none are configured.
+func parseQuietHours(configuration []connector.Configuration) (*quietHours, error) {
+	var spec, timezone string
+	for _, c := range configuration {
+		switch c.ID {
+		case quietHoursConfigID:
+			spec = strings.TrimSpace(c.Value)
+		case quietHoursTimezoneConfigID:
+			timezone = strings.TrimSpace(c.Value)
+		}
+	}
+	if spec == "" {
+		return nil, nil
+	}
+
+	q := &quietHours{location: time.UTC}
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", timezone)
+		}
+		q.location = location
+	}
+	for _, r := range strings.Split(spec, ",") {
+		bounds := strings.Split(strings.TrimSpace(r), "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid range %q, expected start and end like 22:00-06:00", r)
+		}
+		start, err := parseMinuteOfDay(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseMinuteOfDay(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("invalid range %q, start and end are equal", r)
+		}
+		q.ranges = append(q.ranges, quietRange{start, end})
+	}
+	return q, nil
+}
+
+// parseMinuteOfDay parses a time like 06:30 as minutes since midnight.
+func parseMinuteOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, errors.New("invalid time " + value + ", expected hours and minutes like 06:30")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Active reports whether the time is within the quiet hours. A nil schedule is never active.
+func (q *quietHours) Active(now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	local := now.In(q.location)
+	minute := local.Hour()*60 + local.Minute()
+	for _, r := range q.ranges {
+		if r.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// End returns when the quiet hours active at the time end, adjoining ranges like 22:00-00:00,00:00-06:00 are joined.
+// It returns the time itself if the quiet hours are not active.
+func (q *quietHours) End(now time.Time) time.Time {
+	end := now
+	// Each step leaves at least one range, so ranges covering the whole day do not loop forever
+	for i := 0; i < len(q.ranges) && q.Active(end); i++ {
+		local := end.In(q.location)
+		minute := local.Hour()*60 + local.Minute()
+		remaining := 0
+		for _, r := range q.ranges {
+			if r.contains(minute) && (r.end-minute+24*60)%(24*60) > remaining {
+				remaining = (r.end - minute + 24*60) % (24 * 60)
+			}
+		}
+		end = local.Truncate(time.Minute).Add(time.Duration(remaining) * time.Minute)
+	}
+	return end
+}
+
+// contains reports whether the minute of the day is within the range.
+func (r quietRange) contains(minute int) bool {
+	if r.start < r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
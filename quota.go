@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// quotaTracker counts the Giphy requests made with the API key of each installation per UTC day.
+// Giphy silently starts rejecting requests once the daily quota of a key is used up,
+// so we alert as soon as a configurable share of the quota is consumed.
+// The counts are an approximation of the usage Giphy sees: they are kept per installation and in memory only,
+// so installations sharing an API key are counted separately, other replicas and other users of the key are not counted,
+// and a restart starts counting at zero again.
+type quotaTracker struct {
+	dailyQuota   int
+	alertPercent int
+	reporter     ErrorReporter
+	requests     *metricVec
+	usage        *metricVec
+	day          string
+	counts       map[string]int
+	alerted      map[string]bool
+	lock         sync.Mutex
+	now          func() time.Time
+}
+
+// QuotaUsage is the quota state of a single installation as returned by the admin API.
+type QuotaUsage struct {
+	InstallationID string  `json:"installationId"`
+	Day            string  `json:"day"`
+	Requests       int     `json:"requests"`
+	Quota          int     `json:"quota"`
+	UsedPercent    float64 `json:"usedPercent"`
+}
+
+// newQuotaTracker returns a tracker for the given daily quota which alerts once alertPercent of the quota is used.
+// A quota of zero or less disables alerts but requests are still counted.
+func newQuotaTracker(dailyQuota int, alertPercent int, reporter ErrorReporter, metrics *metricsRegistry) *quotaTracker {
+	return &quotaTracker{
+		dailyQuota:   dailyQuota,
+		alertPercent: alertPercent,
+		reporter:     reporter,
+		requests:     metrics.Counter("giphy_requests_total", "Number of requests sent to the Giphy API.", "installation_id"),
+		usage:        metrics.Gauge("giphy_quota_used_ratio", "Share of the daily Giphy quota used by the installation today.", "installation_id"),
+		counts:       map[string]int{},
+		alerted:      map[string]bool{},
+		now:          clock,
+	}
+}
+
+// Record counts a Giphy request made for the given installation.
+func (q *quotaTracker) Record(installationId string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.rollover()
+	q.counts[installationId]++
+	count := q.counts[installationId]
+
+	q.requests.Inc(installationId)
+	if q.dailyQuota <= 0 {
+		return
+	}
+	q.usage.Set(float64(count)/float64(q.dailyQuota), installationId)
+
+	if !q.alerted[installationId] && count*100 >= q.dailyQuota*q.alertPercent {
+		q.alerted[installationId] = true
+		err := fmt.Errorf("installation used %d of %d daily Giphy requests", count, q.dailyQuota)
+		logrus.WithField("installationId", installationId).WithField("alertPercent", q.alertPercent).WithError(err).Warnln("Giphy quota threshold reached")
+		q.reporter.Report(err, ErrorContext{Component: "giphy quota", InstallationID: installationId})
+	}
+}
+
+// Remove discards the counts of a removed installation.
+func (q *quotaTracker) Remove(installationId string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.counts, installationId)
+	delete(q.alerted, installationId)
+	q.usage.Delete(installationId)
+}
+
+// Usage returns the quota state of all installations that made requests today.
+func (q *quotaTracker) Usage() []QuotaUsage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.rollover()
+	usage := make([]QuotaUsage, 0, len(q.counts))
+	for id, count := range q.counts {
+		u := QuotaUsage{
+			InstallationID: id,
+			Day:            q.day,
+			Requests:       count,
+			Quota:          q.dailyQuota,
+		}
+		if q.dailyQuota > 0 {
+			u.UsedPercent = float64(count) * 100 / float64(q.dailyQuota)
+		}
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].InstallationID < usage[j].InstallationID })
+	return usage
+}
+
+// rollover resets all counts when the UTC day changed.
+// It must be called with the lock held.
+func (q *quotaTracker) rollover() {
+	day := q.now().UTC().Format("2006-01-02")
+	if day == q.day {
+		return
+	}
+	q.day = day
+	for id := range q.counts {
+		q.usage.Set(0, id)
+	}
+	q.counts = map[string]int{}
+	q.alerted = map[string]bool{}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/connctd/connector-go"
+)
+
+// randomTagsConfigID is the optional instance configuration parameter with comma separated tags, e.g. "cats,space".
+// The random GIFs of the instance's things without keyword are themed with one of the tags.
+const randomTagsConfigID = "random_tags"
+
+// maxRandomTags is the maximum number of random tags of an instance.
+const maxRandomTags = 20
+
+// instanceRandomTags returns the random tags configured for an instance, or nil if it has none.
+func instanceRandomTags(configuration []connector.Configuration) ([]string, error) {
+	var spec string
+	for _, c := range configuration {
+		if c.ID == randomTagsConfigID {
+			spec = strings.TrimSpace(c.Value)
+		}
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(spec, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			return nil, fmt.Errorf("empty or duplicate tag %q", tag)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxRandomTags {
+		return nil, fmt.Errorf("%d tags, at most %d are allowed", len(tags), maxRandomTags)
+	}
+	return tags, nil
+}
+
+// randomTag picks one of the random tags of the instance, or returns an empty string if it has none.
+// The Giphy random endpoint filters by a single tag, so each update of a thing gets a GIF of one tag.
+// Invalid tags were rejected on instantiation and are ignored.
+func randomTag(configuration []connector.Configuration) string {
+	tags, err := instanceRandomTags(configuration)
+	if err != nil || len(tags) == 0 {
+		return ""
+	}
+	var b [4]byte
+	if _, err := randomness.Read(b[:]); err != nil {
+		return tags[0]
+	}
+	return tags[binary.BigEndian.Uint32(b[:])%uint32(len(tags))]
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// readinessRetryAfter is the time callbacks received during the start are asked to be retried after.
+const readinessRetryAfter = 5 * time.Second
+
+var errorNotReady = connector.NewError("NOT_READY", "The connector is starting, retry later", http.StatusServiceUnavailable)
+
+// readinessGate is opened once the installations and instances loaded from the database are registered with the provider.
+// Until then the provider does not know them, so an action could fail for an instance which exists.
+type readinessGate struct {
+	ready chan struct{}
+	once  sync.Once
+}
+
+func newReadinessGate() *readinessGate {
+	return &readinessGate{ready: make(chan struct{})}
+}
+
+// Open marks the connector as ready. It can be called more than once.
+func (g *readinessGate) Open() {
+	g.once.Do(func() { close(g.ready) })
+}
+
+// Ready reports whether the gate was opened.
+func (g *readinessGate) Ready() bool {
+	select {
+	case <-g.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// readinessHandler responds with service unavailable and a Retry-After header until the gate is opened.
+func readinessHandler(gate *readinessGate, next http.Handler) http.Handler {
+	retryAfter := strconv.Itoa(int(readinessRetryAfter.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !gate.Ready() {
+			w.Header().Set("Retry-After", retryAfter)
+			errorNotReady.Write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// statementCreateInstanceReauthorizations creates the table the instances whose token was rejected by connctd are recorded in.
+const statementCreateInstanceReauthorizations = `CREATE TABLE IF NOT EXISTS instance_reauthorizations (
+	instance_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	since BIGINT NOT NULL
+)`
+
+// errInstanceUnauthorized is returned instead of calling connctd with the token of an instance which needs to be re-authorized.
+var errInstanceUnauthorized = errors.New("the token of the instance was rejected by connctd, it needs to be re-authorized")
+
+// reauthorizationTracker records instances whose token was rejected by connctd with 401 Unauthorized,
+// e.g. because the platform invalidated or rotated it. Calls with such a token can not succeed, so they are not
+// made or retried until an operator marks the instance as re-authorized. The instances are stored in the database,
+// so they survive restarts.
+type reauthorizationTracker struct {
+	db       *sqlx.DB
+	database connector.Database
+	reporter ErrorReporter
+	rejected *metricVec
+
+	instances map[string]time.Time // since when the instance needs re-authorization, by instance ID
+	tokens    map[string]string    // instance ID by token hash
+	lock      sync.Mutex
+}
+
+// newReauthorizationTracker returns a tracker with the instances recorded in the database.
+func newReauthorizationTracker(ctx context.Context, db *sqlx.DB, database connector.Database, reporter ErrorReporter, metrics *metricsRegistry) (*reauthorizationTracker, error) {
+	t := &reauthorizationTracker{
+		db:        db,
+		database:  database,
+		reporter:  reporter,
+		rejected:  metrics.Counter("connctd_unauthorized_total", "Number of calls to connctd rejected because the instance token is invalid."),
+		instances: map[string]time.Time{},
+		tokens:    map[string]string{},
+	}
+
+	var rows []struct {
+		InstanceID string `db:"instance_id"`
+		Since      int64  `db:"since"`
+	}
+	if err := db.SelectContext(ctx, &rows, "SELECT instance_id, since FROM instance_reauthorizations"); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		instance, err := database.GetInstance(ctx, row.InstanceID)
+		if err != nil {
+			continue
+		}
+		t.instances[instance.ID] = time.Unix(row.Since, 0)
+		t.tokens[tokenHash(string(instance.Token))] = instance.ID
+	}
+	return t, nil
+}
+
+// Rejected records that connctd rejected the token. Tokens of unknown instances are ignored.
+func (t *reauthorizationTracker) Rejected(ctx context.Context, token string) {
+	t.rejected.Inc()
+	hash := tokenHash(token)
+
+	t.lock.Lock()
+	_, known := t.tokens[hash]
+	t.lock.Unlock()
+	if known {
+		return
+	}
+
+	instances, err := t.database.GetInstances(ctx)
+	if err != nil {
+		logrus.WithError(err).Warnln("failed to look up the instance of a rejected token")
+		return
+	}
+	for _, instance := range instances {
+		if tokenHash(string(instance.Token)) != hash {
+			continue
+		}
+		now := clock()
+		if _, err := t.db.ExecContext(ctx, t.db.Rebind("INSERT INTO instance_reauthorizations (instance_id, since) VALUES (?, ?)"), instance.ID, now.Unix()); err != nil {
+			logrus.WithError(err).WithField("instanceId", instance.ID).Warnln("failed to record that the instance needs to be re-authorized")
+		}
+		t.lock.Lock()
+		t.instances[instance.ID] = now
+		t.tokens[hash] = instance.ID
+		t.lock.Unlock()
+
+		logrus.WithField("instanceId", instance.ID).WithField("correlationId", correlationID(ctx)).Warnln("connctd rejected the instance token, the instance needs to be re-authorized")
+		t.reporter.Report(errInstanceUnauthorized, ErrorContext{
+			Component:      "connctd client",
+			CorrelationID:  correlationID(ctx),
+			InstallationID: instance.InstallationID,
+			InstanceID:     instance.ID,
+		})
+		return
+	}
+}
+
+// Reauthorized removes the instance, so calls with its token are made again.
+func (t *reauthorizationTracker) Reauthorized(ctx context.Context, instanceId string) error {
+	if _, err := t.db.ExecContext(ctx, t.db.Rebind("DELETE FROM instance_reauthorizations WHERE instance_id = ?"), instanceId); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.instances, instanceId)
+	for hash, id := range t.tokens {
+		if id == instanceId {
+			delete(t.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// NeedsReauthorization reports whether the token of the instance was rejected.
+func (t *reauthorizationTracker) NeedsReauthorization(instanceId string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.instances[instanceId]
+	return ok
+}
+
+// Instances returns since when the instances need to be re-authorized, by instance ID.
+func (t *reauthorizationTracker) Instances() map[string]time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	instances := make(map[string]time.Time, len(t.instances))
+	for id, since := range t.instances {
+		instances[id] = since
+	}
+	return instances
+}
+
+func (t *reauthorizationTracker) tokenRejected(token string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.tokens[tokenHash(token)]
+	return ok
+}
+
+// unauthorizedTransport reports responses of connctd with status 401 Unauthorized to the tracker.
+// The SDK client does not return the status code, so the responses are inspected before they reach it.
+type unauthorizedTransport struct {
+	next    http.RoundTripper
+	tracker *reauthorizationTracker
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *unauthorizedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+			t.tracker.Rejected(r.Context(), token)
+		}
+	}
+	return resp, err
+}
+
+// reauthorizingClient does not call connctd with tokens which were rejected before and returns errInstanceUnauthorized instead.
+// Calls rejected right now fail with errInstanceUnauthorized as well, so they are not retried.
+type reauthorizingClient struct {
+	connector.Client
+	tracker *reauthorizationTracker
+}
+
+// check returns errInstanceUnauthorized if the token was rejected, wrapping the error of the call if there was one.
+func (c *reauthorizingClient) check(token connector.InstantiationToken, err error) error {
+	if !c.tracker.tokenRejected(string(token)) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInstanceUnauthorized, err)
+	}
+	return errInstanceUnauthorized
+}
+
+// CreateThing implements connector.Client.
+func (c *reauthorizingClient) CreateThing(ctx context.Context, token connector.InstantiationToken, thing connctd.Thing) (connctd.Thing, error) {
+	if err := c.check(token, nil); err != nil {
+		return connctd.Thing{}, err
+	}
+	result, err := c.Client.CreateThing(ctx, token, thing)
+	return result, c.check(token, err)
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *reauthorizingClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	if err := c.check(token, nil); err != nil {
+		return err
+	}
+	return c.check(token, c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate))
+}
+
+// UpdateThingStatus implements connector.Client.
+func (c *reauthorizingClient) UpdateThingStatus(ctx context.Context, token connector.InstantiationToken, thingID string, status connctd.StatusType) error {
+	if err := c.check(token, nil); err != nil {
+		return err
+	}
+	return c.check(token, c.Client.UpdateThingStatus(ctx, token, thingID, status))
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *reauthorizingClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	if err := c.check(token, nil); err != nil {
+		return err
+	}
+	return c.check(token, c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e))
+}
+
+// UpdateInstanceState implements connector.Client.
+func (c *reauthorizingClient) UpdateInstanceState(ctx context.Context, token connector.InstantiationToken, state connector.InstantiationState, details json.RawMessage) error {
+	if err := c.check(token, nil); err != nil {
+		return err
+	}
+	return c.check(token, c.Client.UpdateInstanceState(ctx, token, state, details))
+}
+
+// DeleteThing implements connector.Client.
+func (c *reauthorizingClient) DeleteThing(ctx context.Context, token connector.InstantiationToken, thingID string) error {
+	if err := c.check(token, nil); err != nil {
+		return err
+	}
+	return c.check(token, c.Client.DeleteThing(ctx, token, thingID))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/giphy-connector/internal/recording"
+	"github.com/sirupsen/logrus"
+)
+
+// recordedHeaders are the request headers stored with each recorded callback.
+// The signature is not recorded, it does not match the masked body anyway.
+var recordedHeaders = []string{"Content-Type", "Date", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// NewCallbackRecorder returns a writer appending recorded callbacks to the given file.
+func NewCallbackRecorder(file string) (*recording.Writer, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open callback recording: %w", err)
+	}
+	return recording.NewWriter(f), nil
+}
+
+// recordHandler records all callbacks together with the response status, so they can be replayed with the connctd simulator.
+// Tokens and secret configuration values are masked before they are written.
+func recordHandler(recorder *recording.Writer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			connector.ErrorInvalidBody.Write(w)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		callback := recording.Callback{
+			Time:          clock().UTC(),
+			CorrelationID: correlationID(r.Context()),
+			Method:        r.Method,
+			RequestURI:    r.URL.RequestURI(),
+			Headers:       map[string]string{},
+			Body:          redactCallbackBody(body),
+			Status:        sw.status,
+		}
+		for _, h := range recordedHeaders {
+			if v := r.Header.Get(h); v != "" {
+				callback.Headers[h] = v
+			}
+		}
+		if err := recorder.Write(callback); err != nil {
+			logrus.WithError(err).Warnln("failed to record callback")
+		}
+	})
+}
+
+// redactCallbackBody masks the token and all secret configuration values of a callback body.
+// Bodies which are not JSON objects are only checked for API keys.
+func redactCallbackBody(body []byte) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return redactString(string(body))
+	}
+
+	if _, ok := fields["token"]; ok {
+		fields["token"] = redacted
+	}
+	if config, ok := fields["configuration"].([]interface{}); ok {
+		for _, c := range config {
+			if c, ok := c.(map[string]interface{}); ok {
+				if id, ok := c["id"].(string); ok && isSecretConfiguration(id) {
+					c["value"] = redacted
+				}
+			}
+		}
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return redactString(string(body))
+	}
+	return string(b)
+}
+
+// statusWriter remembers the status code written by the wrapped handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	stdlog "log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/provider"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/stdr"
+	"github.com/sirupsen/logrus"
+)
+
+// redacted replaces secret values in logs and error reports.
+const redacted = "[REDACTED]"
+
+// secretConfigurationIDs lists the configuration parameters of this connector which must never be logged.
+// Parameters whose ID looks like a credential are treated as secret as well, see isSecretConfiguration.
+var secretConfigurationIDs = map[string]bool{
+	"giphy_api_key": true,
+	"webhook_url":   true,
+}
+
+// isSecretConfiguration reports whether the value of the configuration parameter with the given ID must be redacted.
+func isSecretConfiguration(id string) bool {
+	if secretConfigurationIDs[id] {
+		return true
+	}
+	id = strings.ToLower(id)
+	for _, s := range []string{"secret", "token", "password", "api_key", "apikey"} {
+		if strings.Contains(id, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyPattern matches API keys in URLs, e.g. in errors returned by the Giphy client.
+var apiKeyPattern = regexp.MustCompile(`(?i)(api_key=)[^&\s"']+`)
+
+// redactString masks API keys contained in s.
+func redactString(s string) string {
+	return apiKeyPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactError returns an error with the same message as err but with API keys masked.
+// The error is returned unchanged if it contains no secrets.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := redactString(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// redactConfiguration returns a copy of config with all secret values masked.
+func redactConfiguration(config []connector.Configuration) []connector.Configuration {
+	if config == nil {
+		return nil
+	}
+	result := make([]connector.Configuration, len(config))
+	for i, c := range config {
+		result[i] = c
+		if isSecretConfiguration(c.ID) {
+			result[i].Value = redacted
+		}
+	}
+	return result
+}
+
+func redactInstallation(i connector.Installation) connector.Installation {
+	i.Token = redacted
+	i.Configuration = redactConfiguration(i.Configuration)
+	return i
+}
+
+func redactInstance(i connector.Instance) connector.Instance {
+	i.Token = redacted
+	i.Configuration = redactConfiguration(i.Configuration)
+	return i
+}
+
+// redactValue returns a copy of v with tokens and secret configuration values masked.
+// It knows the SDK types that carry secrets, all other values are returned unchanged.
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case connector.InstallationToken, *connector.InstallationToken, connector.InstantiationToken, *connector.InstantiationToken:
+		return redacted
+	case connector.InstallationRequest:
+		v.Token = redacted
+		v.Configuration = redactConfiguration(v.Configuration)
+		return v
+	case *connector.InstallationRequest:
+		if v == nil {
+			return v
+		}
+		return redactValue(*v)
+	case connector.InstantiationRequest:
+		v.Token = redacted
+		v.Configuration = redactConfiguration(v.Configuration)
+		return v
+	case *connector.InstantiationRequest:
+		if v == nil {
+			return v
+		}
+		return redactValue(*v)
+	case connector.Installation:
+		return redactInstallation(v)
+	case *connector.Installation:
+		if v == nil {
+			return v
+		}
+		return redactInstallation(*v)
+	case []*connector.Installation:
+		result := make([]connector.Installation, 0, len(v))
+		for _, i := range v {
+			if i != nil {
+				result = append(result, redactInstallation(*i))
+			}
+		}
+		return result
+	case connector.Instance:
+		return redactInstance(v)
+	case *connector.Instance:
+		if v == nil {
+			return v
+		}
+		return redactInstance(*v)
+	case []*connector.Instance:
+		result := make([]connector.Instance, 0, len(v))
+		for _, i := range v {
+			if i != nil {
+				result = append(result, redactInstance(*i))
+			}
+		}
+		return result
+	case provider.PendingAction:
+		if v.Instance != nil {
+			instance := redactInstance(*v.Instance)
+			v.Instance = &instance
+		}
+		return v
+	case connector.Configuration:
+		if isSecretConfiguration(v.ID) {
+			v.Value = redacted
+		}
+		return v
+	case *connector.Configuration:
+		if v == nil {
+			return v
+		}
+		return redactValue(*v)
+	case []connector.Configuration:
+		return redactConfiguration(v)
+	case error:
+		return redactError(v)
+	case string:
+		return redactString(v)
+	default:
+		return v
+	}
+}
+
+// redactKeysAndValues redacts the values of a logr key value list.
+func redactKeysAndValues(kv []interface{}) []interface{} {
+	result := make([]interface{}, len(kv))
+	for i, v := range kv {
+		if i%2 == 1 {
+			v = redactValue(v)
+		}
+		result[i] = v
+	}
+	return result
+}
+
+// redactingLogger masks secrets in all values passed to the wrapped logger.
+// It is handed to the SDK, which logs complete installation and instantiation requests.
+type redactingLogger struct {
+	logger logr.Logger
+}
+
+// newRedactingLogger returns a redacting logger writing to stderr in the format of connector.DefaultLogger.
+// The call depth accounts for the wrapper, so the logged source file is the one of the caller.
+func newRedactingLogger() logr.Logger {
+	return &redactingLogger{stdr.NewWithOptions(stdlog.New(os.Stderr, "", stdlog.LstdFlags|stdlog.Lshortfile), stdr.Options{Depth: 1})}
+}
+
+// Enabled implements logr.Logger.
+func (l *redactingLogger) Enabled() bool {
+	return l.logger.Enabled()
+}
+
+// Info implements logr.Logger.
+func (l *redactingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Info(redactString(msg), redactKeysAndValues(keysAndValues)...)
+}
+
+// Error implements logr.Logger.
+func (l *redactingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.logger.Error(redactError(err), redactString(msg), redactKeysAndValues(keysAndValues)...)
+}
+
+// V implements logr.Logger.
+func (l *redactingLogger) V(level int) logr.Logger {
+	return &redactingLogger{l.logger.V(level)}
+}
+
+// WithValues implements logr.Logger.
+func (l *redactingLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return &redactingLogger{l.logger.WithValues(redactKeysAndValues(keysAndValues)...)}
+}
+
+// WithName implements logr.Logger.
+func (l *redactingLogger) WithName(name string) logr.Logger {
+	return &redactingLogger{l.logger.WithName(name)}
+}
+
+// redactionHook masks secrets in all logrus entries before they are written.
+type redactionHook struct{}
+
+// Levels implements logrus.Hook.
+func (redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook.
+// Logrus passes a copy of the entry to the hooks, so we can modify its data in place.
+func (redactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redactString(entry.Message)
+	for k, v := range entry.Data {
+		entry.Data[k] = redactValue(v)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/crypto"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errorStaleRequest    = connector.NewError("STALE_REQUEST", "Date header is missing, invalid or outside of the accepted time window", http.StatusUnauthorized)
+	errorReplayedRequest = connector.NewError("REPLAYED_REQUEST", "Request was already received", http.StatusConflict)
+)
+
+// statementCreateSeenSignatures creates the table signatures are spilled to when they are evicted from memory.
+const statementCreateSeenSignatures = `CREATE TABLE IF NOT EXISTS seen_signatures (
+	signature CHAR(64) NOT NULL PRIMARY KEY,
+	expires BIGINT NOT NULL
+)`
+
+// replayCache remembers the signatures of received callbacks until their Date leaves the freshness window.
+// A signature covers the method, URL, Date and body, so a duplicate signature within the window is a replayed request.
+// The most recent signatures are kept in memory, older ones are spilled to the database if one is given.
+type replayCache struct {
+	window   time.Duration
+	capacity int
+	db       *sqlx.DB
+
+	entries     map[string]*list.Element
+	order       *list.List
+	lastCleanup time.Time
+	lock        sync.Mutex
+}
+
+type replayEntry struct {
+	key     string
+	expires time.Time
+}
+
+// newReplayCache returns a cache keeping up to capacity signatures in memory.
+// If db is not nil, evicted signatures which did not expire yet are stored in the database.
+func newReplayCache(window time.Duration, capacity int, db *sqlx.DB) *replayCache {
+	return &replayCache{
+		window:   window,
+		capacity: capacity,
+		db:       db,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// Seen reports whether the signature was seen before and remembers it otherwise.
+// The check and the insert are atomic, so only one of concurrent duplicates is accepted.
+func (c *replayCache) Seen(signature string, date time.Time) (bool, error) {
+	key := signatureKey(signature)
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		if e.Value.(*replayEntry).expires.After(now) {
+			return true, nil
+		}
+		c.remove(e)
+	}
+	if c.db != nil {
+		var expires int64
+		err := c.db.Get(&expires, c.db.Rebind("SELECT expires FROM seen_signatures WHERE signature = ?"), key)
+		if err == nil && time.Unix(expires, 0).After(now) {
+			return true, nil
+		} else if err != nil && err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+
+	c.entries[key] = c.order.PushFront(&replayEntry{key, date.Add(c.window)})
+	for c.order.Len() > c.capacity {
+		c.evict(c.order.Back(), now)
+	}
+	return false, nil
+}
+
+// Forget removes a signature remembered by Seen, e.g. because the request was rejected.
+func (c *replayCache) Forget(signature string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[signatureKey(signature)]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *replayCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*replayEntry).key)
+}
+
+// evict removes the entry from memory and spills it to the database if it did not expire yet.
+// Expired signatures are deleted from the database at most once per window.
+func (c *replayCache) evict(e *list.Element, now time.Time) {
+	c.remove(e)
+	entry := e.Value.(*replayEntry)
+	if c.db == nil || !entry.expires.After(now) {
+		return
+	}
+
+	if _, err := c.db.Exec(c.db.Rebind("INSERT INTO seen_signatures (signature, expires) VALUES (?, ?)"), entry.key, entry.expires.Unix()); err != nil {
+		logrus.WithError(err).Warnln("failed to spill signature to the database")
+	}
+	if now.Sub(c.lastCleanup) > c.window {
+		c.lastCleanup = now
+		if _, err := c.db.Exec(c.db.Rebind("DELETE FROM seen_signatures WHERE expires < ?"), now.Unix()); err != nil {
+			logrus.WithError(err).Warnln("failed to delete expired signatures")
+		}
+	}
+}
+
+// signatureKey returns a fixed length key for the signature.
+func signatureKey(signature string) string {
+	sum := sha256.Sum256([]byte(signature))
+	return hex.EncodeToString(sum[:])
+}
+
+// replayProtectionHandler rejects callbacks whose Date is outside of the freshness window of the cache
+// and callbacks whose signature was already received within the window.
+// Requests without signature are passed on and rejected by the signature validation.
+// Rejected requests are forgotten again, so a request with an invalid signature can not block a valid one.
+func replayProtectionHandler(cache *replayCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date, ok := freshDate(r, cache.window)
+		if !ok {
+			errorStaleRequest.Write(w)
+			return
+		}
+
+		signature := r.Header.Get(crypto.SignatureHeaderKey)
+		if signature == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		seen, err := cache.Seen(signature, date)
+		if err != nil {
+			logrus.WithError(err).WithField("correlationId", correlationID(r.Context())).Errorln("failed to check for replayed request")
+			connector.ErrorInternal.Write(w)
+			return
+		}
+		if seen {
+			logrus.WithField("correlationId", correlationID(r.Context())).Warnln("rejected replayed request")
+			errorReplayedRequest.Write(w)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if sw.status >= 400 && sw.status < 500 {
+			cache.Forget(signature)
+		}
+	})
+}
+
+// freshDate returns the Date of the request and whether it differs less than the window from the current time.
+func freshDate(r *http.Request, window time.Duration) (time.Time, bool) {
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	if age := time.Since(date); age > window || age < -window {
+		return date, false
+	}
+	return date, true
+}
+
+// clockSkewHandler rejects callbacks whose Date is older than maxSkew or more than maxSkew in the future.
+// The Date is covered by the signature, so captured requests can only be replayed within this time,
+// even without the replay cache. The clocks of the connector and the platform must not drift further apart.
+func clockSkewHandler(maxSkew time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if date, ok := freshDate(r, maxSkew); !ok {
+			logrus.WithField("correlationId", correlationID(r.Context())).WithField("date", date).Warnln("rejected callback with a stale or future Date")
+			errorStaleRequest.Write(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
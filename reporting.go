@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorContext describes where an error occurred.
+// Fields which are unknown at the reporting site are left empty.
+type ErrorContext struct {
+	Component       string `json:"component,omitempty"`
+	CorrelationID   string `json:"correlationId,omitempty"`
+	InstallationID  string `json:"installationId,omitempty"`
+	InstanceID      string `json:"instanceId,omitempty"`
+	ThingID         string `json:"thingId,omitempty"`
+	ActionRequestID string `json:"actionRequestId,omitempty"`
+	Stacktrace      string `json:"stacktrace,omitempty"`
+}
+
+// tags returns all non empty fields except the stacktrace.
+func (c ErrorContext) tags() map[string]string {
+	tags := map[string]string{}
+	for k, v := range map[string]string{
+		"component":       c.Component,
+		"correlationId":   c.CorrelationID,
+		"installationId":  c.InstallationID,
+		"instanceId":      c.InstanceID,
+		"thingId":         c.ThingID,
+		"actionRequestId": c.ActionRequestID,
+	} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// ErrorReporter forwards errors that need the attention of an operator to an external error tracker.
+// Errors are still logged as usual, reporting is meant to be an additional channel.
+type ErrorReporter interface {
+	// Report sends the error together with its context to the error sink.
+	// It does not block until the error is delivered.
+	Report(err error, errCtx ErrorContext)
+
+	// Flush waits until all pending reports are delivered or the timeout is reached.
+	// It returns false if the timeout was reached.
+	Flush(timeout time.Duration) bool
+}
+
+// NewErrorReporter returns an ErrorReporter for the given configuration.
+// If a Sentry DSN is given, errors are sent to Sentry.
+// Otherwise, if a sink URL is given, errors are posted as JSON to that URL, signed by the signer if it is not nil.
+// If neither is configured, reporting is disabled.
+func NewErrorReporter(sentryDSN string, sinkURL string, signer *payloadSigner) (ErrorReporter, error) {
+	switch {
+	case sentryDSN != "":
+		return newSentryReporter(sentryDSN)
+	case sinkURL != "":
+		if _, err := url.ParseRequestURI(sinkURL); err != nil {
+			return nil, fmt.Errorf("invalid error sink url: %w", err)
+		}
+		return &httpReporter{
+			client: &http.Client{Timeout: 5 * time.Second},
+			encode: encodeSinkEvent,
+			target: sinkURL,
+			signer: signer,
+		}, nil
+	default:
+		return nopReporter{}, nil
+	}
+}
+
+// nopReporter discards all reports.
+type nopReporter struct{}
+
+func (nopReporter) Report(err error, errCtx ErrorContext) {}
+
+func (nopReporter) Flush(timeout time.Duration) bool { return true }
+
+// httpReporter posts each report to the target URL.
+// The encoding of the request body and additional headers are defined by encode.
+type httpReporter struct {
+	client  *http.Client
+	encode  func(err error, errCtx ErrorContext) ([]byte, error)
+	target  string
+	headers map[string]string
+	signer  *payloadSigner
+	pending sync.WaitGroup
+}
+
+// Report implements ErrorReporter.
+func (r *httpReporter) Report(err error, errCtx ErrorContext) {
+	body, encErr := r.encode(redactError(err), errCtx)
+	if encErr != nil {
+		logrus.WithError(encErr).Errorln("failed to encode error report")
+		return
+	}
+
+	r.pending.Add(1)
+	go func() {
+		defer r.pending.Done()
+		if err := r.send(body); err != nil {
+			logrus.WithError(err).Warnln("failed to deliver error report")
+		}
+	}()
+}
+
+// Flush implements ErrorReporter.
+func (r *httpReporter) Flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (r *httpReporter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, r.target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	if r.signer != nil {
+		if err := r.signer.SignRequest(req, body); err != nil {
+			return err
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error sink responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sinkEvent is the JSON document posted to a generic error sink.
+type sinkEvent struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Error     string       `json:"error"`
+	Context   ErrorContext `json:"context"`
+}
+
+func encodeSinkEvent(err error, errCtx ErrorContext) ([]byte, error) {
+	return json.Marshal(sinkEvent{
+		Timestamp: clock().UTC(),
+		Error:     err.Error(),
+		Context:   errCtx,
+	})
+}
+
+// newSentryReporter parses the DSN (https://<key>@<host>/<project>) and returns a reporter
+// which uses the Sentry store endpoint.
+func newSentryReporter(dsn string) (*httpReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry dsn: %w", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("invalid sentry dsn: missing public key")
+	}
+	project := strings.Trim(u.Path, "/")
+	if project == "" {
+		return nil, errors.New("invalid sentry dsn: missing project id")
+	}
+
+	store := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   "/api/" + project + "/store/",
+	}
+
+	return &httpReporter{
+		client: &http.Client{Timeout: 5 * time.Second},
+		encode: encodeSentryEvent,
+		target: store.String(),
+		headers: map[string]string{
+			"X-Sentry-Auth": "Sentry sentry_version=7, sentry_client=giphy-connector/1.0, sentry_key=" + u.User.Username(),
+		},
+	}, nil
+}
+
+// sentryEvent contains the subset of the Sentry event payload we use.
+type sentryEvent struct {
+	EventID   string            `json:"event_id"`
+	Timestamp string            `json:"timestamp"`
+	Level     string            `json:"level"`
+	Logger    string            `json:"logger"`
+	Platform  string            `json:"platform"`
+	Message   string            `json:"message"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Extra     map[string]string `json:"extra,omitempty"`
+}
+
+func encodeSentryEvent(err error, errCtx ErrorContext) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(randomness, id); err != nil {
+		return nil, err
+	}
+
+	event := sentryEvent{
+		EventID:   hex.EncodeToString(id),
+		Timestamp: clock().UTC().Format(time.RFC3339),
+		Level:     "error",
+		Logger:    "giphy-connector",
+		Platform:  "go",
+		Message:   err.Error(),
+		Tags:      errCtx.tags(),
+	}
+	if errCtx.Stacktrace != "" {
+		event.Extra = map[string]string{"stacktrace": errCtx.Stacktrace}
+	}
+
+	return json.Marshal(event)
+}
+
+// reportPanic recovers a panic, reports it synchronously and panics again.
+// It must be deferred directly by the function that should be guarded.
+func reportPanic(reporter ErrorReporter, errCtx ErrorContext) {
+	if r := recover(); r != nil {
+		errCtx.Stacktrace = string(debug.Stack())
+		reporter.Report(fmt.Errorf("panic: %v", r), errCtx)
+		reporter.Flush(5 * time.Second)
+		panic(r)
+	}
+}
+
+// recoverHandler reports panics in the wrapped handler and responds with an internal server error.
+func recoverHandler(reporter ErrorReporter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				reporter.Report(fmt.Errorf("panic: %v", rec), ErrorContext{
+					Component:  "handler " + r.Method + " " + r.URL.Path,
+					Stacktrace: string(debug.Stack()),
+				})
+				connector.ErrorInternal.Write(w)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// failureTracker counts consecutive failures per key.
+// It is used to only report failures which occur repeatedly.
+type failureTracker struct {
+	threshold int
+	failures  map[string]int
+	lock      sync.Mutex
+}
+
+func newFailureTracker(threshold int) *failureTracker {
+	return &failureTracker{
+		threshold: threshold,
+		failures:  map[string]int{},
+	}
+}
+
+// Failed records a failure for key and returns true each time the number of consecutive failures reaches a multiple of the threshold.
+func (t *failureTracker) Failed(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.failures[key]++
+	return t.failures[key]%t.threshold == 0
+}
+
+// Succeeded resets the failure count for key.
+func (t *failureTracker) Succeeded(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.failures, key)
+}
+
+// reportingClient reports all failed calls to the connctd API.
+type reportingClient struct {
+	connector.Client
+	reporter ErrorReporter
+}
+
+// CreateThing implements connector.Client.
+func (c *reportingClient) CreateThing(ctx context.Context, token connector.InstantiationToken, thing connctd.Thing) (connctd.Thing, error) {
+	result, err := c.Client.CreateThing(ctx, token, thing)
+	if err != nil {
+		c.reporter.Report(err, ErrorContext{Component: "connctd CreateThing", CorrelationID: correlationID(ctx)})
+	}
+	return result, err
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *reportingClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+	if err != nil {
+		c.reporter.Report(err, ErrorContext{Component: "connctd UpdateThingPropertyValue", CorrelationID: correlationID(ctx), ThingID: thingID})
+	}
+	return err
+}
+
+// UpdateThingStatus implements connector.Client.
+func (c *reportingClient) UpdateThingStatus(ctx context.Context, token connector.InstantiationToken, thingID string, status connctd.StatusType) error {
+	err := c.Client.UpdateThingStatus(ctx, token, thingID, status)
+	if err != nil {
+		c.reporter.Report(err, ErrorContext{Component: "connctd UpdateThingStatus", CorrelationID: correlationID(ctx), ThingID: thingID})
+	}
+	return err
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *reportingClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	err := c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e)
+	if err != nil {
+		c.reporter.Report(err, ErrorContext{Component: "connctd UpdateActionStatus", CorrelationID: correlationID(ctx), ActionRequestID: actionRequestID})
+	}
+	return err
+}
+
+// UpdateInstallationState implements connector.Client.
+func (c *reportingClient) UpdateInstallationState(ctx context.Context, token connector.InstallationToken, state connector.InstallationState, details json.RawMessage) error {
+	err := c.Client.UpdateInstallationState(ctx, token, state, details)
+	if err != nil {
+		c.reporter.Report(err, ErrorContext{Component: "connctd UpdateInstallationState", CorrelationID: correlationID(ctx)})
+	}
+	return err
+}
+
+// UpdateInstanceState implements connector.Client.
+func (c *reportingClient) UpdateInstanceState(ctx context.Context, token connector.InstantiationToken, state connector.InstantiationState, details json.RawMessage) error {
+	err := c.Client.UpdateInstanceState(ctx, token, state, details)
+	if err != nil {
+		c.reporter.Report(err, ErrorContext{Component: "connctd UpdateInstanceState", CorrelationID: correlationID(ctx)})
+	}
+	return err
+}
+
+// DeleteThing implements connector.Client.
+func (c *reportingClient) DeleteThing(ctx context.Context, token connector.InstantiationToken, thingID string) error {
+	err := c.Client.DeleteThing(ctx, token, thingID)
+	if err != nil {
+		c.reporter.Report(err, ErrorContext{Component: "connctd DeleteThing", CorrelationID: correlationID(ctx), ThingID: thingID})
+	}
+	return err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+// errUnknownComponent is returned for components which are not part of the thing.
+var errUnknownComponent = errors.New("component not found")
+
+// thingContext is what handlers of a thing need to know: the instance and installation it belongs to, its external ID
+// and, if one was asked for, the component.
+type thingContext struct {
+	ThingID      string
+	ComponentID  string
+	ExternalID   string
+	Instance     *connector.Instance
+	Installation *connector.Installation
+}
+
+// Config returns the value of the configuration parameter of the instance, or of the installation if the instance does not have it.
+func (c *thingContext) Config(id string) (string, bool) {
+	for _, configuration := range [][]connector.Configuration{c.Instance.Configuration, c.Installation.Configuration} {
+		for _, config := range configuration {
+			if config.ID == id {
+				return config.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// thingResolver maps things and their components to the instance, installation, configuration and external ID in one call.
+// Installation and instance configurations and thing mappings do not change, so they are cached after the first lookup
+// until the instance or installation is removed.
+type thingResolver struct {
+	db        connector.Database
+	templates connector.ThingTemplates
+	lookups   *metricVec
+
+	instances     map[string]*connector.Instance     // by thing ID
+	installations map[string]*connector.Installation // by installation ID
+	forgetHooks   []func(installationId string)
+	lock          sync.Mutex
+}
+
+func newThingResolver(db connector.Database, templates connector.ThingTemplates, metrics *metricsRegistry) *thingResolver {
+	return &thingResolver{
+		db:            db,
+		templates:     templates,
+		lookups:       metrics.Counter("thing_resolver_lookups_total", "Number of things resolved to their instance and installation by result.", "result"),
+		instances:     map[string]*connector.Instance{},
+		installations: map[string]*connector.Installation{},
+	}
+}
+
+// Resolve returns the context of the thing. An empty component ID skips the check whether the component exists,
+// which is made against the thing template of the instance.
+func (r *thingResolver) Resolve(ctx context.Context, thingId string, componentId string) (*thingContext, error) {
+	r.lock.Lock()
+	instance, ok := r.instances[thingId]
+	var installation *connector.Installation
+	if ok {
+		installation, ok = r.installations[instance.InstallationID]
+	}
+	r.lock.Unlock()
+
+	if ok {
+		r.lookups.Inc("hit")
+	} else {
+		r.lookups.Inc("miss")
+		var err error
+		if instance, installation, err = r.load(ctx, thingId); err != nil {
+			return nil, err
+		}
+	}
+
+	thing := &thingContext{ThingID: thingId, ComponentID: componentId, Instance: instance, Installation: installation}
+	for _, mapping := range instance.ThingMapping {
+		if mapping.ThingID == thingId {
+			thing.ExternalID = mapping.ExternalID
+		}
+	}
+	if componentId != "" && !r.hasComponent(thing, componentId) {
+		return nil, errUnknownComponent
+	}
+	return thing, nil
+}
+
+// load looks up the instance of the thing and the installations and caches them for all things of the instance.
+func (r *thingResolver) load(ctx context.Context, thingId string) (*connector.Instance, *connector.Installation, error) {
+	instance, err := r.db.GetInstanceByThingId(ctx, thingId)
+	if err != nil {
+		return nil, nil, err
+	}
+	installations, err := r.db.GetInstallations(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, installation := range installations {
+		r.installations[installation.ID] = installation
+	}
+	installation, ok := r.installations[instance.InstallationID]
+	if !ok {
+		return nil, nil, connector.ErrorInstallationNotFound
+	}
+	for _, mapping := range instance.ThingMapping {
+		r.instances[mapping.ThingID] = instance
+	}
+	return instance, installation, nil
+}
+
+// hasComponent reports whether the thing template of the thing has the component.
+func (r *thingResolver) hasComponent(thing *thingContext, componentId string) bool {
+	templates := r.templates(connector.InstantiationRequest{
+		ID:             thing.Instance.ID,
+		InstallationID: thing.Instance.InstallationID,
+		Configuration:  thing.Instance.Configuration,
+	})
+	for _, template := range templates {
+		if template.ExternalID != thing.ExternalID {
+			continue
+		}
+		_, ok := findComponent(template.Thing, componentId)
+		return ok
+	}
+	return false
+}
+
+// ForgetInstance removes the things of the instance from the cache.
+func (r *thingResolver) ForgetInstance(instanceId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for thingId, instance := range r.instances {
+		if instance.ID == instanceId {
+			delete(r.instances, thingId)
+		}
+	}
+}
+
+// ForgetInstallation removes the installation and the things of its instances from the cache
+// and calls the hooks registered with OnForgetInstallation.
+func (r *thingResolver) ForgetInstallation(installationId string) {
+	r.lock.Lock()
+	delete(r.installations, installationId)
+	for thingId, instance := range r.instances {
+		if instance.InstallationID == installationId {
+			delete(r.instances, thingId)
+		}
+	}
+	hooks := r.forgetHooks
+	r.lock.Unlock()
+
+	for _, hook := range hooks {
+		hook(installationId)
+	}
+}
+
+// OnForgetInstallation registers a hook called with the ID of each removed installation, e.g. to release its resources.
+func (r *thingResolver) OnForgetInstallation(hook func(installationId string)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.forgetHooks = append(r.forgetHooks, hook)
+}
+
+// resolvingService resolves the thing of action requests with the thing resolver instead of looking it up per request,
+// fills in the parameter defaults of the instance and forgets removed instances and installations.
+type resolvingService struct {
+	connector.ConnectorService
+	resolver *thingResolver
+	provider connector.Provider
+}
+
+// PerformAction implements connector.ConnectorService. It answers like the default service.
+func (s *resolvingService) PerformAction(ctx context.Context, actionRequest connector.ActionRequest) (*connector.ActionResponse, error) {
+	logger := logrus.WithField("actionRequestId", actionRequest.ID).WithField("thingId", actionRequest.ThingID).WithField("correlationId", correlationID(ctx))
+	thing, err := s.resolver.Resolve(ctx, actionRequest.ThingID, actionRequest.ComponentID)
+	if errors.Is(err, errUnknownComponent) {
+		logger.WithField("componentId", actionRequest.ComponentID).Warnln("action request for unknown component")
+		return &connector.ActionResponse{Status: connector.ActionRequestStatusFailed, Error: "component was not found at connector"}, nil
+	}
+	if err != nil {
+		logger.WithError(err).Warnln("could not resolve the thing of an action request")
+		return &connector.ActionResponse{Status: connector.ActionRequestStatusFailed, Error: "thing ID was not found at connector"}, nil
+	}
+
+	// Missing parameters are taken from the defaults of the instance before the provider sees the request
+	status, err := s.provider.RequestAction(ctx, thing.Instance, withParameterDefaults(thing.Instance, actionRequest))
+	if err != nil {
+		return &connector.ActionResponse{Status: status, Error: err.Error()}, err
+	}
+	if status == connector.ActionRequestStatusPending {
+		return &connector.ActionResponse{Status: status}, nil
+	}
+	if status == connector.ActionRequestStatusFailed {
+		logger.Errorln("provider set the action state to FAILED without an error")
+	}
+	return nil, nil
+}
+
+// RemoveInstance implements connector.ConnectorService.
+func (s *resolvingService) RemoveInstance(ctx context.Context, instanceId string) error {
+	err := s.ConnectorService.RemoveInstance(ctx, instanceId)
+	s.resolver.ForgetInstance(instanceId)
+	return err
+}
+
+// RemoveInstallation implements connector.ConnectorService.
+func (s *resolvingService) RemoveInstallation(ctx context.Context, installationId string) error {
+	err := s.ConnectorService.RemoveInstallation(ctx, installationId)
+	s.resolver.ForgetInstallation(installationId)
+	return err
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// retryPolicy decides how often and after which delay a failed operation is attempted again.
+// The delay doubles with every failed attempt, starting at BaseDelay and capped at MaxDelay.
+// Retries and operations which still failed after the last attempt are counted by policy name.
+type retryPolicy struct {
+	Name        string
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Retryable reports whether a failed operation can be attempted again, nil retries all errors.
+	Retryable func(err error) bool
+
+	retries   *metricVec
+	exhausted *metricVec
+}
+
+// Delay returns the delay after the given number of failed attempts, starting at 1.
+func (p *retryPolicy) Delay(failedAttempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < failedAttempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Retry reports whether the operation which failed with err in the given attempt, starting at 1, is attempted again.
+// It counts the retry, or the exhausted operation if a retryable error occurred in the last attempt.
+func (p *retryPolicy) Retry(err error, attempt int) bool {
+	if err == nil || (p.Retryable != nil && !p.Retryable(err)) {
+		return false
+	}
+	if attempt >= p.MaxAttempts {
+		p.exhausted.Inc(p.Name)
+		return false
+	}
+	p.retries.Inc(p.Name)
+	return true
+}
+
+// Do runs the operation until it succeeds, fails with an error which is not retryable or the attempts are used up.
+// It waits for the delay between attempts and stops early when the context is done. The last error is returned.
+func (p *retryPolicy) Do(ctx context.Context, operation func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := operation(ctx)
+		if !p.Retry(err, attempt) {
+			return err
+		}
+		timer := time.NewTimer(p.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryPolicies are the retry policies of the subsystems by name.
+type retryPolicies map[string]*retryPolicy
+
+// Names of the retry policies.
+const (
+	// databaseRetries retries database operations failing because of locks or deadlocks.
+	databaseRetries = "db"
+	// connctdRetries retries the jobs of the job queue, e.g. updates which could not be sent to connctd.
+	connctdRetries = "connctd"
+	// giphyRetries retries requests to the Giphy API failing with a network error or a 502, 503 or 504 response.
+	giphyRetries = "giphy"
+	// webhookRetries retries the deliveries of webhooks.
+	webhookRetries = "webhooks"
+	// eventBusRetries retries the publications of events to the event bus.
+	eventBusRetries = "eventbus"
+)
+
+// defaultRetryPolicies returns the retry policies used unless they are configured otherwise.
+func defaultRetryPolicies() retryPolicies {
+	return retryPolicies{
+		databaseRetries: {Name: databaseRetries, MaxAttempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second, Retryable: transientDatabaseError},
+		connctdRetries:  {Name: connctdRetries, MaxAttempts: 5, BaseDelay: 10 * time.Second, MaxDelay: 10 * time.Minute},
+		giphyRetries:    {Name: giphyRetries, MaxAttempts: 2, BaseDelay: 500 * time.Millisecond, MaxDelay: 2 * time.Second, Retryable: transientGiphyError},
+		webhookRetries:  {Name: webhookRetries, MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second},
+		eventBusRetries: {Name: eventBusRetries, MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second},
+	}
+}
+
+// newRetryPolicies returns the default retry policies with the overrides of the spec applied, policies separated by
+// commas with the form "name=attempts/base delay/max delay", e.g. "giphy=3/1s/5s,db=1/0s/0s". One attempt disables retries.
+func newRetryPolicies(spec string, metrics *metricsRegistry) (retryPolicies, error) {
+	policies := defaultRetryPolicies()
+	for _, override := range strings.Split(spec, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retry policy %q, expected name=attempts/base delay/max delay", override)
+		}
+		policy, ok := policies[strings.TrimSpace(parts[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown retry policy %q, expected one of %s", parts[0], strings.Join(policies.names(), ", "))
+		}
+		values := strings.Split(strings.TrimSpace(parts[1]), "/")
+		if len(values) != 3 {
+			return nil, fmt.Errorf("invalid retry policy %q, expected name=attempts/base delay/max delay", override)
+		}
+		attempts, err := strconv.Atoi(values[0])
+		if err != nil || attempts < 1 {
+			return nil, fmt.Errorf("invalid attempts of retry policy %q, expected at least 1", override)
+		}
+		base, err := time.ParseDuration(values[1])
+		if err != nil || base < 0 {
+			return nil, fmt.Errorf("invalid base delay of retry policy %q", override)
+		}
+		max, err := time.ParseDuration(values[2])
+		if err != nil || max < base {
+			return nil, fmt.Errorf("invalid max delay of retry policy %q, it must not be shorter than the base delay", override)
+		}
+		policy.MaxAttempts, policy.BaseDelay, policy.MaxDelay = attempts, base, max
+	}
+	retries := metrics.Counter("retries_total", "Number of retries of failed operations by retry policy.", "policy")
+	exhausted := metrics.Counter("retries_exhausted_total", "Number of operations which still failed after the last attempt by retry policy.", "policy")
+	for _, policy := range policies {
+		policy.retries, policy.exhausted = retries, exhausted
+	}
+	return policies, nil
+}
+
+func (p retryPolicies) names() []string {
+	var names []string
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// transientDatabaseError reports whether the database operation failed without being applied because the database was
+// locked or aborted it to resolve a deadlock, so it can be attempted again.
+func transientDatabaseError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// Lock wait timeout and deadlock
+		return mysqlErr.Number == 1205 || mysqlErr.Number == 1213
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Serialization failure and deadlock
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+// errRetryableStatus is the error of Giphy responses with a status worth retrying.
+var errRetryableStatus = errors.New("Giphy responded with a retryable status")
+
+// transientGiphyError reports whether a request to Giphy can be attempted again, which is the case unless it was canceled.
+func transientGiphyError(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// retryingTransport attempts requests without body again according to the retry policy if they fail with a network
+// error or a 502, 503 or 504 response. Rate limited responses are passed on, Giphy is backed off by the rate limiter.
+type retryingTransport struct {
+	next   http.RoundTripper
+	policy *retryPolicy
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil && r.Body != http.NoBody {
+		return t.next.RoundTrip(r)
+	}
+	var resp *http.Response
+	err := t.policy.Do(r.Context(), func(ctx context.Context) error {
+		// The response of the previous attempt is discarded
+		if resp != nil {
+			resp.Body.Close()
+		}
+		var err error
+		resp, err = t.next.RoundTrip(r)
+		if err != nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return fmt.Errorf("%w %d", errRetryableStatus, resp.StatusCode)
+		}
+		return nil
+	})
+	if errors.Is(err, errRetryableStatus) {
+		return resp, nil
+	}
+	return resp, err
+}
+
+// retryingDatabase attempts database operations again according to the retry policy, e.g. while SQLite is locked by
+// another connection. Only errors of operations which were not applied are retryable, see transientDatabaseError.
+type retryingDatabase struct {
+	connector.Database
+	policy *retryPolicy
+}
+
+// AddInstallation implements connector.Database.
+func (d *retryingDatabase) AddInstallation(ctx context.Context, installationRequest connector.InstallationRequest) error {
+	return d.policy.Do(ctx, func(ctx context.Context) error {
+		return d.Database.AddInstallation(ctx, installationRequest)
+	})
+}
+
+// AddInstallationConfiguration implements connector.Database.
+func (d *retryingDatabase) AddInstallationConfiguration(ctx context.Context, installationId string, config []connector.Configuration) error {
+	return d.policy.Do(ctx, func(ctx context.Context) error {
+		return d.Database.AddInstallationConfiguration(ctx, installationId, config)
+	})
+}
+
+// GetInstallations implements connector.Database.
+func (d *retryingDatabase) GetInstallations(ctx context.Context) (installations []*connector.Installation, err error) {
+	err = d.policy.Do(ctx, func(ctx context.Context) error {
+		installations, err = d.Database.GetInstallations(ctx)
+		return err
+	})
+	return installations, err
+}
+
+// RemoveInstallation implements connector.Database.
+func (d *retryingDatabase) RemoveInstallation(ctx context.Context, installationId string) error {
+	return d.policy.Do(ctx, func(ctx context.Context) error {
+		return d.Database.RemoveInstallation(ctx, installationId)
+	})
+}
+
+// AddInstance implements connector.Database.
+func (d *retryingDatabase) AddInstance(ctx context.Context, instantiationRequest connector.InstantiationRequest) error {
+	return d.policy.Do(ctx, func(ctx context.Context) error {
+		return d.Database.AddInstance(ctx, instantiationRequest)
+	})
+}
+
+// AddInstanceConfiguration implements connector.Database.
+func (d *retryingDatabase) AddInstanceConfiguration(ctx context.Context, instanceId string, config []connector.Configuration) error {
+	return d.policy.Do(ctx, func(ctx context.Context) error {
+		return d.Database.AddInstanceConfiguration(ctx, instanceId, config)
+	})
+}
+
+// GetInstance implements connector.Database.
+func (d *retryingDatabase) GetInstance(ctx context.Context, instanceId string) (instance *connector.Instance, err error) {
+	err = d.policy.Do(ctx, func(ctx context.Context) error {
+		instance, err = d.Database.GetInstance(ctx, instanceId)
+		return err
+	})
+	return instance, err
+}
+
+// GetInstances implements connector.Database.
+func (d *retryingDatabase) GetInstances(ctx context.Context) (instances []*connector.Instance, err error) {
+	err = d.policy.Do(ctx, func(ctx context.Context) error {
+		instances, err = d.Database.GetInstances(ctx)
+		return err
+	})
+	return instances, err
+}
+
+// GetInstanceByThingId implements connector.Database.
+func (d *retryingDatabase) GetInstanceByThingId(ctx context.Context, thingId string) (instance *connector.Instance, err error) {
+	err = d.policy.Do(ctx, func(ctx context.Context) error {
+		instance, err = d.Database.GetInstanceByThingId(ctx, thingId)
+		return err
+	})
+	return instance, err
+}
+
+// GetInstanceConfiguration implements connector.Database.
+func (d *retryingDatabase) GetInstanceConfiguration(ctx context.Context, instanceId string) (config []connector.Configuration, err error) {
+	err = d.policy.Do(ctx, func(ctx context.Context) error {
+		config, err = d.Database.GetInstanceConfiguration(ctx, instanceId)
+		return err
+	})
+	return config, err
+}
+
+// GetMappingByInstanceId implements connector.Database.
+func (d *retryingDatabase) GetMappingByInstanceId(ctx context.Context, instanceId string) (mappings []connector.ThingMapping, err error) {
+	err = d.policy.Do(ctx, func(ctx context.Context) error {
+		mappings, err = d.Database.GetMappingByInstanceId(ctx, instanceId)
+		return err
+	})
+	return mappings, err
+}
+
+// RemoveInstance implements connector.Database.
+func (d *retryingDatabase) RemoveInstance(ctx context.Context, instanceId string) error {
+	return d.policy.Do(ctx, func(ctx context.Context) error {
+		return d.Database.RemoveInstance(ctx, instanceId)
+	})
+}
+
+// AddThingMapping implements connector.Database.
+func (d *retryingDatabase) AddThingMapping(ctx context.Context, instanceID string, thingID string, externalId string) error {
+	return d.policy.Do(ctx, func(ctx context.Context) error {
+		return d.Database.AddThingMapping(ctx, instanceID, thingID, externalId)
+	})
+}
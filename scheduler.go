@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// updateScheduler keeps the next periodic update of each registered instance ordered by time, so the update loop
+// sleeps until the next instance is due instead of checking all instances on every tick. Each instance has its own
+// interval, one-off updates move its next run forward and paused instances are skipped when they are due.
+// The runs are changed by the update loop, RunNow, Pause and Resume are also called by the admin API and the thing creation.
+type updateScheduler struct {
+	lock   sync.Mutex
+	queue  runQueue
+	runs   map[string]*scheduledRun
+	paused map[string]bool
+	// wake is signaled when a run is moved forward, so the update loop picks it up before its timer fires.
+	wake chan struct{}
+}
+
+// scheduledRun is the next periodic update of an instance.
+type scheduledRun struct {
+	instance *connector.Instance
+	next     time.Time
+	// index is the position in the queue, it is maintained by the heap.
+	index int
+}
+
+// runQueue orders the runs by time, the earliest first. It implements heap.Interface.
+type runQueue []*scheduledRun
+
+func (q runQueue) Len() int           { return len(q) }
+func (q runQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q runQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *runQueue) Push(x interface{}) {
+	run := x.(*scheduledRun)
+	run.index = len(*q)
+	*q = append(*q, run)
+}
+
+func (q *runQueue) Pop() interface{} {
+	old := *q
+	run := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return run
+}
+
+func newUpdateScheduler() *updateScheduler {
+	return &updateScheduler{
+		runs:   map[string]*scheduledRun{},
+		paused: map[string]bool{},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Sync takes over the registered instances. Instances without run are due immediately, so new instances are updated
+// right after their registration, the runs of instances which are not registered anymore are removed.
+func (s *updateScheduler) Sync(instances []*connector.Instance, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	registered := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		registered[instance.ID] = true
+		if run, ok := s.runs[instance.ID]; ok {
+			run.instance = instance
+			continue
+		}
+		s.schedule(instance, now)
+	}
+	for id, run := range s.runs {
+		if !registered[id] {
+			heap.Remove(&s.queue, run.index)
+			delete(s.runs, id)
+		}
+	}
+}
+
+// Schedule sets the next run of the instance, replacing the one scheduled before.
+func (s *updateScheduler) Schedule(instance *connector.Instance, next time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.schedule(instance, next)
+}
+
+func (s *updateScheduler) schedule(instance *connector.Instance, next time.Time) {
+	if run, ok := s.runs[instance.ID]; ok {
+		run.instance = instance
+		run.next = next
+		heap.Fix(&s.queue, run.index)
+		return
+	}
+	run := &scheduledRun{instance: instance, next: next}
+	heap.Push(&s.queue, run)
+	s.runs[instance.ID] = run
+}
+
+// RunNow moves the next run of the instance to now and wakes the update loop. Instances which are not registered yet
+// are due once the update loop registered them, so only the loop is woken. Further calls are ignored while the run is due.
+func (s *updateScheduler) RunNow(instanceId string, now time.Time) {
+	s.lock.Lock()
+	if run, ok := s.runs[instanceId]; ok && run.next.After(now) {
+		run.next = now
+		heap.Fix(&s.queue, run.index)
+	}
+	s.lock.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// The loop is woken already
+	}
+}
+
+// Wake returns the channel signaled when a run was moved forward.
+func (s *updateScheduler) Wake() <-chan struct{} {
+	return s.wake
+}
+
+// Due removes the runs which are due and returns their instances, the earliest first.
+// The caller schedules their next run.
+func (s *updateScheduler) Due(now time.Time) []*connector.Instance {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var due []*connector.Instance
+	for len(s.queue) > 0 && !s.queue[0].next.After(now) {
+		run := heap.Pop(&s.queue).(*scheduledRun)
+		delete(s.runs, run.instance.ID)
+		due = append(due, run.instance)
+	}
+	return due
+}
+
+// Wait returns how long the update loop can sleep until the next run is due, or until the deadline if it is earlier.
+func (s *updateScheduler) Wait(now time.Time, deadline time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.queue) > 0 && s.queue[0].next.Before(deadline) {
+		deadline = s.queue[0].next
+	}
+	if wait := deadline.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Pause skips the runs of the instance until it is resumed, its runs are scheduled nevertheless.
+func (s *updateScheduler) Pause(instanceId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.paused[instanceId] = true
+}
+
+// Resume continues the runs of a paused instance with its next scheduled run.
+func (s *updateScheduler) Resume(instanceId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.paused, instanceId)
+}
+
+// IsPaused reports whether the runs of the instance are skipped.
+func (s *updateScheduler) IsPaused(instanceId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.paused[instanceId]
+}
+
+// Paused returns the IDs of the paused instances.
+func (s *updateScheduler) Paused() map[string]bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	paused := make(map[string]bool, len(s.paused))
+	for id := range s.paused {
+		paused[id] = true
+	}
+	return paused
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// searchThrottleConfigID is the optional installation configuration parameter with the window in which repeated searches
+// for the same keyword are answered with the previous result, e.g. "30s". "0s" disables the throttling for the installation.
+const searchThrottleConfigID = "search_throttle_window"
+
+// maxThrottledSearches is the maximum number of results kept by the search throttle.
+const maxThrottledSearches = 10000
+
+// searchThrottle answers repeated searches of an installation for the same keyword within a window with the previous result
+// instead of a Giphy request, so a burst of searches does not use up the quota of keys with a low rate limit.
+// Unlike the search cache, it needs no Redis server and the results are kept per installation in memory.
+type searchThrottle struct {
+	window    time.Duration
+	throttled *metricVec
+
+	lock    sync.Mutex
+	results map[string]throttledSearch
+}
+
+type throttledSearch struct {
+	result  searchResult
+	expires time.Time
+}
+
+// newSearchThrottle returns a throttle using the window for installations without window parameter, 0 disables it for them.
+func newSearchThrottle(window time.Duration, metrics *metricsRegistry) *searchThrottle {
+	return &searchThrottle{
+		window:    window,
+		throttled: metrics.Counter("giphy_searches_throttled_total", "Number of searches answered with the previous result of the keyword."),
+		results:   map[string]throttledSearch{},
+	}
+}
+
+// parseSearchThrottleWindow parses the window configured for an installation. The second result is false if none is configured.
+func parseSearchThrottleWindow(configuration []connector.Configuration) (time.Duration, bool, error) {
+	for _, c := range configuration {
+		if c.ID != searchThrottleConfigID || c.Value == "" {
+			continue
+		}
+		window, err := time.ParseDuration(c.Value)
+		if err != nil || window < 0 {
+			return 0, false, fmt.Errorf("invalid duration %q, expected e.g. 30s", c.Value)
+		}
+		return window, true, nil
+	}
+	return 0, false, nil
+}
+
+// Window returns the window of the installation with the configuration. Invalid windows were rejected on installation and are ignored.
+func (t *searchThrottle) Window(configuration []connector.Configuration) time.Duration {
+	if window, ok, err := parseSearchThrottleWindow(configuration); err == nil && ok {
+		return window
+	}
+	return t.window
+}
+
+func searchThrottleKey(installationId string, keyword string, rating string) string {
+	return installationId + "\x00" + rating + "\x00" + strings.ToLower(strings.TrimSpace(keyword))
+}
+
+// Get returns the previous result of the installation's search if it is within the window.
+func (t *searchThrottle) Get(installationId string, keyword string, rating string) (searchResult, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	search, ok := t.results[searchThrottleKey(installationId, keyword, rating)]
+	if !ok || !clock().Before(search.expires) {
+		return searchResult{}, false
+	}
+	t.throttled.Inc()
+	return search.result, true
+}
+
+// Set remembers the result of the installation's search for the window.
+// If too many results are kept, expired ones are dropped and the result is not kept if none expired.
+func (t *searchThrottle) Set(installationId string, keyword string, rating string, window time.Duration, result searchResult) {
+	if window <= 0 {
+		return
+	}
+	now := clock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.results) >= maxThrottledSearches {
+		for key, search := range t.results {
+			if !now.Before(search.expires) {
+				delete(t.results, key)
+			}
+		}
+		if len(t.results) >= maxThrottledSearches {
+			return
+		}
+	}
+	t.results[searchThrottleKey(installationId, keyword, rating)] = throttledSearch{result, now.Add(window)}
+}
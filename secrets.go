@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/connctd/connector-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// encryptedPrefix marks encrypted values in the database. Values without it were stored before encryption was enabled.
+const encryptedPrefix = "enc:"
+
+// keyWrapper wraps the data keys of encrypted values with a key encryption key.
+// Implementations can keep the key encryption keys in a KMS, so they never leave it.
+type keyWrapper interface {
+	// PrimaryKeyID returns the ID of the key new data keys are wrapped with.
+	PrimaryKeyID() string
+	// WrapKey encrypts the data key with the key with the given ID.
+	WrapKey(keyID string, dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped by the key with the given ID.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// keyFileWrapper wraps data keys with AES-256 keys read from a local key file.
+type keyFileWrapper struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// newKeyFileWrapper reads a key file with one key per line, given as ID and base64 encoded 32 byte key separated by a space.
+// The first key is the primary key. The other keys are only used to decrypt values encrypted before a key rotation.
+// Empty lines and lines starting with # are ignored.
+func newKeyFileWrapper(file string) (*keyFileWrapper, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer f.Close()
+
+	w := &keyFileWrapper{keys: map[string][]byte{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, errors.New("invalid key file: expected lines of key ID and base64 encoded key")
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid key file: key %s is not a base64 encoded 32 byte key", fields[0])
+		}
+		if _, ok := w.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("invalid key file: duplicate key ID %s", fields[0])
+		}
+		if w.primary == "" {
+			w.primary = fields[0]
+		}
+		w.keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if w.primary == "" {
+		return nil, errors.New("invalid key file: no keys")
+	}
+	return w, nil
+}
+
+// PrimaryKeyID implements keyWrapper.
+func (w *keyFileWrapper) PrimaryKeyID() string {
+	return w.primary
+}
+
+// WrapKey implements keyWrapper.
+func (w *keyFileWrapper) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	key, ok := w.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+	return seal(key, dataKey)
+}
+
+// UnwrapKey implements keyWrapper.
+func (w *keyFileWrapper) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := w.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+	return open(key, wrapped)
+}
+
+// secretBox envelope-encrypts single values.
+// Each value is encrypted with a new data key, which is wrapped with the primary key of the key wrapper
+// and stored together with the value as "enc:<key ID>:<base64 of wrapped key length, wrapped key and ciphertext>".
+type secretBox struct {
+	keys keyWrapper
+}
+
+func newSecretBox(keys keyWrapper) *secretBox {
+	return &secretBox{keys: keys}
+}
+
+// Encrypt encrypts the value with a new data key.
+func (b *secretBox) Encrypt(value string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	defer zero(dataKey)
+
+	keyID := b.keys.PrimaryKeyID()
+	wrapped, err := b.keys.WrapKey(keyID, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	plaintext := []byte(value)
+	defer zero(plaintext)
+	ciphertext, err := seal(dataKey, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	payload := make([]byte, 2, 2+len(wrapped)+len(ciphertext))
+	binary.BigEndian.PutUint16(payload, uint16(len(wrapped)))
+	payload = append(append(payload, wrapped...), ciphertext...)
+	return encryptedPrefix + keyID + ":" + base64.RawStdEncoding.EncodeToString(payload), nil
+}
+
+// Decrypt decrypts a value returned by Encrypt.
+// Values which are not encrypted are returned unchanged.
+// stale reports whether the value is not encrypted or not encrypted with the primary key, so it should be encrypted again.
+func (b *secretBox) Decrypt(value string) (plaintext string, stale bool, err error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, true, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", false, errors.New("malformed encrypted value")
+	}
+	keyID := parts[0]
+	payload, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(payload) < 2 {
+		return "", false, errors.New("malformed encrypted value")
+	}
+	wrappedLength := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+wrappedLength {
+		return "", false, errors.New("malformed encrypted value")
+	}
+
+	dataKey, err := b.keys.UnwrapKey(keyID, payload[2:2+wrappedLength])
+	if err != nil {
+		return "", false, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	defer zero(dataKey)
+	decrypted, err := open(dataKey, payload[2+wrappedLength:])
+	if err != nil {
+		return "", false, err
+	}
+	defer zero(decrypted)
+	return string(decrypted), keyID != b.keys.PrimaryKeyID(), nil
+}
+
+// seal encrypts the plaintext with AES-GCM and prepends the nonce.
+// Keys and nonces always come from crypto/rand, also in deterministic mode, so nonces are never reused.
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts a ciphertext returned by seal.
+func open(key []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt value")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// zero overwrites the buffer, so key material and decrypted secrets do not stay in memory longer than needed.
+// Strings can not be overwritten, so secrets should be kept as strings only as long as the SDK requires it.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// encryptingDatabase encrypts instance tokens, installation tokens and secret configuration values before they are stored.
+// Values read with an old key or stored before encryption was enabled are encrypted with the primary key on read.
+// The SDK database has no update operations, so the re-encrypted values are written with the SQL statements below.
+type encryptingDatabase struct {
+	connector.Database
+	db  *sqlx.DB
+	box *secretBox
+}
+
+const (
+	statementSelectInstallationTokens = `SELECT id, token FROM installations`
+	statementUpdateInstallationToken  = `UPDATE installations SET token = ? WHERE id = ?`
+	statementUpdateInstallationConfig = `UPDATE installation_configuration SET value = ? WHERE installation_id = ? AND id = ?`
+	statementUpdateInstanceToken      = `UPDATE instances SET token = ? WHERE id = ?`
+	statementUpdateInstanceConfig     = `UPDATE instance_configuration SET value = ? WHERE instance_id = ? AND id = ?`
+)
+
+// AddInstallation implements connector.Database.
+func (d *encryptingDatabase) AddInstallation(ctx context.Context, installationRequest connector.InstallationRequest) error {
+	token, err := d.box.Encrypt(string(installationRequest.Token))
+	if err != nil {
+		return err
+	}
+	installationRequest.Token = connector.InstallationToken(token)
+	return d.Database.AddInstallation(ctx, installationRequest)
+}
+
+// AddInstallationConfiguration implements connector.Database.
+func (d *encryptingDatabase) AddInstallationConfiguration(ctx context.Context, installationId string, config []connector.Configuration) error {
+	encrypted, err := d.encryptConfiguration(config)
+	if err != nil {
+		return err
+	}
+	return d.Database.AddInstallationConfiguration(ctx, installationId, encrypted)
+}
+
+// SetInstallationConfiguration implements installationConfigurationUpdater.
+func (d *encryptingDatabase) SetInstallationConfiguration(ctx context.Context, installationId string, config connector.Configuration) error {
+	encrypted, err := d.encryptConfiguration([]connector.Configuration{config})
+	if err != nil {
+		return err
+	}
+	return setInstallationConfiguration(ctx, d.Database, installationId, encrypted[0])
+}
+
+// GetInstallations implements connector.Database.
+// The SDK does not read installation tokens, so stale installation tokens are encrypted again here as well.
+func (d *encryptingDatabase) GetInstallations(ctx context.Context) ([]*connector.Installation, error) {
+	installations, err := d.Database.GetInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, installation := range installations {
+		if installation.Configuration, err = d.decryptConfiguration(ctx, statementUpdateInstallationConfig, installation.ID, installation.Configuration); err != nil {
+			return nil, err
+		}
+	}
+	d.reencryptInstallationTokens(ctx)
+	return installations, nil
+}
+
+// AddInstance implements connector.Database.
+func (d *encryptingDatabase) AddInstance(ctx context.Context, instantiationRequest connector.InstantiationRequest) error {
+	token, err := d.box.Encrypt(string(instantiationRequest.Token))
+	if err != nil {
+		return err
+	}
+	instantiationRequest.Token = connector.InstantiationToken(token)
+	return d.Database.AddInstance(ctx, instantiationRequest)
+}
+
+// AddInstanceConfiguration implements connector.Database.
+func (d *encryptingDatabase) AddInstanceConfiguration(ctx context.Context, instanceId string, config []connector.Configuration) error {
+	encrypted, err := d.encryptConfiguration(config)
+	if err != nil {
+		return err
+	}
+	return d.Database.AddInstanceConfiguration(ctx, instanceId, encrypted)
+}
+
+// GetInstance implements connector.Database.
+func (d *encryptingDatabase) GetInstance(ctx context.Context, instanceId string) (*connector.Instance, error) {
+	instance, err := d.Database.GetInstance(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	return instance, d.decryptInstance(ctx, instance)
+}
+
+// GetInstances implements connector.Database.
+func (d *encryptingDatabase) GetInstances(ctx context.Context) ([]*connector.Instance, error) {
+	instances, err := d.Database.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		if err := d.decryptInstance(ctx, instance); err != nil {
+			return nil, err
+		}
+	}
+	return instances, nil
+}
+
+// GetInstanceByThingId implements connector.Database.
+func (d *encryptingDatabase) GetInstanceByThingId(ctx context.Context, thingId string) (*connector.Instance, error) {
+	instance, err := d.Database.GetInstanceByThingId(ctx, thingId)
+	if err != nil {
+		return nil, err
+	}
+	return instance, d.decryptInstance(ctx, instance)
+}
+
+// GetInstanceConfiguration implements connector.Database.
+func (d *encryptingDatabase) GetInstanceConfiguration(ctx context.Context, instanceId string) ([]connector.Configuration, error) {
+	config, err := d.Database.GetInstanceConfiguration(ctx, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	return d.decryptConfiguration(ctx, statementUpdateInstanceConfig, instanceId, config)
+}
+
+func (d *encryptingDatabase) decryptInstance(ctx context.Context, instance *connector.Instance) error {
+	token, stale, err := d.box.Decrypt(string(instance.Token))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt token of instance %s: %w", instance.ID, err)
+	}
+	instance.Token = connector.InstantiationToken(token)
+	if stale {
+		d.reencrypt(ctx, statementUpdateInstanceToken, token, instance.ID)
+	}
+
+	instance.Configuration, err = d.decryptConfiguration(ctx, statementUpdateInstanceConfig, instance.ID, instance.Configuration)
+	return err
+}
+
+// encryptConfiguration returns a copy of the configuration with all secret values encrypted.
+func (d *encryptingDatabase) encryptConfiguration(config []connector.Configuration) ([]connector.Configuration, error) {
+	encrypted := make([]connector.Configuration, len(config))
+	for i, c := range config {
+		encrypted[i] = c
+		if !isSecretConfiguration(c.ID) {
+			continue
+		}
+		value, err := d.box.Encrypt(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		encrypted[i].Value = value
+	}
+	return encrypted, nil
+}
+
+// decryptConfiguration decrypts all secret values and encrypts stale ones again using the given update statement.
+func (d *encryptingDatabase) decryptConfiguration(ctx context.Context, updateStatement string, ownerId string, config []connector.Configuration) ([]connector.Configuration, error) {
+	for i, c := range config {
+		if !isSecretConfiguration(c.ID) {
+			continue
+		}
+		value, stale, err := d.box.Decrypt(c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt configuration %s of %s: %w", c.ID, ownerId, err)
+		}
+		config[i].Value = value
+		if stale {
+			d.reencrypt(ctx, updateStatement, value, ownerId, c.ID)
+		}
+	}
+	return config, nil
+}
+
+// reencryptInstallationTokens encrypts all stale installation tokens with the primary key.
+func (d *encryptingDatabase) reencryptInstallationTokens(ctx context.Context) {
+	var rows []struct {
+		ID    string `db:"id"`
+		Token string `db:"token"`
+	}
+	if err := d.db.SelectContext(ctx, &rows, statementSelectInstallationTokens); err != nil {
+		logrus.WithError(err).Warnln("failed to read installation tokens for re-encryption")
+		return
+	}
+	for _, row := range rows {
+		token, stale, err := d.box.Decrypt(row.Token)
+		if err != nil {
+			logrus.WithError(err).WithField("installationId", row.ID).Warnln("failed to decrypt installation token")
+			continue
+		}
+		if stale {
+			d.reencrypt(ctx, statementUpdateInstallationToken, token, row.ID)
+		}
+	}
+}
+
+// reencrypt encrypts the value with the primary key and stores it with the update statement.
+// Failures are only logged, the value is encrypted again on the next read.
+func (d *encryptingDatabase) reencrypt(ctx context.Context, updateStatement string, value string, args ...interface{}) {
+	encrypted, err := d.box.Encrypt(value)
+	if err == nil {
+		_, err = d.db.ExecContext(ctx, d.db.Rebind(updateStatement), append([]interface{}{encrypted}, args...)...)
+	}
+	if err != nil {
+		logrus.WithError(err).Warnln("failed to re-encrypt secret")
+	}
+}
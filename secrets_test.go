@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/db"
+)
+
+// testWebhookURL is a webhook URL as long as the ones of common chat and automation services.
+const testWebhookURL = "https://hooks.example.com/services/T0123ABCDE/B0456FGHIJ/aBcDeFgHiJkLmNoPqRsTuVwX?channel=giphy-updates"
+
+func newTestSecretBox(t *testing.T) *secretBox {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(file, []byte("primary "+base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := newKeyFileWrapper(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSecretBox(keys)
+}
+
+func TestSecretBoxRoundTripsWebhookURL(t *testing.T) {
+	box := newTestSecretBox(t)
+	encrypted, err := box.Encrypt(testWebhookURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The SDK stores configuration values as VARCHAR (200), which the schema migrations widen for encrypted values
+	if len(encrypted) <= 200 {
+		t.Errorf("expected the encrypted webhook URL to exceed 200 bytes, got %d", len(encrypted))
+	}
+	decrypted, stale, err := box.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != testWebhookURL || stale {
+		t.Errorf("got %q (stale %t), want %q", decrypted, stale, testWebhookURL)
+	}
+}
+
+func TestEncryptingDatabaseRoundTripsWebhookURL(t *testing.T) {
+	ctx := context.Background()
+	dbClient, err := db.NewDBClient(&db.DBOptions{Driver: db.DriverSqlite3, DSN: filepath.Join(t.TempDir(), "test.sqlite3") + "?_foreign_keys=on"}, connector.DefaultLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbClient.DB.Close()
+	if err := dbClient.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateSchema(ctx, dbClient.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	database := &encryptingDatabase{dbClient, dbClient.DB, newTestSecretBox(t)}
+	config := []connector.Configuration{{ID: "webhook_url", Value: testWebhookURL}}
+	if err := database.AddInstallation(ctx, connector.InstallationRequest{ID: "0b7a53c4-8d6e-4f6b-9a53-6a0f4b1d2c3e", Token: "token", Configuration: config}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AddInstallationConfiguration(ctx, "0b7a53c4-8d6e-4f6b-9a53-6a0f4b1d2c3e", config); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := dbClient.DB.Get(&stored, "SELECT value FROM installation_configuration WHERE id = 'webhook_url'"); err != nil {
+		t.Fatal(err)
+	}
+	if stored == testWebhookURL {
+		t.Error("webhook URL was stored in plain text")
+	}
+	installations, err := database.GetInstallations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(installations) != 1 {
+		t.Fatalf("got %d installations, want 1", len(installations))
+	}
+	if value, ok := installations[0].GetConfig("webhook_url"); !ok || value.Value != testWebhookURL {
+		t.Errorf("got webhook URL %+v, want %q", value, testWebhookURL)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// selfTestName names the in-memory database and the installation and instance of the self-test.
+const selfTestName = "selftest"
+
+// selfTestResult is the outcome of the last self-test run shown by the health endpoint.
+type selfTestResult struct {
+	// Status is "pending" until the first run finished, then "passed" or "failed".
+	Status      string     `json:"status"`
+	LastRun     *time.Time `json:"lastRun,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	FailedStep  string     `json:"failedStep,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// selfTest periodically runs the lifecycle of the end-to-end test inside the service: a synthetic installation and instance
+// are created, updated, searched and removed through the callback handlers, the provider and the connector service.
+// It runs against the fake Giphy API and a fake connctd client, so it needs no credentials and does not touch real instances,
+// but it catches a broken build or configuration of the pipeline in a running deployment.
+type selfTest struct {
+	interval    time.Duration
+	runs        *metricVec
+	lastSuccess *metricVec
+
+	lock   sync.Mutex
+	result selfTestResult
+}
+
+func newSelfTest(interval time.Duration, metrics *metricsRegistry) *selfTest {
+	return &selfTest{
+		interval:    interval,
+		runs:        metrics.Counter("self_test_runs_total", "Number of self-test runs by result.", "result"),
+		lastSuccess: metrics.Gauge("self_test_last_success_timestamp_seconds", "Unix time of the last successful self-test run."),
+		result:      selfTestResult{Status: "pending"},
+	}
+}
+
+// Run runs the self-test right away and then every interval until the context is done.
+func (t *selfTest) Run(ctx context.Context) {
+	e, closeEndToEnd, err := newEndToEnd(selfTestName)
+	if err != nil {
+		logrus.WithError(err).Errorln("failed to set up the self-test")
+		t.record("setup", err)
+		return
+	}
+	defer closeEndToEnd()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		t.runOnce(e)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *selfTest) runOnce(e *endToEnd) {
+	var failedStep string
+	var failure error
+	e.run(func(step string, err error) {
+		if err != nil {
+			failedStep, failure = step, err
+		}
+	})
+	t.record(failedStep, failure)
+	if failure != nil {
+		logrus.WithError(failure).WithField("step", failedStep).Errorln("self-test failed")
+	} else {
+		logrus.Debugln("self-test passed")
+	}
+}
+
+func (t *selfTest) record(failedStep string, err error) {
+	now := clock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.result.LastRun = &now
+	if err != nil {
+		t.runs.Inc("failed")
+		t.result.Status = "failed"
+		t.result.FailedStep = failedStep
+		t.result.Error = err.Error()
+		return
+	}
+	t.runs.Inc("passed")
+	t.lastSuccess.Set(float64(now.Unix()))
+	t.result.Status = "passed"
+	t.result.LastSuccess = &now
+	t.result.FailedStep = ""
+	t.result.Error = ""
+}
+
+// Result returns the outcome of the last run.
+func (t *selfTest) Result() selfTestResult {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.result
+}
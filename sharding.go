@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// statementCreateReplicas creates the table the replicas announce themselves in.
+const statementCreateReplicas = `CREATE TABLE IF NOT EXISTS connector_replicas (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	heartbeat BIGINT NOT NULL
+)`
+
+const (
+	// shardHeartbeatInterval is the interval in which a replica announces itself.
+	shardHeartbeatInterval = 15 * time.Second
+	// shardMemberExpiry is the time after which a replica without heartbeat is not a member anymore.
+	shardMemberExpiry = 3 * shardHeartbeatInterval
+	// shardVirtualNodes is the number of points of each replica on the hash ring, so instances are spread evenly.
+	shardVirtualNodes = 200
+)
+
+// shardMembership partitions instances between the replicas sharing a database with consistent hashing.
+// Each replica writes a heartbeat to the database and builds the same hash ring from all live replicas,
+// so every instance is owned by exactly one replica and only few instances move when a replica joins or leaves.
+type shardMembership struct {
+	db        *sqlx.DB
+	replicaId string
+	replicas  *metricVec
+
+	members       []string
+	ring          []shardPoint
+	lastHeartbeat time.Time
+	lock          sync.RWMutex
+}
+
+type shardPoint struct {
+	hash    uint64
+	replica string
+}
+
+func newShardMembership(db *sqlx.DB, replicaId string, metrics *metricsRegistry) *shardMembership {
+	return &shardMembership{
+		db:        db,
+		replicaId: replicaId,
+		replicas:  metrics.Gauge("shard_replicas", "Number of live replicas the instances are partitioned between."),
+	}
+}
+
+// Owns reports whether this replica updates the instance.
+// A replica which could not announce itself for the member expiry owns no instances,
+// because the other replicas already took them over.
+func (s *shardMembership) Owns(instanceId string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.ring) == 0 || clock().Sub(s.lastHeartbeat) > shardMemberExpiry {
+		return false
+	}
+	h := shardHash(instanceId)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].replica == s.replicaId
+}
+
+// Heartbeat announces this replica and rebuilds the hash ring from all live replicas.
+func (s *shardMembership) Heartbeat(ctx context.Context) error {
+	now := clock()
+	result, err := s.db.ExecContext(ctx, s.db.Rebind("UPDATE connector_replicas SET heartbeat = ? WHERE id = ?"), now.Unix(), s.replicaId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if _, err := s.db.ExecContext(ctx, s.db.Rebind("INSERT INTO connector_replicas (id, heartbeat) VALUES (?, ?)"), s.replicaId, now.Unix()); err != nil {
+			return err
+		}
+	}
+
+	var members []string
+	expired := now.Add(-shardMemberExpiry).Unix()
+	if err := s.db.SelectContext(ctx, &members, s.db.Rebind("SELECT id FROM connector_replicas WHERE heartbeat >= ? ORDER BY id"), expired); err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, s.db.Rebind("DELETE FROM connector_replicas WHERE heartbeat < ?"), expired); err != nil {
+		logrus.WithError(err).Warnln("failed to delete expired replicas")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastHeartbeat = now
+	if strings.Join(members, ",") != strings.Join(s.members, ",") {
+		logrus.WithField("replicas", members).WithField("replicaId", s.replicaId).Infoln("shard membership changed")
+		s.members = members
+		s.ring = newShardRing(members)
+		s.replicas.Set(float64(len(members)))
+	}
+	return nil
+}
+
+// Run sends heartbeats and synchronizes the registrations of the provider with the database until the context is done.
+// Callbacks are received by any replica, so each replica registers the installations and instances stored by the others.
+func (s *shardMembership) Run(ctx context.Context, syncRegistrations func(ctx context.Context) error) {
+	heartbeat := time.NewTicker(shardHeartbeatInterval)
+	defer heartbeat.Stop()
+	registrations := time.NewTicker(time.Minute)
+	defer registrations.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if err := s.Heartbeat(ctx); err != nil {
+				logrus.WithError(err).Warnln("failed to send shard heartbeat")
+			}
+		case <-registrations.C:
+			if err := syncRegistrations(ctx); err != nil {
+				logrus.WithError(err).Warnln("failed to synchronize registrations with the database")
+			}
+		}
+	}
+}
+
+func newShardRing(members []string) []shardPoint {
+	ring := make([]shardPoint, 0, len(members)*shardVirtualNodes)
+	for _, member := range members {
+		for i := 0; i < shardVirtualNodes; i++ {
+			ring = append(ring, shardPoint{shardHash(member + "#" + strconv.Itoa(i)), member})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// shardHash hashes with SHA-256, because faster hashes spread similar IDs like the virtual node names unevenly.
+func shardHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
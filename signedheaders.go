@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/crypto"
+	"github.com/connctd/giphy-connector/internal/signing"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+var errorUnsignedHeader = connector.NewError("UNSIGNED_HEADER", "The request does not sign all required headers", http.StatusBadRequest)
+
+// newSignedHeadersConnectorHandler returns a handler for the endpoints of the connector protocol
+// which verifies the signatures over the given headers instead of only the Date header like the SDK handler.
+// A request may announce that it signed more headers with the Signed-Headers header, as long as the required headers are included.
+// The signature is accepted if it was created with any of the keys.
+func newSignedHeadersConnectorHandler(service connector.ConnectorService, keys func() []ed25519.PublicKey, signedHeaders []string, compatibleContentTypes bool) http.Handler {
+	// The Content-Type is normalized after the verification, since it may be signed
+	verify := func(next http.HandlerFunc) http.Handler {
+		return signatureVerifyingHandler(keys, signedHeaders, jsonContentTypeHandler(compatibleContentTypes, next).ServeHTTP)
+	}
+
+	r := mux.NewRouter()
+	r.Path("/installations").Methods(http.MethodPost).Handler(verify(connector.AddInstallation(service)))
+	r.Path("/installations/{id}").Methods(http.MethodDelete).Handler(verify(connector.RemoveInstallation(service)))
+	r.Path("/instances").Methods(http.MethodPost).Handler(verify(connector.AddInstance(service)))
+	r.Path("/instances/{id}").Methods(http.MethodDelete).Handler(verify(connector.RemoveInstance(service)))
+	r.Path("/actions").Methods(http.MethodPost).Handler(verify(connector.PerformAction(service)))
+	return r
+}
+
+// signatureVerifyingHandler verifies the signature of the request like the SDK signature validation handler,
+// but with the negotiated signed headers and multiple keys. It writes the same errors as the SDK.
+func signatureVerifyingHandler(keys func() []ed25519.PublicKey, required []string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature, err := base64.StdEncoding.DecodeString(r.Header.Get(crypto.SignatureHeaderKey))
+		if err != nil {
+			connector.ErrorBadSignature.Write(w)
+			return
+		}
+		signedHeaders, err := signing.Negotiate(required, r.Header.Get(signing.SignedHeadersHeaderKey))
+		if err != nil {
+			logrus.WithError(err).WithField("correlationId", correlationID(r.Context())).Warnln("rejected request with insufficient signed headers")
+			errorUnsignedHeader.Write(w)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			connector.ErrorInvalidBody.Write(w)
+			return
+		}
+		r.Body.Close()
+
+		params := connector.AutoProxyRequestValidationPreProcessor()(r)
+		payload, err := signing.Payload(r.Method, params.Scheme, params.Host, params.RequestURI, r.Header, signedHeaders, body)
+		if errors.Is(err, signing.ErrorMissingHeader) {
+			connector.ErrorMissingHeader.Write(w)
+			return
+		} else if err != nil {
+			connector.ErrorSigningFailed.Write(w)
+			return
+		}
+
+		publicKeys := keys()
+		if len(publicKeys) == 0 {
+			errorNoPublicKey.Write(w)
+			return
+		}
+		for _, key := range publicKeys {
+			if crypto.Verify(key, payload, signature) {
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		connector.ErrorBadSignature.Write(w)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxStatsdPacketSize keeps each datagram below the usual MTU.
+const maxStatsdPacketSize = 1432
+
+// statsdExporter periodically pushes all metrics of the registry to a StatsD agent using the DogStatsD format.
+// Labels are sent as tags. Counters are sent as the difference to the previously pushed value.
+type statsdExporter struct {
+	registry *metricsRegistry
+	addr     string
+	prefix   string
+	interval time.Duration
+	sent     map[string]float64
+}
+
+// newStatsdExporter returns an exporter pushing to the agent listening on the given UDP address.
+// All metric names are prefixed with prefix.
+func newStatsdExporter(registry *metricsRegistry, addr string, prefix string, interval time.Duration) *statsdExporter {
+	return &statsdExporter{
+		registry: registry,
+		addr:     addr,
+		prefix:   prefix,
+		interval: interval,
+		sent:     map[string]float64{},
+	}
+}
+
+// Run pushes the metrics until the context is canceled.
+func (e *statsdExporter) Run(ctx context.Context) error {
+	conn, err := net.Dial("udp", e.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to statsd agent: %w", err)
+	}
+
+	go func() {
+		defer conn.Close()
+
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, packet := range e.packets() {
+					if _, err := conn.Write(packet); err != nil {
+						logrus.WithError(err).Warnln("failed to push metrics to statsd")
+						break
+					}
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// packets renders the current metric values into datagrams.
+func (e *statsdExporter) packets() [][]byte {
+	var packets [][]byte
+	var b bytes.Buffer
+
+	for _, sample := range e.registry.Samples() {
+		line, ok := e.line(sample)
+		if !ok {
+			continue
+		}
+		if b.Len() > 0 && b.Len()+1+len(line) > maxStatsdPacketSize {
+			packets = append(packets, append([]byte{}, b.Bytes()...))
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		packets = append(packets, b.Bytes())
+	}
+	return packets
+}
+
+// line formats a single sample.
+// It returns false for counters which did not change since the last push.
+func (e *statsdExporter) line(sample metricSample) (string, bool) {
+	tags := make([]string, len(sample.labelNames))
+	for i, name := range sample.labelNames {
+		tags[i] = name + ":" + statsdEscape(sample.labelValues[i])
+	}
+
+	value := sample.value
+	kind := "g"
+	if sample.kind == "counter" {
+		kind = "c"
+		key := sample.name + "\xff" + strings.Join(sample.labelValues, "\xff")
+		value = sample.value - e.sent[key]
+		e.sent[key] = sample.value
+		if value == 0 {
+			return "", false
+		}
+	}
+
+	line := e.prefix + sample.name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line, true
+}
+
+// statsdEscape removes characters with a special meaning in the DogStatsD format from tag values.
+func statsdEscape(s string) string {
+	return strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_").Replace(s)
+}
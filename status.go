@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// maxRecentErrors is the number of errors kept for the status page.
+const maxRecentErrors = 20
+
+// maxActionHistory is the number of action requests kept for the read API.
+const maxActionHistory = 100
+
+// statusRecorder keeps the runtime information shown on the status page which is not stored in the database.
+type statusRecorder struct {
+	lastUpdates  map[string]time.Time
+	values       map[string]map[string]PropertyValue
+	actions      []ActionRecord
+	recentErrors []RecentError
+	lock         sync.Mutex
+}
+
+// PropertyValue is the last value of a property successfully sent to connctd.
+type PropertyValue struct {
+	ComponentID string    `json:"componentId"`
+	PropertyID  string    `json:"propertyId"`
+	Value       string    `json:"value"`
+	Updated     time.Time `json:"updated"`
+}
+
+// ActionRecord is an action request received by the connector and its result.
+type ActionRecord struct {
+	ID          string     `json:"id"`
+	ActionID    string     `json:"actionId"`
+	ThingID     string     `json:"thingId"`
+	ComponentID string     `json:"componentId"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Received    time.Time  `json:"received"`
+	Finished    *time.Time `json:"finished,omitempty"`
+}
+
+// RecentError is an error shown on the status page.
+type RecentError struct {
+	Time    time.Time    `json:"time"`
+	Error   string       `json:"error"`
+	Context ErrorContext `json:"context"`
+}
+
+func newStatusRecorder() *statusRecorder {
+	return &statusRecorder{
+		lastUpdates: map[string]time.Time{},
+		values:      map[string]map[string]PropertyValue{},
+	}
+}
+
+// PropertyUpdated records a successful property update of the given thing.
+func (s *statusRecorder) PropertyUpdated(thingId string, componentId string, propertyId string, value string, t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastUpdates[thingId] = t
+	if s.values[thingId] == nil {
+		s.values[thingId] = map[string]PropertyValue{}
+	}
+	s.values[thingId][componentId+"/"+propertyId] = PropertyValue{componentId, propertyId, value, t}
+}
+
+// PropertyValues returns the last values of the properties of the given thing, sorted by component and property.
+func (s *statusRecorder) PropertyValues(thingId string) []PropertyValue {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	values := make([]PropertyValue, 0, len(s.values[thingId]))
+	for _, v := range s.values[thingId] {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].ComponentID+"/"+values[i].PropertyID < values[j].ComponentID+"/"+values[j].PropertyID
+	})
+	return values
+}
+
+// ActionRequested records a received action request.
+// Only the last maxActionHistory action requests are kept.
+func (s *statusRecorder) ActionRequested(request connector.ActionRequest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.actions = append(s.actions, ActionRecord{
+		ID:          request.ID,
+		ActionID:    request.ActionID,
+		ThingID:     request.ThingID,
+		ComponentID: request.ComponentID,
+		Status:      string(connector.ActionRequestStatusPending),
+		Received:    clock(),
+	})
+	if len(s.actions) > maxActionHistory {
+		s.actions = s.actions[len(s.actions)-maxActionHistory:]
+	}
+}
+
+// ActionFinished records the final status of an action request.
+func (s *statusRecorder) ActionFinished(actionRequestId string, status connector.ActionRequestStatus, e string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := len(s.actions) - 1; i >= 0; i-- {
+		if s.actions[i].ID == actionRequestId {
+			now := clock()
+			s.actions[i].Status = string(status)
+			s.actions[i].Error = e
+			s.actions[i].Finished = &now
+			return
+		}
+	}
+}
+
+// Actions returns the recorded action requests, newest first.
+func (s *statusRecorder) Actions() []ActionRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	actions := make([]ActionRecord, len(s.actions))
+	for i, a := range s.actions {
+		actions[len(actions)-1-i] = a
+	}
+	return actions
+}
+
+// LastUpdate returns the time of the last successful property update of the given thing.
+func (s *statusRecorder) LastUpdate(thingId string) (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.lastUpdates[thingId]
+	return t, ok
+}
+
+// Failed records an error.
+// Only the last maxRecentErrors errors are kept.
+func (s *statusRecorder) Failed(err error, errCtx ErrorContext) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	errCtx.Stacktrace = ""
+	s.recentErrors = append(s.recentErrors, RecentError{clock(), redactString(err.Error()), errCtx})
+	if len(s.recentErrors) > maxRecentErrors {
+		s.recentErrors = s.recentErrors[len(s.recentErrors)-maxRecentErrors:]
+	}
+}
+
+// RecentErrors returns the recorded errors, newest first.
+func (s *statusRecorder) RecentErrors() []RecentError {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	errs := make([]RecentError, len(s.recentErrors))
+	for i, e := range s.recentErrors {
+		errs[len(errs)-1-i] = e
+	}
+	return errs
+}
+
+// recordingReporter records all reported errors for the status page before forwarding them.
+type recordingReporter struct {
+	ErrorReporter
+	status *statusRecorder
+}
+
+// Report implements ErrorReporter.
+func (r *recordingReporter) Report(err error, errCtx ErrorContext) {
+	r.status.Failed(err, errCtx)
+	r.ErrorReporter.Report(err, errCtx)
+}
+
+// recordingClient records successful property updates and action results for the status page.
+type recordingClient struct {
+	connector.Client
+	status *statusRecorder
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *recordingClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+	if err == nil {
+		c.status.PropertyUpdated(thingID, componentID, propertyID, value, lastUpdate)
+	}
+	return err
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *recordingClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	err := c.Client.UpdateActionStatus(ctx, token, actionRequestID, status, e)
+	c.status.ActionFinished(actionRequestID, status, e)
+	return err
+}
+
+// recordingService records received action requests for the status page.
+type recordingService struct {
+	connector.ConnectorService
+	status *statusRecorder
+}
+
+// PerformAction implements connector.ConnectorService.
+func (s *recordingService) PerformAction(ctx context.Context, request connector.ActionRequest) (*connector.ActionResponse, error) {
+	s.status.ActionRequested(request)
+	response, err := s.ConnectorService.PerformAction(ctx, request)
+	if err != nil {
+		s.status.ActionFinished(request.ID, connector.ActionRequestStatusFailed, err.Error())
+	} else if response != nil && response.Status != connector.ActionRequestStatusPending {
+		s.status.ActionFinished(request.ID, response.Status, response.Error)
+	}
+	return response, err
+}
+
+// StatusReport is the content of the status page.
+type StatusReport struct {
+	Time           time.Time            `json:"time"`
+	Installations  []InstallationStatus `json:"installations"`
+	PendingActions []PendingActionInfo  `json:"pendingActions"`
+	RecentErrors   []RecentError        `json:"recentErrors"`
+}
+
+// InstallationStatus describes an installation and its instances.
+type InstallationStatus struct {
+	ID         string           `json:"id"`
+	Registered bool             `json:"registered"`
+	Instances  []InstanceStatus `json:"instances"`
+}
+
+// InstanceStatus describes an instance and its things.
+type InstanceStatus struct {
+	ID             string `json:"id"`
+	InstallationID string `json:"installationId"`
+	Registered     bool   `json:"registered"`
+	Paused         bool   `json:"paused"`
+	// NeedsReauthorization is set once connctd rejected the token of the instance, its updates are not sent anymore.
+	NeedsReauthorization bool          `json:"needsReauthorization"`
+	Things               []ThingStatus `json:"things"`
+}
+
+// ThingStatus describes a thing and when its properties were last updated successfully.
+type ThingStatus struct {
+	ID         string     `json:"id"`
+	ExternalID string     `json:"externalId,omitempty"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+}
+
+// statusReport combines the database content with the state of the provider and the status recorder.
+func statusReport(ctx context.Context, db connector.Database, giphyProvider *GiphyProvider, status *statusRecorder) (*StatusReport, error) {
+	installations, err := db.GetInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := db.GetInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	registeredInstallations, registeredInstances := giphyProvider.Registered()
+	paused := giphyProvider.Paused()
+	reauthorizations := giphyProvider.NeedsReauthorization()
+
+	report := &StatusReport{
+		Time:           clock(),
+		Installations:  make([]InstallationStatus, len(installations)),
+		PendingActions: giphyProvider.PendingActions(),
+		RecentErrors:   status.RecentErrors(),
+	}
+
+	index := map[string]int{}
+	for i, installation := range installations {
+		index[installation.ID] = i
+		report.Installations[i] = InstallationStatus{
+			ID:         installation.ID,
+			Registered: registeredInstallations[installation.ID],
+			Instances:  []InstanceStatus{},
+		}
+	}
+
+	for _, instance := range instances {
+		i, ok := index[instance.InstallationID]
+		if !ok {
+			continue
+		}
+		instanceStatus := InstanceStatus{
+			ID:                   instance.ID,
+			InstallationID:       instance.InstallationID,
+			Registered:           registeredInstances[instance.ID],
+			Paused:               paused[instance.ID],
+			NeedsReauthorization: !reauthorizations[instance.ID].IsZero(),
+			Things:               make([]ThingStatus, len(instance.ThingMapping)),
+		}
+		for j, mapping := range instance.ThingMapping {
+			instanceStatus.Things[j] = ThingStatus{
+				ID:         mapping.ThingID,
+				ExternalID: mapping.ExternalID,
+			}
+			if t, ok := status.LastUpdate(mapping.ThingID); ok {
+				instanceStatus.Things[j].LastUpdate = &t
+			}
+		}
+		report.Installations[i].Instances = append(report.Installations[i].Instances, instanceStatus)
+	}
+
+	return report, nil
+}
+
+// wantsJSON reports whether the client asked for a JSON response, either by query parameter or Accept header.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Giphy connector status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Giphy connector status</h1>
+<p>Generated at {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+
+<h2>Instances</h2>
+<table>
+<tr><th>Installation</th><th>Instance</th><th>Registered</th><th>Paused</th><th>Needs re-authorization</th><th>Thing</th><th>Last update</th></tr>
+{{range $installation := .Installations}}{{range $instance := $installation.Instances}}{{range $thing := $instance.Things}}
+<tr><td>{{$installation.ID}}</td><td>{{$instance.ID}}</td><td>{{$instance.Registered}}</td><td>{{$instance.Paused}}</td><td>{{$instance.NeedsReauthorization}}</td><td>{{$thing.ID}}</td><td>{{if $thing.LastUpdate}}{{$thing.LastUpdate.Format "2006-01-02 15:04:05"}}{{else}}never{{end}}</td></tr>
+{{end}}{{end}}{{end}}
+</table>
+
+<h2>Pending actions</h2>
+<table>
+<tr><th>Action request</th><th>Action</th><th>Instance</th><th>Received</th></tr>
+{{range .PendingActions}}<tr><td>{{.ID}}</td><td>{{.ActionID}}</td><td>{{.InstanceID}}</td><td>{{.Received.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}
+</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Component</th><th>Instance</th><th>Error</th></tr>
+{{range .RecentErrors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Context.Component}}</td><td>{{.Context.InstanceID}}</td><td>{{.Error}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
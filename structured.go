@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/connctd/connector-go/connctd"
+)
+
+// schemaAttributePrefix prefixes the names of the thing attributes declaring the schema of a structured property,
+// e.g. "schema.search.results" contains the JSON schema of the property results of the component search.
+const schemaAttributePrefix = "schema."
+
+// propertySchema is the subset of JSON schema used to declare the values of structured properties.
+// connctd only knows plain property values, so structured values are sent as JSON in string properties
+// and their schema is published as thing attribute, letting clients decode them.
+type propertySchema struct {
+	Type       string                     `json:"type"`
+	Properties map[string]*propertySchema `json:"properties,omitempty"`
+	Required   []string                   `json:"required,omitempty"`
+	Items      *propertySchema            `json:"items,omitempty"`
+}
+
+// Validate checks a decoded JSON value against the schema. Properties not declared by an object schema are allowed.
+func (s *propertySchema) Validate(value interface{}) error {
+	return s.validate("$", value)
+}
+
+func (s *propertySchema) validate(path string, value interface{}) error {
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, schema := range s.Properties {
+			if v, ok := object[name]; ok {
+				if err := schema.validate(path+"."+name, v); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		if s.Items != nil {
+			for i, v := range array {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), v); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected string", path)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected number", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", path)
+		}
+	default:
+		return fmt.Errorf("%s: unknown schema type %q", path, s.Type)
+	}
+	return nil
+}
+
+// marshalStructuredValue marshals the value of the structured property as JSON
+// and validates it against the declared schema, so malformed values are never sent to connctd.
+func marshalStructuredValue(property propertyRef, value interface{}) (string, error) {
+	schema, ok := structuredPropertySchemas[property]
+	if !ok {
+		return "", fmt.Errorf("property %s is not structured", property)
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return "", err
+	}
+	if err := schema.Validate(decoded); err != nil {
+		return "", fmt.Errorf("value of property %s does not match its schema: %w", property, err)
+	}
+	return string(b), nil
+}
+
+// schemaAttributes returns the thing attributes declaring the schemas of the structured properties, sorted by name.
+func schemaAttributes() []connctd.ThingAttribute {
+	attributes := []connctd.ThingAttribute{}
+	for property, schema := range structuredPropertySchemas {
+		b, err := json.Marshal(schema)
+		if err != nil {
+			panic(err)
+		}
+		attributes = append(attributes, connctd.ThingAttribute{
+			Name:  schemaAttributePrefix + property.ComponentID + "." + property.PropertyID,
+			Value: string(b),
+		})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Name < attributes[j].Name })
+	return attributes
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the thing attributes describing where the GIFs of a thing come from.
+const (
+	// sourceAttribute is the data source of the thing, always giphy.
+	sourceAttribute = "source"
+	// sourceApiVersionAttribute is the version of the Giphy API the GIFs are requested from.
+	sourceApiVersionAttribute = "source.api_version"
+	// sourceRatingAttribute is the content rating the GIFs of the installation are limited to.
+	// It depends on the installation, so it is not part of the template but set once the thing was created.
+	sourceRatingAttribute = "source.rating"
+)
+
+// giphyApiVersion is the version of the Giphy API used by the Giphy client.
+const giphyApiVersion = "v1"
+
+// sourceAttributes returns the thing attributes of the template describing the data source.
+func sourceAttributes() []connctd.ThingAttribute {
+	return []connctd.ThingAttribute{
+		{Name: sourceAttribute, Value: "giphy"},
+		{Name: sourceApiVersionAttribute, Value: giphyApiVersion},
+	}
+}
+
+// thingAttributes sets the attributes of things which depend on the installation, like the rating, after the things
+// were created. They are sent to connctd as additive update of the thing, existing attributes with the same name are replaced.
+// Things created before the attributes existed get them with the thing upgrade.
+type thingAttributes struct {
+	db       connector.Database
+	provider *GiphyProvider
+	upgrader *thingUpgrader
+	updates  *metricVec
+}
+
+func newThingAttributes(db connector.Database, provider *GiphyProvider, upgrader *thingUpgrader, metrics *metricsRegistry) *thingAttributes {
+	return &thingAttributes{
+		db:       db,
+		provider: provider,
+		upgrader: upgrader,
+		updates:  metrics.Counter("thing_attribute_updates_total", "Number of updates of the installation dependent thing attributes by result.", "result"),
+	}
+}
+
+// Of returns the installation dependent attributes of the things of the instance.
+func (a *thingAttributes) Of(ctx context.Context, instance *connector.Instance) ([]connctd.ThingAttribute, error) {
+	installations, err := a.db.GetInstallations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, installation := range installations {
+		if installation.ID == instance.InstallationID {
+			return []connctd.ThingAttribute{{Name: sourceRatingAttribute, Value: a.provider.installationRating(installation)}}, nil
+		}
+	}
+	return nil, fmt.Errorf("installation %s of instance %s not found", instance.InstallationID, instance.ID)
+}
+
+// OnThingCreation returns a hook setting the attributes of created things. Failures are only logged,
+// the thing works without them.
+func (a *thingAttributes) OnThingCreation() thingCreationHook {
+	return func(ctx context.Context, result thingCreationResult) {
+		if result.Err != nil {
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), thingStatusTimeout)
+			defer cancel()
+			logger := logrus.WithField("instanceId", result.InstanceID).WithField("thingId", result.ThingID)
+			instance, err := a.db.GetInstance(ctx, result.InstanceID)
+			if err != nil {
+				logger.WithError(err).Warnln("failed to get instance to set the thing attributes")
+				return
+			}
+			attributes, err := a.Of(ctx, instance)
+			if err == nil {
+				err = a.upgrader.UpdateAttributes(ctx, instance.Token, result.ThingID, attributes)
+			}
+			if err != nil {
+				a.updates.Inc("failed")
+				logger.WithError(err).Warnln("failed to set thing attributes")
+				return
+			}
+			a.updates.Inc("updated")
+		}()
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+
+	"github.com/connctd/connector-go"
+)
+
+// EventThingCreationFailed is emitted when a thing of an instance could not be created.
+// The external ID of the thing is passed as "externalId" in the metadata.
+const EventThingCreationFailed = "thing.creation_failed"
+
+// thingCreationResult is the outcome of the creation of a thing of an instance.
+// ThingID is empty if the creation failed with Err.
+type thingCreationResult struct {
+	InstanceID string
+	ThingID    string
+	ExternalID string
+	Err        error
+}
+
+// thingCreationHook is called with the result of each thing creation, either during the instantiation or by the job
+// creating the missing things. Successful creations are reported after the instance was registered with the provider,
+// so a hook can e.g. publish a first value right away instead of waiting for the next periodic update.
+type thingCreationHook func(ctx context.Context, result thingCreationResult)
+
+// OnThingCreation registers a hook called with the results of thing creations.
+// Hooks must be registered before callbacks are handled and must not block for long.
+func (s *thingCreationService) OnThingCreation(hook thingCreationHook) {
+	s.hooks = append(s.hooks, hook)
+}
+
+// notifyInstantiation reports the results of the thing creations of an instantiation which returned err.
+// The SDK creates the things in order and stops at the first failure, so the things with a mapping were created
+// and the first template without one failed.
+func (s *thingCreationService) notifyInstantiation(ctx context.Context, request connector.InstantiationRequest, err error) {
+	if len(s.hooks) == 0 {
+		return
+	}
+	instance, dbErr := s.db.GetInstance(ctx, request.ID)
+	if dbErr != nil {
+		// The instance was not stored, so no thing creation was attempted
+		return
+	}
+	created := map[string]bool{}
+	for _, mapping := range instance.ThingMapping {
+		created[mapping.ExternalID] = true
+		s.notify(ctx, thingCreationResult{InstanceID: instance.ID, ThingID: mapping.ThingID, ExternalID: mapping.ExternalID})
+	}
+	if err == nil {
+		return
+	}
+	for _, template := range s.thingTemplates(request) {
+		if !created[template.ExternalID] {
+			s.notify(ctx, thingCreationResult{InstanceID: instance.ID, ExternalID: template.ExternalID, Err: err})
+			return
+		}
+	}
+}
+
+func (s *thingCreationService) notify(ctx context.Context, result thingCreationResult) {
+	for _, hook := range s.hooks {
+		hook(ctx, result)
+	}
+}
+
+// thingCreationFailedEvents returns a hook emitting an event for each failed thing creation.
+// Successful creations are emitted as thing.created by the event client already.
+func thingCreationFailedEvents(events EventSink) thingCreationHook {
+	return func(ctx context.Context, result thingCreationResult) {
+		if result.Err == nil {
+			return
+		}
+		events.Emit(Event{
+			Type:          EventThingCreationFailed,
+			CorrelationID: correlationID(ctx),
+			InstanceID:    result.InstanceID,
+			Error:         result.Err.Error(),
+			Metadata:      map[string]string{"externalId": result.ExternalID},
+		})
+	}
+}
+
+// firstValueUpdates returns a hook scheduling an update of each instance with created things,
+// so installers see the first GIFs right away.
+func firstValueUpdates(provider *GiphyProvider) thingCreationHook {
+	return func(ctx context.Context, result thingCreationResult) {
+		if result.Err == nil {
+			provider.ScheduleUpdate(result.InstanceID)
+		}
+	}
+}
@@ -1,36 +1,167 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/connctd/connector-go"
 	"github.com/connctd/connector-go/connctd"
 )
 
 const (
-	RandomComponentId       = "random"
-	RandomPropertyId        = "value"
-	SearchComponentId       = "search"
-	SearchPropertyId        = "value"
-	SearchActionId          = "search"
-	SearchActionParameterId = "keyword"
+	RandomComponentId = "random"
+	RandomPropertyId  = "value"
+	SearchComponentId = "search"
+	SearchPropertyId  = "value"
+	// SearchResultCountPropertyId is the number of GIFs found by the last search, 0 or 1.
+	SearchResultCountPropertyId = "result_count"
+	// SearchResultsPropertyId are the GIFs found by the last search with their metadata as structured value.
+	SearchResultsPropertyId = "results"
+	// SearchResultsTruncatedPropertyId is whether results were dropped from the last search results to fit the maximum value length.
+	SearchResultsTruncatedPropertyId = "results_truncated"
+	SearchActionId                   = "search"
+	SearchActionParameterId          = "keyword"
+	// TrendingComponentId is updated with the top trending GIF together with the random component.
+	TrendingComponentId = "trending"
+	TrendingPropertyId  = "value"
+	// TranslateComponentId has the GIF Giphy translated the phrase of the last translate action to.
+	TranslateComponentId       = "translate"
+	TranslatePropertyId        = "value"
+	TranslateActionId          = "translate"
+	TranslateActionParameterId = "phrase"
 )
 
-// thingTemplates returns a thing that can be registered with the connctd platform together with an external id.
+// componentTTLs returns the TTLs of the components whose properties are emptied if they are not updated within the TTL.
+// The random component is updated periodically, the search component only when a search is requested,
+// so its result is emptied after the search TTL. A TTL of 0 disables the expiry of the search result.
+func componentTTLs(searchTTL time.Duration) map[string]time.Duration {
+	ttls := map[string]time.Duration{}
+	if searchTTL > 0 {
+		ttls[SearchComponentId] = searchTTL
+	}
+	return ttls
+}
+
+// emptyPropertyValues are the values properties are set to when they expire, all other properties are set to an empty string.
+var emptyPropertyValues = map[string]string{
+	searchResultCountProperty.String():      "0",
+	searchResultsTruncatedProperty.String(): "false",
+}
+
+// structuredPropertySchemas are the schemas of the properties with structured values.
+// Their values are sent as JSON and must be marshaled with marshalStructuredValue.
+var structuredPropertySchemas = map[propertyRef]*propertySchema{
+	searchResultsProperty: {
+		Type:     "object",
+		Required: []string{"keyword", "results"},
+		Properties: map[string]*propertySchema{
+			"keyword": {Type: "string"},
+			"results": {
+				Type: "array",
+				Items: &propertySchema{
+					Type:     "object",
+					Required: []string{"url"},
+					Properties: map[string]*propertySchema{
+						"id":     {Type: "string"},
+						"url":    {Type: "string"},
+						"rating": {Type: "string"},
+					},
+				},
+			},
+		},
+	},
+}
+
+// searchResults is the structured value of the search results property.
+type searchResults struct {
+	Keyword string         `json:"keyword"`
+	Results []searchResult `json:"results"`
+}
+
+// searchResult is a GIF found by a search. Results taken from the search cache only have a URL.
+type searchResult struct {
+	ID     string `json:"id,omitempty"`
+	URL    string `json:"url"`
+	Rating string `json:"rating,omitempty"`
+}
+
+// keywordsConfigID is the instance configuration parameter with comma separated keywords, e.g. "cats,dogs".
+// Instances with keywords get one thing per keyword, whose periodic update picks a random GIF tagged with the keyword.
+const keywordsConfigID = "keywords"
+
+// maxKeywordThings is the maximum number of keywords and therefore things of an instance.
+// Each thing costs a Giphy request per update cycle.
+const maxKeywordThings = 10
+
+// instanceKeywords returns the keywords configured for an instance, or nil if it has none.
+func instanceKeywords(configuration []connector.Configuration) ([]string, error) {
+	var spec string
+	for _, c := range configuration {
+		if c.ID == keywordsConfigID {
+			spec = strings.TrimSpace(c.Value)
+		}
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	var keywords []string
+	seen := map[string]bool{}
+	for _, keyword := range strings.Split(spec, ",") {
+		keyword = strings.TrimSpace(keyword)
+		if keyword == "" || seen[keyword] {
+			return nil, fmt.Errorf("empty or duplicate keyword %q", keyword)
+		}
+		seen[keyword] = true
+		keywords = append(keywords, keyword)
+	}
+	if len(keywords) > maxKeywordThings {
+		return nil, fmt.Errorf("%d keywords, at most %d are allowed", len(keywords), maxKeywordThings)
+	}
+	return keywords, nil
+}
+
+// thingTemplates returns the things that can be registered with the connctd platform together with an external id.
 // The external id can be used to map external devices or objects to the thing and is stored in the connector by the default service.
-// In our case it is left empty.
+// Instances without keywords get a single thing with an empty external id,
+// instances with keywords get a thing per keyword with the keyword as external id, the provider routes updates by it.
+// Invalid keywords are rejected before the things are created.
 // Note that the thing ID is generated by connctd and returned when the thing is created.
 // The connctd platform will store all information regarding the thing.
 // The connector therefore should only store its ID.
 // The thing will have two components.
 // random will periodically updated by a new random value.
 // search will only be updated when a search action is triggered.
+// The schemas of structured properties are declared as thing attributes.
 func thingTemplate(request connector.InstantiationRequest) []connector.ThingTemplate {
-	thing := connctd.Thing{
-		Name:            "Giphy",
+	keywords, _ := instanceKeywords(request.Configuration)
+	if len(keywords) == 0 {
+		return []connector.ThingTemplate{
+			{
+				Thing:      giphyThing("Giphy"),
+				ExternalID: "",
+			},
+		}
+	}
+	templates := make([]connector.ThingTemplate, len(keywords))
+	for i, keyword := range keywords {
+		templates[i] = connector.ThingTemplate{
+			Thing:      giphyThing("Giphy " + keyword),
+			ExternalID: keyword,
+		}
+	}
+	return templates
+}
+
+// giphyThing returns the thing of the Giphy connector with the given name.
+func giphyThing(name string) connctd.Thing {
+	return connctd.Thing{
+		Name:            name,
 		Manufacturer:    "IoT connctd GmbH",
 		DisplayType:     "core.SENSOR",
 		MainComponentID: RandomComponentId,
 		Status:          "AVAILABLE",
-		Attributes:      []connctd.ThingAttribute{},
+		Attributes:      append(schemaAttributes(), sourceAttributes()...),
 		Components: []connctd.Component{
 			{
 				ID:            RandomComponentId,
@@ -47,9 +178,72 @@ func thingTemplate(request connector.InstantiationRequest) []connector.ThingTemp
 						Type:         connctd.ValueTypeString,
 						PropertyType: "giphy.IMAGE_URL",
 					},
+					{
+						ID:           LastUpdatedPropertyId,
+						Name:         "Giphy random last updated",
+						Type:         connctd.ValueTypeString,
+						PropertyType: "core.DATETIME",
+					},
+				},
+				Actions: []connctd.Action{},
+			},
+			{
+				ID:            TrendingComponentId,
+				Name:          "Giphy trending component",
+				ComponentType: "core.Sensor",
+				Capabilities: []string{
+					"giphy.TRENDING",
+				},
+				Properties: []connctd.Property{
+					{
+						ID:           TrendingPropertyId,
+						Name:         "Giphy trending property",
+						Type:         connctd.ValueTypeString,
+						PropertyType: "giphy.IMAGE_URL",
+					},
+					{
+						ID:           LastUpdatedPropertyId,
+						Name:         "Giphy trending last updated",
+						Type:         connctd.ValueTypeString,
+						PropertyType: "core.DATETIME",
+					},
 				},
 				Actions: []connctd.Action{},
 			},
+			{
+				ID:            TranslateComponentId,
+				Name:          "Giphy translate",
+				ComponentType: "core.Sensor",
+				Capabilities: []string{
+					"giphy.TRANSLATE",
+				},
+				Properties: []connctd.Property{
+					{
+						ID:           TranslatePropertyId,
+						Name:         "Giphy translate property",
+						Type:         connctd.ValueTypeString,
+						PropertyType: "giphy.TRANSLATE_RESULT",
+					},
+					{
+						ID:           LastUpdatedPropertyId,
+						Name:         "Giphy translate last updated",
+						Type:         connctd.ValueTypeString,
+						PropertyType: "core.DATETIME",
+					},
+				},
+				Actions: []connctd.Action{
+					{
+						ID:   TranslateActionId,
+						Name: "Giphy translate action",
+						Parameters: []connctd.ActionParameter{
+							{
+								Name: TranslateActionParameterId,
+								Type: connctd.ValueTypeString,
+							},
+						},
+					},
+				},
+			},
 			{
 				ID:            SearchComponentId,
 				Name:          "Giphy search",
@@ -64,6 +258,30 @@ func thingTemplate(request connector.InstantiationRequest) []connector.ThingTemp
 						Type:         connctd.ValueTypeString,
 						PropertyType: "giphy.SEARCH_RESULT",
 					},
+					{
+						ID:           SearchResultCountPropertyId,
+						Name:         "Giphy search result count",
+						Type:         connctd.ValueTypeNumber,
+						PropertyType: "giphy.SEARCH_RESULT_COUNT",
+					},
+					{
+						ID:           SearchResultsPropertyId,
+						Name:         "Giphy search results",
+						Type:         connctd.ValueTypeString,
+						PropertyType: "giphy.SEARCH_RESULTS_JSON",
+					},
+					{
+						ID:           SearchResultsTruncatedPropertyId,
+						Name:         "Giphy search results truncated",
+						Type:         connctd.ValueTypeBoolean,
+						PropertyType: "giphy.SEARCH_RESULTS_TRUNCATED",
+					},
+					{
+						ID:           LastUpdatedPropertyId,
+						Name:         "Giphy search last updated",
+						Type:         connctd.ValueTypeString,
+						PropertyType: "core.DATETIME",
+					},
 				},
 				Actions: []connctd.Action{
 					{
@@ -80,10 +298,4 @@ func thingTemplate(request connector.InstantiationRequest) []connector.ThingTemp
 			},
 		},
 	}
-	return []connector.ThingTemplate{
-		{
-			Thing:      thing,
-			ExternalID: "",
-		},
-	}
 }
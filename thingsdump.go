@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+)
+
+// goldenInstantiationRequest is the request the golden thing templates are created for.
+var goldenInstantiationRequest = connector.InstantiationRequest{
+	ID:             "golden-instance",
+	InstallationID: "golden-installation",
+	Token:          "golden-token",
+	State:          connector.InstantiationStateInitialized,
+}
+
+// keywordsInstantiationRequest is an instantiation request with keywords, whose thing templates are validated as well.
+var keywordsInstantiationRequest = connector.InstantiationRequest{
+	ID:             "keywords-instance",
+	InstallationID: "golden-installation",
+	Token:          "golden-token",
+	State:          connector.InstantiationStateInitialized,
+	Configuration:  []connector.Configuration{{ID: keywordsConfigID, Value: "cats, dogs"}},
+}
+
+// runThings implements the things subcommand.
+// "things dump" prints the thing templates as JSON, the tests compare them with the golden file.
+func runThings(args []string) error {
+	if len(args) != 1 || args[0] != "dump" {
+		return errors.New("usage: things dump")
+	}
+	current, err := dumpThingTemplates(thingTemplate(goldenInstantiationRequest))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(current)
+	return err
+}
+
+// dumpThingTemplates serializes the thing templates as indented JSON.
+func dumpThingTemplates(templates []connector.ThingTemplate) ([]byte, error) {
+	b, err := json.MarshalIndent(templates, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// validateThingTemplates checks the thing templates against the constraints of the connctd thing schema
+// and the IDs the provider relies on. It returns all problems found.
+func validateThingTemplates(templates []connector.ThingTemplate) []string {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(templates) == 0 {
+		problemf("no thing templates")
+	}
+	externalIds := map[string]bool{}
+	for i, template := range templates {
+		thing := template.Thing
+		prefix := fmt.Sprintf("thing %d", i)
+		// The provider routes updates by the external ID
+		if externalIds[template.ExternalID] {
+			problemf("%s: duplicate external ID %q", prefix, template.ExternalID)
+		}
+		externalIds[template.ExternalID] = true
+		if thing.ID != "" {
+			problemf("%s: ID must be empty, it is generated by connctd", prefix)
+		}
+		if thing.Name == "" || thing.Manufacturer == "" || thing.DisplayType == "" {
+			problemf("%s: name, manufacturer and display type are required", prefix)
+		}
+		if _, ok := connctd.AllStatusTypes[thing.Status]; !ok {
+			problemf("%s: invalid status %q", prefix, thing.Status)
+		}
+
+		components := map[string]connctd.Component{}
+		for _, component := range thing.Components {
+			if component.ID == "" || component.Name == "" || component.ComponentType == "" {
+				problemf("%s: component %q: ID, name and component type are required", prefix, component.ID)
+			}
+			if _, ok := components[component.ID]; ok {
+				problemf("%s: duplicate component %q", prefix, component.ID)
+			}
+			components[component.ID] = component
+
+			properties := map[string]bool{}
+			for _, property := range component.Properties {
+				if property.ID == "" || properties[property.ID] {
+					problemf("%s: component %q: missing or duplicate property ID %q", prefix, component.ID, property.ID)
+				}
+				properties[property.ID] = true
+				if _, ok := connctd.AllValueTypes[property.Type]; !ok {
+					problemf("%s: property %s/%s: invalid type %q", prefix, component.ID, property.ID, property.Type)
+				}
+			}
+
+			actions := map[string]bool{}
+			for _, action := range component.Actions {
+				if action.ID == "" || actions[action.ID] {
+					problemf("%s: component %q: missing or duplicate action ID %q", prefix, component.ID, action.ID)
+				}
+				actions[action.ID] = true
+				for _, parameter := range action.Parameters {
+					if _, ok := connctd.AllValueTypes[parameter.Type]; parameter.Name == "" || !ok {
+						problemf("%s: action %s/%s: invalid parameter %q of type %q", prefix, component.ID, action.ID, parameter.Name, parameter.Type)
+					}
+				}
+			}
+		}
+		if _, ok := components[thing.MainComponentID]; !ok {
+			problemf("%s: main component %q does not exist", prefix, thing.MainComponentID)
+		}
+
+		// The provider updates these properties and handles these actions
+		for _, property := range publishedProperties {
+			if !hasProperty(components[property.ComponentID], property.PropertyID) {
+				problemf("%s: property %s updated by the provider does not exist", prefix, property)
+			}
+		}
+		for property, companion := range lastUpdatedProperties {
+			if !hasProperty(components[companion.ComponentID], companion.PropertyID) {
+				problemf("%s: last updated property %s of %s does not exist", prefix, companion, property)
+			}
+		}
+		for _, action := range handledActions {
+			if !hasActionParameter(components[action.ComponentID], action.ActionID, action.ParameterID) {
+				problemf("%s: action %s/%s with parameter %s does not exist", prefix, action.ComponentID, action.ActionID, action.ParameterID)
+			}
+		}
+
+		attributes := map[string]bool{}
+		for _, attribute := range thing.Attributes {
+			attributes[attribute.Name] = true
+		}
+
+		// Additions of newer template versions are applied to existing things and must exist
+		for _, addition := range thingTemplateAdditions {
+			component, ok := components[addition.ComponentID]
+			if (!ok && addition.ComponentID != "") || addition.Version < 2 || addition.Version > thingTemplateVersion {
+				problemf("%s: addition of template version %d: invalid version or missing component %q", prefix, addition.Version, addition.ComponentID)
+			}
+			for _, propertyId := range addition.PropertyIDs {
+				if !hasProperty(component, propertyId) {
+					problemf("%s: addition of template version %d: property %s/%s does not exist", prefix, addition.Version, addition.ComponentID, propertyId)
+				}
+			}
+			for _, actionId := range addition.ActionIDs {
+				if !hasAction(component, actionId) {
+					problemf("%s: addition of template version %d: action %s/%s does not exist", prefix, addition.Version, addition.ComponentID, actionId)
+				}
+			}
+			for _, name := range addition.Attributes {
+				if !attributes[name] {
+					problemf("%s: addition of template version %d: attribute %q does not exist", prefix, addition.Version, name)
+				}
+			}
+		}
+		if n := len(thingTemplateAdditions); n > 0 && thingTemplateAdditions[n-1].Version != thingTemplateVersion {
+			problemf("%s: the last template addition is not of the template version %d", prefix, thingTemplateVersion)
+		}
+
+		// Structured values are sent as JSON in string properties, their schema must be declared
+		for ref := range structuredPropertySchemas {
+			property, ok := findProperty(components[ref.ComponentID], ref.PropertyID)
+			if !ok || property.Type != connctd.ValueTypeString {
+				problemf("%s: structured property %s must exist with type %s", prefix, ref, connctd.ValueTypeString)
+			}
+			if !attributes[schemaAttributePrefix+ref.ComponentID+"."+ref.PropertyID] {
+				problemf("%s: schema of structured property %s is not declared as attribute", prefix, ref)
+			}
+		}
+	}
+	return problems
+}
+
+func hasProperty(component connctd.Component, propertyId string) bool {
+	_, ok := findProperty(component, propertyId)
+	return ok
+}
+
+func findProperty(component connctd.Component, propertyId string) (connctd.Property, bool) {
+	for _, property := range component.Properties {
+		if property.ID == propertyId {
+			return property, true
+		}
+	}
+	return connctd.Property{}, false
+}
+
+func hasAction(component connctd.Component, actionId string) bool {
+	for _, action := range component.Actions {
+		if action.ID == actionId {
+			return true
+		}
+	}
+	return false
+}
+
+func hasActionParameter(component connctd.Component, actionId string, parameterName string) bool {
+	for _, action := range component.Actions {
+		if action.ID != actionId {
+			continue
+		}
+		for _, parameter := range action.Parameters {
+			if parameter.Name == parameterName {
+				return true
+			}
+		}
+	}
+	return false
+}
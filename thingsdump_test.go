@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+// thingsGoldenFile contains the reviewed thing templates. Changes to the thing structure must update it.
+const thingsGoldenFile = "testdata/things.golden.json"
+
+var updateGolden = flag.Bool("update", false, "write the current thing templates to the golden file instead of comparing them")
+
+func TestThingTemplatesAreValid(t *testing.T) {
+	for _, problem := range validateThingTemplates(thingTemplate(goldenInstantiationRequest)) {
+		t.Error(problem)
+	}
+	templates := thingTemplate(keywordsInstantiationRequest)
+	if len(templates) != 2 {
+		t.Fatalf("got %d thing templates for two keywords, want 2", len(templates))
+	}
+	for _, problem := range validateThingTemplates(templates) {
+		t.Error(problem)
+	}
+}
+
+func TestThingTemplatesMatchGoldenFile(t *testing.T) {
+	current, err := dumpThingTemplates(thingTemplate(goldenInstantiationRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *updateGolden {
+		if err := ioutil.WriteFile(thingsGoldenFile, current, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(thingsGoldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, current) {
+		t.Errorf("thing templates differ from %s, review the output of \"things dump\" and run \"go test -run ThingTemplates -update\" if the change is intended", thingsGoldenFile)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/connctd/connector-go"
+	"github.com/connctd/connector-go/connctd"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// statementCreateThingTemplateVersions creates the table the template version applied to each thing is recorded in.
+const statementCreateThingTemplateVersions = `CREATE TABLE IF NOT EXISTS thing_template_versions (
+	thing_id VARCHAR(255) NOT NULL PRIMARY KEY,
+	version INT NOT NULL,
+	updated BIGINT NOT NULL
+)`
+
+// connectorThingsPath is the path of the things endpoint of the connctd API relative to its base URL.
+const connectorThingsPath = "connectorhub/callback/instances/things"
+
+// thingTemplateVersion is the version of the thing template returned by thingTemplate.
+// It must be increased together with a new entry in thingTemplateAdditions whenever the template is extended.
+const thingTemplateVersion = 8
+
+// thingTemplateAddition is an additive change of the thing template introduced with a version.
+// Without property and action IDs the whole component was added, without component ID only attributes were added.
+type thingTemplateAddition struct {
+	Version     int
+	ComponentID string
+	PropertyIDs []string
+	ActionIDs   []string
+	// Attributes are the names of the thing attributes added with the version.
+	Attributes []string
+}
+
+// thingTemplateAdditions are the changes of the thing template since version 1, the template of things created without a recorded version.
+// Only additions can be applied to existing things, removed or changed parts need a new thing.
+var thingTemplateAdditions = []thingTemplateAddition{
+	{Version: 2, ComponentID: SearchComponentId, PropertyIDs: []string{SearchResultCountPropertyId}},
+	{Version: 3, ComponentID: SearchComponentId, PropertyIDs: []string{SearchResultsPropertyId}, Attributes: []string{schemaAttributePrefix + SearchComponentId + "." + SearchResultsPropertyId}},
+	{Version: 4, ComponentID: SearchComponentId, PropertyIDs: []string{SearchResultsTruncatedPropertyId}},
+	{Version: 5, ComponentID: TrendingComponentId},
+	{Version: 6, ComponentID: TranslateComponentId},
+	{Version: sourceAttributesVersion, Attributes: []string{sourceAttribute, sourceApiVersionAttribute}},
+	{Version: 8, ComponentID: RandomComponentId, PropertyIDs: []string{LastUpdatedPropertyId}},
+	{Version: 8, ComponentID: TrendingComponentId, PropertyIDs: []string{LastUpdatedPropertyId}},
+	{Version: 8, ComponentID: TranslateComponentId, PropertyIDs: []string{LastUpdatedPropertyId}},
+	{Version: 8, ComponentID: SearchComponentId, PropertyIDs: []string{LastUpdatedPropertyId}},
+}
+
+// sourceAttributesVersion is the template version adding the attributes describing the data source.
+// Things upgraded from an older version also get the installation dependent attributes, see thingAttributes.
+const sourceAttributesVersion = 7
+
+// thingUpgrade are the parts of the current thing template missing in things of an older template version.
+// It is sent as additive update of the thing, components contain only the new properties and actions.
+type thingUpgrade struct {
+	Components []connctd.Component      `json:"components"`
+	Attributes []connctd.ThingAttribute `json:"attributes,omitempty"`
+}
+
+// newThingUpgrade returns the additions to the thing which was created with the template version.
+// It returns nil if the thing is up to date.
+func newThingUpgrade(thing connctd.Thing, version int) *thingUpgrade {
+	upgrade := &thingUpgrade{}
+	components := map[string]int{}
+	for _, addition := range thingTemplateAdditions {
+		if addition.Version <= version {
+			continue
+		}
+		upgrade.Attributes = append(upgrade.Attributes, findAttributes(thing, addition.Attributes)...)
+		current, ok := findComponent(thing, addition.ComponentID)
+		if addition.ComponentID == "" || !ok {
+			continue
+		}
+		i, ok := components[addition.ComponentID]
+		if !ok {
+			i = len(upgrade.Components)
+			components[addition.ComponentID] = i
+			upgrade.Components = append(upgrade.Components, connctd.Component{
+				ID:            current.ID,
+				Name:          current.Name,
+				ComponentType: current.ComponentType,
+				Capabilities:  current.Capabilities,
+				Properties:    []connctd.Property{},
+				Actions:       []connctd.Action{},
+			})
+		}
+		component := &upgrade.Components[i]
+		if len(addition.PropertyIDs) == 0 && len(addition.ActionIDs) == 0 {
+			component.Properties = current.Properties
+			component.Actions = current.Actions
+		}
+		for _, propertyId := range addition.PropertyIDs {
+			if property, ok := findProperty(current, propertyId); ok {
+				component.Properties = append(component.Properties, property)
+			}
+		}
+		for _, action := range current.Actions {
+			for _, actionId := range addition.ActionIDs {
+				if action.ID == actionId {
+					component.Actions = append(component.Actions, action)
+				}
+			}
+		}
+	}
+	if len(upgrade.Components) == 0 && len(upgrade.Attributes) == 0 {
+		return nil
+	}
+	return upgrade
+}
+
+// findAttributes returns the attributes of the thing with the given names.
+func findAttributes(thing connctd.Thing, names []string) []connctd.ThingAttribute {
+	var attributes []connctd.ThingAttribute
+	for _, attribute := range thing.Attributes {
+		for _, name := range names {
+			if attribute.Name == name {
+				attributes = append(attributes, attribute)
+			}
+		}
+	}
+	return attributes
+}
+
+func findComponent(thing connctd.Thing, componentId string) (connctd.Component, bool) {
+	for _, component := range thing.Components {
+		if component.ID == componentId {
+			return component, true
+		}
+	}
+	return connctd.Component{}, false
+}
+
+// thingUpgrader applies the additions of newer thing templates to the things of existing instances,
+// so instances created before a component or property was added get it as well.
+// The template version of each thing is recorded in the database, things without a record are of version 1.
+type thingUpgrader struct {
+	db         *sqlx.DB
+	database   connector.Database
+	httpClient *http.Client
+	baseURL    string
+	templates  connector.ThingTemplates
+	reporter   ErrorReporter
+	upgrades   *metricVec
+	// attributes returns the installation dependent attributes of the things of an instance, nil if there are none.
+	attributes func(ctx context.Context, instance *connector.Instance) ([]connctd.ThingAttribute, error)
+}
+
+// newThingUpgrader returns an upgrader sending the updates to the connctd API at the base URL with the given client.
+func newThingUpgrader(db *sqlx.DB, database connector.Database, httpClient *http.Client, baseURL *url.URL, templates connector.ThingTemplates, reporter ErrorReporter, metrics *metricsRegistry) *thingUpgrader {
+	base := connector.APIBaseURL
+	if baseURL != nil {
+		base = baseURL.String()
+	}
+	return &thingUpgrader{
+		db:         db,
+		database:   database,
+		httpClient: httpClient,
+		baseURL:    base,
+		templates:  templates,
+		reporter:   reporter,
+		upgrades:   metrics.Counter("thing_upgrades_total", "Number of things updated to the current thing template by result.", "result"),
+	}
+}
+
+// SetInstanceAttributes lets the upgrader add the installation dependent attributes to things upgraded from a version
+// without source attributes. Must be called before the upgrader is run.
+func (u *thingUpgrader) SetInstanceAttributes(attributes func(ctx context.Context, instance *connector.Instance) ([]connctd.ThingAttribute, error)) {
+	u.attributes = attributes
+}
+
+// Created records that the thing was created with the current template version.
+func (u *thingUpgrader) Created(ctx context.Context, thingId string) error {
+	return u.record(ctx, thingId, thingTemplateVersion)
+}
+
+// Run updates the things of all instances which were created with an older template version.
+// Failed updates are logged and reported, they are retried on the next start.
+func (u *thingUpgrader) Run(ctx context.Context) error {
+	instances, err := u.database.GetInstances(ctx)
+	if err != nil {
+		return err
+	}
+	var outdated, failed int
+	for _, instance := range instances {
+		templates := u.templates(connector.InstantiationRequest{
+			ID:             instance.ID,
+			InstallationID: instance.InstallationID,
+			Token:          instance.Token,
+			Configuration:  instance.Configuration,
+		})
+		things := map[string]connctd.Thing{}
+		for _, template := range templates {
+			things[template.ExternalID] = template.Thing
+		}
+		for _, mapping := range instance.ThingMapping {
+			thing, ok := things[mapping.ExternalID]
+			if !ok {
+				continue
+			}
+			version, err := u.version(ctx, mapping.ThingID)
+			if err != nil {
+				return err
+			}
+			if version >= thingTemplateVersion {
+				continue
+			}
+			outdated++
+			logger := logrus.WithField("instanceId", instance.ID).WithField("thingId", mapping.ThingID).WithField("version", version)
+			if err := u.upgrade(ctx, instance, mapping.ThingID, thing, version); err != nil {
+				failed++
+				logger.WithError(err).Warnln("failed to update thing to the current template")
+				u.reporter.Report(fmt.Errorf("failed to update thing to template version %d: %w", thingTemplateVersion, err), ErrorContext{
+					Component:      "thing upgrade",
+					InstallationID: instance.InstallationID,
+					InstanceID:     instance.ID,
+					ThingID:        mapping.ThingID,
+				})
+				u.upgrades.Inc("failed")
+				continue
+			}
+			logger.Infoln("updated thing to the current template")
+			u.upgrades.Inc("updated")
+		}
+	}
+	logrus.WithField("outdated", outdated).WithField("failed", failed).WithField("version", thingTemplateVersion).Infoln("thing template upgrade finished")
+	return nil
+}
+
+// upgrade sends the additions since the version to connctd and records the current version.
+func (u *thingUpgrader) upgrade(ctx context.Context, instance *connector.Instance, thingId string, thing connctd.Thing, version int) error {
+	upgrade := newThingUpgrade(thing, version)
+	if version < sourceAttributesVersion && u.attributes != nil {
+		attributes, err := u.attributes(ctx, instance)
+		if err != nil {
+			return err
+		}
+		if upgrade == nil {
+			upgrade = &thingUpgrade{Components: []connctd.Component{}}
+		}
+		upgrade.Attributes = append(upgrade.Attributes, attributes...)
+	}
+	if upgrade != nil {
+		if err := u.send(ctx, instance.Token, thingId, upgrade); err != nil {
+			return err
+		}
+	}
+	return u.record(ctx, thingId, thingTemplateVersion)
+}
+
+// UpdateAttributes adds the attributes to the thing or replaces the attributes with the same names.
+func (u *thingUpgrader) UpdateAttributes(ctx context.Context, token connector.InstantiationToken, thingId string, attributes []connctd.ThingAttribute) error {
+	return u.send(ctx, token, thingId, &thingUpgrade{Components: []connctd.Component{}, Attributes: attributes})
+}
+
+// send adds the components, properties, actions and attributes of the upgrade to the thing.
+// Existing parts of the thing are left untouched by connctd.
+func (u *thingUpgrader) send(ctx context.Context, token connector.InstantiationToken, thingId string, upgrade *thingUpgrade) error {
+	body, err := json.Marshal(upgrade)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, u.baseURL+path.Join(connectorThingsPath, thingId), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+string(token))
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("connctd responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (u *thingUpgrader) version(ctx context.Context, thingId string) (int, error) {
+	var versions []int
+	if err := u.db.SelectContext(ctx, &versions, u.db.Rebind("SELECT version FROM thing_template_versions WHERE thing_id = ?"), thingId); err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 1, nil
+	}
+	return versions[0], nil
+}
+
+func (u *thingUpgrader) record(ctx context.Context, thingId string, version int) error {
+	now := clock().Unix()
+	result, err := u.db.ExecContext(ctx, u.db.Rebind("UPDATE thing_template_versions SET version = ?, updated = ? WHERE thing_id = ?"), version, now, thingId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		_, err = u.db.ExecContext(ctx, u.db.Rebind("INSERT INTO thing_template_versions (thing_id, version, updated) VALUES (?, ?, ?)"), thingId, version, now)
+		return err
+	}
+	return nil
+}
+
+// upgradingClient records the template version of created things with the thing upgrader.
+type upgradingClient struct {
+	connector.Client
+	upgrader *thingUpgrader
+}
+
+// CreateThing implements connector.Client.
+func (c *upgradingClient) CreateThing(ctx context.Context, token connector.InstantiationToken, thing connctd.Thing) (connctd.Thing, error) {
+	result, err := c.Client.CreateThing(ctx, token, thing)
+	if err == nil {
+		if err := c.upgrader.Created(ctx, result.ID); err != nil {
+			logrus.WithError(err).WithField("thingId", result.ID).Warnln("failed to record the template version of the thing")
+		}
+	}
+	return result, err
+}
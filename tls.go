@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tlsVersions are the TLS versions the callback listener can be restricted to.
+// Older versions are not supported by the connctd platform and are not offered.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultCipherSuites are the TLS 1.2 cipher suites used if none are configured:
+// only suites with forward secrecy and authenticated encryption.
+// TLS 1.3 suites are not configurable, Go only offers secure ones.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// newCallbackTLSConfig returns the TLS configuration of the callback listener.
+// If a CA bundle is given, clients have to present a certificate signed by one of its CAs.
+// This is meant as defense in depth in addition to the request signatures, e.g. if a trusted proxy terminates
+// the connection of the connctd platform and presents its own client certificate.
+// The minimum version is "1.2" or "1.3", cipherSuites is a comma separated list of TLS 1.2 cipher suite names.
+func newCallbackTLSConfig(clientCAFile string, minVersion string, cipherSuites string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported minimum TLS version %q, expected 1.2 or 1.3", minVersion)
+	}
+	suites, err := parseCipherSuites(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: version, CipherSuites: suites}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client CA bundle contains no certificates")
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// parseCipherSuites returns the IDs of the named cipher suites, or the default suites if names is empty.
+// Suites Go considers insecure are rejected, as well as TLS 1.3 suites, which can not be configured.
+func parseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return defaultCipherSuites, nil
+	}
+	available := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		suite, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("cipher suite %s is a TLS 1.3 suite, which can not be configured", name)
+		}
+		suites = append(suites, suite.ID)
+	}
+	return suites, nil
+}
+
+// hstsHandler sets the Strict-Transport-Security header on all responses,
+// so clients only connect to the connector with TLS for the given time.
+func hstsHandler(maxAge time.Duration, includeSubdomains bool, next http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certificateCheckInterval is how often the certificate files are checked for changes during handshakes.
+const certificateCheckInterval = time.Minute
+
+// certificateReloader serves the certificate of the callback listener and loads it again once its files changed,
+// so certificates renewed by an ACME client like certbot are used without restarting the connector.
+// A certificate which fails to load is logged and the previous one is kept.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= certificateCheckInterval {
+		r.checked = now
+		if modTime, err := r.latestModTime(); err == nil && modTime.After(r.modTime) {
+			if err := r.load(); err != nil {
+				logrus.WithError(err).Errorln("failed to reload TLS certificate, the previous certificate is used")
+			} else {
+				logrus.WithField("certFile", r.certFile).Infoln("reloaded TLS certificate")
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// load reads the certificate and key, the lock must be held unless the reloader is created.
+func (r *certificateReloader) load() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert, r.modTime, r.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+// latestModTime returns the time the certificate or key file was changed last.
+func (r *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// acmeChallengePath is the path ACME servers fetch HTTP-01 challenge tokens from.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// httpsRedirectHandler redirects plain HTTP requests to the TLS listener with the given address.
+// If webroot is set, ACME HTTP-01 challenges are served from the files an ACME client like certbot --webroot writes to
+// webroot/.well-known/acme-challenge/, so certificates can be issued and renewed without a reverse proxy.
+func httpsRedirectHandler(tlsAddr string, webroot string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webroot != "" && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+			if token == "" || token != path.Base(token) || strings.HasPrefix(token, ".") {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeFile(w, r, filepath.Join(webroot, filepath.FromSlash(acmeChallengePath), token))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "use HTTPS", http.StatusBadRequest)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+// TraceparentHeader carries the W3C trace context of incoming callbacks and outgoing connctd API calls.
+const TraceparentHeader = "traceparent"
+
+// tracingExportInterval is how often finished spans are exported.
+const tracingExportInterval = 5 * time.Second
+
+// maxQueuedSpans limits the finished spans waiting for the export, further spans are dropped.
+const maxQueuedSpans = 2048
+
+// spanKind is the OTLP kind of a span.
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+// spanContext identifies a span within its trace.
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// valid reports whether the context identifies a span, the zero context does not.
+func (c spanContext) valid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// traceparent returns the context as value of the traceparent header, all spans are sampled.
+func (c spanContext) traceparent() string {
+	return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" + hex.EncodeToString(c.SpanID[:]) + "-01"
+}
+
+// parseTraceparent returns the span context of a traceparent header like "00-<trace ID>-<span ID>-01".
+func parseTraceparent(header string) (spanContext, bool) {
+	var c spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return c, false
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return c, false
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return c, false
+	}
+	return c, c.valid()
+}
+
+// span is an operation of a trace. All methods can be called on a nil span, which is returned if tracing is disabled.
+type span struct {
+	tracer  *tracer
+	name    string
+	kind    spanKind
+	context spanContext
+	parent  [8]byte
+	start   time.Time
+
+	lock       sync.Mutex
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+// Context returns the context of the span, the zero context for a nil span.
+func (s *span) Context() spanContext {
+	if s == nil {
+		return spanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records an attribute of the operation, e.g. the ID of the action request.
+func (s *span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// End finishes the span, a non-nil error marks the operation as failed. Only the first call has an effect.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if !s.end.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+	s.end = clock()
+	s.err = err
+	s.lock.Unlock()
+	s.tracer.finished(s)
+}
+
+type spanKey struct{}
+
+// withSpan returns a copy of ctx carrying the span, operations started with the context become its children.
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFromContext returns the span carried by ctx or nil.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// spanLink is a span context handed from one goroutine to another.
+type spanLink struct {
+	context spanContext
+	created time.Time
+}
+
+// tracer records spans and exports them to an OpenTelemetry collector with OTLP over HTTP in the JSON encoding.
+// Like the correlation IDs, the span contexts of asynchronous operations are handed over by key, e.g. from the action
+// request to the action handler and on to the update of the action status.
+// All methods can be called on a nil tracer, which disables tracing.
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	exported    *metricVec
+
+	lock   sync.Mutex
+	queue  []*span
+	links  map[string]spanLink
+	export sync.Mutex
+}
+
+// newTracer returns a tracer exporting to the OTLP traces endpoint, e.g. http://localhost:4318/v1/traces.
+func newTracer(endpoint string, headers map[string]string, serviceName string, metrics *metricsRegistry) *tracer {
+	return &tracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		exported:    metrics.Counter("trace_spans_total", "Number of finished trace spans by export result.", "result"),
+		links:       map[string]spanLink{},
+	}
+}
+
+// tracerFromEnv returns a tracer configured with the standard OpenTelemetry environment variables
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME.
+// It returns nil if no endpoint is configured.
+func tracerFromEnv(metrics *metricsRegistry) (*tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+	headers := map[string]string{}
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected key=value", header)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP header %q: %w", header, err)
+		}
+		headers[strings.TrimSpace(parts[0])] = value
+	}
+	return newTracer(endpoint, headers, envOrDefault("OTEL_SERVICE_NAME", "giphy-connector"), metrics), nil
+}
+
+// Start starts a span as child of the span carried by ctx, or as root of a new trace, and returns a context carrying it.
+func (t *tracer) Start(ctx context.Context, name string, kind spanKind) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := t.startSpan(spanFromContext(ctx).Context(), name, kind)
+	return withSpan(ctx, s), s
+}
+
+// StartLinked starts a span as child of the span context handed over with the key, or as root of a new trace.
+func (t *tracer) StartLinked(key string, name string, kind spanKind) *span {
+	if t == nil {
+		return nil
+	}
+	return t.startSpan(t.Take(key), name, kind)
+}
+
+// Child starts a span as child of the parent span.
+func (t *tracer) Child(parent *span, name string, kind spanKind) *span {
+	if t == nil {
+		return nil
+	}
+	return t.startSpan(parent.Context(), name, kind)
+}
+
+func (t *tracer) startSpan(parent spanContext, name string, kind spanKind) *span {
+	s := &span{tracer: t, name: name, kind: kind, start: clock(), attributes: map[string]string{}}
+	if parent.valid() {
+		s.context.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+	} else {
+		io.ReadFull(randomness, s.context.TraceID[:])
+	}
+	io.ReadFull(randomness, s.context.SpanID[:])
+	return s
+}
+
+// Put hands the span context over to the operation continuing the trace with the key. Invalid contexts are ignored.
+func (t *tracer) Put(key string, c spanContext) {
+	if t == nil || !c.valid() {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := clock()
+	for k, link := range t.links {
+		if now.Sub(link.created) > correlationTTL {
+			delete(t.links, k)
+		}
+	}
+	t.links[key] = spanLink{c, now}
+}
+
+// Take returns and removes the span context handed over with the key, the zero context if there is none.
+func (t *tracer) Take(key string) spanContext {
+	if t == nil {
+		return spanContext{}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	link, ok := t.links[key]
+	if !ok {
+		return spanContext{}
+	}
+	delete(t.links, key)
+	return link.context
+}
+
+// finished queues the span for the next export.
+func (t *tracer) finished(s *span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.queue) >= maxQueuedSpans {
+		t.exported.Inc("dropped")
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+// Run exports the finished spans periodically until the context is canceled.
+// The spans finished during the shutdown are exported with a last call of Flush.
+func (t *tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(tracingExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Flush(ctx)
+		}
+	}
+}
+
+// Flush exports the finished spans. Spans which could not be exported are dropped, traces are best-effort.
+// The returned error tells how many spans were dropped.
+func (t *tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.export.Lock()
+	defer t.export.Unlock()
+	t.lock.Lock()
+	spans := t.queue
+	t.queue = nil
+	t.lock.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	if err := t.send(ctx, spans); err != nil {
+		t.exported.Add(float64(len(spans)), "failed")
+		logrus.WithError(err).WithField("spans", len(spans)).Warnln("failed to export trace spans")
+		return fmt.Errorf("%d spans were not exported: %w", len(spans), err)
+	}
+	t.exported.Add(float64(len(spans)), "exported")
+	return nil
+}
+
+// otlpAttribute is an attribute in the OTLP JSON encoding, all attributes of the connector are strings.
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	list := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		attribute := otlpAttribute{Key: key}
+		attribute.Value.StringValue = value
+		list = append(list, attribute)
+	}
+	return list
+}
+
+// send posts the spans as OTLP ExportTraceServiceRequest.
+func (t *tracer) send(ctx context.Context, spans []*span) error {
+	type otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              spanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            otlpStatus      `json:"status"`
+	}
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.lock.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.lock.Unlock()
+		encoded = append(encoded, o)
+	}
+
+	resource := map[string]string{"service.name": t.serviceName}
+	if name := hostname(); name != "" {
+		resource["host.name"] = name
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/connctd/giphy-connector"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// tracingHandler starts a server span for each callback, continuing the trace of the traceparent header if present.
+// The span covers the signature validation and the handling of the callback by the service.
+func tracingHandler(t *tracer, next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		parent, _ := parseTraceparent(r.Header.Get(TraceparentHeader))
+		s := t.startSpan(parent, "callback "+r.Method+" "+r.URL.Path, spanKindServer)
+		s.SetAttribute("http.method", r.Method)
+		s.SetAttribute("http.target", r.URL.Path)
+		if id := correlationID(ctx); id != "" {
+			s.SetAttribute("correlation.id", id)
+		}
+		writer := &statusWriter{w, http.StatusOK}
+		next.ServeHTTP(writer, r.WithContext(withSpan(ctx, s)))
+		s.SetAttribute("http.status_code", strconv.Itoa(writer.status))
+		var err error
+		if writer.status >= 500 {
+			err = fmt.Errorf("callback failed with status %d", writer.status)
+		}
+		s.End(err)
+	})
+}
+
+// tracingTransport sets the traceparent header on outgoing requests if their context carries a span.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if s := spanFromContext(r.Context()); s != nil {
+		r = r.Clone(r.Context())
+		r.Header.Set(TraceparentHeader, s.Context().traceparent())
+	}
+	return t.next.RoundTrip(r)
+}
+
+// tracingService records a span for each callback handled by the wrapped service.
+type tracingService struct {
+	connector.ConnectorService
+	tracer *tracer
+}
+
+// AddInstallation implements connector.ConnectorService.
+func (s *tracingService) AddInstallation(ctx context.Context, request connector.InstallationRequest) (*connector.InstallationResponse, error) {
+	ctx, span := s.tracer.Start(ctx, "AddInstallation", spanKindInternal)
+	span.SetAttribute("installation.id", request.ID)
+	response, err := s.ConnectorService.AddInstallation(ctx, request)
+	span.End(err)
+	return response, err
+}
+
+// RemoveInstallation implements connector.ConnectorService.
+func (s *tracingService) RemoveInstallation(ctx context.Context, installationId string) error {
+	ctx, span := s.tracer.Start(ctx, "RemoveInstallation", spanKindInternal)
+	span.SetAttribute("installation.id", installationId)
+	err := s.ConnectorService.RemoveInstallation(ctx, installationId)
+	span.End(err)
+	return err
+}
+
+// AddInstance implements connector.ConnectorService.
+func (s *tracingService) AddInstance(ctx context.Context, request connector.InstantiationRequest) (*connector.InstantiationResponse, error) {
+	ctx, span := s.tracer.Start(ctx, "AddInstance", spanKindInternal)
+	span.SetAttribute("instance.id", request.ID)
+	response, err := s.ConnectorService.AddInstance(ctx, request)
+	span.End(err)
+	return response, err
+}
+
+// RemoveInstance implements connector.ConnectorService.
+func (s *tracingService) RemoveInstance(ctx context.Context, instanceId string) error {
+	ctx, span := s.tracer.Start(ctx, "RemoveInstance", spanKindInternal)
+	span.SetAttribute("instance.id", instanceId)
+	err := s.ConnectorService.RemoveInstance(ctx, instanceId)
+	span.End(err)
+	return err
+}
+
+// PerformAction implements connector.ConnectorService.
+func (s *tracingService) PerformAction(ctx context.Context, request connector.ActionRequest) (*connector.ActionResponse, error) {
+	ctx, span := s.tracer.Start(ctx, "PerformAction", spanKindInternal)
+	span.SetAttribute("action.request_id", request.ID)
+	span.SetAttribute("action.id", request.ActionID)
+	response, err := s.ConnectorService.PerformAction(ctx, request)
+	if response != nil {
+		span.SetAttribute("action.status", string(response.Status))
+	}
+	span.End(err)
+	return response, err
+}
+
+// tracingClient records a span for each update of an action status, as child of the span of the action handler.
+type tracingClient struct {
+	connector.Client
+	tracer *tracer
+}
+
+// UpdateActionStatus implements connector.Client.
+func (c *tracingClient) UpdateActionStatus(ctx context.Context, token connector.InstantiationToken, actionRequestID string, status connector.ActionRequestStatus, e string) error {
+	span := c.tracer.StartLinked(actionKey(actionRequestID), "UpdateActionStatus", spanKindClient)
+	span.SetAttribute("action.request_id", actionRequestID)
+	span.SetAttribute("action.status", string(status))
+	err := c.Client.UpdateActionStatus(withSpan(ctx, span), token, actionRequestID, status, e)
+	span.End(err)
+	return err
+}
+
+// SetTracer lets the provider record spans of the action handler and the Giphy requests of actions.
+// Must be called before the provider is started.
+func (h *GiphyProvider) SetTracer(tracer *tracer) {
+	h.tracer = tracer
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// statementCreatePropertyValues creates the table the hashes of the last values sent to connctd are stored in.
+const statementCreatePropertyValues = `CREATE TABLE IF NOT EXISTS property_values (
+	thing_id VARCHAR(255) NOT NULL,
+	component_id VARCHAR(255) NOT NULL,
+	property_id VARCHAR(255) NOT NULL,
+	value_hash CHAR(64) NOT NULL,
+	updated BIGINT NOT NULL,
+	PRIMARY KEY (thing_id, component_id, property_id)
+)`
+
+// unchangedValues decides which property updates are skipped because connctd has the value already.
+// The last values are stored as hashes in the database, so they are known after restarts and to all replicas.
+type unchangedValues struct {
+	db *sqlx.DB
+	// enabled is the default of all components, components overrides it by component ID.
+	enabled    bool
+	components map[string]bool
+	suppressed *metricVec
+}
+
+// newUnchangedValues returns the store of the last values. The overrides are a comma separated list of
+// component=true|false, e.g. "search=true,random=false".
+func newUnchangedValues(db *sqlx.DB, enabled bool, overrides string, metrics *metricsRegistry) (*unchangedValues, error) {
+	components, err := parseComponentOverrides(overrides)
+	if err != nil {
+		return nil, err
+	}
+	return &unchangedValues{
+		db:         db,
+		enabled:    enabled,
+		components: components,
+		suppressed: metrics.Counter("property_updates_suppressed_total", "Number of property updates not sent because connctd has the value already by component.", "component"),
+	}, nil
+}
+
+// parseComponentOverrides returns the overrides by component ID, only components with published properties are accepted.
+func parseComponentOverrides(overrides string) (map[string]bool, error) {
+	known := map[string]bool{}
+	var names []string
+	for _, property := range publishedProperties {
+		if !known[property.ComponentID] {
+			known[property.ComponentID] = true
+			names = append(names, property.ComponentID)
+		}
+	}
+	components := map[string]bool{}
+	for _, override := range strings.Split(overrides, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid override %q, expected component=true or component=false", override)
+		}
+		component := strings.TrimSpace(parts[0])
+		if !known[component] {
+			return nil, fmt.Errorf("unknown component %q, expected one of %s", component, strings.Join(names, ", "))
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid override %q, expected component=true or component=false", override)
+		}
+		components[component] = enabled
+	}
+	return components, nil
+}
+
+// Suppresses reports whether unchanged values of the component are skipped.
+func (u *unchangedValues) Suppresses(componentID string) bool {
+	if enabled, ok := u.components[componentID]; ok {
+		return enabled
+	}
+	return u.enabled
+}
+
+// Unchanged reports whether the value is the last value sent for the property.
+func (u *unchangedValues) Unchanged(ctx context.Context, thingID string, componentID string, propertyID string, value string) (bool, error) {
+	var stored string
+	err := u.db.GetContext(ctx, &stored, u.db.Rebind("SELECT value_hash FROM property_values WHERE thing_id = ? AND component_id = ? AND property_id = ?"),
+		thingID, componentID, propertyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return stored == valueHash(value), nil
+}
+
+// Sent stores the value as the last value sent for the property.
+func (u *unchangedValues) Sent(ctx context.Context, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	tx, err := u.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM property_values WHERE thing_id = ? AND component_id = ? AND property_id = ?"), thingID, componentID, propertyID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, tx.Rebind("INSERT INTO property_values (thing_id, component_id, property_id, value_hash, updated) VALUES (?, ?, ?, ?, ?)"),
+		thingID, componentID, propertyID, valueHash(value), lastUpdate.Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// valueHash returns the hex encoded SHA-256 hash of the value, values like search results can be large.
+func valueHash(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+// unchangedClient skips property updates whose value connctd has already, e.g. the same results of a repeated search.
+// Updates of components which do not suppress unchanged values are sent as before, their values are stored nevertheless,
+// so enabling the suppression later does not resend them. If the last value can not be read, the update is sent.
+type unchangedClient struct {
+	connector.Client
+	values *unchangedValues
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *unchangedClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	logger := logrus.WithField("thingId", thingID).WithField("componentId", componentID).WithField("propertyId", propertyID)
+	if c.values.Suppresses(componentID) {
+		unchanged, err := c.values.Unchanged(ctx, thingID, componentID, propertyID, value)
+		if err != nil {
+			logger.WithError(err).Warnln("failed to read last property value, the update is sent")
+		}
+		if unchanged {
+			c.values.suppressed.Inc(componentID)
+			return nil
+		}
+	}
+	if err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate); err != nil {
+		return err
+	}
+	if lastUpdate.IsZero() {
+		lastUpdate = clock()
+	}
+	if err := c.values.Sent(ctx, thingID, componentID, propertyID, value, lastUpdate); err != nil {
+		logger.WithError(err).Warnln("failed to store last property value")
+	}
+	return nil
+}
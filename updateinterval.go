@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// updateIntervalConfigID is the optional instance configuration parameter with the interval of its periodic update, e.g. "15m".
+const updateIntervalConfigID = "update_interval"
+
+// Bounds of the periodic update.
+const (
+	// defaultUpdateInterval is the interval of instances without update interval parameter unless another one is set.
+	defaultUpdateInterval = time.Minute
+	// minUpdateInterval protects the Giphy quota, each update of an instance costs a request per thing and one for the trending GIF.
+	// Pending registrations are applied with it as well.
+	minUpdateInterval = 30 * time.Second
+)
+
+// parseUpdateInterval parses the update interval configured for an instance. It returns 0 if none is configured.
+func parseUpdateInterval(configuration []connector.Configuration) (time.Duration, error) {
+	for _, c := range configuration {
+		if c.ID != updateIntervalConfigID || c.Value == "" {
+			continue
+		}
+		interval, err := time.ParseDuration(c.Value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q, expected e.g. 5m", c.Value)
+		}
+		if interval < minUpdateInterval {
+			return 0, fmt.Errorf("%s is shorter than the minimum of %s", interval, minUpdateInterval)
+		}
+		return interval, nil
+	}
+	return 0, nil
+}
+
+// SetUpdateInterval sets the interval of the periodic update of instances without update interval parameter.
+// Intervals shorter than minUpdateInterval are rejected.
+func (h *GiphyProvider) SetUpdateInterval(interval time.Duration) error {
+	if interval < minUpdateInterval {
+		return fmt.Errorf("update interval %s is shorter than the minimum of %s", interval, minUpdateInterval)
+	}
+	h.updateInterval = interval
+	return nil
+}
+
+// instanceUpdateInterval returns the update interval of the instance.
+// Invalid intervals were rejected on instantiation and are ignored.
+func (h *GiphyProvider) instanceUpdateInterval(instance *connector.Instance) time.Duration {
+	if interval, err := parseUpdateInterval(instance.Configuration); err == nil && interval > 0 {
+		return interval
+	}
+	return h.updateInterval
+}
+
+// updateDueInstances updates the instances whose next update is due and schedules their following update after their interval.
+// Instances in quiet hours are scheduled for the end of the quiet hours instead, if it comes before their interval passed,
+// so they show a new GIF right away. The times are taken from the timer rather than the clock, so they advance in deterministic mode as well.
+func (h *GiphyProvider) updateDueInstances(now time.Time) {
+	trending := map[string]string{}
+	for _, instance := range h.schedule.Due(now) {
+		next := now.Add(h.instanceUpdateInterval(instance))
+		// Invalid quiet hours were rejected on instantiation and are ignored
+		if quiet, err := parseQuietHours(instance.Configuration); err == nil && quiet.Active(clock()) {
+			if end := now.Add(quiet.End(clock()).Sub(clock())); end.Before(next) {
+				next = end
+			}
+		}
+		h.schedule.Schedule(instance, next)
+		h.updateInstance(instance, trending)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Policies for values exceeding the maximum length.
+const (
+	// valueLimitTruncate drops trailing search results from the structured results until they fit.
+	// Plain values like URLs can not be shortened without breaking them and are rejected.
+	valueLimitTruncate = "truncate"
+	// valueLimitReject rejects every value exceeding the maximum length.
+	valueLimitReject = "reject"
+)
+
+// errValueTooLong is returned for values which exceed the maximum length and can not be truncated.
+var errValueTooLong = errors.New("property value is too long")
+
+// valueLimiter enforces the maximum length of property values before they are sent to connctd,
+// which rejects long values with an error that does not tell what was wrong.
+type valueLimiter struct {
+	maxLength int
+	policy    string
+	limited   *metricVec
+}
+
+// newValueLimiter returns a limiter of values to maxLength bytes with the given policy.
+func newValueLimiter(maxLength int, policy string, metrics *metricsRegistry) (*valueLimiter, error) {
+	if policy != valueLimitTruncate && policy != valueLimitReject {
+		return nil, fmt.Errorf("unknown policy %q, expected %s or %s", policy, valueLimitTruncate, valueLimitReject)
+	}
+	return &valueLimiter{
+		maxLength: maxLength,
+		policy:    policy,
+		limited:   metrics.Counter("property_values_limited_total", "Number of property values exceeding the maximum length by property and outcome.", "property", "outcome"),
+	}, nil
+}
+
+// Check returns errValueTooLong if the value of the property exceeds the maximum length.
+func (l *valueLimiter) Check(property propertyRef, value string) error {
+	if len(value) <= l.maxLength {
+		return nil
+	}
+	l.limited.Inc(property.String(), "rejected")
+	return l.tooLong(property, value)
+}
+
+// Results marshals the structured search results and reports whether results were dropped to fit the maximum length.
+func (l *valueLimiter) Results(results searchResults) (string, bool, error) {
+	value, err := marshalStructuredValue(searchResultsProperty, results)
+	if err != nil || len(value) <= l.maxLength {
+		return value, false, err
+	}
+	if l.policy == valueLimitTruncate {
+		for n := len(results.Results) - 1; n >= 0; n-- {
+			results.Results = results.Results[:n]
+			truncated, err := marshalStructuredValue(searchResultsProperty, results)
+			if err != nil {
+				return "", false, err
+			}
+			if len(truncated) <= l.maxLength {
+				l.limited.Inc(searchResultsProperty.String(), "truncated")
+				return truncated, true, nil
+			}
+		}
+	}
+	l.limited.Inc(searchResultsProperty.String(), "rejected")
+	return "", false, l.tooLong(searchResultsProperty, value)
+}
+
+func (l *valueLimiter) tooLong(property propertyRef, value string) error {
+	return fmt.Errorf("%w: %s has %d bytes, at most %d are accepted", errValueTooLong, property, len(value), l.maxLength)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+)
+
+// valueTransformer rewrites a property value before it is sent to connctd, e.g. to serve GIFs through a CDN.
+type valueTransformer func(value string) (string, error)
+
+// valueTransformers are the transformers of the published properties, applied in the order they were added.
+// Transformers are added in code with Add or from rules with AddRules, e.g. "random/value=proxy:https://cdn.example.com/?url=".
+// Structured values are sent as JSON, so they can not be transformed.
+type valueTransformers struct {
+	transformed *metricVec
+
+	lock         sync.RWMutex
+	transformers map[propertyRef][]valueTransformer
+}
+
+// newValueTransformers returns an empty pipeline, values are sent unchanged until transformers are added.
+func newValueTransformers(metrics *metricsRegistry) *valueTransformers {
+	return &valueTransformers{
+		transformed:  metrics.Counter("property_values_transformed_total", "Number of property values rewritten by transformers by property and outcome.", "property", "outcome"),
+		transformers: map[propertyRef][]valueTransformer{},
+	}
+}
+
+// Add appends a transformer of the property. A property with an empty property ID stands for all properties of the
+// component which have no structured value.
+func (t *valueTransformers) Add(property propertyRef, transformer valueTransformer) error {
+	properties, err := transformedProperties(property)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, p := range properties {
+		t.transformers[p] = append(t.transformers[p], transformer)
+	}
+	return nil
+}
+
+// transformedProperties returns the published properties the transformers of the property apply to.
+func transformedProperties(property propertyRef) ([]propertyRef, error) {
+	var properties []propertyRef
+	for _, p := range publishedProperties {
+		if p.ComponentID != property.ComponentID || (property.PropertyID != "" && p.PropertyID != property.PropertyID) {
+			continue
+		}
+		if _, ok := structuredPropertySchemas[p]; ok {
+			if property.PropertyID != "" {
+				return nil, fmt.Errorf("%s has a structured value which can not be transformed", p)
+			}
+			continue
+		}
+		properties = append(properties, p)
+	}
+	if len(properties) == 0 {
+		return nil, fmt.Errorf("unknown property %s", property)
+	}
+	return properties, nil
+}
+
+// AddRules adds the transformers of rules separated by semicolons. Each rule has the form "component/property=transformer",
+// "component/*" applies to all properties of the component. The transformers are
+//   - "prefix:text" prepends the text
+//   - "proxy:url" appends the query escaped value to the URL, e.g. of an image proxy
+//   - "lowercase" and "uppercase" change the case
+//   - "map:from=to,from=to" replaces the listed values and keeps all others
+func (t *valueTransformers) AddRules(rules string) error {
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid rule %q, expected component/property=transformer", rule)
+		}
+		target := strings.SplitN(strings.TrimSpace(parts[0]), "/", 2)
+		if len(target) != 2 {
+			return fmt.Errorf("invalid property %q, expected component/property", parts[0])
+		}
+		componentId, propertyId := target[0], target[1]
+		if propertyId == "*" {
+			propertyId = ""
+		}
+		transformer, err := parseValueTransformer(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid rule %q: %w", rule, err)
+		}
+		if err := t.Add(propertyRef{componentId, propertyId}, transformer); err != nil {
+			return fmt.Errorf("invalid rule %q: %w", rule, err)
+		}
+	}
+	return nil
+}
+
+func parseValueTransformer(definition string) (valueTransformer, error) {
+	parts := strings.SplitN(definition, ":", 2)
+	name, argument := parts[0], ""
+	if len(parts) == 2 {
+		argument = parts[1]
+	}
+	switch name {
+	case "prefix":
+		return func(value string) (string, error) { return argument + value, nil }, nil
+	case "proxy":
+		if _, err := url.Parse(argument); err != nil || argument == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", argument)
+		}
+		return func(value string) (string, error) {
+			if value == "" {
+				return value, nil
+			}
+			return argument + url.QueryEscape(value), nil
+		}, nil
+	case "lowercase":
+		return func(value string) (string, error) { return strings.ToLower(value), nil }, nil
+	case "uppercase":
+		return func(value string) (string, error) { return strings.ToUpper(value), nil }, nil
+	case "map":
+		mapping := map[string]string{}
+		for _, pair := range strings.Split(argument, ",") {
+			fromTo := strings.SplitN(pair, "=", 2)
+			if len(fromTo) != 2 {
+				return nil, fmt.Errorf("invalid mapping %q, expected from=to", pair)
+			}
+			mapping[fromTo[0]] = fromTo[1]
+		}
+		return func(value string) (string, error) {
+			if to, ok := mapping[value]; ok {
+				return to, nil
+			}
+			return value, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transformer %q, expected prefix, proxy, lowercase, uppercase or map", name)
+}
+
+// Transform returns the value of the property rewritten by its transformers.
+func (t *valueTransformers) Transform(property propertyRef, value string) (string, error) {
+	t.lock.RLock()
+	transformers := t.transformers[property]
+	t.lock.RUnlock()
+	if len(transformers) == 0 {
+		return value, nil
+	}
+	for _, transformer := range transformers {
+		var err error
+		if value, err = transformer(value); err != nil {
+			t.transformed.Inc(property.String(), "failed")
+			return "", fmt.Errorf("failed to transform value of %s: %w", property, err)
+		}
+	}
+	t.transformed.Inc(property.String(), "transformed")
+	return value, nil
+}
+
+// transformingClient rewrites property values with the transformers before they are sent to connctd.
+type transformingClient struct {
+	connector.Client
+	transformers *valueTransformers
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *transformingClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	value, err := c.transformers.Transform(propertyRef{componentID, propertyID}, value)
+	if err != nil {
+		return err
+	}
+	return c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+}
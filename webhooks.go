@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/connctd/connector-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookConfigID is the installation configuration parameter with the URL property updates are posted to.
+	webhookConfigID = "webhook_url"
+	// webhookQueueSize is the number of deliveries buffered per webhook, further deliveries are dropped.
+	webhookQueueSize = 100
+	// webhookBreakerThreshold is the number of consecutive failed deliveries after which a webhook is not called for webhookBreakerCooldown.
+	webhookBreakerThreshold = 5
+	webhookBreakerCooldown  = time.Minute
+)
+
+// webhookDispatcher posts the property updates of installations with a configured webhook URL to that URL.
+// The payload is the property.updated event as JSON, signed like the error sink requests.
+// The installation of a thing and its webhook URL are looked up with the thing resolver.
+// The URLs are set by the installations, so only https URLs of public addresses are called, unless the operator allowed their host,
+// and redirects are not followed. Otherwise an installation could make the connector call its admin API or other internal services.
+type webhookDispatcher struct {
+	things       *thingResolver
+	signer       *payloadSigner
+	retry        *retryPolicy
+	allowedHosts map[string]bool
+	client       *http.Client
+	deliveries   *metricVec
+
+	endpoints map[string]*webhookEndpoint // by installation ID
+	lock      sync.Mutex
+}
+
+// newWebhookDispatcher returns a dispatcher for the webhooks of the installations. The allowed hosts are comma separated host names
+// which may also be called with http and on loopback or private addresses, e.g. a receiver in the same cluster.
+// Webhooks are not called through the outbound proxy, whose address would hide the address of the webhook.
+func newWebhookDispatcher(things *thingResolver, signer *payloadSigner, retry *retryPolicy, allowedHosts string, metrics *metricsRegistry) *webhookDispatcher {
+	d := &webhookDispatcher{
+		things:       things,
+		signer:       signer,
+		retry:        retry,
+		allowedHosts: map[string]bool{},
+		deliveries:   metrics.Counter("webhook_deliveries_total", "Number of property updates posted to webhooks by result.", "result"),
+		endpoints:    map[string]*webhookEndpoint{},
+	}
+	for _, host := range strings.Split(allowedHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			d.allowedHosts[host] = true
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = d.dialContext
+	d.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// validateURL checks the webhook URL before it is called, the addresses of its host are checked when it is dialed.
+func (d *webhookDispatcher) validateURL(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || u.Hostname() == "" {
+		return errors.New("invalid webhook URL")
+	}
+	if d.allowedHosts[strings.ToLower(u.Hostname())] {
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return fmt.Errorf("unsupported webhook URL scheme %s", u.Scheme)
+		}
+		return nil
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("webhook URL must use https, not %s", u.Scheme)
+	}
+	return nil
+}
+
+// dialContext dials allowed hosts as they are and all other hosts only on public addresses.
+// The host is resolved once and the checked address is dialed, so a second lookup can not return another address.
+func (d *webhookDispatcher) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.allowedHosts[strings.ToLower(host)] {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no address found for webhook host")
+	}
+	for _, address := range addresses {
+		if !publicAddress(address.IP) {
+			return nil, fmt.Errorf("webhook host resolves to the non-public address %s", address.IP)
+		}
+	}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(addresses[0].IP.String(), port))
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which is not public either.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicAddress reports whether the address is neither loopback, private, link-local, multicast nor unspecified.
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// RemoveInstallation stops the deliveries of the installation, e.g. after it was removed.
+// Queued updates are still delivered.
+func (d *webhookDispatcher) RemoveInstallation(installationId string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if endpoint, ok := d.endpoints[installationId]; ok {
+		endpoint.stop()
+		delete(d.endpoints, installationId)
+	}
+}
+
+// PropertyUpdated queues the delivery of the property update to the webhook of the thing's installation, if there is one.
+func (d *webhookDispatcher) PropertyUpdated(ctx context.Context, event Event) {
+	thing, err := d.things.Resolve(ctx, event.ThingID, "")
+	if err != nil {
+		logrus.WithError(err).WithField("thingId", event.ThingID).Warnln("failed to find the installation of a thing for its webhook")
+		return
+	}
+	webhook, ok := thing.Installation.GetConfig(webhookConfigID)
+	if !ok || webhook.Value == "" {
+		return
+	}
+	event.InstallationID = thing.Installation.ID
+	event.InstanceID = thing.Instance.ID
+
+	// The endpoint is replaced when the installation changed its URL. The queue is only sent to and closed with the lock held.
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	endpoint, ok := d.endpoints[thing.Installation.ID]
+	if ok && endpoint.url != webhook.Value {
+		endpoint.stop()
+		ok = false
+	}
+	if !ok {
+		endpoint = &webhookEndpoint{dispatcher: d, url: webhook.Value, installationId: thing.Installation.ID}
+		// An invalid URL is logged once, its updates are counted as invalid until the URL is changed
+		if err := d.validateURL(webhook.Value); err != nil {
+			logrus.WithError(err).WithField("installationId", thing.Installation.ID).Warnln("not calling webhook")
+		} else {
+			endpoint.queue = make(chan Event, webhookQueueSize)
+			go endpoint.run()
+		}
+		d.endpoints[thing.Installation.ID] = endpoint
+	}
+	if endpoint.queue == nil {
+		d.deliveries.Inc("invalid_url")
+		return
+	}
+
+	select {
+	case endpoint.queue <- event:
+	default:
+		d.deliveries.Inc("dropped")
+	}
+}
+
+// webhookEndpoint delivers the queued property updates of an installation to its webhook in order.
+// After webhookBreakerThreshold consecutive failed deliveries the circuit breaker opens and updates are dropped
+// until the cooldown is over. Then the next update is tried again, which closes the breaker on success.
+type webhookEndpoint struct {
+	dispatcher     *webhookDispatcher
+	url            string
+	installationId string
+	queue          chan Event
+	failures       int
+	openUntil      time.Time
+}
+
+// stop ends the goroutine of the endpoint once its queued updates were delivered, the dispatcher lock is held.
+func (e *webhookEndpoint) stop() {
+	if e.queue != nil {
+		close(e.queue)
+	}
+}
+
+func (e *webhookEndpoint) run() {
+	for event := range e.queue {
+		if clock().Before(e.openUntil) {
+			e.dispatcher.deliveries.Inc("rejected")
+			continue
+		}
+
+		err := e.dispatcher.retry.Do(context.Background(), func(ctx context.Context) error {
+			return e.deliver(event)
+		})
+		if err == nil {
+			e.failures = 0
+			e.dispatcher.deliveries.Inc("delivered")
+			continue
+		}
+
+		e.failures++
+		e.dispatcher.deliveries.Inc("failed")
+		logger := logrus.WithError(err).WithField("installationId", e.installationId).WithField("correlationId", event.CorrelationID)
+		if e.failures >= webhookBreakerThreshold {
+			e.openUntil = clock().Add(webhookBreakerCooldown)
+			logger.WithField("failures", e.failures).Warnln("webhook keeps failing, pausing deliveries")
+		} else {
+			logger.Warnln("failed to deliver property update to webhook")
+		}
+	}
+}
+
+// deliver posts the signed event. Every status other than 2xx is a failure.
+func (e *webhookEndpoint) deliver(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if event.CorrelationID != "" {
+		req.Header.Set(CorrelationHeader, event.CorrelationID)
+	}
+	if err := e.dispatcher.signer.SignRequest(req, body); err != nil {
+		return err
+	}
+
+	// The URL is not logged, it may contain credentials of the receiver
+	resp, err := e.dispatcher.client.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("failed to post to webhook: %w", urlErr.Err)
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookClient hands all property updates successfully sent to connctd to the webhook dispatcher.
+type webhookClient struct {
+	connector.Client
+	webhooks *webhookDispatcher
+}
+
+// UpdateThingPropertyValue implements connector.Client.
+func (c *webhookClient) UpdateThingPropertyValue(ctx context.Context, token connector.InstantiationToken, thingID string, componentID string, propertyID string, value string, lastUpdate time.Time) error {
+	err := c.Client.UpdateThingPropertyValue(ctx, token, thingID, componentID, propertyID, value, lastUpdate)
+	if err == nil {
+		c.webhooks.PropertyUpdated(ctx, Event{
+			Time:          lastUpdate.UTC(),
+			Type:          EventPropertyUpdated,
+			CorrelationID: correlationID(ctx),
+			ThingID:       thingID,
+			ComponentID:   componentID,
+			PropertyID:    propertyID,
+			Value:         value,
+		})
+	}
+	return err
+}
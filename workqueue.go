@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// jobVisibilityTimeout is the time a claimed job is hidden from other workers.
+	// If the worker does not finish the job within this time, e.g. because the process died, the job is claimed again.
+	jobVisibilityTimeout = 5 * time.Minute
+	// jobWorkers is the number of jobs run concurrently.
+	jobWorkers = 4
+	// jobPollInterval is the interval in which idle workers look for due jobs.
+	jobPollInterval = time.Second
+)
+
+// job is a unit of asynchronous work. The payload is the JSON encoded input of the handler of the kind.
+// Due times use the real time even in deterministic mode, otherwise retries would never be due.
+type job struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempt   int             `json:"attempt"`
+	NotBefore time.Time       `json:"notBefore"`
+	LastError string          `json:"lastError,omitempty"`
+}
+
+// jobBackend stores the jobs of a queue. Jobs are delivered at least once:
+// a claimed job is hidden for the visibility timeout and delivered again if it is neither completed nor rescheduled in time.
+type jobBackend interface {
+	// Enqueue stores a new job, which is due at its NotBefore time.
+	Enqueue(ctx context.Context, j job) error
+	// Claim returns the job which is due longest and hides it for the visibility timeout, or nil if no job is due.
+	Claim(ctx context.Context, visibility time.Duration) (*job, error)
+	// Complete removes the job.
+	Complete(ctx context.Context, id string) error
+	// Reschedule stores the attempt, due time and error of the job.
+	Reschedule(ctx context.Context, j job) error
+}
+
+// jobHandler does the work of a job. The job is retried with backoff if it returns an error,
+// lastAttempt tells the handler that the job is given up after a failure, so it can report a final result.
+type jobHandler func(ctx context.Context, payload json.RawMessage, lastAttempt bool) error
+
+// jobQueue runs asynchronous work with the same retry, visibility and persistence semantics for all kinds of jobs.
+// Jobs survive restarts with the SQL and Redis backends and are shared by all replicas using the same backend.
+// Failed jobs are retried with the delays of the retry policy until its attempts are used up.
+type jobQueue struct {
+	backend  jobBackend
+	retry    *retryPolicy
+	handlers map[string]jobHandler
+	jobs     *metricVec
+	wake     chan struct{}
+}
+
+func newJobQueue(backend jobBackend, retry *retryPolicy, metrics *metricsRegistry) *jobQueue {
+	return &jobQueue{
+		backend:  backend,
+		retry:    retry,
+		handlers: map[string]jobHandler{},
+		jobs:     metrics.Counter("jobs_total", "Number of jobs by kind and result (enqueued, completed, retried or failed).", "kind", "result"),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// newJobBackend returns the backend given by the configuration: memory, sql or a redis:// URL.
+func newJobBackend(config string, db *sqlx.DB) (jobBackend, error) {
+	switch {
+	case config == "memory":
+		return newMemoryJobBackend(), nil
+	case config == "sql":
+		return newSQLJobBackend(db), nil
+	case strings.HasPrefix(config, "redis://") || strings.HasPrefix(config, "rediss://"):
+		redis, err := newRedisClient(config)
+		if err != nil {
+			return nil, err
+		}
+		return &redisJobBackend{redis}, nil
+	default:
+		return nil, fmt.Errorf("unsupported job queue %q, expected memory, sql or a redis:// URL", config)
+	}
+}
+
+// Handle registers the handler of a kind of jobs. Handlers must be registered before the queue is run.
+func (q *jobQueue) Handle(kind string, handler jobHandler) {
+	q.handlers[kind] = handler
+}
+
+// Enqueue adds a job with the JSON encoded payload, which is run as soon as a worker is idle.
+func (q *jobQueue) Enqueue(ctx context.Context, kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if err := q.backend.Enqueue(ctx, job{ID: newJobID(), Kind: kind, Payload: data, NotBefore: time.Now()}); err != nil {
+		return fmt.Errorf("failed to enqueue %s job: %w", kind, err)
+	}
+	q.jobs.Inc(kind, "enqueued")
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run starts the given number of workers, which run jobs until the context is done.
+func (q *jobQueue) Run(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go q.work(ctx)
+	}
+}
+
+func (q *jobQueue) work(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		j, err := q.backend.Claim(ctx, jobVisibilityTimeout)
+		if err != nil {
+			logrus.WithError(err).Warnln("failed to claim job")
+		}
+		if j != nil {
+			q.run(ctx, j)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// run runs the handler of the job and completes or reschedules it.
+func (q *jobQueue) run(ctx context.Context, j *job) {
+	logger := logrus.WithField("jobId", j.ID).WithField("kind", j.Kind).WithField("attempt", j.Attempt+1)
+	handler, ok := q.handlers[j.Kind]
+	if !ok {
+		// The job may be meant for a newer version of the connector sharing the backend, so it is left for its visibility timeout
+		logger.Warnln("no handler for job")
+		return
+	}
+
+	lastAttempt := j.Attempt+1 >= q.retry.MaxAttempts
+	err := q.handle(ctx, handler, j, lastAttempt)
+	if !q.retry.Retry(err, j.Attempt+1) {
+		if err != nil {
+			q.jobs.Inc(j.Kind, "failed")
+			logger.WithError(err).Errorln("job failed, giving up")
+		} else {
+			q.jobs.Inc(j.Kind, "completed")
+		}
+		if err := q.backend.Complete(ctx, j.ID); err != nil {
+			logger.WithError(err).Warnln("failed to complete job")
+		}
+		return
+	}
+
+	q.jobs.Inc(j.Kind, "retried")
+	j.LastError = err.Error()
+	j.Attempt++
+	j.NotBefore = time.Now().Add(q.retry.Delay(j.Attempt))
+	logger.WithError(err).WithField("retryAt", j.NotBefore.UTC().Format(time.RFC3339)).Warnln("job failed, retrying")
+	if err := q.backend.Reschedule(ctx, *j); err != nil {
+		logger.WithError(err).Warnln("failed to reschedule job")
+	}
+}
+
+// handle runs the handler and turns panics into errors, so a broken job does not stop the worker.
+func (q *jobQueue) handle(ctx context.Context, handler jobHandler, j *job, lastAttempt bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, j.Payload, lastAttempt)
+}
+
+// newJobID returns a new random job ID.
+func newJobID() string {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(randomness, id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// memoryJobBackend keeps the jobs in memory, so they are lost on restart.
+type memoryJobBackend struct {
+	jobs map[string]job
+	lock sync.Mutex
+}
+
+func newMemoryJobBackend() *memoryJobBackend {
+	return &memoryJobBackend{jobs: map[string]job{}}
+}
+
+// Enqueue implements jobBackend.
+func (b *memoryJobBackend) Enqueue(ctx context.Context, j job) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.jobs[j.ID] = j
+	return nil
+}
+
+// Claim implements jobBackend.
+func (b *memoryJobBackend) Claim(ctx context.Context, visibility time.Duration) (*job, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	var due []job
+	for _, j := range b.jobs {
+		if !j.NotBefore.After(now) {
+			due = append(due, j)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	sort.Slice(due, func(i, k int) bool { return due[i].NotBefore.Before(due[k].NotBefore) })
+	j := due[0]
+	hidden := j
+	hidden.NotBefore = now.Add(visibility)
+	b.jobs[j.ID] = hidden
+	return &j, nil
+}
+
+// Complete implements jobBackend.
+func (b *memoryJobBackend) Complete(ctx context.Context, id string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.jobs, id)
+	return nil
+}
+
+// Reschedule implements jobBackend.
+func (b *memoryJobBackend) Reschedule(ctx context.Context, j job) error {
+	return b.Enqueue(ctx, j)
+}
+
+// statementCreateJobs creates the table of the SQL job backend.
+const statementCreateJobs = `CREATE TABLE IF NOT EXISTS connector_jobs (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	kind VARCHAR(255) NOT NULL,
+	payload TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	not_before BIGINT NOT NULL,
+	last_error TEXT NOT NULL
+)`
+
+// sqlJobBackend stores the jobs in the database of the connector.
+// Jobs are claimed by moving their due time with a conditional update, so several replicas can share the table.
+type sqlJobBackend struct {
+	db *sqlx.DB
+}
+
+type sqlJob struct {
+	ID        string `db:"id"`
+	Kind      string `db:"kind"`
+	Payload   string `db:"payload"`
+	Attempt   int    `db:"attempt"`
+	NotBefore int64  `db:"not_before"`
+	LastError string `db:"last_error"`
+}
+
+func newSQLJobBackend(db *sqlx.DB) *sqlJobBackend {
+	return &sqlJobBackend{db}
+}
+
+// Enqueue implements jobBackend.
+func (b *sqlJobBackend) Enqueue(ctx context.Context, j job) error {
+	_, err := b.db.ExecContext(ctx, b.db.Rebind("INSERT INTO connector_jobs (id, kind, payload, attempt, not_before, last_error) VALUES (?, ?, ?, ?, ?, ?)"),
+		j.ID, j.Kind, string(j.Payload), j.Attempt, j.NotBefore.UnixMilli(), j.LastError)
+	return err
+}
+
+// Claim implements jobBackend.
+func (b *sqlJobBackend) Claim(ctx context.Context, visibility time.Duration) (*job, error) {
+	// Another replica may claim the job between the select and the update, then the next due job is tried
+	for i := 0; i < 3; i++ {
+		now := time.Now()
+		var rows []sqlJob
+		err := b.db.SelectContext(ctx, &rows, b.db.Rebind("SELECT id, kind, payload, attempt, not_before, last_error FROM connector_jobs WHERE not_before <= ? ORDER BY not_before LIMIT 1"), now.UnixMilli())
+		if err != nil || len(rows) == 0 {
+			return nil, err
+		}
+		row := rows[0]
+		result, err := b.db.ExecContext(ctx, b.db.Rebind("UPDATE connector_jobs SET not_before = ? WHERE id = ? AND not_before = ?"), now.Add(visibility).UnixMilli(), row.ID, row.NotBefore)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 1 {
+			return &job{row.ID, row.Kind, json.RawMessage(row.Payload), row.Attempt, time.UnixMilli(row.NotBefore), row.LastError}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Complete implements jobBackend.
+func (b *sqlJobBackend) Complete(ctx context.Context, id string) error {
+	_, err := b.db.ExecContext(ctx, b.db.Rebind("DELETE FROM connector_jobs WHERE id = ?"), id)
+	return err
+}
+
+// Reschedule implements jobBackend.
+func (b *sqlJobBackend) Reschedule(ctx context.Context, j job) error {
+	_, err := b.db.ExecContext(ctx, b.db.Rebind("UPDATE connector_jobs SET attempt = ?, not_before = ?, last_error = ? WHERE id = ?"),
+		j.Attempt, j.NotBefore.UnixMilli(), j.LastError, j.ID)
+	return err
+}
+
+const (
+	// redisJobsKey is the sorted set of job IDs by due time in milliseconds.
+	redisJobsKey = "giphy-connector:jobs:due"
+	// redisJobDataKey is the hash of the JSON encoded jobs by ID.
+	redisJobDataKey = "giphy-connector:jobs:data"
+
+	// The scripts keep the sorted set and the hash consistent and claim jobs atomically.
+	redisScriptStoreJob = `redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1`
+	redisScriptClaimJob = `local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1)
+if #ids == 0 then return false end
+redis.call('ZADD', KEYS[1], ARGV[2], ids[1])
+return redis.call('HGET', KEYS[2], ids[1])`
+	redisScriptCompleteJob = `redis.call('ZREM', KEYS[1], ARGV[1])
+return redis.call('HDEL', KEYS[2], ARGV[1])`
+)
+
+// redisJobBackend stores the jobs in Redis.
+type redisJobBackend struct {
+	redis *redisClient
+}
+
+// Enqueue implements jobBackend.
+func (b *redisJobBackend) Enqueue(ctx context.Context, j job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	_, err = b.redis.Eval(redisScriptStoreJob, []string{redisJobsKey, redisJobDataKey}, j.ID, strconv.FormatInt(j.NotBefore.UnixMilli(), 10), string(data))
+	return err
+}
+
+// Claim implements jobBackend.
+func (b *redisJobBackend) Claim(ctx context.Context, visibility time.Duration) (*job, error) {
+	now := time.Now()
+	reply, err := b.redis.Eval(redisScriptClaimJob, []string{redisJobsKey, redisJobDataKey}, strconv.FormatInt(now.UnixMilli(), 10), strconv.FormatInt(now.Add(visibility).UnixMilli(), 10))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %v when claiming job", reply)
+	}
+	var j job
+	if err := json.Unmarshal([]byte(data), &j); err != nil {
+		return nil, fmt.Errorf("invalid job: %w", err)
+	}
+	return &j, nil
+}
+
+// Complete implements jobBackend.
+func (b *redisJobBackend) Complete(ctx context.Context, id string) error {
+	_, err := b.redis.Eval(redisScriptCompleteJob, []string{redisJobsKey, redisJobDataKey}, id)
+	return err
+}
+
+// Reschedule implements jobBackend.
+func (b *redisJobBackend) Reschedule(ctx context.Context, j job) error {
+	return b.Enqueue(ctx, j)
+}